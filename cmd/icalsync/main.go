@@ -0,0 +1,88 @@
+// Command icalsync imports an external iCalendar feed, from a file or an http(s) address,
+// into a room's blocks. Running it again with the same feed only applies what has changed.
+// Nights the feed no longer blocks are offered to the guests on the waitlist, whose offers
+// are put in the mail outbox for the web server to send.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/eador/bookings/internal/config"
+	"github.com/eador/bookings/internal/driver"
+	"github.com/eador/bookings/internal/emails"
+	"github.com/eador/bookings/internal/handlers"
+	"github.com/eador/bookings/internal/ical"
+	"github.com/eador/bookings/internal/tokens"
+	"github.com/eador/bookings/internal/waitlist"
+)
+
+func main() {
+	roomID := flag.Int("room", 0, "ID of the room to block")
+	source := flag.String("source", "", "Path or http(s) address of the calendar to import")
+	dbHost := flag.String("dbhost", "localhost", "Database Host")
+	dbName := flag.String("dbname", "", "Database Name")
+	dbUser := flag.String("dbuser", "", "Database User")
+	dbPass := flag.String("dbpass", "", "Database Password")
+	dbPort := flag.String("dbport", "5432", "Database Port")
+	dbSSL := flag.String("dbssl", "disable", "Database SSL settings (disable, prefer, require)")
+	secretKey := flag.String("secret", os.Getenv("SECRET_KEY"), "Key the web server signs links with, for the waitlist offers sent for nights that come free")
+	baseURL := flag.String("baseurl", "http://localhost:8080", "Address of the site, for links in waitlist offers")
+	waitlistHold := flag.Int("waitlisthold", 24, "Hours a room that comes free is held for a guest on the waitlist")
+	flag.Parse()
+
+	if *roomID == 0 || *source == "" || *dbName == "" || *dbUser == "" || *secretKey == "" {
+		fmt.Println("Missing required flags")
+		os.Exit(1)
+	}
+
+	var app config.AppConfig
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	app.BaseURL = *baseURL
+	app.Tokens = tokens.New([]byte(*secretKey))
+
+	et, err := emails.New("./email-templates")
+	if err != nil {
+		log.Fatal("cannot load email templates: ", err)
+	}
+	app.EmailTemplates = et
+
+	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPass, *dbSSL)
+	db, err := driver.ConnectSQL(connectionString)
+	if err != nil {
+		log.Fatalln("Cannot connect to database! Dying...")
+	}
+	defer db.SQL.Close()
+
+	repo := handlers.NewRepo(&app, db)
+	app.Waitlist = waitlist.New(repo.DB, time.Duration(*waitlistHold)*time.Hour, repo.SendWaitlistOffer, app.InfoLog, app.ErrorLog)
+	if _, err := repo.DB.GetRoomById(*roomID); err != nil {
+		log.Fatalf("cannot find room %d: %s", *roomID, err)
+	}
+
+	rc, err := ical.Open(*source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	events, err := ical.Parse(rc)
+	rc.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result, err := ical.Sync(repo.DB, *roomID, *source, events, time.Now())
+	offered := 0
+	if len(result.Released) > 0 {
+		offered = app.Waitlist.Released(result.Released...)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.InfoLog.Printf("%s: %d nights blocked, %d unblocked, %d unchanged, %d of our own events skipped, %d waitlist offers made",
+		*source, result.Added, result.Removed, result.Unchanged, result.Skipped, offered)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/eador/bookings/internal/repository"
+	"github.com/eador/bookings/internal/unpaid"
+)
+
+// expireUnpaid starts cancelling reservations that were not paid for within app.CheckoutHold,
+// offering their rooms to the waitlist
+func expireUnpaid(db repository.DatabaseRepo) *unpaid.Expirer {
+	expirer := unpaid.New(db, app.Waitlist.Released, infoLog, errorLog)
+	expirer.Start()
+	return expirer
+}
@@ -7,15 +7,23 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/eador/bookings/internal/cancellation"
 	"github.com/eador/bookings/internal/config"
 	"github.com/eador/bookings/internal/driver"
+	"github.com/eador/bookings/internal/emails"
 	"github.com/eador/bookings/internal/handlers"
 	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/lockout"
+	"github.com/eador/bookings/internal/mailer"
 	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
 	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/tokens"
+	"github.com/eador/bookings/internal/waitlist"
 )
 
 const port = ":8080"
@@ -26,15 +34,27 @@ var infoLog *log.Logger
 var errorLog *log.Logger
 
 func main() {
-	db, err := run()
+	db, m, err := run()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.SQL.Close()
-	defer close(app.MailChan)
 
-	infoLog.Println("starting mail server")
-	listenForMail()
+	infoLog.Println("starting mail workers")
+	mailQueue := listenForMail(handlers.Repo.DB, m)
+	defer mailQueue.Stop()
+
+	infoLog.Println("starting trash purger")
+	purger := purgeTrash(handlers.Repo.DB)
+	defer purger.Stop()
+
+	infoLog.Println("starting waitlist")
+	app.Waitlist.Start()
+	defer app.Waitlist.Stop()
+
+	infoLog.Println("starting unpaid reservation expiry")
+	expirer := expireUnpaid(handlers.Repo.DB)
+	defer expirer.Stop()
 
 	infoLog.Println("Starting application on port", port[1:])
 	srv := &http.Server{
@@ -46,7 +66,7 @@ func main() {
 	log.Fatal(err)
 }
 
-func run() (*driver.DB, error) {
+func run() (*driver.DB, mailer.Mailer, error) {
 	gob.Register(models.Reservation{})
 	gob.Register(models.User{})
 	gob.Register(models.Room{})
@@ -62,6 +82,24 @@ func run() (*driver.DB, error) {
 	dbPass := flag.String("dbpass", "", "Database Password")
 	dbPort := flag.String("dbport", "5432", "Database Port")
 	dbSSL := flag.String("dbssl", "disable", "Database SSL settings (disable, prefer, require)")
+	mailDriver := flag.String("mailer", envString("MAILER", "smtp"), "Mail driver (smtp, file)")
+	smtpHost := flag.String("smtphost", envString("SMTP_HOST", "localhost"), "SMTP Host")
+	smtpPort := flag.Int("smtpport", envInt("SMTP_PORT", 1025), "SMTP Port")
+	smtpUser := flag.String("smtpuser", envString("SMTP_USERNAME", ""), "SMTP Username")
+	smtpPass := flag.String("smtppass", envString("SMTP_PASSWORD", ""), "SMTP Password")
+	smtpEncryption := flag.String("smtpencryption", envString("SMTP_ENCRYPTION", "none"), "SMTP encryption (none, starttls, tls)")
+	mailDir := flag.String("maildir", envString("MAIL_DIR", "./tmp/mail"), "Directory the file mail driver writes to")
+	mailFrom := flag.String("mailfrom", envString("MAIL_FROM", "me@here.com"), "Address mail is sent from")
+	mailAdmin := flag.String("mailadmin", envString("MAIL_ADMIN", "me@here.com"), "Address notifications for the owner are sent to")
+	secretKey := flag.String("secret", envString("SECRET_KEY", ""), "Key used to sign invite and password reset links")
+	trashDays := flag.Int("trashdays", envInt("TRASH_RETENTION_DAYS", 30), "Days deleted reservations are kept in the trash")
+	paymentsDriver := flag.String("payments", envString("PAYMENTS", ""), "Payment provider (fake, the default outside production)")
+	paymentsSecret := flag.String("paymentssecret", envString("PAYMENTS_WEBHOOK_SECRET", ""), "Secret the payment provider signs webhooks with")
+	checkoutHold := flag.Int("checkouthold", envInt("CHECKOUT_HOLD_MINUTES", 30), "Minutes a guest has to pay before the rooms they booked are released")
+	depositPercent := flag.Int("deposit", envInt("DEPOSIT_PERCENT", 20), "Percentage of the total a guest can pay as a deposit, or 0 to take full payment")
+	freeCancellation := flag.Int("freecancellation", envInt("FREE_CANCELLATION_DAYS", 7), "Days before arrival a guest can cancel for free under the default cancellation policy")
+	waitlistHold := flag.Int("waitlisthold", envInt("WAITLIST_HOLD_HOURS", 24), "Hours a room that comes free is held for a guest on the waitlist")
+	baseURL := flag.String("baseurl", envString("BASE_URL", "http://localhost:8080"), "Address of the site, for links in emails sent in the background")
 	flag.Parse()
 
 	if *dbName == "" || *dbUser == "" {
@@ -69,8 +107,8 @@ func run() (*driver.DB, error) {
 		os.Exit(1)
 	}
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
+	app.MailNotify = make(chan struct{}, 1)
+	app.AdminEmail = *mailAdmin
 
 	app.InProduction = *inProduction
 	app.UseCache = *useCache
@@ -98,14 +136,80 @@ func run() (*driver.DB, error) {
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
 		log.Fatal("cannot create template cache")
-		return nil, err
+		return nil, nil, err
 	}
 
 	app.TemplateCache = tc
+
+	key := []byte(*secretKey)
+	if len(key) == 0 {
+		// links sent before a restart stop working, which is fine for development
+		infoLog.Println("No -secret set, using a random key to sign links")
+		key, err = tokens.RandomKey()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	app.Tokens = tokens.New(key)
+	app.LoginPolicy = lockout.DefaultPolicy()
+	app.TrashRetention = time.Duration(*trashDays) * 24 * time.Hour
+
+	app.Payments, err = payments.New(payments.Config{
+		Driver:        *paymentsDriver,
+		WebhookSecret: *paymentsSecret,
+		Production:    app.InProduction,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	app.DepositPercent = *depositPercent
+	app.CheckoutHold = time.Duration(*checkoutHold) * time.Minute
+	app.CancellationPolicy = cancellation.Default(*freeCancellation)
+
+	et, err := emails.New("./email-templates")
+	if err != nil {
+		return nil, nil, err
+	}
+	app.EmailTemplates = et
+
+	app.BaseURL = *baseURL
+
 	repo := handlers.NewRepo(&app, db)
 	handlers.NewHandlers(repo)
+	app.Waitlist = waitlist.New(repo.DB, time.Duration(*waitlistHold)*time.Hour, repo.SendWaitlistOffer, infoLog, errorLog)
 	render.NewRenderer(&app)
 	helpers.NewHelpers(&app)
 
-	return db, nil
+	m, err := mailer.New(mailer.Config{
+		Driver:     *mailDriver,
+		Host:       *smtpHost,
+		Port:       *smtpPort,
+		Username:   *smtpUser,
+		Password:   *smtpPass,
+		Encryption: *smtpEncryption,
+		From:       *mailFrom,
+		Dir:        *mailDir,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return db, m, nil
+}
+
+// envString returns the environment variable key, or def if it is not set
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envInt returns the environment variable key as a number, or def if it is not set or not a number
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
 }
@@ -2,14 +2,19 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/eador/bookings/internal/helpers"
 	"github.com/justinas/nosurf"
 )
 
-// NoSurf add CSRF protection to all POST requests
+// NoSurf add CSRF protection to all POST requests, except those to the JSON API and from the
+// payment provider, whose clients send no form token
 func NoSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/payments/webhook"
+	})
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/eador/bookings/internal/repository"
+	"github.com/eador/bookings/internal/trash"
+)
+
+// purgeTrash starts removing reservations that have been in the trash longer than app.TrashRetention
+func purgeTrash(db repository.DatabaseRepo) *trash.Purger {
+	purger := trash.New(db, app.TrashRetention, infoLog, errorLog)
+	purger.Start()
+	return purger
+}
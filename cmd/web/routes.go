@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/eador/bookings/internal/access"
 	"github.com/eador/bookings/internal/config"
 	"github.com/eador/bookings/internal/handlers"
 	"github.com/go-chi/chi/v5"
@@ -11,6 +12,7 @@ import (
 
 func routes(app *config.AppConfig) http.Handler {
 	mux := chi.NewRouter()
+	can := handlers.Repo.RequirePermission
 
 	mux.Use(middleware.Recoverer)
 	mux.Use(NoSurf)
@@ -18,38 +20,134 @@ func routes(app *config.AppConfig) http.Handler {
 
 	mux.Get("/", handlers.Repo.Home)
 	mux.Get("/about", handlers.Repo.About)
-	mux.Get("/generals-quarters", handlers.Repo.Generals)
-	mux.Get("/majors-suite", handlers.Repo.Majors)
+	mux.Get("/rooms", handlers.Repo.Rooms)
+	mux.Get("/rooms/{slug}", handlers.Repo.Room)
+	mux.Get("/rooms/{slug}/calendar.ics", handlers.Repo.RoomCalendar)
+
+	// the original room pages, kept so old links and bookmarks still work
+	mux.Handle("/generals-quarters", http.RedirectHandler("/rooms/generals-quarters", http.StatusMovedPermanently))
+	mux.Handle("/majors-suite", http.RedirectHandler("/rooms/majors-suite", http.StatusMovedPermanently))
 
 	mux.Get("/make-reservation", handlers.Repo.Reservation)
 	mux.Post("/make-reservation", handlers.Repo.PostReservation)
+	mux.Get("/checkout", handlers.Repo.Checkout)
+	mux.Post("/checkout", handlers.Repo.PostCheckout)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
+	mux.Post("/payments/webhook", handlers.Repo.PaymentWebhook)
 
 	mux.Get("/search-availability", handlers.Repo.Availability)
 	mux.Post("/search-availability", handlers.Repo.PostAvailability)
 	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
 	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
+	mux.Post("/choose-rooms", handlers.Repo.PostChooseRooms)
 	mux.Get("/book-room", handlers.Repo.BookRoom)
+	mux.Get("/waitlist", handlers.Repo.Waitlist)
+	mux.Post("/waitlist", handlers.Repo.PostWaitlist)
+	mux.Get("/waitlist/book", handlers.Repo.WaitlistBook)
+
+	mux.Get("/find-reservation", handlers.Repo.FindReservation)
+	mux.Post("/find-reservation", handlers.Repo.PostFindReservation)
+	mux.Get("/manage-reservation", handlers.Repo.ManageReservation)
+	mux.Post("/manage-reservation/change-dates", handlers.Repo.PostChangeReservationDates)
+	mux.Post("/manage-reservation/cancel", handlers.Repo.PostCancelReservation)
+	mux.Post("/manage-reservation/cancel-room", handlers.Repo.PostCancelReservationRoom)
 
 	mux.Get("/contact", handlers.Repo.Contact)
 
 	mux.Get("/user/login", handlers.Repo.ShowLogin)
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
 	mux.Get("/user/logout", handlers.Repo.Logout)
+	mux.Get("/user/forgot-password", handlers.Repo.ForgotPassword)
+	mux.Post("/user/forgot-password", handlers.Repo.PostForgotPassword)
+	mux.Get("/user/set-password", handlers.Repo.SetPassword)
+	mux.Post("/user/set-password", handlers.Repo.PostSetPassword)
+	mux.Get("/user/two-factor", handlers.Repo.TwoFactor)
+	mux.Post("/user/two-factor", handlers.Repo.PostTwoFactor)
 
 	mux.Route("/admin", func(mux chi.Router) {
-		//mux.Use(Auth)
+		mux.Use(Auth)
+		mux.Use(can(access.ViewReservations))
 		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
 
 		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
 		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
 		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalender)
-		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalender)
-		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
-		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+		mux.With(can(access.EditCalendar)).Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalender)
+		mux.With(can(access.ManageReservations)).Get("/reservations/{src}/{id}/status/{status}/do", handlers.Repo.AdminReservationStatus)
+		mux.With(can(access.ManageReservations)).Get("/reservations/{src}/{id}/cancel-group/do", handlers.Repo.AdminCancelReservationGroup)
+		mux.With(can(access.DeleteReservations)).Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+		mux.With(can(access.DeleteReservations)).Get("/trash", handlers.Repo.AdminTrash)
+		mux.With(can(access.DeleteReservations)).Get("/trash/{id}/restore/do", handlers.Repo.AdminRestoreReservation)
 
 		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
-		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+		mux.With(can(access.ManageReservations)).Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+
+		mux.Get("/rooms", handlers.Repo.AdminRooms)
+		mux.Get("/rooms/{id}", handlers.Repo.AdminShowRoom)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(can(access.ManageRooms))
+			mux.Get("/rooms/new", handlers.Repo.AdminNewRoom)
+			mux.Post("/rooms/new", handlers.Repo.AdminPostNewRoom)
+			mux.Post("/rooms/{id}", handlers.Repo.AdminPostShowRoom)
+			mux.Get("/rooms/{id}/retire/do", handlers.Repo.AdminRetireRoom)
+			mux.Get("/rooms/{id}/restore/do", handlers.Repo.AdminRetireRoom)
+			mux.Get("/rooms/{id}/move/{direction}/do", handlers.Repo.AdminMoveRoom)
+			mux.Post("/rooms/{id}/calendar-import", handlers.Repo.AdminImportRoomCalendar)
+		})
+
+		mux.Get("/promo-codes", handlers.Repo.AdminPromoCodes)
+		mux.Get("/promo-codes/{id}", handlers.Repo.AdminShowPromoCode)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(can(access.ManagePromoCodes))
+			mux.Get("/promo-codes/new", handlers.Repo.AdminNewPromoCode)
+			mux.Post("/promo-codes/new", handlers.Repo.AdminPostNewPromoCode)
+			mux.Post("/promo-codes/{id}", handlers.Repo.AdminPostShowPromoCode)
+		})
+
+		mux.Get("/guests", handlers.Repo.AdminGuests)
+		mux.Get("/guests/{id}", handlers.Repo.AdminShowGuest)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(can(access.ManageGuests))
+			mux.Post("/guests/{id}", handlers.Repo.AdminPostShowGuest)
+			mux.Post("/guests/{id}/merge", handlers.Repo.AdminMergeGuest)
+		})
+
+		mux.Get("/mail-failed", handlers.Repo.AdminFailedMail)
+		mux.With(can(access.ManageMail)).Get("/mail/{id}/resend/do", handlers.Repo.AdminResendMail)
+		mux.Get("/email-templates", handlers.Repo.AdminEmailTemplates)
+		mux.Get("/email-templates/{name}", handlers.Repo.AdminEmailTemplate)
+
+		mux.With(can(access.ViewAuditLog)).Get("/audit", handlers.Repo.AdminAuditLog)
+		mux.With(can(access.ViewReports)).Get("/reports/taxes", handlers.Repo.AdminTaxReport)
+
+		mux.Get("/two-factor", handlers.Repo.AdminTwoFactor)
+		mux.Post("/two-factor/enable", handlers.Repo.AdminEnableTwoFactor)
+		mux.Post("/two-factor/disable", handlers.Repo.AdminDisableTwoFactor)
+		mux.Post("/two-factor/recovery-codes", handlers.Repo.AdminRecoveryCodes)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(can(access.ManageUsers))
+			mux.Get("/users", handlers.Repo.AdminUsers)
+			mux.Get("/users/new", handlers.Repo.AdminNewUser)
+			mux.Post("/users/new", handlers.Repo.AdminPostNewUser)
+			mux.Post("/users/two-factor", handlers.Repo.AdminPostRequireTwoFactor)
+			mux.Post("/users/{id}/role", handlers.Repo.AdminPostUserRole)
+			mux.Get("/users/{id}/invite/do", handlers.Repo.AdminInviteUser)
+			mux.Get("/users/{id}/deactivate/do", handlers.Repo.AdminActivateUser)
+			mux.Get("/users/{id}/activate/do", handlers.Repo.AdminActivateUser)
+			mux.Get("/users/{id}/unlock/do", handlers.Repo.AdminUnlockUser)
+		})
+	})
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Get("/openapi.json", handlers.Repo.APIOpenAPI)
+		mux.Get("/rooms", handlers.Repo.APIRooms)
+		mux.Get("/rooms/{id}/availability", handlers.Repo.APIRoomAvailability)
+		mux.Get("/availability", handlers.Repo.APIAvailability)
+		mux.Post("/reservations", handlers.Repo.APICreateReservation)
+		mux.Get("/reservations/{code}", handlers.Repo.APIGetReservation)
+		mux.Post("/reservations/{code}/cancel", handlers.Repo.APICancelReservation)
+		mux.With(handlers.Repo.RequireAPIPermission(access.ViewReservations)).Get("/admin/reservations", handlers.Repo.APIAdminReservations)
 	})
 
 	fileServer := http.FileServer(http.Dir("./static/"))
@@ -1,58 +1,16 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
-	"strings"
-	"time"
-
-	"github.com/eador/bookings/internal/models"
-	mail "github.com/xhit/go-simple-mail/v2"
+	"github.com/eador/bookings/internal/mailer"
+	"github.com/eador/bookings/internal/mailqueue"
+	"github.com/eador/bookings/internal/repository"
 )
 
-func listenForMail() {
-
-	go func() {
-		for {
-			msg := <-app.MailChan
-			sendMsg(msg)
-		}
-	}()
-
-}
-
-func sendMsg(m models.MailData) {
-	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
-
-	client, err := server.Connect()
-	if err != nil {
-		errorLog.Println(err)
-	}
-
-	email := mail.NewMSG()
-	email.SetFrom(m.From).AddTo(m.To).SetSubject(m.Subject)
-	if m.Template == "" {
-		email.SetBody(mail.TextHTML, m.Content)
-	} else {
-		data, err := ioutil.ReadFile(fmt.Sprintf("./email-templates/%s", m.Template))
-		if err != nil {
-			errorLog.Println(err)
-		}
-		mailTemplate := string(data)
-		msgToSend := strings.Replace(mailTemplate, "[%body%]", m.Content, 1)
-		email.SetBody(mail.TextHTML, msgToSend)
-	}
-
-	err = email.Send(client)
+const mailWorkers = 4
 
-	if err != nil {
-		errorLog.Println(err)
-	} else {
-		infoLog.Println("email sent")
-	}
+// listenForMail starts the workers that send the mail in the outbox through m
+func listenForMail(db repository.DatabaseRepo, m mailer.Mailer) *mailqueue.Queue {
+	queue := mailqueue.New(db, m.Send, app.MailNotify, infoLog, errorLog)
+	queue.Start(mailWorkers)
+	return queue
 }
@@ -0,0 +1,76 @@
+package access
+
+// Roles are stored in users.access_level
+const (
+	ReadOnly  = 1
+	FrontDesk = 2
+	Owner     = 3
+)
+
+// Permission is something a role may be allowed to do in the admin area
+type Permission string
+
+// The permissions checked by the admin routes
+const (
+	ViewReservations   Permission = "view_reservations"
+	ManageReservations Permission = "manage_reservations"
+	DeleteReservations Permission = "delete_reservations"
+	EditCalendar       Permission = "edit_calendar"
+	ManageRooms        Permission = "manage_rooms"
+	ManagePromoCodes   Permission = "manage_promo_codes"
+	ManageGuests       Permission = "manage_guests"
+	ManageMail         Permission = "manage_mail"
+	ManageUsers        Permission = "manage_users"
+	ViewAuditLog       Permission = "view_audit_log"
+	ViewReports        Permission = "view_reports"
+)
+
+// Role describes an access level
+type Role struct {
+	AccessLevel int
+	Name        string
+}
+
+var roles = []Role{
+	{ReadOnly, "Read Only"},
+	{FrontDesk, "Front Desk"},
+	{Owner, "Owner"},
+}
+
+var permissions = map[int][]Permission{
+	ReadOnly:  {ViewReservations},
+	FrontDesk: {ViewReservations, ManageReservations, EditCalendar, ManageGuests, ManageMail},
+	Owner: {ViewReservations, ManageReservations, DeleteReservations, EditCalendar, ManageRooms,
+		ManagePromoCodes, ManageGuests, ManageMail, ManageUsers, ViewAuditLog, ViewReports},
+}
+
+// Roles returns the roles from least to most access
+func Roles() []Role {
+	return roles
+}
+
+// RoleName returns the name of the role for an access level
+func RoleName(accessLevel int) string {
+	for _, r := range roles {
+		if r.AccessLevel == accessLevel {
+			return r.Name
+		}
+	}
+	return "No Access"
+}
+
+// ValidRole reports whether accessLevel is one of the roles
+func ValidRole(accessLevel int) bool {
+	_, ok := permissions[accessLevel]
+	return ok
+}
+
+// Can reports whether a user with accessLevel has permission p
+func Can(accessLevel int, p Permission) bool {
+	for _, allowed := range permissions[accessLevel] {
+		if allowed == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package access
+
+import "testing"
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		accessLevel int
+		permission  Permission
+		expected    bool
+	}{
+		{ReadOnly, ViewReservations, true},
+		{ReadOnly, ManageReservations, false},
+		{ReadOnly, DeleteReservations, false},
+		{FrontDesk, ManageReservations, true},
+		{FrontDesk, EditCalendar, true},
+		{FrontDesk, DeleteReservations, false},
+		{FrontDesk, ManageUsers, false},
+		{Owner, DeleteReservations, true},
+		{Owner, ManageUsers, true},
+		{Owner, ViewAuditLog, true},
+		{FrontDesk, ViewAuditLog, false},
+		{Owner, ManagePromoCodes, true},
+		{FrontDesk, ManagePromoCodes, false},
+		{FrontDesk, ManageGuests, true},
+		{ReadOnly, ManageGuests, false},
+		{Owner, ViewReports, true},
+		{FrontDesk, ViewReports, false},
+		{0, ViewReservations, false},
+		{99, ViewReservations, false},
+	}
+	for _, e := range tests {
+		if got := Can(e.accessLevel, e.permission); got != e.expected {
+			t.Errorf("Can(%d, %s): expected %t but got %t", e.accessLevel, e.permission, e.expected, got)
+		}
+	}
+}
+
+func TestRoleName(t *testing.T) {
+	if RoleName(Owner) != "Owner" || RoleName(FrontDesk) != "Front Desk" || RoleName(ReadOnly) != "Read Only" {
+		t.Error("unexpected role names")
+	}
+	if RoleName(0) != "No Access" {
+		t.Errorf("expected No Access for an unknown level but got %s", RoleName(0))
+	}
+}
+
+func TestValidRole(t *testing.T) {
+	for _, r := range Roles() {
+		if !ValidRole(r.AccessLevel) {
+			t.Errorf("expected %s to be valid", r.Name)
+		}
+	}
+	if ValidRole(4) {
+		t.Error("expected 4 not to be a valid role")
+	}
+}
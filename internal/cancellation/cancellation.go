@@ -0,0 +1,175 @@
+package cancellation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/status"
+)
+
+// ErrInvalidTiers is returned by ParseTiers when a tier is not written days:percent
+var ErrInvalidTiers = errors.New("cancellation tiers must be written days:percent, e.g. 14:0,7:50")
+
+// Default returns the policy for rooms without one: cancelling at least freeDays days before
+// arrival is free, and later costs the full price
+func Default(freeDays int) models.CancellationPolicy {
+	return models.CancellationPolicy{
+		Name:  "Standard",
+		Tiers: []models.CancellationTier{{Days: freeDays, Percent: 0}},
+	}
+}
+
+// ParseTiers reads tiers stored as a comma separated list of days:percent, e.g. "14:0,7:50".
+// An empty list has no tiers, so cancelling always costs the full price.
+func ParseTiers(s string) ([]models.CancellationTier, error) {
+	var tiers []models.CancellationTier
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		parts := strings.Split(t, ":")
+		if len(parts) != 2 {
+			return nil, ErrInvalidTiers
+		}
+		days, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || days < 0 {
+			return nil, ErrInvalidTiers
+		}
+		percent, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, ErrInvalidTiers
+		}
+		tiers = append(tiers, models.CancellationTier{Days: days, Percent: percent})
+	}
+	return sorted(tiers), nil
+}
+
+// FormatTiers writes tiers in the form ParseTiers reads
+func FormatTiers(tiers []models.CancellationTier) string {
+	var list []string
+	for _, t := range sorted(tiers) {
+		list = append(list, fmt.Sprintf("%d:%d", t.Days, t.Percent))
+	}
+	return strings.Join(list, ",")
+}
+
+// Describe explains a policy's tiers to a guest, one sentence for each
+func Describe(tiers []models.CancellationTier) []string {
+	var lines []string
+	for _, t := range sorted(tiers) {
+		when := fmt.Sprintf("up to %s before arrival", plural(t.Days, "day"))
+		if t.Days == 0 {
+			when = "up to the day of arrival"
+		}
+		if t.Percent == 0 {
+			lines = append(lines, "Free cancellation "+when)
+		} else {
+			lines = append(lines, fmt.Sprintf("%d%% of the price %s", t.Percent, when))
+		}
+	}
+	if len(lines) == 0 {
+		return []string{"Non-refundable: cancelling costs the full price"}
+	}
+	last := sorted(tiers)[len(tiers)-1]
+	if last.Percent < 100 {
+		lines = append(lines, "After that, the full price")
+	}
+	return lines
+}
+
+// PenaltyPercent returns the percentage of the price that cancelling a stay arriving on arrival
+// at now costs
+func PenaltyPercent(tiers []models.CancellationTier, arrival, now time.Time) int {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, t := range sorted(tiers) {
+		if !arrival.Before(today.AddDate(0, 0, t.Days)) {
+			return t.Percent
+		}
+	}
+	return 100
+}
+
+// Penalty returns what cancelling a stay costing total and arriving on arrival at now costs
+func Penalty(tiers []models.CancellationTier, total int, arrival, now time.Time) int {
+	return (total*PenaltyPercent(tiers, arrival, now) + 50) / 100
+}
+
+// PolicyOf returns the cancellation policy recorded on res when it was booked, or def if none was
+func PolicyOf(res models.Reservation, def models.CancellationPolicy) models.CancellationPolicy {
+	if res.CancellationPolicy == "" {
+		return def
+	}
+	return models.CancellationPolicy{
+		ID:    res.CancellationPolicyID,
+		Name:  res.CancellationPolicy,
+		Tiers: res.CancellationTiers,
+	}
+}
+
+// Quote is what cancelling some of the rooms of a booking costs the guest
+type Quote struct {
+	// Penalties holds the penalty for each cancelled reservation by id, and Penalty their sum
+	Penalties map[int]int
+	Penalty   int
+	// Refund is what the guest has paid beyond the penalty and the price of the rooms still booked
+	Refund int
+}
+
+// Calculate quotes cancelling the reservations with ids in cancelled from the booking res at
+// now; every room of a booking arrives on the same day. Each is charged under its PolicyOf. Only what the guest has paid can be kept, so the penalty never leads
+// to a further charge.
+func Calculate(res models.Reservation, def models.CancellationPolicy, now time.Time, cancelled ...int) Quote {
+	q := Quote{Penalties: make(map[int]int)}
+
+	remaining := 0
+	for _, g := range res.Reservations() {
+		if status.ReleasesRoom(g.Status) {
+			continue
+		}
+		if !contains(cancelled, g.ID) {
+			remaining += g.TotalAmount
+			continue
+		}
+
+		penalty := Penalty(PolicyOf(g, def).Tiers, g.TotalAmount, res.StartDate, now)
+		q.Penalties[g.ID] = penalty
+		q.Penalty += penalty
+	}
+
+	q.Refund = res.Paid() - remaining - q.Penalty
+	if q.Refund < 0 {
+		q.Refund = 0
+	}
+	return q
+}
+
+// sorted returns a copy of tiers with the most days before arrival first
+func sorted(tiers []models.CancellationTier) []models.CancellationTier {
+	list := append([]models.CancellationTier(nil), tiers...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Days > list[j].Days
+	})
+	return list
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+func contains(list []int, n int) bool {
+	for _, l := range list {
+		if l == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package cancellation
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/status"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := ParseTiers(" 7:50, 14:0 ,1:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []models.CancellationTier{{Days: 14, Percent: 0}, {Days: 7, Percent: 50}, {Days: 1, Percent: 100}}
+	if !reflect.DeepEqual(tiers, expected) {
+		t.Errorf("expected %v but got %v", expected, tiers)
+	}
+	if s := FormatTiers(tiers); s != "14:0,7:50,1:100" {
+		t.Errorf("unexpected tiers %q", s)
+	}
+
+	if tiers, err := ParseTiers(""); err != nil || len(tiers) != 0 {
+		t.Errorf("expected no tiers but got %v, %v", tiers, err)
+	}
+	for _, s := range []string{"14", "14:0:1", "x:0", "14:x", "-1:0", "14:101"} {
+		if _, err := ParseTiers(s); err != ErrInvalidTiers {
+			t.Errorf("expected %q not to be valid", s)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		tiers    []models.CancellationTier
+		expected []string
+	}{
+		{[]models.CancellationTier{{Days: 1, Percent: 0}}, []string{"Free cancellation up to 1 day before arrival", "After that, the full price"}},
+		{[]models.CancellationTier{{Days: 7, Percent: 50}, {Days: 14, Percent: 0}}, []string{"Free cancellation up to 14 days before arrival", "50% of the price up to 7 days before arrival", "After that, the full price"}},
+		{[]models.CancellationTier{{Days: 0, Percent: 0}}, []string{"Free cancellation up to the day of arrival", "After that, the full price"}},
+		{[]models.CancellationTier{{Days: 30, Percent: 100}}, []string{"100% of the price up to 30 days before arrival"}},
+		{nil, []string{"Non-refundable: cancelling costs the full price"}},
+	}
+	for _, e := range tests {
+		if got := Describe(e.tiers); !reflect.DeepEqual(got, e.expected) {
+			t.Errorf("expected %q but got %q", e.expected, got)
+		}
+	}
+}
+
+func TestPenalty(t *testing.T) {
+	strict := []models.CancellationTier{{Days: 14, Percent: 0}, {Days: 7, Percent: 50}}
+	now := date("2050-01-01").Add(18 * time.Hour)
+
+	tests := []struct {
+		name     string
+		tiers    []models.CancellationTier
+		arrival  string
+		expected int
+	}{
+		{"well ahead", strict, "2050-02-01", 0},
+		{"exactly 14 days ahead", strict, "2050-01-15", 0},
+		{"13 days ahead", strict, "2050-01-14", 5000},
+		{"7 days ahead", strict, "2050-01-08", 5000},
+		{"6 days ahead", strict, "2050-01-07", 10000},
+		{"non-refundable", nil, "2050-12-31", 10000},
+	}
+	for _, e := range tests {
+		if got := Penalty(e.tiers, 10000, date(e.arrival), now); got != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	now := date("2050-01-01")
+	def := Default(7)
+
+	// three rooms paid for in full: one moderate, one booked before policies were recorded and
+	// one already cancelled
+	res := models.Reservation{
+		ID:        1,
+		StartDate: date("2050-01-04"),
+		Group: []models.Reservation{
+			{ID: 1, TotalAmount: 10000, CancellationPolicy: "Moderate", CancellationTiers: []models.CancellationTier{{Days: 5, Percent: 0}, {Days: 1, Percent: 50}}},
+			{ID: 2, TotalAmount: 8000},
+			{ID: 3, TotalAmount: 6000, Status: status.Cancelled},
+		},
+		Payments: []models.Payment{
+			{ID: 1, Kind: payments.Full, Status: payments.Captured, Amount: 24000},
+		},
+	}
+
+	q := Calculate(res, def, now, 1)
+	if q.Penalty != 5000 || q.Penalties[1] != 5000 || q.Refund != 24000-8000-5000 {
+		t.Errorf("unexpected quote for one room %+v", q)
+	}
+
+	q = Calculate(res, def, now, 1, 2)
+	if q.Penalty != 13000 || q.Penalties[2] != 8000 || q.Refund != 24000-13000 {
+		t.Errorf("unexpected quote for both rooms %+v", q)
+	}
+
+	// only a deposit was paid, which the penalty more than uses up
+	res.Payments[0].Amount = 2000
+	q = Calculate(res, def, now, 1, 2)
+	if q.Penalty != 13000 || q.Refund != 0 {
+		t.Errorf("unexpected quote after a deposit %+v", q)
+	}
+
+	// far enough ahead to cancel for free under both policies
+	res.StartDate = date("2050-02-01")
+	res.Payments[0].Amount = 24000
+	q = Calculate(res, def, now, 1, 2)
+	if q.Penalty != 0 || q.Refund != 24000 {
+		t.Errorf("unexpected quote well ahead %+v", q)
+	}
+}
@@ -3,18 +3,37 @@ package config
 import (
 	"html/template"
 	"log"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/eador/bookings/internal/emails"
+	"github.com/eador/bookings/internal/lockout"
 	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/tokens"
+	"github.com/eador/bookings/internal/waitlist"
 )
 
 //AppConfig holds the application config
 type AppConfig struct {
-	UseCache      bool
-	TemplateCache map[string]*template.Template
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	InProduction  bool
-	Session       *scs.SessionManager
-	MailChan      chan models.MailData
+	UseCache       bool
+	TemplateCache  map[string]*template.Template
+	InfoLog        *log.Logger
+	ErrorLog       *log.Logger
+	InProduction   bool
+	Session        *scs.SessionManager
+	MailNotify     chan struct{}
+	AdminEmail     string
+	EmailTemplates *emails.Templates
+	Tokens         *tokens.Signer
+	LoginPolicy    lockout.Policy
+	TrashRetention time.Duration
+	Payments       payments.Provider
+	DepositPercent int
+	// CheckoutHold is how long a guest has to pay before the rooms they booked are released
+	CheckoutHold time.Duration
+	// CancellationPolicy applies to rooms and reservations without a cancellation policy of their own
+	CancellationPolicy models.CancellationPolicy
+	Waitlist           *waitlist.Offerer
+	BaseURL            string
 }
@@ -0,0 +1,247 @@
+package emails
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/pricing"
+)
+
+// The names of the email templates
+const (
+	ReservationConfirmationName = "reservation-confirmation"
+	AdminNotificationName       = "admin-notification"
+	ReservationChangedName      = "reservation-changed"
+	ReservationCancelledName    = "reservation-cancelled"
+	ReservationReminderName     = "reservation-reminder"
+	UserInviteName              = "user-invite"
+	PasswordResetName           = "password-reset"
+	WaitlistOfferName           = "waitlist-offer"
+)
+
+// ReservationConfirmation is sent to a guest when they book
+type ReservationConfirmation struct {
+	Reservation models.Reservation
+}
+
+// AdminNotification tells the owner something happened to a reservation. Event completes
+// "Reservation ... has been", e.g. "made" or "cancelled by the guest".
+type AdminNotification struct {
+	Reservation models.Reservation
+	Event       string
+}
+
+// ReservationChanged is sent to a guest when they move their reservation
+type ReservationChanged struct {
+	Reservation models.Reservation
+}
+
+// ReservationCancelled is sent to a guest when their reservation is cancelled. Penalty is what
+// cancelling cost under the cancellation policy and Refunded is what is being paid back to them.
+type ReservationCancelled struct {
+	Reservation models.Reservation
+	Penalty     int
+	Refunded    int
+}
+
+// ReservationReminder is sent to a guest shortly before they arrive
+type ReservationReminder struct {
+	Reservation models.Reservation
+	DaysUntil   int
+}
+
+// UserInvite is sent to a new admin user with a link to choose their password.
+// ValidFor says how long the link works, e.g. "7 days".
+type UserInvite struct {
+	User     models.User
+	Link     string
+	ValidFor string
+}
+
+// PasswordReset is sent to a user who has forgotten their password
+type PasswordReset struct {
+	User     models.User
+	Link     string
+	ValidFor string
+}
+
+// WaitlistOffer tells a guest on the waitlist that a room is being held for them. ValidFor says
+// how long the link to book it works, e.g. "24 hours".
+type WaitlistOffer struct {
+	Entry    models.WaitlistEntry
+	Link     string
+	ValidFor string
+}
+
+// Message is a rendered email
+type Message struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+var functions = texttemplate.FuncMap{
+	"money":    pricing.FormatMoney,
+	"longDate": longDate,
+}
+
+// longDate formats a date as it is written in emails, e.g. Saturday, January 1, 2050
+func longDate(t time.Time) string {
+	return t.Format("Monday, January 2, 2006")
+}
+
+// Templates holds the parsed email templates
+type Templates struct {
+	html map[string]*htmltemplate.Template
+	text map[string]*texttemplate.Template
+}
+
+// New parses the email templates in dir. Each template is a pair of files, name.html.tmpl
+// using the layout in layout.html.tmpl and name.txt.tmpl, which also defines the subject.
+func New(dir string) (*Templates, error) {
+	t := &Templates{
+		html: make(map[string]*htmltemplate.Template),
+		text: make(map[string]*texttemplate.Template),
+	}
+
+	pages, err := filepath.Glob(filepath.Join(dir, "*.txt.tmpl"))
+	if err != nil {
+		return t, err
+	}
+	if len(pages) == 0 {
+		return t, fmt.Errorf("emails: no templates found in %s", dir)
+	}
+
+	layout := filepath.Join(dir, "layout.html.tmpl")
+	for _, page := range pages {
+		name := strings.TrimSuffix(filepath.Base(page), ".txt.tmpl")
+
+		tt, err := texttemplate.New(filepath.Base(page)).Funcs(functions).ParseFiles(page)
+		if err != nil {
+			return t, err
+		}
+		if tt.Lookup("subject") == nil {
+			return t, fmt.Errorf("emails: %s does not define a subject", page)
+		}
+		t.text[name] = tt
+
+		htmlPage := filepath.Join(dir, name+".html.tmpl")
+		ht, err := htmltemplate.New(filepath.Base(htmlPage)).Funcs(htmltemplate.FuncMap(functions)).ParseFiles(htmlPage, layout)
+		if err != nil {
+			return t, err
+		}
+		t.html[name] = ht
+	}
+
+	return t, nil
+}
+
+// Names returns the names of the templates in order
+func (t *Templates) Names() []string {
+	var names []string
+	for name := range t.text {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render renders the named template with data
+func (t *Templates) Render(name string, data interface{}) (Message, error) {
+	var msg Message
+
+	tt, ok := t.text[name]
+	if !ok {
+		return msg, fmt.Errorf("emails: unknown template %q", name)
+	}
+
+	var buf bytes.Buffer
+	if err := tt.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return msg, err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := tt.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.Text = strings.TrimSpace(buf.String()) + "\n"
+
+	buf.Reset()
+	if err := t.html[name].Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.HTML = buf.String()
+
+	return msg, nil
+}
+
+// Mail renders the named template as a message to the given address
+func (t *Templates) Mail(to, name string, data interface{}) (models.MailData, error) {
+	msg, err := t.Render(name, data)
+	if err != nil {
+		return models.MailData{}, err
+	}
+	return models.MailData{
+		To:      to,
+		Subject: msg.Subject,
+		Content: msg.HTML,
+		Text:    msg.Text,
+	}, nil
+}
+
+// Sample returns example data for the named template, for previews
+func Sample(name string) interface{} {
+	res := models.Reservation{
+		FirstName:        "Jane",
+		LastName:         "O'Hara",
+		Email:            "jane@example.com",
+		StartDate:        time.Date(2050, 1, 7, 0, 0, 0, 0, time.UTC),
+		EndDate:          time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+		ConfirmationCode: "ABCD2345",
+		TotalAmount:      38000,
+		Currency:         "USD",
+		Adults:           2,
+		Room:             models.Room{RoomName: "General's Quarters"},
+	}
+	user := models.User{FirstName: "Jane", LastName: "O'Hara", Email: "jane@example.com"}
+
+	switch name {
+	case ReservationConfirmationName:
+		res.Payments = []models.Payment{{Kind: payments.Deposit, Status: payments.Captured, Amount: 7600, Currency: "USD"}}
+		return ReservationConfirmation{Reservation: res}
+	case AdminNotificationName:
+		return AdminNotification{Reservation: res, Event: "made"}
+	case ReservationChangedName:
+		return ReservationChanged{Reservation: res}
+	case ReservationCancelledName:
+		return ReservationCancelled{Reservation: res, Penalty: 3800, Refunded: 7600}
+	case ReservationReminderName:
+		return ReservationReminder{Reservation: res, DaysUntil: 3}
+	case UserInviteName:
+		return UserInvite{User: user, Link: "https://example.com/user/set-password?token=ABCD2345", ValidFor: "7 days"}
+	case PasswordResetName:
+		return PasswordReset{User: user, Link: "https://example.com/user/set-password?token=ABCD2345", ValidFor: "1 hour"}
+	case WaitlistOfferName:
+		entry := models.WaitlistEntry{
+			FirstName: res.FirstName,
+			LastName:  res.LastName,
+			Email:     res.Email,
+			StartDate: res.StartDate,
+			EndDate:   res.EndDate,
+			Adults:    res.Adults,
+			Room:      res.Room,
+		}
+		return WaitlistOffer{Entry: entry, Link: "https://example.com/waitlist/book?token=ABCD2345", ValidFor: "24 hours"}
+	default:
+		return nil
+	}
+}
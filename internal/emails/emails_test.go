@@ -0,0 +1,212 @@
+package emails
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+func templates(t *testing.T) *Templates {
+	et, err := New("./../../email-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return et
+}
+
+func TestNew(t *testing.T) {
+	et := templates(t)
+
+	expected := []string{AdminNotificationName, PasswordResetName, ReservationCancelledName, ReservationChangedName,
+		ReservationConfirmationName, ReservationReminderName, UserInviteName, WaitlistOfferName}
+	names := et.Names()
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected templates %v but got %v", expected, names)
+	}
+
+	_, err := New(t.TempDir())
+	if err == nil {
+		t.Error("expected an error for a folder without templates")
+	}
+}
+
+func TestRender_Samples(t *testing.T) {
+	et := templates(t)
+
+	for _, name := range et.Names() {
+		msg, err := et.Render(name, Sample(name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if msg.Subject == "" || strings.Contains(msg.Subject, "\n") {
+			t.Errorf("%s: bad subject %q", name, msg.Subject)
+		}
+		if !strings.Contains(msg.HTML, "<html") || !strings.Contains(msg.HTML, "ABCD2345") {
+			t.Errorf("%s: expected the body inside the layout", name)
+		}
+		if strings.Contains(msg.Text, "<") {
+			t.Errorf("%s: expected no markup in the plain text:\n%s", name, msg.Text)
+		}
+	}
+}
+
+func TestRender_Escaping(t *testing.T) {
+	et := templates(t)
+
+	data := Sample(ReservationConfirmationName).(ReservationConfirmation)
+	data.Reservation.FirstName = `<script>alert("hi")</script>`
+
+	msg, err := et.Render(ReservationConfirmationName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg.HTML, "<script>") {
+		t.Error("expected the guest's name to be escaped in the HTML")
+	}
+	if !strings.Contains(msg.Text, `<script>alert("hi")</script>`) {
+		t.Error("expected the guest's name as written in the plain text")
+	}
+	if !strings.Contains(msg.Text, "Friday, January 7, 2050") {
+		t.Errorf("expected dates written out in full:\n%s", msg.Text)
+	}
+}
+
+func TestRender_Reminder(t *testing.T) {
+	et := templates(t)
+
+	data := Sample(ReservationReminderName).(ReservationReminder)
+	data.DaysUntil = 1
+	msg, err := et.Render(ReservationReminderName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Your stay begins tomorrow" {
+		t.Errorf("unexpected subject %q", msg.Subject)
+	}
+}
+
+func TestRender_Payments(t *testing.T) {
+	et := templates(t)
+
+	msg, err := et.Render(ReservationConfirmationName, Sample(ReservationConfirmationName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "You have paid $76.00 and $304.00 is due on arrival.") {
+		t.Errorf("expected the payment in the plain text:\n%s", msg.Text)
+	}
+
+	msg, err = et.Render(ReservationCancelledName, Sample(ReservationCancelledName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "$76.00 will be refunded") {
+		t.Errorf("expected the refund in the plain text:\n%s", msg.Text)
+	}
+	if !strings.Contains(msg.Text, "A cancellation charge of $38.00 applies") {
+		t.Errorf("expected the penalty in the plain text:\n%s", msg.Text)
+	}
+
+	msg, err = et.Render(ReservationCancelledName, ReservationCancelled{Reservation: Sample(ReservationCancelledName).(ReservationCancelled).Reservation})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg.Text, "refunded") || strings.Contains(msg.Text, "cancellation charge") {
+		t.Errorf("expected no refund or penalty in the plain text:\n%s", msg.Text)
+	}
+}
+
+func TestRender_PromoCode(t *testing.T) {
+	et := templates(t)
+
+	data := Sample(ReservationConfirmationName).(ReservationConfirmation)
+	data.Reservation.PromoCodeID = 1
+	data.Reservation.PromoCode = "SUMMER"
+	data.Reservation.DiscountAmount = 4000
+	data.Reservation.TotalAmount -= 4000
+
+	msg, err := et.Render(ReservationConfirmationName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "The total for your stay is $340.00, with $40.00 off for promo code SUMMER.") {
+		t.Errorf("expected the discount in the plain text:\n%s", msg.Text)
+	}
+	if !strings.Contains(msg.HTML, "off for promo code SUMMER") {
+		t.Errorf("expected the discount in the html:\n%s", msg.HTML)
+	}
+}
+
+func TestRender_Charges(t *testing.T) {
+	et := templates(t)
+
+	data := Sample(ReservationConfirmationName).(ReservationConfirmation)
+	data.Reservation.Charges = []models.ReservationCharge{
+		{Name: "Occupancy Tax", Kind: "tax", Basis: "percent", Rate: 1000, Amount: 3800},
+		{Name: "Cleaning Fee", Kind: "fee", Basis: "per_stay", Amount: 2500},
+	}
+	data.Reservation.TotalAmount += 6300
+
+	msg, err := et.Render(ReservationConfirmationName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "This includes:\n  - Occupancy Tax, $38.00\n  - Cleaning Fee, $25.00") {
+		t.Errorf("expected the taxes and fees in the plain text:\n%s", msg.Text)
+	}
+	if !strings.Contains(msg.HTML, "<li>Cleaning Fee, $25.00</li>") {
+		t.Errorf("expected the taxes and fees in the html:\n%s", msg.HTML)
+	}
+}
+
+func TestRender_Group(t *testing.T) {
+	et := templates(t)
+
+	data := Sample(ReservationConfirmationName).(ReservationConfirmation)
+	second := data.Reservation
+	second.Room.RoomName = "Major's Suite"
+	second.TotalAmount = 12000
+	second.Adults = 1
+	second.Children = 1
+	data.Reservation.Group = []models.Reservation{data.Reservation, second}
+
+	msg, err := et.Render(ReservationConfirmationName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"2 rooms", "General's Quarters for 2 adults, $380.00", "Major's Suite for 1 adult, 1 child, $120.00", "$500.00"} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("expected %q in the plain text:\n%s", want, msg.Text)
+		}
+	}
+	if !strings.Contains(msg.HTML, "Major&#39;s Suite") {
+		t.Error("expected every room in the HTML")
+	}
+
+	msg, err = et.Render(AdminNotificationName, AdminNotification{Reservation: data.Reservation, Event: "made"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Reservation made: 2 rooms" {
+		t.Errorf("unexpected subject %q", msg.Subject)
+	}
+}
+
+func TestMail(t *testing.T) {
+	et := templates(t)
+
+	msg, err := et.Mail("jane@example.com", ReservationCancelledName, Sample(ReservationCancelledName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.To != "jane@example.com" || msg.Subject != "Reservation Cancelled" || msg.Content == "" || msg.Text == "" {
+		t.Errorf("unexpected mail %+v", msg)
+	}
+
+	_, err = et.Mail("jane@example.com", "no-such-template", nil)
+	if err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+}
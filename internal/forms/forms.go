@@ -3,6 +3,8 @@ package forms
 import (
 	"fmt"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
@@ -62,3 +64,24 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "Invalid email address")
 	}
 }
+
+var slugRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// IsSlug checks that a field only has lower case letters, numbers and single dashes
+func (f *Form) IsSlug(field string) {
+	if !slugRegex.MatchString(f.Get(field)) {
+		f.Errors.Add(field, "Only lower case letters, numbers and dashes are allowed")
+	}
+}
+
+// IsInt checks that a field is a whole number of at least min
+func (f *Form) IsInt(field string, min int) {
+	i, err := strconv.Atoi(strings.TrimSpace(f.Get(field)))
+	if err != nil {
+		f.Errors.Add(field, "This field must be a whole number")
+		return
+	}
+	if i < min {
+		f.Errors.Add(field, fmt.Sprintf("This field must be at least %d", min))
+	}
+}
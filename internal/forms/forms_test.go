@@ -92,3 +92,45 @@ func TestForm_IsEmail(t *testing.T) {
 		t.Error("got error message for valid email address")
 	}
 }
+
+func TestForm_IsSlug(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("a", "generals-quarters")
+	postedData.Add("b", "General's Quarters")
+	postedData.Add("c", "trailing-")
+	form := New(postedData)
+
+	form.IsSlug("a")
+	form.IsSlug("b")
+	form.IsSlug("c")
+	if form.Errors.Get("a") != "" {
+		t.Error("got error message for valid slug")
+	}
+	if form.Errors.Get("b") == "" {
+		t.Error("did not get error message for slug with spaces and capitals")
+	}
+	if form.Errors.Get("c") == "" {
+		t.Error("did not get error message for slug with trailing dash")
+	}
+}
+
+func TestForm_IsInt(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("a", "3")
+	postedData.Add("b", "three")
+	postedData.Add("c", "0")
+	form := New(postedData)
+
+	form.IsInt("a", 1)
+	form.IsInt("b", 1)
+	form.IsInt("c", 1)
+	if form.Errors.Get("a") != "" {
+		t.Error("got error message for valid number")
+	}
+	if form.Errors.Get("b") != "This field must be a whole number" {
+		t.Error("did not get error message for text")
+	}
+	if form.Errors.Get("c") != "This field must be at least 1" {
+		t.Error("did not get error message for number below minimum")
+	}
+}
@@ -0,0 +1,758 @@
+package handlers
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/access"
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/repository"
+	"github.com/eador/bookings/internal/status"
+	"github.com/eador/bookings/internal/stayrules"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// maxAPIBodyBytes limits the size of JSON request bodies accepted by the API
+const maxAPIBodyBytes = 1 << 20
+
+// apiEnvelope wraps every API response; exactly one of Data or Error is set
+type apiEnvelope struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *apiError   `json:"error,omitempty"`
+}
+
+// apiError describes why an API request failed
+type apiError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+type apiPhoto struct {
+	URL     string `json:"url"`
+	Caption string `json:"caption"`
+}
+
+type apiRoom struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Slug        string     `json:"slug"`
+	Description string     `json:"description"`
+	Capacity    int        `json:"capacity"`
+	MaxAdults   int        `json:"max_adults"`
+	MaxChildren int        `json:"max_children"`
+	Amenities   []string   `json:"amenities"`
+	BaseRate    int        `json:"base_rate"`
+	Currency    string     `json:"currency"`
+	Photos      []apiPhoto `json:"photos"`
+}
+
+type apiNight struct {
+	Night    string `json:"night"`
+	RateName string `json:"rate_name"`
+	Amount   int    `json:"amount"`
+}
+
+type apiReservation struct {
+	ID               int         `json:"id,omitempty"`
+	ConfirmationCode string      `json:"confirmation_code"`
+	FirstName        string      `json:"first_name"`
+	LastName         string      `json:"last_name"`
+	Email            string      `json:"email"`
+	Phone            string      `json:"phone"`
+	RoomID           int         `json:"room_id"`
+	RoomName         string      `json:"room_name"`
+	StartDate        string      `json:"start_date"`
+	EndDate          string      `json:"end_date"`
+	Adults           int         `json:"adults"`
+	Children         int         `json:"children"`
+	TotalAmount      int         `json:"total_amount"`
+	Currency         string      `json:"currency"`
+	Status           string      `json:"status"`
+	Cancelled        bool        `json:"cancelled"`
+	Processed        *bool       `json:"processed,omitempty"`
+	Paid             int         `json:"paid"`
+	Refunded         *int        `json:"refunded,omitempty"`
+	Nights           []apiNight  `json:"nights,omitempty"`
+	Charges          []apiCharge `json:"charges,omitempty"`
+	// Rooms are the reservations for each room of a booking of several rooms
+	Rooms []apiReservation `json:"rooms,omitempty"`
+
+	CancellationPolicy  string `json:"cancellation_policy,omitempty"`
+	CancellationReason  string `json:"cancellation_reason,omitempty"`
+	CancellationPenalty int    `json:"cancellation_penalty,omitempty"`
+}
+
+type apiCharge struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Amount int    `json:"amount"`
+}
+
+type apiAvailability struct {
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Available bool   `json:"available"`
+}
+
+type apiReservationRequest struct {
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Adults    *int   `json:"adults"`
+	Children  *int   `json:"children"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+
+	PaymentToken string `json:"payment_token"`
+	Amount       string `json:"amount"`
+}
+
+type apiCancelRequest struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+}
+
+func toAPIRoom(room models.Room) apiRoom {
+	out := apiRoom{
+		ID:          room.ID,
+		Name:        room.RoomName,
+		Slug:        room.Slug,
+		Description: room.Description,
+		Capacity:    room.Capacity,
+		MaxAdults:   room.MaxAdults,
+		MaxChildren: room.MaxChildren,
+		Amenities:   room.AmenityList(),
+		BaseRate:    room.BaseRate,
+		Currency:    room.Currency,
+		Photos:      []apiPhoto{},
+	}
+	if out.Amenities == nil {
+		out.Amenities = []string{}
+	}
+	for _, p := range room.Photos {
+		out.Photos = append(out.Photos, apiPhoto{URL: p.URL, Caption: p.Caption})
+	}
+	return out
+}
+
+func toAPIReservation(res models.Reservation) apiReservation {
+	out := apiReservation{
+		ConfirmationCode: res.ConfirmationCode,
+		FirstName:        res.FirstName,
+		LastName:         res.LastName,
+		Email:            res.Email,
+		Phone:            res.Phone,
+		RoomID:           res.RoomID,
+		RoomName:         res.Room.RoomName,
+		StartDate:        res.StartDate.Format("2006-01-02"),
+		EndDate:          res.EndDate.Format("2006-01-02"),
+		Adults:           res.Adults,
+		Children:         res.Children,
+		TotalAmount:      res.TotalAmount,
+		Currency:         res.Currency,
+		Status:           res.Status,
+		Cancelled:        res.Status == status.Cancelled,
+		Paid:             res.Paid(),
+
+		CancellationPolicy:  res.CancellationPolicy,
+		CancellationReason:  res.CancellationReason,
+		CancellationPenalty: res.CancellationPenalty,
+	}
+	for _, n := range res.Nights {
+		out.Nights = append(out.Nights, apiNight{
+			Night:    n.Night.Format("2006-01-02"),
+			RateName: n.RateName,
+			Amount:   n.Amount,
+		})
+	}
+	for _, c := range res.Charges {
+		out.Charges = append(out.Charges, apiCharge{
+			Name:   c.Name,
+			Kind:   c.Kind,
+			Amount: c.Amount,
+		})
+	}
+	for _, g := range res.Group {
+		g.Payments = nil
+		out.Rooms = append(out.Rooms, toAPIReservation(g))
+	}
+	return out
+}
+
+// writeJSON writes v as the data of an API response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.MarshalIndent(apiEnvelope{Data: v}, "", "  ")
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// writeJSONError writes an API error response
+func writeJSONError(w http.ResponseWriter, status int, code, message string, fields map[string]string) {
+	out, _ := json.MarshalIndent(apiEnvelope{Error: &apiError{
+		Code:    code,
+		Message: message,
+		Fields:  fields,
+	}}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// readJSON decodes a JSON request body into dst, rejecting unknown fields and trailing data
+func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("body must contain a single JSON object")
+	}
+	return nil
+}
+
+// parseAPIDates reads and checks the start and end query parameters
+func parseAPIDates(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	layout := "2006-01-02"
+	start, err := time.Parse(layout, r.URL.Query().Get("start"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_start_date", "start must be a date in the form YYYY-MM-DD", nil)
+		return start, start, false
+	}
+	end, err := time.Parse(layout, r.URL.Query().Get("end"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_end_date", "end must be a date in the form YYYY-MM-DD", nil)
+		return start, end, false
+	}
+	if !end.After(start) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_dates", "end must be after start", nil)
+		return start, end, false
+	}
+	return start, end, true
+}
+
+// writeStayErrors answers with the stay rules a stay breaks, under the start and end parameters
+func writeStayErrors(w http.ResponseWriter, violations []stayrules.Violation) {
+	form := forms.New(nil)
+	addStayErrors(form, violations, "start", "end")
+	fields := make(map[string]string)
+	for field := range form.Errors {
+		fields[field] = form.Errors.Get(field)
+	}
+	writeJSONError(w, http.StatusUnprocessableEntity, "stay_rules", "The stay breaks the booking rules for those dates", fields)
+}
+
+// parseAPIParty reads and checks the adults and children query parameters, which default to one
+// adult and no children
+func parseAPIParty(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	adults, children := 1, 0
+	var err error
+	if v := r.URL.Query().Get("adults"); v != "" {
+		adults, err = strconv.Atoi(v)
+		if err != nil || adults < 1 {
+			writeJSONError(w, http.StatusBadRequest, "invalid_adults", "adults must be a whole number of at least 1", nil)
+			return adults, children, false
+		}
+	}
+	if v := r.URL.Query().Get("children"); v != "" {
+		children, err = strconv.Atoi(v)
+		if err != nil || children < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid_children", "children must be a whole number of at least 0", nil)
+			return adults, children, false
+		}
+	}
+	return adults, children, true
+}
+
+// APIOpenAPI serves the OpenAPI document describing the v1 API
+func (m *Repository) APIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// APIRooms lists the rooms offered to guests
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.ActiveRooms()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+		return
+	}
+
+	out := []apiRoom{}
+	for _, room := range rooms {
+		out = append(out, toAPIRoom(room))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APIAvailability lists the rooms that are free for the whole of a date range and sleep the party
+func (m *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	start, end, ok := parseAPIDates(w, r)
+	if !ok {
+		return
+	}
+
+	adults, children, ok := parseAPIParty(w, r)
+	if !ok {
+		return
+	}
+
+	rules, err := m.DB.GetStayRulesForArrival(start)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+		return
+	}
+	if violations := stayrules.Check(rules, 0, start, end, time.Now()); len(violations) > 0 {
+		writeStayErrors(w, violations)
+		return
+	}
+
+	rooms, err := m.DB.SearchAvailablitiyForAllRooms(start, end, adults, children)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+		return
+	}
+	rooms, _ = keepStayRules(rules, rooms, start, end)
+
+	out := []apiRoom{}
+	for _, room := range rooms {
+		out = append(out, toAPIRoom(room))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APIRoomAvailability reports whether one room is free for the whole of a date range and sleeps the party
+func (m *Repository) APIRoomAvailability(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	roomID, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Room not found", nil)
+		return
+	}
+
+	start, end, ok := parseAPIDates(w, r)
+	if !ok {
+		return
+	}
+
+	adults, children, ok := parseAPIParty(w, r)
+	if !ok {
+		return
+	}
+
+	room, err := m.DB.GetRoomById(roomID)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Room not found", nil)
+		return
+	}
+
+	violations, err := m.checkStay(roomID, start, end)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+		return
+	}
+	if len(violations) > 0 {
+		writeStayErrors(w, violations)
+		return
+	}
+
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(start, end, roomID)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiAvailability{
+		RoomID:    roomID,
+		StartDate: start.Format("2006-01-02"),
+		EndDate:   end.Format("2006-01-02"),
+		Available: available && room.Fits(adults, children),
+	})
+}
+
+// APICreateReservation books a room and takes the payment for it, sending the confirmation once it's paid
+func (m *Repository) APICreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req apiReservationRequest
+	err := readJSON(w, r, &req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", err.Error(), nil)
+		return
+	}
+
+	form := forms.New(url.Values{
+		"first_name":    {req.FirstName},
+		"last_name":     {req.LastName},
+		"email":         {req.Email},
+		"phone":         {req.Phone},
+		"start_date":    {req.StartDate},
+		"end_date":      {req.EndDate},
+		"payment_token": {req.PaymentToken},
+	})
+	form.Required("first_name", "last_name", "email", "start_date", "end_date", "payment_token")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, req.StartDate)
+	if err != nil && form.Has("start_date") {
+		form.Errors.Add("start_date", "Must be a date in the form YYYY-MM-DD")
+	}
+	endDate, err := time.Parse(layout, req.EndDate)
+	if err != nil && form.Has("end_date") {
+		form.Errors.Add("end_date", "Must be a date in the form YYYY-MM-DD")
+	}
+	if form.Errors.Get("start_date") == "" && form.Errors.Get("end_date") == "" {
+		violations, err := m.checkStay(req.RoomID, startDate, endDate)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+			return
+		}
+		addStayErrors(form, violations, "start_date", "end_date")
+	}
+
+	adults, children := 1, 0
+	if req.Adults != nil {
+		adults = *req.Adults
+	}
+	if req.Children != nil {
+		children = *req.Children
+	}
+	if adults < 1 {
+		form.Errors.Add("adults", "Must be at least 1")
+	}
+	if children < 0 {
+		form.Errors.Add("children", "Can not be negative")
+	}
+
+	kind := req.Amount
+	if kind == "" {
+		kind = payments.Full
+	}
+	if kind != payments.Full && kind != payments.Deposit {
+		form.Errors.Add("amount", "Must be deposit or full")
+	}
+
+	if !form.Valid() {
+		fields := make(map[string]string)
+		for field := range form.Errors {
+			fields[field] = form.Errors.Get(field)
+		}
+		writeJSONError(w, http.StatusUnprocessableEntity, "validation_failed", "The reservation is not valid", fields)
+		return
+	}
+
+	room, err := m.DB.GetRoomById(req.RoomID)
+	if err != nil || room.Retired == 1 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "validation_failed", "The reservation is not valid",
+			map[string]string{"room_id": "Unknown room"})
+		return
+	}
+	if !room.Fits(adults, children) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "validation_failed", "The reservation is not valid",
+			map[string]string{"adults": fmt.Sprintf("The room sleeps at most %d guests: up to %d adults and %d children",
+				room.Capacity, room.MaxAdults, room.MaxChildren)})
+		return
+	}
+
+	reservation := models.Reservation{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		StartDate: startDate,
+		EndDate:   endDate,
+		Adults:    adults,
+		Children:  children,
+		RoomID:    room.ID,
+		Room:      room,
+	}
+
+	err = m.priceReservation(&reservation, room)
+	if err == nil {
+		err = m.addCharges(&reservation)
+	}
+	if err == nil {
+		err = m.setCancellationPolicy(&reservation, room)
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Can not work out the price of this stay", nil)
+		return
+	}
+
+	reservation.ConfirmationCode, err = helpers.NewConfirmationCode()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Can not create reservation", nil)
+		return
+	}
+
+	amount := reservation.BookingTotal()
+	if kind == payments.Deposit {
+		amount = m.depositAmount(reservation)
+		if amount == 0 {
+			writeJSONError(w, http.StatusUnprocessableEntity, "validation_failed", "The reservation is not valid",
+				map[string]string{"amount": "A deposit can't be paid for this stay"})
+			return
+		}
+	}
+
+	// the room is held while the payment is taken, and released by the unpaid reservations
+	// job if we never get as far as recording it
+	due := time.Now().Add(m.App.CheckoutHold)
+	reservation.PaymentDueAt = &due
+
+	reservation.ID, err = m.DB.CreateReservation(reservation)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		writeJSONError(w, http.StatusConflict, "room_unavailable", "The room is not available for those dates", nil)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Can not create reservation", nil)
+		return
+	}
+
+	ref, err := m.App.Payments.Authorize(amount, reservation.Currency, req.PaymentToken, "Reservation "+reservation.ConfirmationCode)
+	if err != nil {
+		m.releaseUnpaid(reservation)
+		if errors.Is(err, payments.ErrDeclined) {
+			writeJSONError(w, http.StatusPaymentRequired, "payment_declined", "The card was declined", nil)
+			return
+		}
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusPaymentRequired, "payment_failed", "Can not take the payment", nil)
+		return
+	}
+
+	payment, err := m.capturePayment(reservation, ref, kind, amount)
+	if errors.Is(err, repository.ErrPaymentTooLate) {
+		writeJSONError(w, http.StatusConflict, "payment_too_late", "The reservation was released before it was paid for", nil)
+		return
+	}
+	if errors.Is(err, repository.ErrAlreadyPaid) {
+		writeJSONError(w, http.StatusConflict, "already_paid", "The reservation has already been paid for", nil)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Can not record the payment", nil)
+		return
+	}
+	reservation.Payments = append(reservation.Payments, payment)
+	reservation.PaymentDueAt = nil
+
+	m.sendConfirmation(reservation)
+
+	writeJSON(w, http.StatusCreated, toAPIReservation(reservation))
+}
+
+// releaseUnpaid cancels a reservation whose payment failed and offers its room to the waitlist
+func (m *Repository) releaseUnpaid(res models.Reservation) {
+	err := m.DB.CancelReservation(models.Actor{}, res.ID, models.Cancellation{Reason: "Payment declined"})
+	if err != nil {
+		// the unpaid reservations job releases it once the hold runs out
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	m.offerReleased(res)
+}
+
+// APIGetReservation returns a reservation by confirmation code, for the guest whose email is
+// given, with every room booked under the code
+func (m *Repository) APIGetReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	code := exploded[4]
+
+	res, ok := m.apiBooking(w, code, r.URL.Query().Get("email"))
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toAPIReservation(res))
+}
+
+// APICancelReservation cancels every room still booked under a confirmation code, for the guest
+// whose email is given
+func (m *Repository) APICancelReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	code := exploded[4]
+
+	var req apiCancelRequest
+	err := readJSON(w, r, &req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", err.Error(), nil)
+		return
+	}
+
+	res, ok := m.apiBooking(w, code, req.Email)
+	if !ok {
+		return
+	}
+
+	rooms := cancellable(res)
+	if len(rooms) == 0 {
+		if allCancelled(res) {
+			writeJSONError(w, http.StatusConflict, "already_cancelled", "The reservation has already been cancelled", nil)
+			return
+		}
+		writeJSONError(w, http.StatusConflict, "cannot_cancel", "The reservation can no longer be cancelled", nil)
+		return
+	}
+
+	q := m.quoteCancellation(res, cancellableIDs(res)...)
+	_, err = m.DB.CancelReservationGroup(m.actor(r), res.ConfirmationCode, models.Cancellation{
+		Reason:    req.Reason,
+		Penalties: q.Penalties,
+	})
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		writeJSONError(w, http.StatusConflict, "cannot_cancel", "The reservation can no longer be cancelled", nil)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Can not cancel reservation", nil)
+		return
+	}
+
+	refunded, err := m.refundCancellation(res, q)
+	if err != nil {
+		m.App.ErrorLog.Println("refund failed:", err)
+	}
+	m.offerReleased(rooms...)
+
+	for _, room := range rooms {
+		res = markCancelled(res, room.ID, req.Reason, q.Penalties[room.ID])
+	}
+	res.CancellationPenalty = q.Penalty
+	out := toAPIReservation(res)
+	out.Refunded = &refunded
+	writeJSON(w, http.StatusOK, out)
+}
+
+// apiBooking looks up the booking with confirmation code for the guest whose email is given,
+// with its group and payments. It writes an error and returns false if it can't.
+func (m *Repository) apiBooking(w http.ResponseWriter, code, email string) (models.Reservation, bool) {
+	res, err := m.DB.GetReservationByConfirmationCode(code, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Reservation not found", nil)
+		return res, false
+	}
+	if err == nil {
+		res, err = m.DB.GetReservationByID(res.ID)
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+		return res, false
+	}
+	return res, true
+}
+
+// allCancelled reports whether every room booked with res has been cancelled
+func allCancelled(res models.Reservation) bool {
+	for _, g := range res.Reservations() {
+		if g.Status != status.Cancelled {
+			return false
+		}
+	}
+	return true
+}
+
+// markCancelled returns res with the room booked as reservation id marked cancelled for reason
+// and penalty
+func markCancelled(res models.Reservation, id int, reason string, penalty int) models.Reservation {
+	if res.ID == id {
+		res.Status = status.Cancelled
+		res.CancellationReason = reason
+	}
+	for i := range res.Group {
+		if res.Group[i].ID == id {
+			res.Group[i].Status = status.Cancelled
+			res.Group[i].CancellationReason = reason
+			res.Group[i].CancellationPenalty = penalty
+		}
+	}
+	return res
+}
+
+// RequireAPIPermission is RequirePermission for the API, answering with a JSON error rather
+// than redirecting
+func (m *Repository) RequireAPIPermission(p access.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			check, err := m.checkAccess(r, p)
+			if err != nil {
+				m.App.ErrorLog.Println(err)
+				writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+				return
+			}
+
+			switch check {
+			case accessLoggedOut, accessRevoked:
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized", "Log in first", nil)
+			case accessNeedsTwoFactor:
+				writeJSONError(w, http.StatusForbidden, "two_factor_required", "Set up two-factor login to continue", nil)
+			case accessDenied:
+				writeJSONError(w, http.StatusForbidden, "forbidden", "You do not have permission to do that", nil)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// APIAdminReservations lists all reservations for a user who can view them
+func (m *Repository) APIAdminReservations(w http.ResponseWriter, r *http.Request) {
+	var reservations []models.Reservation
+	var err error
+	if r.URL.Query().Get("new") == "true" {
+		reservations, err = m.DB.NewReservations()
+	} else {
+		reservations, err = m.DB.AllReservations()
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "Error connecting to database", nil)
+		return
+	}
+
+	out := []apiReservation{}
+	for _, res := range reservations {
+		a := toAPIReservation(res)
+		a.ID = res.ID
+		processed := res.Status != status.Pending
+		a.Processed = &processed
+		out = append(out, a)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eador/bookings/internal/access"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/status"
+)
+
+var apiTests = []struct {
+	name           string
+	method         string
+	url            string
+	body           string
+	expectedStatus int
+	expectedError  string
+}{
+	{"openapi", "GET", "/api/v1/openapi.json", "", http.StatusOK, ""},
+	{"rooms", "GET", "/api/v1/rooms", "", http.StatusOK, ""},
+	{"availability", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-03", "", http.StatusOK, ""},
+	{"availability bad start", "GET", "/api/v1/availability?start=soon&end=2050-01-03", "", http.StatusBadRequest, "invalid_start_date"},
+	{"availability reversed", "GET", "/api/v1/availability?start=2050-01-03&end=2050-01-01", "", http.StatusBadRequest, "invalid_dates"},
+	{"availability for party", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-03&adults=2&children=2", "", http.StatusOK, ""},
+	{"availability bad adults", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-03&adults=0", "", http.StatusBadRequest, "invalid_adults"},
+	{"availability bad children", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-03&children=some", "", http.StatusBadRequest, "invalid_children"},
+	{"availability db error", "GET", "/api/v1/availability?start=2060-01-01&end=2060-01-03", "", http.StatusInternalServerError, "server_error"},
+	{"availability in the past", "GET", "/api/v1/availability?start=2000-01-01&end=2000-01-03", "", http.StatusUnprocessableEntity, "stay_rules"},
+	{"availability summer weekday", "GET", "/api/v1/availability?start=2050-06-06&end=2050-06-13", "", http.StatusUnprocessableEntity, "stay_rules"},
+	{"availability summer week", "GET", "/api/v1/availability?start=2050-06-04&end=2050-06-11", "", http.StatusOK, ""},
+	{"availability rules db error", "GET", "/api/v1/availability?start=2052-01-01&end=2052-01-03", "", http.StatusInternalServerError, "server_error"},
+	{"room availability summer short", "GET", "/api/v1/rooms/1/availability?start=2050-06-04&end=2050-06-06", "", http.StatusUnprocessableEntity, "stay_rules"},
+	{"room availability", "GET", "/api/v1/rooms/1/availability?start=2050-01-01&end=2050-01-03", "", http.StatusOK, ""},
+	{"room availability bad children", "GET", "/api/v1/rooms/1/availability?start=2050-01-01&end=2050-01-03&children=-1", "", http.StatusBadRequest, "invalid_children"},
+	{"room availability unknown room", "GET", "/api/v1/rooms/99/availability?start=2050-01-01&end=2050-01-03", "", http.StatusNotFound, "not_found"},
+	{"room availability db error", "GET", "/api/v1/rooms/3/availability?start=2050-01-01&end=2050-01-03", "", http.StatusInternalServerError, "server_error"},
+	{"create reservation", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa","phone":"555-555-5555"}`, http.StatusCreated, ""},
+	{"create reservation bad json", "POST", "/api/v1/reservations", `{"room_id":`, http.StatusBadRequest, "invalid_json"},
+	{"create reservation unknown field", "POST", "/api/v1/reservations", `{"room_id":1,"colour":"blue"}`, http.StatusBadRequest, "invalid_json"},
+	{"create reservation invalid", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"J","last_name":"Smith","email":"john"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation past", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2000-01-01","end_date":"2000-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation unknown room", "POST", "/api/v1/reservations", `{"room_id":99,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation too many guests", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","adults":3,"children":2,"first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation no adults", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","adults":0,"first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation summer short", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-06-04","end_date":"2050-06-06","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation db error", "POST", "/api/v1/reservations", `{"room_id":2,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`, http.StatusInternalServerError, "server_error"},
+	{"create reservation no payment token", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation bad amount", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa","amount":"half"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation deposit", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa","amount":"deposit"}`, http.StatusCreated, ""},
+	{"create reservation declined", "POST", "/api/v1/reservations", `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_declined"}`, http.StatusPaymentRequired, "payment_declined"},
+	{"create reservation unavailable", "POST", "/api/v1/reservations", `{"room_id":3,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`, http.StatusConflict, "room_unavailable"},
+	{"get reservation", "GET", "/api/v1/reservations/ABCD2345?email=john@smith.com", "", http.StatusOK, ""},
+	{"get reservation wrong email", "GET", "/api/v1/reservations/ABCD2345?email=jane@smith.com", "", http.StatusNotFound, "not_found"},
+	{"get reservation db error", "GET", "/api/v1/reservations/BROKEN23?email=john@smith.com", "", http.StatusInternalServerError, "server_error"},
+	{"cancel reservation", "POST", "/api/v1/reservations/ABCD2345/cancel", `{"email":"john@smith.com"}`, http.StatusOK, ""},
+	{"get group reservation", "GET", "/api/v1/reservations/GROUP234?email=group@here.com", "", http.StatusOK, ""},
+	{"cancel group reservation", "POST", "/api/v1/reservations/GROUP234/cancel", `{"email":"group@here.com"}`, http.StatusOK, ""},
+	{"cancel reservation wrong email", "POST", "/api/v1/reservations/ABCD2345/cancel", `{"email":"jane@smith.com"}`, http.StatusNotFound, "not_found"},
+	{"admin reservations logged out", "GET", "/api/v1/admin/reservations", "", http.StatusUnauthorized, "unauthorized"},
+}
+
+func TestAPI(t *testing.T) {
+	routes := getRoutes()
+	ts := httptest.NewTLSServer(routes)
+	defer ts.Close()
+
+	for _, e := range apiTests {
+		req, _ := http.NewRequest(e.method, ts.URL+e.url, strings.NewReader(e.body))
+		if e.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != e.expectedStatus {
+			t.Errorf("for %s, expected %d but got %d", e.name, e.expectedStatus, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("for %s, expected content type application/json but got %s", e.name, ct)
+		}
+
+		var envelope apiEnvelope
+		err = json.NewDecoder(resp.Body).Decode(&envelope)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("for %s, could not decode response: %s", e.name, err)
+			continue
+		}
+
+		if e.expectedError == "" && envelope.Error != nil {
+			t.Errorf("for %s, expected no error but got %s", e.name, envelope.Error.Code)
+		}
+		if e.expectedError != "" && (envelope.Error == nil || envelope.Error.Code != e.expectedError) {
+			t.Errorf("for %s, expected error %s but got %+v", e.name, e.expectedError, envelope.Error)
+		}
+	}
+}
+
+func TestRepository_APIAdminReservations(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/v1/admin/reservations?new=true", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.APIAdminReservations)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected code %d but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestRepository_APICreateReservation_Fields(t *testing.T) {
+	body := `{"room_id":1,"start_date":"2050-01-03","end_date":"2050-01-01","first_name":"John","last_name":"","email":"john@smith.com"}`
+	req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.APICreateReservation)
+	handler.ServeHTTP(rr, req)
+
+	var envelope apiEnvelope
+	err := json.Unmarshal(rr.Body.Bytes(), &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Error == nil {
+		t.Fatal("expected an error but got none")
+	}
+	for _, field := range []string{"last_name", "end_date"} {
+		if envelope.Error.Fields[field] == "" {
+			t.Errorf("expected an error for %s but got none", field)
+		}
+	}
+}
+
+func TestRepository_APICreateReservation_Paid(t *testing.T) {
+	resetPayments()
+	defer resetPayments()
+
+	for _, amount := range []string{"full", "deposit"} {
+		body := `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa","amount":"` + amount + `"}`
+		req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.APICreateReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("for %s, expected code %d but got %d", amount, http.StatusCreated, rr.Code)
+		}
+
+		var envelope struct {
+			Data apiReservation `json:"data"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := envelope.Data
+		if res.Paid == 0 {
+			t.Errorf("for %s, expected the reservation to be paid for", amount)
+		}
+		if amount == "full" && res.Paid != res.TotalAmount {
+			t.Errorf("for full, expected %d to be paid but got %d", res.TotalAmount, res.Paid)
+		}
+		if amount == "deposit" && res.Paid >= res.TotalAmount {
+			t.Errorf("for deposit, expected less than %d to be paid but got %d", res.TotalAmount, res.Paid)
+		}
+	}
+}
+
+func TestRepository_RequireAPIPermission(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name           string
+		userID         int
+		permission     access.Permission
+		twoFactor      bool
+		expectedStatus int
+		expectedError  string
+	}{
+		{"owner", 1, access.ViewReservations, false, http.StatusOK, ""},
+		{"read only", 3, access.ViewReservations, false, http.StatusOK, ""},
+		{"read only deletes", 3, access.DeleteReservations, false, http.StatusForbidden, "forbidden"},
+		{"not logged in", 0, access.ViewReservations, false, http.StatusUnauthorized, "unauthorized"},
+		{"unknown user", 99, access.ViewReservations, false, http.StatusUnauthorized, "unauthorized"},
+		{"deactivated user", 4, access.ViewReservations, false, http.StatusUnauthorized, "unauthorized"},
+		{"two-factor not set up", 1, access.ViewReservations, true, http.StatusForbidden, "two_factor_required"},
+		{"two-factor set up", 2, access.ViewReservations, true, http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		if e.twoFactor {
+			_ = Repo.DB.UpdateSetting(models.Actor{}, requireTwoFactorSetting, "1")
+		}
+
+		req, _ := http.NewRequest("GET", "/api/v1/admin/reservations", nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		if e.userID > 0 {
+			session.Put(ctx, "user_id", e.userID)
+		}
+		rr := httptest.NewRecorder()
+
+		handler := Repo.RequireAPIPermission(e.permission)(next)
+		handler.ServeHTTP(rr, req)
+		_ = Repo.DB.UpdateSetting(models.Actor{}, requireTwoFactorSetting, "0")
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedError == "" {
+			continue
+		}
+		var envelope apiEnvelope
+		err := json.Unmarshal(rr.Body.Bytes(), &envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if envelope.Error == nil || envelope.Error.Code != e.expectedError {
+			t.Errorf("failed %s: expected error %s but got %+v", e.name, e.expectedError, envelope.Error)
+		}
+	}
+}
+
+func TestRepository_APICancelReservation_Group(t *testing.T) {
+	for _, url := range []string{"/api/v1/reservations/GROUP234?email=group@here.com", "/api/v1/reservations/GROUP234/cancel"} {
+		method, body := "GET", ""
+		if strings.HasSuffix(url, "/cancel") {
+			method, body = "POST", `{"email":"group@here.com"}`
+		}
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req = req.WithContext(GetCtx(req))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.APIGetReservation)
+		if method == "POST" {
+			handler = Repo.APICancelReservation
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("for %s %s, expected code %d but got %d", method, url, http.StatusOK, rr.Code)
+		}
+
+		var envelope struct {
+			Data apiReservation `json:"data"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rooms := envelope.Data.Rooms
+		if len(rooms) != 2 {
+			t.Fatalf("for %s, expected both rooms of the booking but got %d", method, len(rooms))
+		}
+		if method == "POST" && (rooms[0].Status != status.Cancelled || !rooms[0].Cancelled) {
+			t.Errorf("expected the room still booked to be cancelled but it is %s", rooms[0].Status)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+)
+
+// auditLimit is the most audit events shown at once
+const auditLimit = 200
+
+// actor returns the logged in user making a change, for the audit log
+func (m *Repository) actor(r *http.Request) models.Actor {
+	return models.Actor{
+		UserID:    m.App.Session.GetInt(r.Context(), "user_id"),
+		IPAddress: helpers.ClientIP(r),
+	}
+}
+
+// AdminAuditLog shows the audit log of changes made in the admin area, filtered by reservation,
+// user or a range of dates
+func (m *Repository) AdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	form := forms.New(query)
+
+	filter := models.AuditFilter{Limit: auditLimit}
+	if query.Get("reservation") != "" {
+		form.IsInt("reservation", 1)
+		filter.ReservationID, _ = strconv.Atoi(query.Get("reservation"))
+	}
+	if query.Get("user") != "" {
+		form.IsInt("user", 1)
+		filter.UserID, _ = strconv.Atoi(query.Get("user"))
+	}
+	if from := query.Get("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			form.Errors.Add("from", "Enter a date")
+		}
+		filter.Start = t
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			form.Errors.Add("to", "Enter a date")
+		} else {
+			// the filter includes the whole of the last day
+			filter.End = t.AddDate(0, 0, 1)
+		}
+	}
+
+	data := make(map[string]interface{})
+
+	users, err := m.DB.AllUsers()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data["users"] = users
+
+	var events []models.AuditEvent
+	if form.Valid() {
+		events, err = m.DB.AuditEvents(filter)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+	data["events"] = events
+
+	intMap := make(map[string]int)
+	intMap["user"] = filter.UserID
+	intMap["limit"] = auditLimit
+
+	render.Template(w, r, "admin-audit.page.html", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+		Form:   form,
+	})
+}
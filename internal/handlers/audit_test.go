@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var auditLogTests = []struct {
+	name           string
+	url            string
+	expectedStatus int
+	expectedHTML   string
+}{
+	{"everything", "/admin/audit", http.StatusOK, "Owen Owner"},
+	{"bad date", "/admin/audit?from=yesterday", http.StatusOK, "From: Enter a date"},
+	{"bad reservation", "/admin/audit?reservation=abc", http.StatusOK, "Reservation: This field must be a whole number"},
+	{"database error", "/admin/audit?user=5", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_AdminAuditLog(t *testing.T) {
+	for _, e := range auditLogTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminAuditLog)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected html %q", e.name, e.expectedHTML)
+		}
+	}
+}
+
+func TestRepository_AdminPostReservationsCalender(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"add and remove blocks", "y=2026&m=10&add_block_1_2026-10-20", http.StatusSeeOther},
+		{"database error", "y=2026&m=10&add_block_2_2026-10-20", http.StatusInternalServerError},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader(e.body))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "user_id", 1)
+		for _, id := range []int{1, 2} {
+			blocks := map[string]int{"2026-10-1": 0, "2026-10-2": 0}
+			if id == 1 {
+				blocks["2026-10-2"] = 7
+			}
+			session.Put(ctx, fmt.Sprintf("block_map_%d", id), blocks)
+		}
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostReservationsCalender)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
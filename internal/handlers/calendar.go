@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/ical"
+	"github.com/eador/bookings/internal/models"
+)
+
+// RoomCalendar publishes a room's reservations and blocks for the coming year as an iCalendar feed
+func (m *Repository) RoomCalendar(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	slug := exploded[2]
+
+	room, err := m.DB.GetRoomBySlug(slug)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && room.Retired == 1) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	restrictions, err := m.DB.GetRestrictionsForRoomByDate(room.ID, today, today.AddDate(1, 0, 0))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var events []ical.Event
+	for _, rr := range restrictions {
+		summary := "Blocked"
+		if rr.ReservationID > 0 {
+			summary = "Reserved"
+		}
+		events = append(events, ical.Event{
+			UID:     ical.UID(rr.ID),
+			Summary: summary,
+			Start:   rr.StartDate,
+			End:     rr.EndDate,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", room.Slug+".ics"))
+	err = ical.Write(w, room.RoomName, events)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// AdminImportRoomCalendar syncs a room's blocks with an external calendar feed
+func (m *Repository) AdminImportRoomCalendar(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+	back := fmt.Sprintf("/admin/rooms/%d", id)
+
+	// only feeds on the web can be imported from here; files can be imported with cmd/icalsync
+	source := strings.TrimSpace(r.Form.Get("source"))
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		m.App.Session.Put(r.Context(), "error", "Enter the calendar's http or https address")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	result, err := m.syncRoomCalendar(id, source)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Could not import calendar: %s", err))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Calendar imported: %d nights blocked, %d unblocked, %d unchanged",
+		result.Added, result.Removed, result.Unchanged))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// syncRoomCalendar reads the calendar at source and syncs the room's blocks with it
+func (m *Repository) syncRoomCalendar(roomID int, source string) (ical.SyncResult, error) {
+	rc, err := ical.Open(source)
+	if err != nil {
+		return ical.SyncResult{}, err
+	}
+	defer rc.Close()
+
+	events, err := ical.Parse(rc)
+	if err != nil {
+		return ical.SyncResult{}, err
+	}
+
+	result, err := ical.Sync(m.DB, roomID, source, events, time.Now())
+	if len(result.Released) > 0 {
+		m.App.Waitlist.Released(result.Released...)
+	}
+	return result, err
+}
+
+// calendarFeedURL returns the address of a room's iCalendar feed
+func (m *Repository) calendarFeedURL(room models.Room) string {
+	return m.siteURL("/rooms/" + room.Slug + "/calendar.ics")
+}
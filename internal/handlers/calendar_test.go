@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRepository_RoomCalendar(t *testing.T) {
+	routes := getRoutes()
+	ts := httptest.NewTLSServer(routes)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/rooms/generals-quarters/calendar.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Errorf("expected a text/calendar response but got %s", ct)
+	}
+
+	resp, err = ts.Client().Get(ts.URL + "/rooms/no-such-room/calendar.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown room but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestRepository_AdminImportRoomCalendar(t *testing.T) {
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:abc@channel.example\r\n"+
+			"DTSTART;VALUE=DATE:20500101\r\nDTEND;VALUE=DATE:20500103\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+	}))
+	defer feed.Close()
+
+	tests := []struct {
+		name        string
+		roomID      int
+		source      string
+		expectedKey string
+	}{
+		{"valid", 1, feed.URL, "flash"},
+		{"not a web address", 1, "/etc/passwd", "error"},
+		{"unreachable", 1, "http://127.0.0.1:1/room.ics", "error"},
+		{"block error", 2, feed.URL, "error"},
+		{"database error", 3, feed.URL, "error"},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("source", e.source)
+
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/admin/rooms/%d/calendar-import", e.roomID), strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminImportRoomCalendar)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != fmt.Sprintf("/admin/rooms/%d", e.roomID) {
+			t.Errorf("failed %s: unexpected redirect to %s", e.name, loc)
+		}
+		if session.GetString(ctx, e.expectedKey) == "" {
+			t.Errorf("failed %s: expected a %s message", e.name, e.expectedKey)
+		}
+	}
+}
+
+func TestRepository_AdminShowRoom_FeedURL(t *testing.T) {
+	// the feed address comes from the configured base URL, whatever Host the client sends
+	req, _ := http.NewRequest("GET", "/admin/rooms/1", nil)
+	req.Host = "evil.example"
+	req = req.WithContext(GetCtx(req))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.AdminShowRoom)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("AdminShowRoom returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	if strings.Contains(rr.Body.String(), "evil.example") {
+		t.Error("expected the feed address not to use the request's Host")
+	}
+	if !strings.Contains(rr.Body.String(), app.BaseURL+"/rooms/") {
+		t.Errorf("expected the feed address to start with %s", app.BaseURL)
+	}
+}
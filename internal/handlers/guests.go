@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/repository"
+)
+
+// AdminGuests lists the guests with their stays, nights and spend, optionally searching by name,
+// email or phone number
+func (m *Repository) AdminGuests(w http.ResponseWriter, r *http.Request) {
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	guests, err := m.DB.AllGuests(search)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["q"] = search
+
+	data := make(map[string]interface{})
+	data["guests"] = guests
+	render.Template(w, r, "admin-guests.page.html", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminShowGuest shows a guest's stay history, notes and flags, and the guests who might be
+// duplicates of them
+func (m *Repository) AdminShowGuest(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+
+	g, err := m.DB.GetGuestByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "Guest not found")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderGuest(w, r, g, forms.New(nil))
+}
+
+// AdminPostShowGuest saves changes to a guest's details, notes and flags
+func (m *Repository) AdminPostShowGuest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+
+	g, err := m.DB.GetGuestByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name")
+
+	g.FirstName = strings.TrimSpace(r.Form.Get("first_name"))
+	g.LastName = strings.TrimSpace(r.Form.Get("last_name"))
+	g.Phone = strings.TrimSpace(r.Form.Get("phone"))
+	g.Notes = strings.TrimSpace(r.Form.Get("notes"))
+	g.VIP = 0
+	if r.Form.Get("vip") != "" {
+		g.VIP = 1
+	}
+	g.DoNotRent = 0
+	if r.Form.Get("do_not_rent") != "" {
+		g.DoNotRent = 1
+	}
+
+	if !form.Valid() {
+		m.renderGuest(w, r, g, form)
+		return
+	}
+
+	err = m.DB.UpdateGuest(m.actor(r), g)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/guests/%d", id), http.StatusSeeOther)
+}
+
+// AdminMergeGuest merges a duplicate guest record, posted as merge_id, into this guest
+func (m *Repository) AdminMergeGuest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+	back := fmt.Sprintf("/admin/guests/%d", id)
+
+	mergeID, err := strconv.Atoi(strings.TrimSpace(r.Form.Get("merge_id")))
+	if err != nil || mergeID < 1 {
+		m.App.Session.Put(r.Context(), "error", "Choose the guest to merge into this one")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.MergeGuests(m.actor(r), id, mergeID)
+	switch {
+	case errors.Is(err, repository.ErrSameGuest):
+		m.App.Session.Put(r.Context(), "error", "A guest can't be merged into themselves")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		m.App.Session.Put(r.Context(), "error", "Guest not found")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	case err != nil:
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Guest %d merged into this guest", mergeID))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// renderGuest displays a guest's page with form holding their details
+func (m *Repository) renderGuest(w http.ResponseWriter, r *http.Request, g models.Guest, form *forms.Form) {
+	similar, err := m.DB.SimilarGuests(g)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["guest"] = g
+	data["similar"] = similar
+	render.Template(w, r, "admin-guest.page.html", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
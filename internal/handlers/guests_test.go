@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRepository_AdminGuests(t *testing.T) {
+	tests := []struct {
+		query          string
+		expectedStatus int
+		expected       []string
+		unexpected     []string
+	}{
+		{"", http.StatusOK, []string{"John Smith", "Jon Smith", "VIP", "Do not rent"}, nil},
+		{"?q=john", http.StatusOK, []string{"John Smith"}, []string{"Jon Smith"}},
+		{"?q=nobody", http.StatusOK, []string{"No guests found"}, nil},
+		{"?q=error", http.StatusInternalServerError, nil, nil},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/guests"+e.query, nil)
+		req = req.WithContext(GetCtx(req))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminGuests)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%q: expected code %d but got %d", e.query, e.expectedStatus, rr.Code)
+			continue
+		}
+		for _, want := range e.expected {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Errorf("%q: expected %q on the page", e.query, want)
+			}
+		}
+		for _, unwanted := range e.unexpected {
+			if strings.Contains(rr.Body.String(), unwanted) {
+				t.Errorf("%q: did not expect %q on the page", e.query, unwanted)
+			}
+		}
+	}
+}
+
+func TestRepository_AdminShowGuest(t *testing.T) {
+	tests := []struct {
+		url              string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"/admin/guests/1", http.StatusOK, ""},
+		{"/admin/guests/3", http.StatusInternalServerError, ""},
+		{"/admin/guests/99", http.StatusSeeOther, "/admin/guests"},
+		{"/admin/guests/x", http.StatusSeeOther, "/admin/guests"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req = req.WithContext(GetCtx(req))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminShowGuest)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected code %d but got %d", e.url, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %q but got %q", e.url, e.expectedLocation, loc)
+		}
+	}
+
+	// the stay history counts the stay that was kept, and the duplicate is offered for merging
+	req, _ := http.NewRequest("GET", "/admin/guests/1", nil)
+	req = req.WithContext(GetCtx(req))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminShowGuest).ServeHTTP(rr, req)
+	for _, want := range []string{"Stays: 1, 3 nights, $300.00 spent", "Major&#39;s Suite", "Likes a quiet room", "jon@smith.com"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q on the guest page", want)
+		}
+	}
+}
+
+var postGuestTests = []struct {
+	name           string
+	url            string
+	field          string
+	value          string
+	expectedStatus int
+}{
+	{"valid", "/admin/guests/1", "", "", http.StatusSeeOther},
+	{"missing name", "/admin/guests/1", "first_name", "", http.StatusOK},
+	{"unknown guest", "/admin/guests/99", "", "", http.StatusInternalServerError},
+	{"database error", "/admin/guests/2", "", "", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminPostShowGuest(t *testing.T) {
+	for _, e := range postGuestTests {
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("phone", "555-0100")
+		postedData.Add("notes", "Allergic to feathers")
+		postedData.Add("vip", "1")
+		if e.field != "" {
+			postedData.Set(e.field, e.value)
+		}
+
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(postedData.Encode()))
+		req = req.WithContext(GetCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowGuest)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminMergeGuest(t *testing.T) {
+	tests := []struct {
+		name           string
+		mergeID        string
+		expectedStatus int
+		expectedFlash  string
+		expectedError  string
+	}{
+		{"merged", "2", http.StatusSeeOther, "Guest 2 merged into this guest", ""},
+		{"missing guest", "", http.StatusSeeOther, "", "Choose the guest to merge into this one"},
+		{"itself", "1", http.StatusSeeOther, "", "A guest can't be merged into themselves"},
+		{"unknown guest", "99", http.StatusSeeOther, "", "Guest not found"},
+		{"database error", "3", http.StatusInternalServerError, "", ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("merge_id", e.mergeID)
+
+		req, _ := http.NewRequest("POST", "/admin/guests/1/merge", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminMergeGuest)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if rr.Code != http.StatusSeeOther {
+			continue
+		}
+		if loc := rr.Header().Get("Location"); loc != "/admin/guests/1" {
+			t.Errorf("failed %s: expected redirect to the guest but got %q", e.name, loc)
+		}
+		if flash := session.GetString(ctx, "flash"); flash != e.expectedFlash {
+			t.Errorf("failed %s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := session.GetString(ctx, "error"); msg != e.expectedError {
+			t.Errorf("failed %s: expected error %q but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
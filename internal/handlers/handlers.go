@@ -1,22 +1,32 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/eador/bookings/internal/cancellation"
 	"github.com/eador/bookings/internal/config"
 	"github.com/eador/bookings/internal/driver"
+	"github.com/eador/bookings/internal/emails"
 	"github.com/eador/bookings/internal/forms"
 	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/lockout"
 	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/pricing"
+	"github.com/eador/bookings/internal/promo"
 	"github.com/eador/bookings/internal/render"
 	"github.com/eador/bookings/internal/repository"
 	"github.com/eador/bookings/internal/repository/dbrepo"
+	"github.com/eador/bookings/internal/status"
+	"github.com/eador/bookings/internal/stayrules"
+	"github.com/eador/bookings/internal/taxes"
 )
 
 // Repo the repositry used by the handlers
@@ -58,16 +68,6 @@ func (m *Repository) About(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "about.page.html", &models.TemplateData{})
 }
 
-// General is the general quarters page  handler
-func (m *Repository) Generals(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "generals.page.html", &models.TemplateData{})
-}
-
-// Major is the majors suite page handler
-func (m *Repository) Majors(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "majors.page.html", &models.TemplateData{})
-}
-
 // Reservation is the reservation page handler
 func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
@@ -85,6 +85,56 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	res.Room.RoomName = room.RoomName
+
+	err = m.priceReservation(&res, room)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't work out the price of this stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = m.priceGroup(&res)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't work out the price of this stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	fits := room.Fits(res.Adults, res.Children)
+	if len(res.Group) > 0 {
+		fits = assignGuests(&res)
+	}
+	if !fits {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, the rooms you chose can't sleep %s", res.Guests()))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	err = m.addCharges(&res)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't work out the price of this stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = m.setCancellationPolicy(&res, room)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't access database")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	violations, err := m.checkGroupStay(res)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't access database")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if len(violations) > 0 {
+		m.App.Session.Put(r.Context(), "error", violations[0].Message)
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	sd := res.StartDate.Format("2006-01-02")
@@ -132,74 +182,378 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	reservation.RoomID = room.ID
 	reservation.Room = room
 
+	err = m.priceReservation(&reservation, room)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't work out the price of this stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = m.priceGroup(&reservation)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't work out the price of this stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	assignGuests(&reservation)
+
 	form := forms.New(r.PostForm)
 
 	form.Required("first_name", "last_name", "email")
 	form.MinLength("first_name", 3)
 	form.IsEmail("email")
 
+	// the rules may have changed since the guest searched
+	violations, err := m.checkGroupStay(reservation)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't access database")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	addStayErrors(form, violations, "start_date", "end_date")
+
+	err = m.applyPromoCode(form, &reservation)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't access database")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = m.addCharges(&reservation)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't work out the price of this stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = m.setCancellationPolicy(&reservation, room)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't access database")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
 	if !form.Valid() {
 		data := make(map[string]interface{})
 		data["reservation"] = reservation
+		stringMap := make(map[string]string)
+		stringMap["start_date"] = reservation.StartDate.Format("2006-01-02")
+		stringMap["end_date"] = reservation.EndDate.Format("2006-01-02")
 		render.Template(w, r, "make-reservation.page.html", &models.TemplateData{
-			Form: form,
-			Data: data,
+			Form:      form,
+			Data:      data,
+			StringMap: stringMap,
 		})
 		return
 	}
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	reservation.ConfirmationCode, err = helpers.NewConfirmationCode()
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		helpers.ServerError(w, err)
 		return
 	}
 
-	rr := models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        reservation.RoomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1,
+	// the rooms are only held while the guest pays; if they don't, they are released
+	due := time.Now().Add(m.App.CheckoutHold)
+	reservation.PaymentDueAt = &due
+
+	// every room in a group is booked for the same guest under the same confirmation code
+	for i := range reservation.Group {
+		reservation.Group[i].FirstName = reservation.FirstName
+		reservation.Group[i].LastName = reservation.LastName
+		reservation.Group[i].Phone = reservation.Phone
+		reservation.Group[i].Email = reservation.Email
+		reservation.Group[i].ConfirmationCode = reservation.ConfirmationCode
+		reservation.Group[i].PaymentDueAt = &due
+	}
+
+	var ids []int
+	if entryID := m.App.Session.GetInt(r.Context(), "waitlist_entry_id"); entryID > 0 {
+		// the room held for a guest from the waitlist is theirs to book
+		ids, err = m.DB.BookWaitlistOffer(entryID, reservation.Reservations())
+	} else {
+		ids, err = m.DB.CreateReservations(reservation.Reservations())
+	}
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, this room was just booked by someone else for those dates. Please search again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, promo.ErrUsedUp) || errors.Is(err, promo.ErrGuestLimit) {
+		// others booked with the code while the guest filled in the form
+		m.App.Session.Put(r.Context(), "error", promo.Message(err))
+		http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+		return
 	}
-	err = m.DB.InsertRoomRestricition(rr)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert room restriction into database")
+		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	reservation.ID = ids[0]
+	for i := range reservation.Group {
+		reservation.Group[i].ID = ids[i]
+	}
+	m.App.Session.Remove(r.Context(), "waitlist_entry_id")
+
+	// the confirmation is sent once the guest has paid
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+	http.Redirect(w, r, "/checkout", http.StatusSeeOther)
+}
 
-	htmlMessage := fmt.Sprintf(`
-		<strong>Reservation Confirmation</strong><br>
-		Dear %s, <br>
-		This is to confirm your reservation from %s to %s.
-	`, reservation.FirstName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
-	msg := models.MailData{
-		To:       reservation.Email,
-		From:     "me@here.com",
-		Subject:  "Reservation Confirmation",
-		Content:  htmlMessage,
-		Template: "basic.html",
+// priceReservation works out the price of a stay and records the total and nightly breakdown on the reservation
+func (m *Repository) priceReservation(res *models.Reservation, room models.Room) error {
+	overrides, err := m.DB.GetRateOverridesForRoom(room.ID, res.StartDate, res.EndDate)
+	if err != nil {
+		return err
 	}
-	m.App.MailChan <- msg
 
-	htmlMessage = fmt.Sprintf(`
-		<strong>Reservation Notification</strong><br>
-		A reservation has been made for%s from %s to %s.
-	`, reservation.Room.RoomName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
-	msg = models.MailData{
-		To:      "me@here.com",
-		From:    "me@here.com",
-		Subject: "Reservation Notification",
-		Content: htmlMessage,
+	quote, err := pricing.Calculate(room, overrides, res.StartDate, res.EndDate)
+	if err != nil {
+		return err
 	}
-	m.App.MailChan <- msg
-	m.App.Session.Put(r.Context(), "reservation", reservation)
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+
+	res.TotalAmount = quote.Total
+	res.Currency = quote.Currency
+	res.Nights = quote.Nights
+	return nil
+}
+
+// priceGroup looks up the room for each reservation in a group booking and prices its stay
+func (m *Repository) priceGroup(res *models.Reservation) error {
+	for i := range res.Group {
+		room, err := m.DB.GetRoomById(res.Group[i].RoomID)
+		if err != nil {
+			return err
+		}
+		res.Group[i].Room = room
+
+		err = m.priceReservation(&res.Group[i], room)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCharges adds the taxes and fees on a priced stay to the price of each room booked. It comes
+// after any discount, since taxes are charged on what the guest pays for the room.
+func (m *Repository) addCharges(res *models.Reservation) error {
+	charges, err := m.DB.GetChargesForStay(res.StartDate, res.EndDate)
+	if err != nil {
+		return err
+	}
+
+	if len(res.Group) > 0 {
+		for i := range res.Group {
+			taxes.Apply(charges, &res.Group[i])
+		}
+		return nil
+	}
+	taxes.Apply(charges, res)
+	return nil
+}
+
+// setCancellationPolicy records on each room booked the cancellation policy it is sold under, so
+// later changes to the policy don't alter it: the policy of the rate charged on the arrival night,
+// else the room's own, else the default policy. room is the room of res when it is not a group
+// booking; the rooms of a group come from priceGroup.
+func (m *Repository) setCancellationPolicy(res *models.Reservation, room models.Room) error {
+	if len(res.Group) > 0 {
+		for i := range res.Group {
+			err := m.setCancellationPolicy(&res.Group[i], res.Group[i].Room)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	overrides, err := m.DB.GetRateOverridesForRoom(room.ID, res.StartDate, res.StartDate.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+
+	policy := m.App.CancellationPolicy
+	id := room.CancellationPolicyID
+	if o := pricing.RateFor(overrides, res.StartDate); o != nil && o.CancellationPolicyID > 0 {
+		id = o.CancellationPolicyID
+	}
+	if id > 0 {
+		policy, err = m.DB.GetCancellationPolicyByID(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	res.CancellationPolicyID = policy.ID
+	res.CancellationPolicy = policy.Name
+	res.CancellationTiers = policy.Tiers
+	return nil
+}
+
+// applyPromoCode takes the discount for the promo code entered on form off the price of every room
+// in res it covers, or adds why the code can't be used to the form. Nothing changes if no code was
+// entered.
+func (m *Repository) applyPromoCode(form *forms.Form, res *models.Reservation) error {
+	code := promo.Normalize(form.Get("promo_code"))
+	if code == "" {
+		return nil
+	}
+
+	p, err := m.DB.GetPromoCodeByCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		form.Errors.Add("promo_code", promo.Message(promo.ErrInvalid))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	uses, guestUses, err := m.DB.PromoCodeUses(p.ID, res.Email)
+	if err != nil {
+		return err
+	}
+
+	var roomIDs []int
+	for _, g := range res.Reservations() {
+		roomIDs = append(roomIDs, g.RoomID)
+	}
+	err = promo.Check(p, roomIDs, res.StartDate, res.EndDate, time.Now(), uses, guestUses)
+	if err != nil {
+		form.Errors.Add("promo_code", promo.Message(err))
+		return nil
+	}
+
+	if len(res.Group) > 0 {
+		promo.Apply(p, res.Group)
+		res.PromoCodeID = p.ID
+		res.PromoCode = p.Code
+		return nil
+	}
+	group := []models.Reservation{*res}
+	promo.Apply(p, group)
+	*res = group[0]
+	return nil
+}
+
+// reapplyPromoCode takes the discount for the promo code a reservation was booked with off its new
+// price after its dates have changed, as long as the code covers the new dates. The code's limits
+// aren't checked again, since the booking has already used it.
+func (m *Repository) reapplyPromoCode(res *models.Reservation) error {
+	if res.PromoCodeID == 0 {
+		return nil
+	}
+
+	p, err := m.DB.GetPromoCodeByID(res.PromoCodeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		res.PromoCodeID, res.PromoCode, res.DiscountAmount = 0, "", 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !promo.CoversStay(p, res.StartDate, res.EndDate) {
+		res.PromoCodeID, res.PromoCode, res.DiscountAmount = 0, "", 0
+		return nil
+	}
+
+	group := []models.Reservation{*res}
+	promo.Apply(p, group)
+	*res = group[0]
+	return nil
+}
+
+// checkStay returns the stay rules a stay in room roomID from start up to end breaks. A roomID
+// of 0 checks only the rules that cover every room.
+func (m *Repository) checkStay(roomID int, start, end time.Time) ([]stayrules.Violation, error) {
+	rules, err := m.DB.GetStayRulesForArrival(start)
+	if err != nil {
+		return nil, err
+	}
+	return stayrules.Check(rules, roomID, start, end, time.Now()), nil
+}
+
+// checkGroupStay returns the stay rules broken by a stay in any of a reservation's rooms
+func (m *Repository) checkGroupStay(res models.Reservation) ([]stayrules.Violation, error) {
+	rules, err := m.DB.GetStayRulesForArrival(res.StartDate)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []stayrules.Violation
+	for _, g := range res.Reservations() {
+		violations = append(violations, stayrules.Check(rules, g.RoomID, res.StartDate, res.EndDate, time.Now())...)
+	}
+	return violations, nil
+}
+
+// addStayErrors adds broken stay rules to a form under the names of its arrival and departure fields
+func addStayErrors(form *forms.Form, violations []stayrules.Violation, startField, endField string) {
+	for _, v := range violations {
+		field := startField
+		if v.Field == stayrules.Departure {
+			field = endField
+		}
+		if !hasString(form.Errors[field], v.Message) {
+			form.Errors.Add(field, v.Message)
+		}
+	}
+}
+
+// keepStayRules returns the rooms whose own stay rules a stay from start up to end keeps, and the
+// rules broken by the others
+func keepStayRules(rules []models.StayRule, rooms []models.Room, start, end time.Time) ([]models.Room, []stayrules.Violation) {
+	var kept []models.Room
+	var broken []stayrules.Violation
+	for _, room := range rooms {
+		violations := stayrules.Check(rules, room.ID, start, end, time.Now())
+		if len(violations) > 0 {
+			broken = append(broken, violations...)
+			continue
+		}
+		kept = append(kept, room)
+	}
+	return kept, broken
+}
+
+func hasString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// assignGuests shares a group booking's party out among its rooms, filling each room in the
+// order chosen, and reports whether the rooms can sleep everyone
+func assignGuests(res *models.Reservation) bool {
+	adults, children := res.Adults, res.Children
+	for i := range res.Group {
+		room := res.Group[i].Room
+		a := minInt(adults, minInt(room.MaxAdults, room.Capacity))
+		c := minInt(children, minInt(room.MaxChildren, room.Capacity-a))
+		res.Group[i].Adults = a
+		res.Group[i].Children = c
+		adults -= a
+		children -= c
+	}
+	return adults == 0 && children == 0
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 // Availability is the search availability page handler
 func (m *Repository) Availability(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "search-availability.page.html", &models.TemplateData{})
+	render.Template(w, r, "search-availability.page.html", &models.TemplateData{
+		Form: forms.New(nil),
+	})
 }
 
 // PostAvailability is the search availability page handler
@@ -227,26 +581,72 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailablitiyForAllRooms(startDate, endDate)
+	rules, err := m.DB.GetStayRulesForArrival(startDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't access database")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("adults")
+	form.IsInt("adults", 1)
+	form.IsInt("children", 0)
+	addStayErrors(form, stayrules.Check(rules, 0, startDate, endDate, time.Now()), "start", "end")
+	if !form.Valid() {
+		render.Template(w, r, "search-availability.page.html", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+	adults, _ := strconv.Atoi(strings.TrimSpace(r.Form.Get("adults")))
+	children, _ := strconv.Atoi(strings.TrimSpace(r.Form.Get("children")))
+
+	rooms, err := m.DB.SearchAvailablitiyForAllRooms(startDate, endDate, adults, children)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't access database")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	rooms, broken := keepStayRules(rules, rooms, startDate, endDate)
 
+	// when no one room sleeps the whole party, offer the free rooms to book together
+	split := false
 	if len(rooms) == 0 {
-		m.App.Session.Put(r.Context(), "error", "No Availability")
+		rooms, err = m.DB.SearchAvailablitiyForAllRooms(startDate, endDate, 1, 0)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't access database")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		rooms, broken = keepStayRules(rules, rooms, startDate, endDate)
+		split = true
+	}
+
+	if len(rooms) == 0 && len(broken) > 0 {
+		// say why when the only free rooms have rules of their own the stay breaks
+		m.App.Session.Put(r.Context(), "error", broken[0].Message)
 		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
-	data := make(map[string]interface{})
-	data["rooms"] = rooms
-
+	if len(rooms) == 0 {
+		m.App.Session.Put(r.Context(), "error", "No Availability")
+		q := url.Values{"start": {start}, "end": {end}, "a": {strconv.Itoa(adults)}, "c": {strconv.Itoa(children)}}
+		http.Redirect(w, r, "/waitlist?"+q.Encode(), http.StatusSeeOther)
+		return
+	}
 	res := models.Reservation{
 		StartDate: startDate,
 		EndDate:   endDate,
+		Adults:    adults,
+		Children:  children,
 	}
 
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	data["split"] = split
+	data["reservation"] = res
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	render.Template(w, r, "choose-room.page.html", &models.TemplateData{
@@ -260,6 +660,8 @@ type jsonResponse struct {
 	RoomID    string `json:"room_id"`
 	StartDate string `json:"start_date"`
 	EndDate   string `json:"end_date"`
+	Adults    string `json:"adults"`
+	Children  string `json:"children"`
 }
 
 // AvailabilityJSON handles request for availability and returns JSON response
@@ -271,7 +673,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 			Message: "Internal Server Error",
 		}
 		out, _ := json.MarshalIndent(resp, "", "    ")
-		w.Header().Set("Content_Type", "application/json")
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(out)
 		return
 	}
@@ -286,7 +688,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 			Message: "Can not parse start date",
 		}
 		out, _ := json.MarshalIndent(resp, "", "    ")
-		w.Header().Set("Content_Type", "application/json")
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(out)
 		return
 	}
@@ -297,12 +699,73 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 			Message: "Can not parse end date",
 		}
 		out, _ := json.MarshalIndent(resp, "", "    ")
-		w.Header().Set("Content_Type", "application/json")
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(out)
 		return
 	}
 	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
 
+	form := forms.New(r.PostForm)
+	form.Required("adults")
+	form.IsInt("adults", 1)
+	form.IsInt("children", 0)
+	if !form.Valid() {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "Please give the number of adults and children staying",
+		}
+		out, _ := json.MarshalIndent(resp, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+	adults, _ := strconv.Atoi(strings.TrimSpace(r.Form.Get("adults")))
+	children, _ := strconv.Atoi(strings.TrimSpace(r.Form.Get("children")))
+
+	room, err := m.DB.GetRoomById(roomID)
+	if err != nil {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "Error connecting to database",
+		}
+		out, _ := json.MarshalIndent(resp, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+	if !room.Fits(adults, children) {
+		resp := jsonResponse{
+			OK:      false,
+			Message: fmt.Sprintf("This room sleeps at most %d guests: up to %d adults and %d children", room.Capacity, room.MaxAdults, room.MaxChildren),
+		}
+		out, _ := json.MarshalIndent(resp, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+
+	violations, err := m.checkStay(roomID, startDate, endDate)
+	if err != nil {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "Error connecting to database",
+		}
+		out, _ := json.MarshalIndent(resp, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+	if len(violations) > 0 {
+		resp := jsonResponse{
+			OK:      false,
+			Message: violations[0].Message,
+		}
+		out, _ := json.MarshalIndent(resp, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+
 	available, err := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomID)
 	if err != nil {
 		resp := jsonResponse{
@@ -310,7 +773,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 			Message: "Error connecting to database",
 		}
 		out, _ := json.MarshalIndent(resp, "", "    ")
-		w.Header().Set("Content_Type", "application/json")
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(out)
 		return
 	}
@@ -320,6 +783,8 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		StartDate: sd,
 		EndDate:   ed,
 		RoomID:    strconv.Itoa(roomID),
+		Adults:    strconv.Itoa(adults),
+		Children:  strconv.Itoa(children),
 	}
 
 	out, _ := json.MarshalIndent(resp, "", "  ")
@@ -333,83 +798,514 @@ func (m *Repository) Contact(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "contact.page.html", &models.TemplateData{})
 }
 
-// ReservationSummary is the reservation summary page handler
-func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request) {
-	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
-	if !ok {
-		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// ReservationSummary is the reservation summary page handler
+func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request) {
+	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Remove(r.Context(), "reservation")
+	data := make(map[string]interface{})
+	data["reservation"] = reservation
+
+	sd := reservation.StartDate.Format("2006-01-02")
+	ed := reservation.EndDate.Format("2006-01-02")
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = sd
+	stringMap["end_date"] = ed
+
+	render.Template(w, r, "reservation-summary.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// ChooseRoom displays list of available rooms
+func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	roomID, err := strconv.Atoi(exploded[2])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "can not get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res.RoomID = roomID
+	res.Group = nil
+	m.App.Session.Put(r.Context(), "reservation", res)
+
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// PostChooseRooms takes the rooms picked from the list of available rooms, so a group can book
+// several together
+func (m *Repository) PostChooseRooms(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "can not get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	var roomIDs []int
+	seen := make(map[int]bool)
+	for _, v := range r.Form["room_id"] {
+		roomID, err := strconv.Atoi(v)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "invalid room")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+		if !seen[roomID] {
+			seen[roomID] = true
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	if len(roomIDs) == 0 {
+		m.App.Session.Put(r.Context(), "error", "Please choose at least one room")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	res.RoomID = roomIDs[0]
+	res.Group = nil
+	if len(roomIDs) > 1 {
+		for _, roomID := range roomIDs {
+			res.Group = append(res.Group, models.Reservation{
+				RoomID:    roomID,
+				StartDate: res.StartDate,
+				EndDate:   res.EndDate,
+			})
+		}
+	}
+	m.App.Session.Put(r.Context(), "reservation", res)
+
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// BookRoom takes URL parameters, builds a sessional variable, and takes user to make reservation screen
+func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	sd := r.URL.Query().Get("s")
+	ed := r.URL.Query().Get("e")
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, sd)
+	if err != nil {
+		helpers.ServerError(w, err)
+	}
+	endDate, err := time.Parse(layout, ed)
+	if err != nil {
+		helpers.ServerError(w, err)
+	}
+	room, err := m.DB.GetRoomById(roomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the party was checked against the room when availability was looked up
+	adults, err := strconv.Atoi(r.URL.Query().Get("a"))
+	if err != nil || adults < 1 {
+		adults = 1
+	}
+	children, err := strconv.Atoi(r.URL.Query().Get("c"))
+	if err != nil || children < 0 {
+		children = 0
+	}
+
+	var res models.Reservation
+	res.RoomID = roomID
+	res.StartDate = startDate
+	res.EndDate = endDate
+	res.Adults = adults
+	res.Children = children
+	res.Room.RoomName = room.RoomName
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// FindReservation displays the form guests use to look up their reservation
+func (m *Repository) FindReservation(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "find-reservation.page.html", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostFindReservation looks up a reservation by confirmation code and email
+func (m *Repository) PostFindReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("confirmation_code", "email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "find-reservation.page.html", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(r.Form.Get("confirmation_code")))
+	email := strings.TrimSpace(r.Form.Get("email"))
+
+	res, err := m.DB.GetReservationByConfirmationCode(code, email)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "We could not find a reservation with that confirmation code and email")
+		http.Redirect(w, r, "/find-reservation", http.StatusSeeOther)
+		return
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "manage_reservation_id", res.ID)
+	http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+}
+
+// ManageReservation shows a guest their reservation with options to change dates or cancel
+func (m *Repository) ManageReservation(w http.ResponseWriter, r *http.Request) {
+	id, ok := m.App.Session.Get(r.Context(), "manage_reservation_id").(int)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Please look up your reservation first")
+		http.Redirect(w, r, "/find-reservation", http.StatusSeeOther)
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderManageReservation(w, r, res, forms.New(nil))
+}
+
+// renderManageReservation shows the manage reservation page for res, with any errors from a
+// change of dates on form
+func (m *Repository) renderManageReservation(w http.ResponseWriter, r *http.Request, res models.Reservation, form *forms.Form) {
+	// a group booking is upcoming while any of its rooms is
+	upcoming := false
+	for _, g := range res.Reservations() {
+		if status.Upcoming(g.Status) {
+			upcoming = true
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["upcoming"] = upcoming
+	data["cancellation_policy"] = cancellation.PolicyOf(res, m.App.CancellationPolicy)
+	data["cancellation_quote"] = m.quoteCancellation(res, cancellableIDs(res)...)
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-02")
+
+	render.Template(w, r, "manage-reservation.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// PostChangeReservationDates moves a guest's reservation to new dates if the room is free
+func (m *Repository) PostChangeReservationDates(w http.ResponseWriter, r *http.Request) {
+	id, ok := m.App.Session.Get(r.Context(), "manage_reservation_id").(int)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Please look up your reservation first")
+		http.Redirect(w, r, "/find-reservation", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if res.Status == status.Cancelled {
+		m.App.Session.Put(r.Context(), "error", "This reservation has been cancelled")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+	if !status.Upcoming(res.Status) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be changed")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+	if len(res.Group) > 0 {
+		m.App.Session.Put(r.Context(), "error", "The dates of a booking with several rooms can't be changed online. Please contact us.")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse start date")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+	endDate, err := time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse end date")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+
+	violations, err := m.checkStay(res.RoomID, startDate, endDate)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if len(violations) > 0 {
+		form := forms.New(r.PostForm)
+		addStayErrors(form, violations, "start_date", "end_date")
+		m.renderManageReservation(w, r, res, form)
+		return
+	}
+
+	before := res
+	res.StartDate = startDate
+	res.EndDate = endDate
+
+	room, err := m.DB.GetRoomById(res.RoomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.priceReservation(&res, room)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.reapplyPromoCode(&res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.addCharges(&res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.UpdateReservationDates(m.actor(r), res)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, the room is not available for those dates")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be changed")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	// any nights of the old stay the new one doesn't cover have come free
+	m.offerReleased(before)
+
+	m.queueTemplatedMail(res.Email, emails.ReservationChangedName, emails.ReservationChanged{
+		Reservation: res,
+	})
+
+	m.App.Session.Put(r.Context(), "flash", "Your reservation dates have been changed")
+	http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+}
+
+// PostCancelReservation cancels a guest's reservation
+func (m *Repository) PostCancelReservation(w http.ResponseWriter, r *http.Request) {
+	id, ok := m.App.Session.Get(r.Context(), "manage_reservation_id").(int)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Please look up your reservation first")
+		http.Redirect(w, r, "/find-reservation", http.StatusSeeOther)
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if len(res.Group) > 0 {
+		m.cancelReservationGroup(w, r, res)
 		return
 	}
 
-	m.App.Session.Remove(r.Context(), "reservation")
-	data := make(map[string]interface{})
-	data["reservation"] = reservation
+	if res.Status == status.Cancelled {
+		m.App.Session.Put(r.Context(), "warning", "This reservation was already cancelled")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
 
-	sd := reservation.StartDate.Format("2006-01-02")
-	ed := reservation.EndDate.Format("2006-01-02")
-	stringMap := make(map[string]string)
-	stringMap["start_date"] = sd
-	stringMap["end_date"] = ed
+	q := m.quoteCancellation(res, res.ID)
+	err = m.DB.CancelReservation(m.actor(r), id, models.Cancellation{
+		Reason:    r.FormValue("reason"),
+		Penalties: q.Penalties,
+	})
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be cancelled")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-	render.Template(w, r, "reservation-summary.page.html", &models.TemplateData{
-		Data:      data,
-		StringMap: stringMap,
+	refunded, err := m.refundCancellation(res, q)
+	m.offerReleased(res)
+
+	m.queueTemplatedMail(res.Email, emails.ReservationCancelledName, emails.ReservationCancelled{
+		Reservation: res,
+		Penalty:     q.Penalty,
+		Refunded:    refunded,
 	})
+	m.queueTemplatedMail(m.App.AdminEmail, emails.AdminNotificationName, emails.AdminNotification{
+		Reservation: res,
+		Event:       "cancelled by the guest",
+	})
+
+	m.App.Session.Put(r.Context(), "flash", "Your reservation has been cancelled"+m.refundMessage(q.Penalty, refunded, res.Currency, err))
+	http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
 }
 
-// ChooseRoom displays list of available rooms
-func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
-	exploded := strings.Split(r.RequestURI, "/")
-	roomID, err := strconv.Atoi(exploded[2])
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "missing url param")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// cancelReservationGroup cancels every room of a guest's group booking that can still be cancelled
+func (m *Repository) cancelReservationGroup(w http.ResponseWriter, r *http.Request, res models.Reservation) {
+	q := m.quoteCancellation(res, cancellableIDs(res)...)
+	_, err := m.DB.CancelReservationGroup(m.actor(r), res.ConfirmationCode, models.Cancellation{
+		Reason:    r.FormValue("reason"),
+		Penalties: q.Penalties,
+	})
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be cancelled")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
 		return
 	}
-
-	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
-	if !ok {
-		m.App.Session.Put(r.Context(), "error", "can not get reservation from session")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+	if err != nil {
+		helpers.ServerError(w, err)
 		return
 	}
 
-	res.RoomID = roomID
-	m.App.Session.Put(r.Context(), "reservation", res)
+	refunded, err := m.refundCancellation(res, q)
+	m.offerReleased(cancellable(res)...)
 
-	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+	m.queueTemplatedMail(res.Email, emails.ReservationCancelledName, emails.ReservationCancelled{
+		Reservation: res,
+		Penalty:     q.Penalty,
+		Refunded:    refunded,
+	})
+	m.queueTemplatedMail(m.App.AdminEmail, emails.AdminNotificationName, emails.AdminNotification{
+		Reservation: res,
+		Event:       "cancelled by the guest",
+	})
+
+	m.App.Session.Put(r.Context(), "flash", "Your reservation has been cancelled"+m.refundMessage(q.Penalty, refunded, res.Currency, err))
+	http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
 }
 
-// BookRoom takes URL parameters, builds a sessional variable, and takes user to make reservation screen
-func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
-	roomID, _ := strconv.Atoi(r.URL.Query().Get("id"))
-	sd := r.URL.Query().Get("s")
-	ed := r.URL.Query().Get("e")
+// PostCancelReservationRoom cancels one room of a guest's group booking
+func (m *Repository) PostCancelReservationRoom(w http.ResponseWriter, r *http.Request) {
+	id, ok := m.App.Session.Get(r.Context(), "manage_reservation_id").(int)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Please look up your reservation first")
+		http.Redirect(w, r, "/find-reservation", http.StatusSeeOther)
+		return
+	}
 
-	layout := "2006-01-02"
-	startDate, err := time.Parse(layout, sd)
+	err := r.ParseForm()
 	if err != nil {
-		helpers.ServerError(w, err)
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
 	}
-	endDate, err := time.Parse(layout, ed)
+
+	res, err := m.DB.GetReservationByID(id)
 	if err != nil {
 		helpers.ServerError(w, err)
+		return
+	}
+
+	// the guest may only cancel rooms booked under the confirmation code they looked up
+	roomID, _ := strconv.Atoi(r.Form.Get("reservation_id"))
+	var room models.Reservation
+	for _, g := range res.Group {
+		if g.ID == roomID {
+			room = g
+		}
+	}
+	if room.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "That room is not part of your reservation")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
+	}
+
+	q := m.quoteCancellation(res, room.ID)
+	err = m.DB.CancelReservation(m.actor(r), room.ID, models.Cancellation{
+		Reason:    r.Form.Get("reason"),
+		Penalties: q.Penalties,
+	})
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", "This room can no longer be cancelled")
+		http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
+		return
 	}
-	room, err := m.DB.GetRoomById(roomID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	var res models.Reservation
-	res.RoomID = roomID
-	res.StartDate = startDate
-	res.EndDate = endDate
-	res.Room.RoomName = room.RoomName
+	refunded, err := m.refundCancellation(res, q)
+	m.offerReleased(room)
 
-	m.App.Session.Put(r.Context(), "reservation", res)
-	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+	m.queueTemplatedMail(room.Email, emails.ReservationCancelledName, emails.ReservationCancelled{
+		Reservation: room,
+		Penalty:     q.Penalty,
+		Refunded:    refunded,
+	})
+	m.queueTemplatedMail(m.App.AdminEmail, emails.AdminNotificationName, emails.AdminNotification{
+		Reservation: room,
+		Event:       "cancelled by the guest",
+	})
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been cancelled", room.Room.RoomName)+m.refundMessage(q.Penalty, refunded, res.Currency, err))
+	http.Redirect(w, r, "/manage-reservation", http.StatusSeeOther)
 }
 
 // ShowLogin displays the login form
@@ -443,19 +1339,141 @@ func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, _, err := m.DB.Authenticate(email, password)
+	now := time.Now()
+	policy := m.App.LoginPolicy
+	attempt := models.LoginAttempt{Email: email, IPAddress: helpers.ClientIP(r)}
+
+	addressFailures, err := m.DB.CountFailedLoginsFromIP(attempt.IPAddress, now.Add(-policy.Window))
 	if err != nil {
-		log.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+	if policy.AddressBlocked(addressFailures) {
+		m.recordLoginAttempt(attempt, lockout.AddressBlocked)
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServerError(w, err)
+		return
+	}
+	attempt.UserID = user.ID
+	if user.Locked(now) {
+		m.recordLoginAttempt(attempt, lockout.AccountLocked)
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _, err := m.DB.Authenticate(email, password)
+	if errors.Is(err, repository.ErrInvalidCredentials) {
+		m.recordLoginAttempt(attempt, lockout.BadCredentials)
+		err = m.countFailedLogin(user, addressFailures, now)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
 		m.App.Session.Put(r.Context(), "error", "invalid login credentials")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	attempt.UserID = id
+
+	// with two-factor login the user is only logged in once they give a code as well
+	if user.TOTPEnabled == 1 {
+		m.recordLoginAttempt(attempt, lockout.PasswordAccepted)
+		m.App.Session.Put(r.Context(), "two_factor_user_id", id)
+		m.App.Session.Put(r.Context(), "two_factor_started", now)
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.recordLoginAttempt(attempt, lockout.Succeeded)
+	m.logIn(w, r, user)
+}
+
+// countFailedLogin counts a failed login against user, if the email address was a user's, locks
+// them out if they have failed too often, then waits before the caller answers. The wait grows
+// with failures from the address as well as against the account, so guessing many accounts
+// from one address is slowed down too.
+func (m *Repository) countFailedLogin(user models.User, addressFailures int, now time.Time) error {
+	policy := m.App.LoginPolicy
+
+	failures := addressFailures + 1
+	if user.ID > 0 {
+		userFailures, err := m.DB.RecordFailedLogin(user.ID)
+		if err != nil {
+			return err
+		}
+		if d := policy.LockDuration(userFailures); d > 0 {
+			m.App.InfoLog.Printf("locking user %d for %s after %d failed logins", user.ID, d, userFailures)
+			err = m.DB.LockUser(user.ID, now.Add(d))
+			if err != nil {
+				return err
+			}
+		}
+		if userFailures > failures {
+			failures = userFailures
+		}
+	}
+	time.Sleep(policy.Delay(failures))
+	return nil
+}
+
+// logIn puts user in the session once every factor has been checked, and sends them on.
+// Failed logins only stop counting against a user here, not when their password alone is right.
+func (m *Repository) logIn(w http.ResponseWriter, r *http.Request, user models.User) {
+	if user.FailedLogins > 0 {
+		// the user isn't in the session yet, so is recorded as clearing their own failed logins
+		err := m.DB.UnlockUser(models.Actor{UserID: user.ID, IPAddress: helpers.ClientIP(r)}, user.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "user_id", user.ID)
+	m.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
+
+	if user.TOTPEnabled == 0 {
+		required, err := m.twoFactorRequired()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if required {
+			m.App.Session.Put(r.Context(), "warning", "Set up two-factor login to continue")
+			http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+			return
+		}
+	}
 
-	m.App.Session.Put(r.Context(), "user_id", id)
 	m.App.Session.Put(r.Context(), "flash", "logged in successfully")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// recordLoginAttempt adds a login attempt with outcome to the audit table, logging any error
+// rather than failing the login over it
+func (m *Repository) recordLoginAttempt(attempt models.LoginAttempt, outcome string) {
+	attempt.Outcome = outcome
+	if outcome == lockout.Succeeded || outcome == lockout.PasswordAccepted {
+		attempt.Succeeded = 1
+	}
+	err := m.DB.InsertLoginAttempt(attempt)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
 // Logout logs a user out
 func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 	_ = m.App.Session.Destroy(r.Context())
@@ -464,8 +1482,26 @@ func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
+// AdminDashboard shows locked out accounts and the latest login attempts
 func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.html", &models.TemplateData{})
+	locked, err := m.DB.LockedUsers()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	attempts, err := m.DB.RecentLoginAttempts(25)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["locked"] = locked
+	data["attempts"] = attempts
+	render.Template(w, r, "admin-dashboard.page.html", &models.TemplateData{
+		Data: data,
+	})
 }
 
 func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
@@ -482,8 +1518,18 @@ func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request
 	})
 }
 
+// AdminAllReservations lists the reservations, optionally only those with the status given in the query
 func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+	st := r.URL.Query().Get("status")
+
+	var reservations []models.Reservation
+	var err error
+	if status.Valid(st) {
+		reservations, err = m.DB.ReservationsByStatus(st)
+	} else {
+		st = ""
+		reservations, err = m.DB.AllReservations()
+	}
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -491,8 +1537,14 @@ func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request
 
 	data := make(map[string]interface{})
 	data["reservations"] = reservations
+	data["statuses"] = status.All()
+
+	stringMap := make(map[string]string)
+	stringMap["status"] = st
+
 	render.Template(w, r, "admin-all-reservations.page.html", &models.TemplateData{
-		Data: data,
+		Data:      data,
+		StringMap: stringMap,
 	})
 }
 
@@ -524,6 +1576,22 @@ func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request
 
 	data := make(map[string]interface{})
 	data["reservation"] = reservation
+	data["cancellation_policy"] = cancellation.PolicyOf(reservation, m.App.CancellationPolicy)
+	data["cancellation_quote"] = m.quoteCancellation(reservation, reservation.ID)
+	if len(reservation.Group) > 0 {
+		data["group_cancellation_quote"] = m.quoteCancellation(reservation, cancellableIDs(reservation)...)
+	}
+	if reservation.DeletedAt == nil {
+		data["next_statuses"] = status.Next(reservation.Status)
+	}
+	if reservation.GuestID > 0 {
+		guest, err := m.DB.GetGuestByID(reservation.GuestID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["guest"] = guest
+	}
 	render.Template(w, r, "admin-reservations-show.page.html", &models.TemplateData{
 		StringMap: stringMap,
 		Data:      data,
@@ -561,7 +1629,7 @@ func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Req
 	res.Phone = r.Form.Get("phone")
 	res.Email = r.Form.Get("email")
 
-	err = m.DB.UpdateReservation(res)
+	err = m.DB.UpdateReservation(m.actor(r), res)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -630,10 +1698,12 @@ func (m *Repository) AdminReservationsCalender(w http.ResponseWriter, r *http.Re
 	for _, x := range rooms {
 		reservationMap := make(map[string]int)
 		blockMap := make(map[string]int)
+		holdMap := make(map[string]int)
 
 		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
 			reservationMap[d.Format("2006-01-2")] = 0
 			blockMap[d.Format("2006-01-2")] = 0
+			holdMap[d.Format("2006-01-2")] = 0
 		}
 
 		restricitons, err := m.DB.GetRestrictionsForRoomByDate(x.ID, firstOfMonth, lastOfMonth)
@@ -647,12 +1717,18 @@ func (m *Repository) AdminReservationsCalender(w http.ResponseWriter, r *http.Re
 				for d := y.StartDate; !d.After(y.EndDate); d = d.AddDate(0, 0, 1) {
 					reservationMap[d.Format("2006-01-2")] = y.ReservationID
 				}
+			} else if y.RestrictionID == 3 {
+				// a room held for a guest from the waitlist, which only lapsing or booking releases
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					holdMap[d.Format("2006-01-2")] = y.ID
+				}
 			} else {
 				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
 			}
 		}
 		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
 		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+		data[fmt.Sprintf("hold_map_%d", x.ID)] = holdMap
 
 		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
 	}
@@ -684,46 +1760,47 @@ func (m *Repository) AdminPostReservationsCalender(w http.ResponseWriter, r *htt
 
 	form := forms.New(r.PostForm)
 
+	// blocks shown on the calendar whose box has been unticked are removed
+	var remove []int
+	var released []models.RoomRestriction
 	for _, x := range rooms {
 		curMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
 		for name, value := range curMap {
-			if val, ok := curMap[name]; ok {
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
-						err := m.DB.DeleteBlockByID(value)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}
+			if value > 0 && !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
+				remove = append(remove, value)
+				night, _ := time.Parse("2006-01-2", name)
+				released = append(released, models.RoomRestriction{RoomID: x.ID, StartDate: night, EndDate: night.AddDate(0, 0, 1)})
 			}
 		}
-		// Get the block map from the session
-		// Get the changed block map from the form
-
 	}
-	for name, _ := range r.PostForm {
+
+	var add []models.RoomRestriction
+	for name := range r.PostForm {
 		if strings.HasPrefix(name, "add_block") {
 			exploded := strings.Split(name, "_")
 			roomID, _ := strconv.Atoi(exploded[2])
 			t, _ := time.Parse("2006-01-2", exploded[3])
-			err := m.DB.InsertBlockForRoom(roomID, t)
-			if err != nil {
-				log.Println(err)
-			}
+			add = append(add, models.RoomRestriction{RoomID: roomID, StartDate: t})
 		}
 	}
+
+	err = m.DB.UpdateBlocks(m.actor(r), add, remove)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Waitlist.Released(released...)
+
 	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
 	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
 }
 
-// AdminProcessReservation marks a reservation as processed
-func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
-	exploded := strings.Split(r.RequestURI, "/")
+// AdminReservationStatus moves a reservation to a new status
+func (m *Repository) AdminReservationStatus(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
 
 	src := exploded[3]
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
+	to := exploded[6]
 
 	id, err := strconv.Atoi(exploded[4])
 	if err != nil {
@@ -732,23 +1809,111 @@ func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = m.DB.UpdateProcessedForReservation(id, 1)
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+	back := fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+	if year != "" {
+		back += fmt.Sprintf("?y=%s&m=%s", year, month)
+	}
+
+	st, ok := status.Get(to)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Unknown status")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// cancelling records the reason given and the penalty charged under the reservation's policy
+	q := m.quoteCancellation(res, res.ID)
+	if st.Value == status.Cancelled {
+		err = m.DB.CancelReservation(m.actor(r), id, models.Cancellation{
+			Reason:    r.URL.Query().Get("reason"),
+			Penalties: q.Penalties,
+		})
+	} else {
+		err = m.DB.UpdateReservationStatus(m.actor(r), id, st.Value)
+	}
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("This reservation can't be marked %s", st.Name))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
+	msg := fmt.Sprintf("Reservation marked %s", st.Name)
+	if st.Value == status.Cancelled {
+		refunded, err := m.refundCancellation(res, q)
+		msg += m.refundMessage(q.Penalty, refunded, res.Currency, err)
+	}
+	if status.ReleasesRoom(st.Value) && !status.ReleasesRoom(res.Status) {
+		m.offerReleased(res)
+	}
+	m.App.Session.Put(r.Context(), "flash", msg)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminCancelReservationGroup cancels every room of the group booking a reservation belongs to
+func (m *Repository) AdminCancelReservationGroup(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+
+	src := exploded[3]
+
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
-	m.App.Session.Put(r.Context(), "flash", "Reservation Marked as processed")
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	back := fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+	if year != "" {
+		back += fmt.Sprintf("?y=%s&m=%s", year, month)
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if len(res.Group) == 0 {
+		m.App.Session.Put(r.Context(), "error", "This reservation was booked on its own")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
 	}
+
+	q := m.quoteCancellation(res, cancellableIDs(res)...)
+	n, err := m.DB.CancelReservationGroup(m.actor(r), res.ConfirmationCode, models.Cancellation{
+		Reason:    r.URL.Query().Get("reason"),
+		Penalties: q.Penalties,
+	})
+	if errors.Is(err, repository.ErrInvalidStatusChange) {
+		m.App.Session.Put(r.Context(), "error", "None of the rooms in this booking can be cancelled")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	refunded, err := m.refundCancellation(res, q)
+	m.offerReleased(cancellable(res)...)
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Cancelled %d rooms", n)+m.refundMessage(q.Penalty, refunded, res.Currency, err))
+	http.Redirect(w, r, back, http.StatusSeeOther)
 }
 
-// AdminDeleteReservation deletes a reservation
+// AdminDeleteReservation moves a reservation to the trash
 func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
 	exploded := strings.Split(r.RequestURI, "/")
 
@@ -763,15 +1928,24 @@ func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = m.DB.DeleteReservation(id)
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteReservation(m.actor(r), id)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
+	if !status.ReleasesRoom(res.Status) {
+		m.offerReleased(res)
+	}
 
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
-	m.App.Session.Put(r.Context(), "flash", "Reservation Deleted")
+	m.App.Session.Put(r.Context(), "flash", "Reservation moved to the trash")
 	if year == "" {
 		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
 	} else {
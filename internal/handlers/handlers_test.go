@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/eador/bookings/internal/models"
 )
@@ -23,10 +24,13 @@ var theTests = []struct {
 }{
 	{"home", "/", "get", http.StatusOK},
 	{"about", "/about", "get", http.StatusOK},
-	{"gq", "/generals-quarters", "get", http.StatusOK},
-	{"ms", "/majors-suite", "get", http.StatusOK},
+	{"rooms", "/rooms", "get", http.StatusOK},
+	{"gq", "/rooms/generals-quarters", "get", http.StatusOK},
+	{"ms", "/rooms/majors-suite", "get", http.StatusOK},
+	{"unknown room", "/rooms/no-such-room", "get", http.StatusNotFound},
 	{"contact", "/contact", "get", http.StatusOK},
 	{"search availability", "/search-availability", "get", http.StatusOK},
+	{"find reservation", "/find-reservation", "get", http.StatusOK},
 	{"non-existant", "/bad-url", "get", http.StatusNotFound},
 	{"login", "/user/login", "get", http.StatusOK},
 	{"logout", "/user/logout", "get", http.StatusOK},
@@ -34,6 +38,30 @@ var theTests = []struct {
 	{"new reservations", "/admin/reservations-new", "get", http.StatusOK},
 	{"all reservations", "/admin/reservations-all", "get", http.StatusOK},
 	{"show reservations", "/admin/reservations/new/1/show", "get", http.StatusOK},
+	{"admin rooms", "/admin/rooms", "get", http.StatusOK},
+	{"admin failed mail", "/admin/mail-failed", "get", http.StatusOK},
+	{"admin email templates", "/admin/email-templates", "get", http.StatusOK},
+	{"admin email template", "/admin/email-templates/reservation-confirmation", "get", http.StatusOK},
+	{"admin unknown email template", "/admin/email-templates/no-such-template", "get", http.StatusNotFound},
+	{"admin users", "/admin/users", "get", http.StatusOK},
+	{"admin new user", "/admin/users/new", "get", http.StatusOK},
+	{"forgot password", "/user/forgot-password", "get", http.StatusOK},
+	{"set password without a token", "/user/set-password", "get", http.StatusOK},
+	{"admin new room", "/admin/rooms/new", "get", http.StatusOK},
+	{"admin show room", "/admin/rooms/1", "get", http.StatusOK},
+	{"two factor without a password", "/user/two-factor", "get", http.StatusOK},
+	{"admin audit log", "/admin/audit", "get", http.StatusOK},
+	{"admin trash", "/admin/trash", "get", http.StatusOK},
+	{"admin show group reservation", "/admin/reservations/all/8/show", "get", http.StatusOK},
+	{"admin show reservation with a cancellation policy", "/admin/reservations/all/12/show", "get", http.StatusOK},
+	{"admin confirmed reservations", "/admin/reservations-all?status=confirmed", "get", http.StatusOK},
+	{"admin reservations unknown status", "/admin/reservations-all?status=nonsense", "get", http.StatusOK},
+	{"admin reservations database error", "/admin/reservations-all?status=no_show", "get", http.StatusInternalServerError},
+	{"show reservation in the trash", "/admin/reservations/trash/1/show", "get", http.StatusOK},
+	{"admin guests", "/admin/guests", "get", http.StatusOK},
+	{"admin show guest", "/admin/guests/1", "get", http.StatusOK},
+	{"admin show reservation by a flagged guest", "/admin/reservations/all/13/show", "get", http.StatusOK},
+	{"admin audit log filtered", "/admin/audit?reservation=1&user=1&from=2026-01-01&to=2026-12-31", "get", http.StatusOK},
 }
 
 func TestHandlers(t *testing.T) {
@@ -55,7 +83,9 @@ func TestHandlers(t *testing.T) {
 
 func TestRepository_Reservation(t *testing.T) {
 	reservation := models.Reservation{
-		RoomID: 1,
+		RoomID:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
 		Room: models.Room{
 			ID:       1,
 			RoomName: "General's Quarters",
@@ -102,7 +132,9 @@ func TestRepository_Reservation(t *testing.T) {
 
 func TestRepository_PostReservation(t *testing.T) {
 	reservation := models.Reservation{
-		RoomID: 1,
+		RoomID:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
 		Room: models.Room{
 			ID:       1,
 			RoomName: "General's Quarters",
@@ -166,6 +198,24 @@ func TestRepository_PostReservation(t *testing.T) {
 		t.Errorf("Reservation handlers returned wrong response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
 	}
 
+	// Test for room booked by someone else in the meantime
+	reservation.RoomID = 3
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx = GetCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	session.Put(ctx, "reservation", reservation)
+	handler = http.HandlerFunc(Repo.PostReservation)
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostReservation handler returned wrong response code for unavailable room: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/search-availability" {
+		t.Errorf("PostReservation handler redirected to wrong location for unavailable room: got %s, wanted %s", actualLoc.String(), "/search-availability")
+	}
+
 	// Test for error inserting room restriction
 	reservation.RoomID = 1000
 	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
@@ -214,24 +264,40 @@ var availabilityJSONTests = []struct {
 		OK:      false,
 		Message: "Can not parse end date",
 	}},
-	{"Available", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=1"), jsonResponse{
+	{"Available", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=1&adults=2&children=0"), jsonResponse{
 		OK:        true,
 		Message:   "",
 		StartDate: "2050-01-01",
 		EndDate:   "2050-01-02",
 		RoomID:    "1",
+		Adults:    "2",
+		Children:  "0",
 	}},
-	{"Unavailable", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=2"), jsonResponse{
+	{"Unavailable", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=2&adults=1&children=0"), jsonResponse{
 		OK:        false,
 		Message:   "",
 		StartDate: "2050-01-01",
 		EndDate:   "2050-01-02",
 		RoomID:    "2",
+		Adults:    "1",
+		Children:  "0",
 	}},
-	{"Database Error", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=200"), jsonResponse{
+	{"Database Error", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=200&adults=1&children=0"), jsonResponse{
 		OK:      false,
 		Message: "Error connecting to database",
 	}},
+	{"Stay Rules", strings.NewReader("start=2050-06-04&end=2050-06-06&room_id=1&adults=1&children=0"), jsonResponse{
+		OK:      false,
+		Message: "Stays must be at least 7 nights",
+	}},
+	{"No Adults", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=1&adults=0"), jsonResponse{
+		OK:      false,
+		Message: "Please give the number of adults and children staying",
+	}},
+	{"Too Many Guests", strings.NewReader("start=2050-01-01&end=2050-01-02&room_id=1&adults=3&children=2"), jsonResponse{
+		OK:      false,
+		Message: "This room sleeps at most 4 guests: up to 2 adults and 2 children",
+	}},
 }
 
 func TestRepository_AvailabilityJSON(t *testing.T) {
@@ -267,6 +333,9 @@ func TestRepository_AvailabilityJSON(t *testing.T) {
 		if j.RoomID != e.json.RoomID {
 			t.Errorf("Result JSON for test %s does not match: expected %s, actual %s", e.name, e.json.RoomID, j.RoomID)
 		}
+		if j.Adults != e.json.Adults || j.Children != e.json.Children {
+			t.Errorf("Result JSON for test %s does not match: expected %s/%s guests, actual %s/%s", e.name, e.json.Adults, e.json.Children, j.Adults, j.Children)
+		}
 	}
 
 }
@@ -362,12 +431,19 @@ var availabilityTests = []struct {
 	code    int
 	message string
 }{
-	{"Available", strings.NewReader("start=2050-01-01&end=2050-01-02"), http.StatusOK, " "},
+	{"Available", strings.NewReader("start=2050-01-01&end=2050-01-02&adults=2&children=0"), http.StatusOK, " "},
+	{"Split Party", strings.NewReader("start=2050-01-01&end=2050-01-02&adults=2&children=3"), http.StatusOK, " "},
+	{"No Adults", strings.NewReader("start=2050-01-01&end=2050-01-02&adults=0"), http.StatusOK, " "},
+	{"Bad Children", strings.NewReader("start=2050-01-01&end=2050-01-02&adults=2&children=lots"), http.StatusOK, " "},
 	{"No Form", nil, http.StatusSeeOther, "can't parse form"},
 	{"Bad Start", strings.NewReader("start=Bad&end=2050-01-02"), http.StatusSeeOther, "can't parse start date"},
 	{"Bad End", strings.NewReader("start=2050-01-01&end=BAD"), http.StatusSeeOther, "can't parse end date"},
-	{"DB Error", strings.NewReader("start=1050-01-01&end=1050-01-02"), http.StatusSeeOther, "can't access database"},
-	{"No Rooms", strings.NewReader("start=1050-01-01&end=2050-01-02"), http.StatusSeeOther, "No Availability"},
+	{"DB Error", strings.NewReader("start=2060-01-01&end=2060-01-02&adults=2&children=0"), http.StatusSeeOther, "can't access database"},
+	{"No Rooms", strings.NewReader("start=2061-01-01&end=2061-01-02&adults=2&children=0"), http.StatusSeeOther, "No Availability"},
+	{"Rules DB Error", strings.NewReader("start=2052-01-01&end=2052-01-02&adults=2&children=0"), http.StatusSeeOther, "can't access database"},
+	{"In The Past", strings.NewReader("start=2000-01-01&end=2000-01-02&adults=2&children=0"), http.StatusOK, " "},
+	{"Same Day", strings.NewReader("start=2050-01-02&end=2050-01-02&adults=2&children=0"), http.StatusOK, " "},
+	{"Summer Weekday", strings.NewReader("start=2050-06-06&end=2050-06-13&adults=2&children=0"), http.StatusOK, " "},
 }
 
 func TestRepository_PostAvailability(t *testing.T) {
@@ -428,6 +504,27 @@ var loginTests = []struct {
 		`action="/user/login`,
 		"",
 	},
+	{
+		"locked account",
+		"reader@here.com",
+		http.StatusSeeOther,
+		"",
+		"/user/login",
+	},
+	{
+		"known account wrong password",
+		"desk@here.com",
+		http.StatusSeeOther,
+		"",
+		"/user/login",
+	},
+	{
+		"database error",
+		"broken@here.com",
+		http.StatusInternalServerError,
+		"",
+		"",
+	},
 }
 
 func TestLogin(t *testing.T) {
@@ -465,3 +562,678 @@ func TestLogin(t *testing.T) {
 		}
 	}
 }
+
+func TestLogin_AddressBlocked(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("email", "me@here.com")
+	postedData.Add("password", "password")
+
+	req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postedData.Encode()))
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	req.RemoteAddr = "192.0.2.66:50000"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.PostShowLogin)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+		t.Errorf("expected a blocked address to be sent back to the login page but got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if session.Exists(ctx, "user_id") {
+		t.Error("expected a blocked address not to be logged in, even with the right password")
+	}
+}
+
+var findReservationTests = []struct {
+	name             string
+	code             string
+	email            string
+	expectedStatus   int
+	expectedLocation string
+}{
+	{"found", "abcd2345", "john@smith.com", http.StatusSeeOther, "/manage-reservation"},
+	{"not found", "ZZZZ9999", "john@smith.com", http.StatusSeeOther, "/find-reservation"},
+	{"invalid email", "ABCD2345", "john", http.StatusOK, ""},
+	{"missing code", "", "john@smith.com", http.StatusOK, ""},
+}
+
+func TestRepository_PostFindReservation(t *testing.T) {
+	for _, e := range findReservationTests {
+		postedData := url.Values{}
+		postedData.Add("confirmation_code", e.code)
+		postedData.Add("email", e.email)
+
+		req, _ := http.NewRequest("POST", "/find-reservation", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostFindReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+func TestRepository_ManageReservation(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/manage-reservation", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "manage_reservation_id", 1)
+
+	handler := http.HandlerFunc(Repo.ManageReservation)
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("ManageReservation returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+
+	// no reservation looked up
+	req, _ = http.NewRequest("GET", "/manage-reservation", nil)
+	ctx = GetCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("ManageReservation returned wrong response code without lookup: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+}
+
+var changeDatesTests = []struct {
+	name    string
+	start   string
+	end     string
+	code    int
+	message string
+}{
+	{"valid", "2050-01-01", "2050-01-03", http.StatusSeeOther, ""},
+	{"bad start", "bad", "2050-01-03", http.StatusSeeOther, "can't parse start date"},
+	{"bad end", "2050-01-01", "bad", http.StatusSeeOther, "can't parse end date"},
+	{"in the past", "2000-01-01", "2000-01-03", http.StatusOK, "Arrival can not be in the past"},
+	{"end before start", "2050-01-03", "2050-01-01", http.StatusOK, "Departure must be after arrival"},
+	{"same day", "2050-01-03", "2050-01-03", http.StatusOK, "Departure must be after arrival"},
+	{"summer weekday", "2050-06-06", "2050-06-13", http.StatusOK, "Arrival must be on a Saturday"},
+	{"summer short", "2050-06-04", "2050-06-06", http.StatusOK, "Stays must be at least 7 nights"},
+	{"summer week", "2050-06-04", "2050-06-11", http.StatusSeeOther, ""},
+	{"rules db error", "2052-01-01", "2052-01-03", http.StatusInternalServerError, ""},
+	{"cancelled meanwhile", "2057-01-01", "2057-01-03", http.StatusSeeOther, "This reservation can no longer be changed"},
+}
+
+func TestRepository_PostChangeReservationDates(t *testing.T) {
+	for _, e := range changeDatesTests {
+		postedData := url.Values{}
+		postedData.Add("start_date", e.start)
+		postedData.Add("end_date", e.end)
+
+		req, _ := http.NewRequest("POST", "/manage-reservation/change-dates", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "manage_reservation_id", 1)
+
+		handler := http.HandlerFunc(Repo.PostChangeReservationDates)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.code {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.code, rr.Code)
+		}
+		if e.code == http.StatusOK {
+			// broken stay rules are shown on the form
+			if !strings.Contains(rr.Body.String(), e.message) {
+				t.Errorf("failed %s: expected %q on the page", e.name, e.message)
+			}
+			continue
+		}
+		if msg := session.PopString(ctx, "error"); msg != e.message {
+			t.Errorf("failed %s: expected error %q but got %q", e.name, e.message, msg)
+		}
+	}
+}
+
+func TestRepository_PostCancelReservation(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/manage-reservation/cancel", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "manage_reservation_id", 1)
+
+	handler := http.HandlerFunc(Repo.PostCancelReservation)
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostCancelReservation returned wrong response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	// database error
+	req, _ = http.NewRequest("POST", "/manage-reservation/cancel", nil)
+	ctx = GetCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	session.Put(ctx, "manage_reservation_id", 2)
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("PostCancelReservation returned wrong response code for database error: got %d, wanted %d", rr.Code, http.StatusInternalServerError)
+	}
+
+	// no reservation looked up
+	req, _ = http.NewRequest("POST", "/manage-reservation/cancel", nil)
+	ctx = GetCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostCancelReservation returned wrong response code without lookup: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+}
+
+var reservationStatusTests = []struct {
+	name             string
+	url              string
+	expectedStatus   int
+	expectedLocation string
+	expectedKey      string
+}{
+	{"confirm", "/admin/reservations/new/1/status/confirmed/do", http.StatusSeeOther, "/admin/reservations/new/1/show", "flash"},
+	{"from the calendar", "/admin/reservations/cal/1/status/confirmed/do?y=2026&m=10", http.StatusSeeOther, "/admin/reservations/cal/1/show?y=2026&m=10", "flash"},
+	{"not allowed", "/admin/reservations/all/3/status/checked_in/do", http.StatusSeeOther, "/admin/reservations/all/3/show", "error"},
+	{"unknown status", "/admin/reservations/all/1/status/nonsense/do", http.StatusSeeOther, "/admin/reservations/all/1/show", "error"},
+	{"bad id", "/admin/reservations/all/x/status/confirmed/do", http.StatusSeeOther, "/", "error"},
+	{"database error", "/admin/reservations/all/2/status/confirmed/do", http.StatusInternalServerError, "", ""},
+}
+
+func TestRepository_AdminReservationStatus(t *testing.T) {
+	for _, e := range reservationStatusTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminReservationStatus)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+		if e.expectedKey != "" && session.GetString(ctx, e.expectedKey) == "" {
+			t.Errorf("failed %s: expected a %s message", e.name, e.expectedKey)
+		}
+	}
+}
+
+func TestRepository_PostChangeReservationDates_CheckedOut(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("start_date", "2050-01-01")
+	postedData.Add("end_date", "2050-01-03")
+
+	req, _ := http.NewRequest("POST", "/manage-reservation/change-dates", strings.NewReader(postedData.Encode()))
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "manage_reservation_id", 4)
+
+	handler := http.HandlerFunc(Repo.PostChangeReservationDates)
+	handler.ServeHTTP(rr, req)
+
+	if msg := session.PopString(ctx, "error"); msg != "This reservation can no longer be changed" {
+		t.Errorf("expected the reservation to be refused but got %q", msg)
+	}
+}
+
+func TestRepository_PostChooseRooms(t *testing.T) {
+	reservation := models.Reservation{
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name             string
+		rooms            []string
+		inSession        bool
+		expectedLocation string
+		expectedGroup    int
+	}{
+		{"several rooms", []string{"1", "2", "1"}, true, "/make-reservation", 2},
+		{"one room", []string{"1"}, true, "/make-reservation", 0},
+		{"no rooms", nil, true, "/search-availability", 0},
+		{"bad room", []string{"x"}, true, "/search-availability", 0},
+		{"no reservation in session", []string{"1"}, false, "/", 0},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		for _, id := range e.rooms {
+			postedData.Add("room_id", id)
+		}
+
+		req, _ := http.NewRequest("POST", "/choose-rooms", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		if e.inSession {
+			session.Put(ctx, "reservation", reservation)
+		}
+
+		handler := http.HandlerFunc(Repo.PostChooseRooms)
+		handler.ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %s but got %s", e.name, e.expectedLocation, loc)
+			continue
+		}
+		if e.expectedLocation != "/make-reservation" {
+			continue
+		}
+
+		res := session.Get(ctx, "reservation").(models.Reservation)
+		if res.RoomID != 1 || len(res.Group) != e.expectedGroup {
+			t.Errorf("failed %s: expected room 1 and %d rooms in the group but got %d and %d", e.name, e.expectedGroup, res.RoomID, len(res.Group))
+		}
+	}
+}
+
+func TestRepository_PostReservation_Group(t *testing.T) {
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		rooms            []int
+		expectedLocation string
+	}{
+		{"booked", []int{1, 1}, "/checkout"},
+		{"one room taken", []int{1, 3}, "/search-availability"},
+	}
+
+	for _, e := range tests {
+		reservation := models.Reservation{RoomID: e.rooms[0], StartDate: start, EndDate: end}
+		for _, id := range e.rooms {
+			reservation.Group = append(reservation.Group, models.Reservation{RoomID: id, StartDate: start, EndDate: end})
+		}
+
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("phone", "12345")
+		postedData.Add("email", "john@smith.com")
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "reservation", reservation)
+
+		handler := http.HandlerFunc(Repo.PostReservation)
+		handler.ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %s but got %s", e.name, e.expectedLocation, loc)
+			continue
+		}
+		if e.expectedLocation != "/checkout" {
+			continue
+		}
+
+		res := session.Get(ctx, "reservation").(models.Reservation)
+		for i, g := range res.Group {
+			if g.ID != i+1 || g.Email != "john@smith.com" || g.ConfirmationCode != res.ConfirmationCode || g.TotalAmount == 0 {
+				t.Errorf("failed %s: room %d was not booked for the guest: %+v", e.name, i, g)
+			}
+		}
+	}
+}
+
+func TestRepository_ReservationSummary_Group(t *testing.T) {
+	reservation := models.Reservation{
+		RoomID:           1,
+		ConfirmationCode: "GROUP234",
+		Currency:         "USD",
+		Group: []models.Reservation{
+			{ID: 1, RoomID: 1, Room: models.Room{RoomName: "General's Quarters"}, TotalAmount: 20000, Currency: "USD"},
+			{ID: 2, RoomID: 2, Room: models.Room{RoomName: "Major's Suite"}, TotalAmount: 30000, Currency: "USD"},
+		},
+	}
+
+	req, _ := http.NewRequest("GET", "/reservation-summary", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", reservation)
+
+	handler := http.HandlerFunc(Repo.ReservationSummary)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code %d but got %d", http.StatusOK, rr.Code)
+	}
+	for _, want := range []string{"General&#39;s Quarters", "Major&#39;s Suite", "$500.00"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q in the summary", want)
+		}
+	}
+}
+
+func TestRepository_ManageReservation_Group(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/manage-reservation", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "manage_reservation_id", 9)
+
+	handler := http.HandlerFunc(Repo.ManageReservation)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code %d but got %d", http.StatusOK, rr.Code)
+	}
+	body := rr.Body.String()
+	if strings.Count(body, "Cancel This Room") != 1 {
+		t.Error("expected a cancel button for the one room still booked")
+	}
+	if !strings.Contains(body, "Cancel All Rooms") || strings.Contains(body, "Change Dates</button>") {
+		t.Error("expected the whole booking to be cancellable but not movable")
+	}
+}
+
+var cancelGroupTests = []struct {
+	name             string
+	manageID         int
+	url              string
+	roomID           string
+	expectedStatus   int
+	expectedLocation string
+	expectedKey      string
+	expectedMessage  string
+}{
+	{"whole group", 8, "/manage-reservation/cancel", "", http.StatusSeeOther, "/manage-reservation", "flash", "Your reservation has been cancelled"},
+	{"whole group from another room", 9, "/manage-reservation/cancel", "", http.StatusSeeOther, "/manage-reservation", "flash", "Your reservation has been cancelled"},
+	{"one room", 8, "/manage-reservation/cancel-room", "8", http.StatusSeeOther, "/manage-reservation", "flash", "General's Quarters has been cancelled"},
+	{"room from another booking", 8, "/manage-reservation/cancel-room", "1", http.StatusSeeOther, "/manage-reservation", "error", "That room is not part of your reservation"},
+	{"room of a single booking", 1, "/manage-reservation/cancel-room", "1", http.StatusSeeOther, "/manage-reservation", "error", "That room is not part of your reservation"},
+	{"room not looked up", 0, "/manage-reservation/cancel-room", "8", http.StatusSeeOther, "/find-reservation", "error", "Please look up your reservation first"},
+	{"change group dates", 8, "/manage-reservation/change-dates", "", http.StatusSeeOther, "/manage-reservation", "error", "The dates of a booking with several rooms can't be changed online. Please contact us."},
+}
+
+func TestRepository_CancelReservationGroup(t *testing.T) {
+	for _, e := range cancelGroupTests {
+		postedData := url.Values{}
+		postedData.Add("reservation_id", e.roomID)
+		postedData.Add("start_date", "2050-01-01")
+		postedData.Add("end_date", "2050-01-03")
+
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		if e.manageID > 0 {
+			session.Put(ctx, "manage_reservation_id", e.manageID)
+		}
+
+		var handler http.HandlerFunc
+		switch e.url {
+		case "/manage-reservation/cancel":
+			handler = Repo.PostCancelReservation
+		case "/manage-reservation/cancel-room":
+			handler = Repo.PostCancelReservationRoom
+		default:
+			handler = Repo.PostChangeReservationDates
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %s but got %s", e.name, e.expectedLocation, loc)
+		}
+		if msg := session.GetString(ctx, e.expectedKey); msg != e.expectedMessage {
+			t.Errorf("failed %s: expected %s %q but got %q", e.name, e.expectedKey, e.expectedMessage, msg)
+		}
+	}
+}
+
+func TestRepository_AdminCancelReservationGroup(t *testing.T) {
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedKey    string
+	}{
+		{"group", "/admin/reservations/all/8/cancel-group/do", http.StatusSeeOther, "flash"},
+		{"single booking", "/admin/reservations/all/1/cancel-group/do", http.StatusSeeOther, "error"},
+		{"bad id", "/admin/reservations/all/x/cancel-group/do", http.StatusSeeOther, "error"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminCancelReservationGroup)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if session.GetString(ctx, e.expectedKey) == "" {
+			t.Errorf("failed %s: expected a %s message", e.name, e.expectedKey)
+		}
+	}
+}
+
+var reservationGuestsTests = []struct {
+	name     string
+	adults   int
+	children int
+	group    []int
+	code     int
+}{
+	{"Fits", 2, 2, nil, http.StatusOK},
+	{"Too Many Adults", 3, 0, nil, http.StatusSeeOther},
+	{"Too Many Guests", 2, 3, nil, http.StatusSeeOther},
+	{"Group Fits", 4, 2, []int{1, 2}, http.StatusOK},
+	{"Group Too Small", 5, 0, []int{1, 2}, http.StatusSeeOther},
+}
+
+func TestRepository_Reservation_Guests(t *testing.T) {
+	for _, e := range reservationGuestsTests {
+		reservation := models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+			Adults:    e.adults,
+			Children:  e.children,
+		}
+		for _, id := range e.group {
+			reservation.Group = append(reservation.Group, models.Reservation{RoomID: id, StartDate: reservation.StartDate, EndDate: reservation.EndDate})
+		}
+
+		req, _ := http.NewRequest("GET", "/make-reservation", nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "reservation", reservation)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.Reservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.code {
+			t.Errorf("%s: got code %d, wanted %d", e.name, rr.Code, e.code)
+		}
+		if e.code == http.StatusSeeOther {
+			if loc := rr.Header().Get("Location"); loc != "/search-availability" {
+				t.Errorf("%s: redirected to %s", e.name, loc)
+			}
+		}
+	}
+}
+
+func TestKeepStayRules(t *testing.T) {
+	start := time.Date(2050, 6, 4, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2050, 6, 12, 0, 0, 0, 0, time.UTC)
+	rules, _ := Repo.DB.GetStayRulesForArrival(start)
+	rooms, _ := Repo.DB.ActiveRooms()
+
+	// the suite's summer stays must end on a Saturday
+	kept, broken := keepStayRules(rules, rooms, start, end)
+	if len(kept) != 1 || kept[0].ID != 1 {
+		t.Errorf("expected only room 1 to be kept but got %v", kept)
+	}
+	if len(broken) != 1 || broken[0].Message != "Departure must be on a Saturday" {
+		t.Errorf("unexpected broken rules %v", broken)
+	}
+}
+
+func TestRepository_PostReservation_StayRules(t *testing.T) {
+	// summer arrivals must be on a Saturday
+	reservation := models.Reservation{
+		RoomID:    1,
+		StartDate: time.Date(2050, 6, 6, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 6, 13, 0, 0, 0, 0, time.UTC),
+	}
+
+	postedData := url.Values{}
+	postedData.Add("first_name", "John")
+	postedData.Add("last_name", "Smith")
+	postedData.Add("phone", "12345")
+	postedData.Add("email", "john@smith.com")
+
+	req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", reservation)
+
+	handler := http.HandlerFunc(Repo.PostReservation)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected code %d but got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Arrival must be on a Saturday") {
+		t.Error("expected the broken rule on the page")
+	}
+
+	// the make reservation page sends the guest back to search
+	req, _ = http.NewRequest("GET", "/make-reservation", nil)
+	ctx = GetCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	session.Put(ctx, "reservation", reservation)
+
+	handler = http.HandlerFunc(Repo.Reservation)
+	handler.ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "/search-availability" {
+		t.Errorf("expected redirect to /search-availability but got %s", loc)
+	}
+	if msg := session.PopString(ctx, "error"); msg != "Arrival must be on a Saturday" {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestRepository_Reservation_CancellationPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		roomID   int
+		year     int
+		expected string
+		terms    string
+	}{
+		{"room without a policy", 1, 2050, "Standard", "Free cancellation up to 7 days before arrival"},
+		{"room with its own policy", 3, 2050, "Strict", "50% of the price up to 7 days before arrival"},
+		{"non-refundable rate", 3, 2055, "Non-refundable", "Non-refundable: cancelling costs the full price"},
+	}
+
+	for _, e := range tests {
+		reservation := models.Reservation{
+			RoomID:    e.roomID,
+			StartDate: time.Date(e.year, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(e.year, 1, 3, 0, 0, 0, 0, time.UTC),
+			Adults:    2,
+		}
+
+		req, _ := http.NewRequest("GET", "/make-reservation", nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "reservation", reservation)
+
+		handler := http.HandlerFunc(Repo.Reservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, http.StatusOK, rr.Code)
+			continue
+		}
+		res := session.Get(ctx, "reservation").(models.Reservation)
+		if res.CancellationPolicy != e.expected {
+			t.Errorf("failed %s: expected policy %q but got %q", e.name, e.expected, res.CancellationPolicy)
+		}
+		if !strings.Contains(rr.Body.String(), e.terms) {
+			t.Errorf("failed %s: expected %q on the page", e.name, e.terms)
+		}
+	}
+}
+
+func TestRepository_ManageReservation_CancellationQuote(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       int
+		expected string
+	}{
+		{"free", 10, "Cancelling now is free and $200.00 will be refunded to you."},
+		{"half the price", 12, "Cancelling now costs <strong>$100.00</strong>"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/manage-reservation", nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "manage_reservation_id", e.id)
+
+		handler := http.HandlerFunc(Repo.ManageReservation)
+		handler.ServeHTTP(rr, req)
+
+		if !strings.Contains(rr.Body.String(), e.expected) {
+			t.Errorf("failed %s: expected %q on the page", e.name, e.expected)
+		}
+	}
+}
+
+func TestRepository_AdminReservationStatus_Cancel(t *testing.T) {
+	resetPayments()
+
+	req, _ := http.NewRequest("GET", "/admin/reservations/all/12/status/cancelled/do?reason=Plans+changed", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.AdminReservationStatus)
+	handler.ServeHTTP(rr, req)
+
+	expected := "Reservation marked Cancelled. A cancellation charge of $100.00 applies. $100.00 will be refunded to the card used to pay"
+	if flash := session.GetString(ctx, "flash"); flash != expected {
+		t.Errorf("expected flash %q but got %q", expected, flash)
+	}
+}
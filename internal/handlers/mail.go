@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eador/bookings/internal/emails"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+)
+
+// AdminFailedMail lists the messages that could not be sent
+func (m *Repository) AdminFailedMail(w http.ResponseWriter, r *http.Request) {
+	mail, err := m.DB.FailedMail()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["mail"] = mail
+	render.Template(w, r, "admin-mail.page.html", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminResendMail puts a failed message back in the outbox
+func (m *Repository) AdminResendMail(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/mail-failed", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.ResendMail(m.actor(r), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.wakeMailWorker()
+
+	m.App.Session.Put(r.Context(), "flash", "Message queued to be sent again")
+	http.Redirect(w, r, "/admin/mail-failed", http.StatusSeeOther)
+}
+
+// AdminEmailTemplates lists the email templates
+func (m *Repository) AdminEmailTemplates(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["names"] = m.App.EmailTemplates.Names()
+	render.Template(w, r, "admin-email-templates.page.html", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminEmailTemplate previews an email template, rendered with sample data
+func (m *Repository) AdminEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	name := exploded[3]
+
+	sample := emails.Sample(name)
+	if sample == nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	msg, err := m.App.EmailTemplates.Render(name, sample)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["message"] = msg
+
+	stringMap := make(map[string]string)
+	stringMap["name"] = name
+
+	render.Template(w, r, "admin-email-template.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// queueMail puts msg in the mail outbox and wakes a mail worker, without waiting for it to be sent
+func (m *Repository) queueMail(msg models.MailData) {
+	_, err := m.DB.EnqueueMail(msg)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	m.wakeMailWorker()
+}
+
+// queueTemplatedMail renders the named email template with data and queues it to be sent to to
+func (m *Repository) queueTemplatedMail(to, name string, data interface{}) {
+	msg, err := m.App.EmailTemplates.Mail(to, name, data)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	m.queueMail(msg)
+}
+
+// wakeMailWorker tells a waiting mail worker there is mail to send, if one is not already being told
+func (m *Repository) wakeMailWorker() {
+	select {
+	case m.App.MailNotify <- struct{}{}:
+	default:
+	}
+}
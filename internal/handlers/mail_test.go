@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+var resendMailTests = []struct {
+	name             string
+	url              string
+	expectedStatus   int
+	expectedLocation string
+}{
+	{"valid", "/admin/mail/1/resend/do", http.StatusSeeOther, "/admin/mail-failed"},
+	{"bad id", "/admin/mail/x/resend/do", http.StatusSeeOther, "/admin/mail-failed"},
+	{"database error", "/admin/mail/2/resend/do", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_AdminResendMail(t *testing.T) {
+	for _, e := range resendMailTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminResendMail)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedLocation != "" && rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %s but got %s", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRepository_queueMail(t *testing.T) {
+	// draining first shows queueMail leaves a wake up for the workers without blocking on a full channel
+	select {
+	case <-app.MailNotify:
+	default:
+	}
+
+	for i := 0; i < 3; i++ {
+		Repo.queueMail(models.MailData{To: "john@smith.com", From: "me@here.com", Subject: "Test"})
+	}
+
+	select {
+	case <-app.MailNotify:
+	default:
+		t.Error("expected the mail workers to be woken")
+	}
+}
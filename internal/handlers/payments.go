@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/eador/bookings/internal/cancellation"
+	"github.com/eador/bookings/internal/emails"
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/pricing"
+	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/repository"
+	"github.com/eador/bookings/internal/status"
+)
+
+// maxWebhookBytes limits the size of a payment provider's webhook body
+const maxWebhookBytes = 64 << 10
+
+// Checkout asks the guest to pay a deposit or the full amount for the reservation they just made
+func (m *Repository) Checkout(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok || res.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if res.Paid() > 0 {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+	if paymentOverdue(res, time.Now()) {
+		m.releasedBeforePayment(w, r)
+		return
+	}
+
+	m.renderCheckout(w, r, res, forms.New(nil))
+}
+
+// PostCheckout takes the guest's payment and sends their confirmation
+func (m *Repository) PostCheckout(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok || res.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if res.Paid() > 0 {
+		m.App.Session.Put(r.Context(), "warning", "This reservation has already been paid")
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("payment_token", "amount")
+
+	kind := r.Form.Get("amount")
+	amount := res.BookingTotal()
+	switch {
+	case kind == payments.Deposit && m.depositAmount(res) > 0:
+		amount = m.depositAmount(res)
+	case kind == payments.Full:
+	case kind != "":
+		form.Errors.Add("amount", "Please choose how much to pay")
+	}
+
+	if !form.Valid() {
+		m.renderCheckout(w, r, res, form)
+		return
+	}
+	if paymentOverdue(res, time.Now()) {
+		m.releasedBeforePayment(w, r)
+		return
+	}
+
+	provider := m.App.Payments
+	ref, err := provider.Authorize(amount, res.Currency, r.Form.Get("payment_token"), "Reservation "+res.ConfirmationCode)
+	if errors.Is(err, payments.ErrDeclined) {
+		form.Errors.Add("payment_token", "Your card was declined. Please try another card.")
+		m.renderCheckout(w, r, res, form)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		form.Errors.Add("payment_token", "We could not take your payment. Please try again.")
+		m.renderCheckout(w, r, res, form)
+		return
+	}
+
+	payment, err := m.capturePayment(res, ref, kind, amount)
+	if errors.Is(err, repository.ErrPaymentTooLate) {
+		m.releasedBeforePayment(w, r)
+		return
+	}
+	if errors.Is(err, repository.ErrAlreadyPaid) {
+		m.App.Session.Put(r.Context(), "warning", "This reservation has already been paid. You have not been charged again.")
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	res.Payments = append(res.Payments, payment)
+	res.PaymentDueAt = nil
+	for i := range res.Group {
+		res.Group[i].PaymentDueAt = nil
+	}
+
+	m.sendConfirmation(res)
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// paymentOverdue reports whether res was due to be paid for before now, so its rooms have been
+// or are about to be released
+func paymentOverdue(res models.Reservation, now time.Time) bool {
+	return res.PaymentDueAt != nil && now.After(*res.PaymentDueAt)
+}
+
+// releasedBeforePayment tells a guest that the rooms they booked were released because they
+// didn't pay in time
+func (m *Repository) releasedBeforePayment(w http.ResponseWriter, r *http.Request) {
+	m.App.Session.Remove(r.Context(), "reservation")
+	m.App.Session.Put(r.Context(), "error", "Sorry, your reservation was released because it was not paid for in time. You have not been charged. Please search again.")
+	http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+}
+
+// capturePayment takes the payment authorized as ref for res and records it, which stops res
+// being released for not being paid. If res was released first, or has already been paid for,
+// the payment is refunded and repository.ErrPaymentTooLate or repository.ErrAlreadyPaid returned.
+func (m *Repository) capturePayment(res models.Reservation, ref, kind string, amount int) (models.Payment, error) {
+	provider := m.App.Payments
+	err := provider.Capture(ref, amount)
+	if err != nil {
+		return models.Payment{}, err
+	}
+
+	payment := models.Payment{
+		ReservationID: res.Reservations()[0].ID,
+		Provider:      provider.Name(),
+		Reference:     ref,
+		Kind:          kind,
+		Status:        payments.Captured,
+		Amount:        amount,
+		Currency:      res.Currency,
+	}
+	payment.ID, err = m.DB.InsertPayment(payment)
+	if errors.Is(err, repository.ErrPaymentTooLate) || errors.Is(err, repository.ErrAlreadyPaid) {
+		if _, rerr := provider.Refund(ref, amount); rerr != nil {
+			m.App.ErrorLog.Printf("payment %s of %d for reservation %d must be refunded by hand (%v): %v", ref, amount, payment.ReservationID, err, rerr)
+		}
+		return payment, err
+	}
+	if err != nil {
+		m.App.ErrorLog.Printf("payment %s of %d for reservation %d was taken but not recorded", ref, amount, payment.ReservationID)
+		return payment, err
+	}
+	return payment, nil
+}
+
+// sendConfirmation emails the guest their confirmation and tells the owner about a booking that
+// has been paid for
+func (m *Repository) sendConfirmation(res models.Reservation) {
+	m.queueTemplatedMail(res.Email, emails.ReservationConfirmationName, emails.ReservationConfirmation{
+		Reservation: res,
+	})
+	m.queueTemplatedMail(m.App.AdminEmail, emails.AdminNotificationName, emails.AdminNotification{
+		Reservation: res,
+		Event:       "made",
+	})
+}
+
+// renderCheckout shows the checkout page for res, with any errors on form
+func (m *Repository) renderCheckout(w http.ResponseWriter, r *http.Request, res models.Reservation, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	if _, ok := m.App.Payments.(*payments.Fake); ok {
+		data["test_cards"] = payments.TestCards
+	}
+
+	intMap := make(map[string]int)
+	intMap["deposit"] = m.depositAmount(res)
+	intMap["deposit_percent"] = m.App.DepositPercent
+	if res.PaymentDueAt != nil {
+		intMap["hold_minutes"] = int(math.Ceil(time.Until(*res.PaymentDueAt).Minutes()))
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-02")
+
+	render.Template(w, r, "checkout.page.html", &models.TemplateData{
+		Data:      data,
+		IntMap:    intMap,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// depositAmount returns the deposit due on a booking, or 0 if it must be paid in full
+func (m *Repository) depositAmount(res models.Reservation) int {
+	if m.App.DepositPercent <= 0 || m.App.DepositPercent >= 100 {
+		return 0
+	}
+	return payments.DepositAmount(res.BookingTotal(), m.App.DepositPercent)
+}
+
+// PaymentWebhook records changes to payments and refunds reported by the payment provider
+func (m *Repository) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	provider := m.App.Payments
+	event, err := provider.VerifyWebhook(body, r.Header.Get("X-Payment-Signature"))
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.UpdatePaymentStatus(provider.Name(), event.Reference, event.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		// not one of ours, so there is nothing for the provider to retry
+		m.App.InfoLog.Printf("ignoring %s webhook for unknown payment %s", event.Type, event.Reference)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// quoteCancellation works out the penalty and refund for cancelling the reservations with ids in
+// cancelled from the booking res now
+func (m *Repository) quoteCancellation(res models.Reservation, cancelled ...int) cancellation.Quote {
+	return cancellation.Calculate(res, m.App.CancellationPolicy, time.Now(), cancelled...)
+}
+
+// refundCancellation pays back the refund in q, quoted by quoteCancellation for the booking res as
+// it was before the cancellation. It returns the amount refunded.
+func (m *Repository) refundCancellation(res models.Reservation, q cancellation.Quote) (int, error) {
+	due := q.Refund
+
+	// pay back the most recent charges first
+	refunded := 0
+	for i := len(res.Payments) - 1; i >= 0 && due > 0; i-- {
+		p := res.Payments[i]
+		if p.Kind == payments.Refund || p.Status != payments.Captured {
+			continue
+		}
+		left := p.Amount
+		for _, q := range res.Payments {
+			if q.ParentID == p.ID && q.Status != payments.Failed {
+				left -= q.Amount
+			}
+		}
+		amount := minInt(left, due)
+		if amount <= 0 {
+			continue
+		}
+
+		ref, err := m.App.Payments.Refund(p.Reference, amount)
+		if err != nil {
+			return refunded, err
+		}
+		_, err = m.DB.InsertPayment(models.Payment{
+			ReservationID: p.ReservationID,
+			ParentID:      p.ID,
+			Provider:      p.Provider,
+			Reference:     ref,
+			Kind:          payments.Refund,
+			Status:        payments.Pending,
+			Amount:        amount,
+			Currency:      p.Currency,
+		})
+		if err != nil {
+			return refunded, err
+		}
+		refunded += amount
+		due -= amount
+	}
+
+	return refunded, nil
+}
+
+// refundMessage describes the penalty charged and the outcome of refundCancellation, to be added
+// to the end of a flash message
+func (m *Repository) refundMessage(penalty, refunded int, currency string, err error) string {
+	msg := ""
+	if penalty > 0 {
+		msg = fmt.Sprintf(". A cancellation charge of %s applies", pricing.FormatMoney(penalty, currency))
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("refund failed:", err)
+		return msg + ". The payment could not be refunded automatically and will be refunded by hand"
+	}
+	if refunded == 0 {
+		return msg
+	}
+	return msg + fmt.Sprintf(". %s will be refunded to the card used to pay", pricing.FormatMoney(refunded, currency))
+}
+
+// cancellable returns the reservations in a booking that can still be cancelled
+func cancellable(res models.Reservation) []models.Reservation {
+	var rooms []models.Reservation
+	for _, g := range res.Reservations() {
+		if status.CanChange(g.Status, status.Cancelled) {
+			rooms = append(rooms, g)
+		}
+	}
+	return rooms
+}
+
+// cancellableIDs returns the ids of the reservations in a booking that can still be cancelled
+func cancellableIDs(res models.Reservation) []int {
+	var ids []int
+	for _, g := range cancellable(res) {
+		ids = append(ids, g.ID)
+	}
+	return ids
+}
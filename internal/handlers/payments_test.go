@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+)
+
+// unpaid is a reservation just made by PostReservation
+func unpaid(id int) models.Reservation {
+	return models.Reservation{
+		ID:               id,
+		RoomID:           1,
+		ConfirmationCode: "ABCD2345",
+		Email:            "john@smith.com",
+		StartDate:        time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:          time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		Room:             models.Room{RoomName: "General's Quarters"},
+		TotalAmount:      20000,
+		Currency:         "USD",
+	}
+}
+
+func TestRepository_Checkout(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/checkout", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", unpaid(1))
+
+	handler := http.HandlerFunc(Repo.Checkout)
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Checkout returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	for _, want := range []string{"$40.00", "$200.00", payments.CardOK} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q on the checkout page", want)
+		}
+	}
+
+	// no reservation in the session
+	req, _ = http.NewRequest("GET", "/checkout", nil)
+	req = req.WithContext(GetCtx(req))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("Checkout returned wrong response code without a reservation: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+}
+
+var postCheckoutTests = []struct {
+	name             string
+	reservationID    int
+	paid             bool
+	postedData       url.Values
+	expectedStatus   int
+	expectedLocation string
+	expectedPaid     int
+}{
+	{"deposit", 1, false, url.Values{"amount": {"deposit"}, "payment_token": {payments.CardOK}}, http.StatusSeeOther, "/reservation-summary", 4000},
+	{"full", 1, false, url.Values{"amount": {"full"}, "payment_token": {payments.CardOK}}, http.StatusSeeOther, "/reservation-summary", 20000},
+	{"declined", 1, false, url.Values{"amount": {"full"}, "payment_token": {payments.CardDeclined}}, http.StatusOK, "", 0},
+	{"unknown card", 1, false, url.Values{"amount": {"full"}, "payment_token": {"tok_stolen"}}, http.StatusOK, "", 0},
+	{"missing card", 1, false, url.Values{"amount": {"full"}}, http.StatusOK, "", 0},
+	{"bad amount", 1, false, url.Values{"amount": {"half"}, "payment_token": {payments.CardOK}}, http.StatusOK, "", 0},
+	{"already paid", 1, true, url.Values{"amount": {"full"}, "payment_token": {payments.CardOK}}, http.StatusSeeOther, "/reservation-summary", 20000},
+	{"database error", 2, false, url.Values{"amount": {"full"}, "payment_token": {payments.CardOK}}, http.StatusInternalServerError, "", 0},
+}
+
+func TestRepository_PostCheckout(t *testing.T) {
+	for _, e := range postCheckoutTests {
+		res := unpaid(e.reservationID)
+		if e.paid {
+			res.Payments = []models.Payment{{Kind: payments.Full, Status: payments.Captured, Amount: 20000}}
+		}
+
+		req, _ := http.NewRequest("POST", "/checkout", strings.NewReader(e.postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "reservation", res)
+
+		handler := http.HandlerFunc(Repo.PostCheckout)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+		if paid := session.Get(ctx, "reservation").(models.Reservation).Paid(); paid != e.expectedPaid {
+			t.Errorf("failed %s: expected %d paid but got %d", e.name, e.expectedPaid, paid)
+		}
+	}
+}
+
+var paymentWebhookTests = []struct {
+	name           string
+	body           string
+	signed         bool
+	expectedStatus int
+}{
+	{"captured", `{"type":"payment.captured","reference":"pay_000001"}`, true, http.StatusOK},
+	{"bad signature", `{"type":"payment.captured","reference":"pay_000001"}`, false, http.StatusBadRequest},
+	{"unknown event", `{"type":"payment.disputed","reference":"pay_000001"}`, true, http.StatusBadRequest},
+	{"unknown payment", `{"type":"refund.succeeded","reference":"unknown"}`, true, http.StatusOK},
+	{"database error", `{"type":"refund.failed","reference":"broken"}`, true, http.StatusInternalServerError},
+}
+
+func TestRepository_PaymentWebhook(t *testing.T) {
+	fake := app.Payments.(*payments.Fake)
+
+	for _, e := range paymentWebhookTests {
+		req, _ := http.NewRequest("POST", "/payments/webhook", strings.NewReader(e.body))
+		sig := "00"
+		if e.signed {
+			sig = fake.Sign([]byte(e.body))
+		}
+		req.Header.Set("X-Payment-Signature", sig)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PaymentWebhook)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestRepository_PostCancelReservation_Refund(t *testing.T) {
+	tests := []struct {
+		name          string
+		id            int
+		expectedFlash string
+	}{
+		{"refunded", 10, "Your reservation has been cancelled. $200.00 will be refunded to the card used to pay"},
+		{"too late for a refund", 11, "Your reservation has been cancelled. A cancellation charge of $200.00 applies"},
+		{"half refunded under the moderate policy", 12, "Your reservation has been cancelled. A cancellation charge of $100.00 applies. $100.00 will be refunded to the card used to pay"},
+	}
+
+	for _, e := range tests {
+		resetPayments()
+
+		req, _ := http.NewRequest("POST", "/manage-reservation/cancel", nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "manage_reservation_id", e.id)
+
+		handler := http.HandlerFunc(Repo.PostCancelReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if flash := session.GetString(ctx, "flash"); flash != e.expectedFlash {
+			t.Errorf("failed %s: expected flash %q but got %q", e.name, e.expectedFlash, flash)
+		}
+	}
+
+	// the provider refuses the refund
+	app.Payments = payments.NewFake("secret")
+	defer resetPayments()
+
+	req, _ := http.NewRequest("POST", "/manage-reservation/cancel", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "manage_reservation_id", 10)
+
+	handler := http.HandlerFunc(Repo.PostCancelReservation)
+	handler.ServeHTTP(rr, req)
+
+	if flash := session.GetString(ctx, "flash"); !strings.Contains(flash, "refunded by hand") {
+		t.Errorf("expected a failed refund in the flash but got %q", flash)
+	}
+}
+
+func TestRefundCancellation_Partial(t *testing.T) {
+	resetPayments()
+
+	// two rooms paid for together, one of them cancelled
+	res := models.Reservation{
+		ID:        20,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		Currency:  "USD",
+		Group: []models.Reservation{
+			{ID: 20, TotalAmount: 12000},
+			{ID: 21, TotalAmount: 8000},
+		},
+		Payments: []models.Payment{
+			{ID: 1, Reference: "pay_000001", Kind: payments.Full, Status: payments.Captured, Amount: 20000},
+		},
+	}
+
+	refunded, err := Repo.refundCancellation(res, Repo.quoteCancellation(res, 21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refunded != 8000 {
+		t.Errorf("expected 8000 refunded but got %d", refunded)
+	}
+
+	// only a deposit was paid, which the remaining room more than covers
+	res.Payments[0].Kind = payments.Deposit
+	res.Payments[0].Amount = 4000
+	refunded, err = Repo.refundCancellation(res, Repo.quoteCancellation(res, 21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refunded != 0 {
+		t.Errorf("expected nothing refunded but got %d", refunded)
+	}
+}
+
+func TestRepository_PostCheckout_Overdue(t *testing.T) {
+	resetPayments()
+
+	// the guest took too long, so the rooms may already have been released
+	overdue := unpaid(1)
+	past := time.Now().Add(-time.Minute)
+	overdue.PaymentDueAt = &past
+
+	// the rooms were released while the guest was paying
+	released := unpaid(14)
+	future := time.Now().Add(time.Minute)
+	released.PaymentDueAt = &future
+
+	tests := []struct {
+		name    string
+		method  string
+		res     models.Reservation
+		handler http.HandlerFunc
+	}{
+		{"checkout page", "GET", overdue, Repo.Checkout},
+		{"pay overdue", "POST", overdue, Repo.PostCheckout},
+		{"pay after release", "POST", released, Repo.PostCheckout},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{"amount": {"full"}, "payment_token": {payments.CardOK}}
+		req, _ := http.NewRequest(e.method, "/checkout", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "reservation", e.res)
+
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/search-availability" {
+			t.Errorf("failed %s: expected a redirect to search again but got %d %q", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+		if msg := session.GetString(ctx, "error"); !strings.Contains(msg, "not been charged") {
+			t.Errorf("failed %s: unexpected error %q", e.name, msg)
+		}
+		if session.Exists(ctx, "reservation") {
+			t.Errorf("failed %s: expected the released reservation to be removed from the session", e.name)
+		}
+	}
+
+	// the payment taken after the release, the second the provider has seen, was given back
+	if _, err := app.Payments.Refund("pay_000002", 1); err == nil {
+		t.Error("expected the payment taken after the release to have been refunded in full")
+	}
+}
+
+func TestRepository_PostCheckout_AlreadyPaid(t *testing.T) {
+	resetPayments()
+
+	// another checkout of the booking, in a second tab, recorded its charge first
+	postedData := url.Values{"amount": {"full"}, "payment_token": {payments.CardOK}}
+	req, _ := http.NewRequest("POST", "/checkout", strings.NewReader(postedData.Encode()))
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", unpaid(15))
+
+	http.HandlerFunc(Repo.PostCheckout).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/reservation-summary" {
+		t.Errorf("expected a redirect to the summary but got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if msg := session.GetString(ctx, "warning"); !strings.Contains(msg, "not been charged again") {
+		t.Errorf("unexpected warning %q", msg)
+	}
+
+	// the second charge was given back
+	if _, err := app.Payments.Refund("pay_000002", 1); err == nil {
+		t.Error("expected the second charge to have been refunded in full")
+	}
+}
+
+func TestRepository_Checkout_HoldMinutes(t *testing.T) {
+	res := unpaid(1)
+	due := time.Now().Add(10 * time.Minute)
+	res.PaymentDueAt = &due
+
+	req, _ := http.NewRequest("GET", "/checkout", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", res)
+
+	http.HandlerFunc(Repo.Checkout).ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), "held for 10 more minutes") {
+		t.Error("expected how long the room is held on the checkout page")
+	}
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/pricing"
+	"github.com/eador/bookings/internal/promo"
+	"github.com/eador/bookings/internal/render"
+)
+
+// AdminPromoCodes lists the promo codes with how many bookings have used each
+func (m *Repository) AdminPromoCodes(w http.ResponseWriter, r *http.Request) {
+	codes, err := m.DB.AllPromoCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["codes"] = codes
+	render.Template(w, r, "admin-promo-codes.page.html", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewPromoCode displays the form for adding a promo code
+func (m *Repository) AdminNewPromoCode(w http.ResponseWriter, r *http.Request) {
+	m.renderPromoCodeForm(w, r, models.PromoCode{Kind: promo.Percent, Currency: "USD", Active: 1}, forms.New(nil))
+}
+
+// AdminPostNewPromoCode adds a promo code
+func (m *Repository) AdminPostNewPromoCode(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var p models.PromoCode
+	form := m.promoCodeFromForm(r, &p)
+	if !form.Valid() {
+		m.renderPromoCodeForm(w, r, p, form)
+		return
+	}
+
+	_, err = m.DB.InsertPromoCode(m.actor(r), p)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Promo code added")
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// AdminShowPromoCode displays the form for editing a promo code
+func (m *Repository) AdminShowPromoCode(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+		return
+	}
+
+	p, err := m.DB.GetPromoCodeByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderPromoCodeForm(w, r, p, forms.New(nil))
+}
+
+// AdminPostShowPromoCode saves changes to a promo code
+func (m *Repository) AdminPostShowPromoCode(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+		return
+	}
+
+	p, err := m.DB.GetPromoCodeByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := m.promoCodeFromForm(r, &p)
+	if !form.Valid() {
+		m.renderPromoCodeForm(w, r, p, form)
+		return
+	}
+
+	err = m.DB.UpdatePromoCode(m.actor(r), p)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// promoCodeFromForm copies the posted promo code form into p and returns the validated form
+func (m *Repository) promoCodeFromForm(r *http.Request, p *models.PromoCode) *forms.Form {
+	form := forms.New(r.PostForm)
+	form.Required("code", "kind", "amount", "currency")
+
+	p.Code = promo.Normalize(r.Form.Get("code"))
+	p.Description = strings.TrimSpace(r.Form.Get("description"))
+	p.Kind = r.Form.Get("kind")
+	p.Currency = strings.ToUpper(strings.TrimSpace(r.Form.Get("currency")))
+	p.Active = 0
+	if r.Form.Get("active") != "" {
+		p.Active = 1
+	}
+
+	if form.Has("code") && !promo.ValidCode(p.Code) {
+		form.Errors.Add("code", "Only letters, numbers and dashes are allowed")
+	}
+	if form.Errors.Get("code") == "" {
+		existing, err := m.DB.GetPromoCodeByCode(p.Code)
+		if err == nil && existing.ID != p.ID {
+			form.Errors.Add("code", "This code is already used by another promotion")
+		}
+	}
+
+	switch p.Kind {
+	case promo.Percent:
+		form.IsInt("amount", 1)
+		p.Amount, _ = strconv.Atoi(strings.TrimSpace(r.Form.Get("amount")))
+		if p.Amount > 100 {
+			form.Errors.Add("amount", "A discount can be at most 100%")
+		}
+	case promo.Fixed:
+		amount, err := pricing.ParseMoney(r.Form.Get("amount"))
+		if err != nil || amount == 0 {
+			form.Errors.Add("amount", "Enter an amount such as 20 or 19.50")
+		}
+		p.Amount = amount
+	default:
+		form.Errors.Add("kind", "Choose a percentage or fixed discount")
+	}
+
+	if len(p.Currency) != 3 {
+		form.Errors.Add("currency", "Use a three letter currency code such as USD")
+	}
+
+	p.ValidFrom = optionalDate(form, "valid_from")
+	p.ValidUntil = optionalDate(form, "valid_until")
+	if !p.ValidFrom.IsZero() && !p.ValidUntil.IsZero() && p.ValidUntil.Before(p.ValidFrom) {
+		form.Errors.Add("valid_until", "Must not be before the first day the code can be used")
+	}
+	p.StayFrom = optionalDate(form, "stay_from")
+	p.StayUntil = optionalDate(form, "stay_until")
+	if !p.StayFrom.IsZero() && !p.StayUntil.IsZero() && p.StayUntil.Before(p.StayFrom) {
+		form.Errors.Add("stay_until", "Must not be before the first night")
+	}
+
+	p.MaxUses = optionalLimit(form, "max_uses")
+	p.MaxUsesPerGuest = optionalLimit(form, "max_uses_per_guest")
+
+	p.RoomIDs = nil
+	for _, v := range r.Form["room_id"] {
+		id, err := strconv.Atoi(v)
+		if err == nil && id > 0 {
+			p.RoomIDs = append(p.RoomIDs, id)
+		}
+	}
+
+	return form
+}
+
+// optionalDate reads a date that may be left blank from a form field, adding an error if it is
+// not a date
+func optionalDate(form *forms.Form, field string) time.Time {
+	if strings.TrimSpace(form.Get(field)) == "" {
+		return time.Time{}
+	}
+	d, err := time.Parse("2006-01-02", strings.TrimSpace(form.Get(field)))
+	if err != nil {
+		form.Errors.Add(field, "Please enter a date like 2050-01-31")
+	}
+	return d
+}
+
+// optionalLimit reads a limit from a form field, where blank means no limit
+func optionalLimit(form *forms.Form, field string) int {
+	if strings.TrimSpace(form.Get(field)) == "" {
+		return 0
+	}
+	form.IsInt(field, 0)
+	n, _ := strconv.Atoi(strings.TrimSpace(form.Get(field)))
+	return n
+}
+
+// renderPromoCodeForm displays the promo code form for a new or existing code
+func (m *Repository) renderPromoCodeForm(w http.ResponseWriter, r *http.Request, p models.PromoCode, form *forms.Form) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	chosen := make(map[int]bool)
+	for _, id := range p.RoomIDs {
+		chosen[id] = true
+	}
+
+	data := make(map[string]interface{})
+	data["promo"] = p
+	data["rooms"] = rooms
+	data["chosen"] = chosen
+
+	stringMap := make(map[string]string)
+	stringMap["amount"] = ""
+	if p.Kind == promo.Fixed {
+		stringMap["amount"] = fmt.Sprintf("%d.%02d", p.Amount/100, p.Amount%100)
+	} else if p.Amount > 0 {
+		stringMap["amount"] = strconv.Itoa(p.Amount)
+	}
+	for field, d := range map[string]time.Time{
+		"valid_from":  p.ValidFrom,
+		"valid_until": p.ValidUntil,
+		"stay_from":   p.StayFrom,
+		"stay_until":  p.StayUntil,
+	} {
+		stringMap[field] = ""
+		if !d.IsZero() {
+			stringMap[field] = d.Format("2006-01-02")
+		}
+	}
+	if p.MaxUses > 0 {
+		stringMap["max_uses"] = strconv.Itoa(p.MaxUses)
+	}
+	if p.MaxUsesPerGuest > 0 {
+		stringMap["max_uses_per_guest"] = strconv.Itoa(p.MaxUsesPerGuest)
+	}
+
+	render.Template(w, r, "admin-promo-code.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+var postReservationPromoTests = []struct {
+	name             string
+	code             string
+	expectedStatus   int
+	expectedLocation string
+	expectedMessage  string
+}{
+	{"no code", "", http.StatusSeeOther, "/checkout", ""},
+	{"percent off", " save10 ", http.StatusSeeOther, "/checkout", ""},
+	{"fixed off", "FLAT50", http.StatusSeeOther, "/checkout", ""},
+	{"unknown code", "NOPE", http.StatusOK, "", "This promo code is not valid"},
+	{"expired", "expired", http.StatusOK, "", "This promo code has expired"},
+	{"used up", "usedup", http.StatusOK, "", "This promo code has been used up"},
+	{"another room", "suite", http.StatusOK, "", "This promo code can&#39;t be used for the room you chose"},
+	{"used up while booking", "lastone", http.StatusSeeOther, "/make-reservation", ""},
+	{"database error", "broken", http.StatusSeeOther, "/", ""},
+}
+
+func TestRepository_PostReservation_PromoCode(t *testing.T) {
+	for _, e := range postReservationPromoTests {
+		reservation := models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		}
+
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("phone", "12345")
+		postedData.Add("email", "john@smith.com")
+		postedData.Add("promo_code", e.code)
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "reservation", reservation)
+
+		handler := http.HandlerFunc(Repo.PostReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+		if e.expectedMessage != "" && !strings.Contains(rr.Body.String(), e.expectedMessage) {
+			t.Errorf("failed %s: expected %q on the form", e.name, e.expectedMessage)
+		}
+		if e.expectedLocation != "/checkout" {
+			continue
+		}
+
+		res := session.Get(ctx, "reservation").(models.Reservation)
+		price := res.TotalAmount + res.DiscountAmount
+		switch e.code {
+		case "":
+			if res.PromoCodeID != 0 || res.DiscountAmount != 0 {
+				t.Errorf("failed %s: expected no discount but got %+v", e.name, res)
+			}
+		case "FLAT50":
+			if res.PromoCode != "FLAT50" || res.DiscountAmount != 5000 {
+				t.Errorf("failed %s: expected 5000 off but got %d", e.name, res.DiscountAmount)
+			}
+		default:
+			if res.PromoCode != "SAVE10" || res.DiscountAmount != price/10 {
+				t.Errorf("failed %s: expected 10%% of %d off but got %d", e.name, price, res.DiscountAmount)
+			}
+		}
+	}
+}
+
+func TestRepository_AdminPromoCodes(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/promo-codes", nil)
+	req = req.WithContext(GetCtx(req))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.AdminPromoCodes)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("AdminPromoCodes returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "SAVE10") || !strings.Contains(body, "1 of 1") {
+		t.Error("expected the codes with their redemptions")
+	}
+}
+
+func TestRepository_AdminShowPromoCode(t *testing.T) {
+	tests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/admin/promo-codes/new", http.StatusOK},
+		{"/admin/promo-codes/1", http.StatusOK},
+		{"/admin/promo-codes/5", http.StatusInternalServerError},
+		{"/admin/promo-codes/99", http.StatusInternalServerError},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req = req.WithContext(GetCtx(req))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminShowPromoCode)
+		if strings.HasSuffix(e.url, "/new") {
+			handler = Repo.AdminNewPromoCode
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected code %d but got %d", e.url, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func promoCodePostData() url.Values {
+	postedData := url.Values{}
+	postedData.Add("code", "summer-50")
+	postedData.Add("description", "Summer sale")
+	postedData.Add("kind", "fixed")
+	postedData.Add("amount", "50")
+	postedData.Add("currency", "usd")
+	postedData.Add("valid_from", "2050-01-01")
+	postedData.Add("valid_until", "2050-05-31")
+	postedData.Add("stay_from", "2050-06-01")
+	postedData.Add("stay_until", "2050-08-31")
+	postedData.Add("max_uses", "100")
+	postedData.Add("max_uses_per_guest", "")
+	postedData.Add("room_id", "1")
+	postedData.Add("active", "1")
+	return postedData
+}
+
+var postPromoCodeTests = []struct {
+	name           string
+	field          string
+	value          string
+	expectedStatus int
+}{
+	{"valid", "", "", http.StatusSeeOther},
+	{"missing code", "code", "", http.StatusOK},
+	{"bad code", "code", "summer sale", http.StatusOK},
+	{"code in use", "code", "usedup", http.StatusOK},
+	{"bad kind", "kind", "free", http.StatusOK},
+	{"bad amount", "amount", "lots", http.StatusOK},
+	{"bad currency", "currency", "dollars", http.StatusOK},
+	{"bad date", "valid_from", "soon", http.StatusOK},
+	{"ends before it starts", "valid_until", "2049-12-31", http.StatusOK},
+	{"stay ends before it starts", "stay_until", "2050-05-01", http.StatusOK},
+	{"bad limit", "max_uses", "-1", http.StatusOK},
+	{"database error", "code", "fail", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminPostPromoCode(t *testing.T) {
+	for _, path := range []string{"/admin/promo-codes/new", "/admin/promo-codes/1"} {
+		for _, e := range postPromoCodeTests {
+			postedData := promoCodePostData()
+			if e.field != "" {
+				postedData.Set(e.field, e.value)
+			}
+
+			req, _ := http.NewRequest("POST", path, strings.NewReader(postedData.Encode()))
+			req = req.WithContext(GetCtx(req))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.AdminPostShowPromoCode)
+			if strings.HasSuffix(path, "/new") {
+				handler = Repo.AdminPostNewPromoCode
+			}
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedStatus {
+				t.Errorf("%s %s: expected code %d but got %d", path, e.name, e.expectedStatus, rr.Code)
+			}
+		}
+	}
+
+	// a percentage can't be more than 100
+	postedData := promoCodePostData()
+	postedData.Set("kind", "percent")
+	postedData.Set("amount", "150")
+	req, _ := http.NewRequest("POST", "/admin/promo-codes/new", strings.NewReader(postedData.Encode()))
+	req = req.WithContext(GetCtx(req))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminPostNewPromoCode).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "at most 100%") {
+		t.Errorf("expected the form again with an error but got code %d", rr.Code)
+	}
+}
+
+func TestRepository_reapplyPromoCode(t *testing.T) {
+	tests := []struct {
+		name             string
+		promoCodeID      int
+		expectedDiscount int
+		expectedErr      bool
+	}{
+		{"no code", 0, 0, false},
+		{"still covered", 1, 2000, false},
+		{"code deleted", 99, 0, false},
+		{"database error", 5, 0, true},
+	}
+
+	for _, e := range tests {
+		res := models.Reservation{
+			RoomID:      1,
+			StartDate:   time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:     time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+			TotalAmount: 20000,
+			PromoCodeID: e.promoCodeID,
+		}
+		err := Repo.reapplyPromoCode(&res)
+		if (err != nil) != e.expectedErr {
+			t.Errorf("failed %s: unexpected error %v", e.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if res.DiscountAmount != e.expectedDiscount || res.TotalAmount != 20000-e.expectedDiscount {
+			t.Errorf("failed %s: expected %d off but got %d, leaving %d", e.name, e.expectedDiscount, res.DiscountAmount, res.TotalAmount)
+		}
+	}
+}
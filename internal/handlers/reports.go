@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/taxes"
+)
+
+// AdminTaxReport shows the taxes charged on the nights stayed in a month, this month unless
+// another is chosen, or downloads them as CSV for filing
+func (m *Repository) AdminTaxReport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	form := forms.New(query)
+
+	month := time.Now()
+	if query.Get("month") != "" {
+		t, err := time.Parse("2006-01", query.Get("month"))
+		if err != nil {
+			form.Errors.Add("month", "Enter a month like 2050-01")
+		} else {
+			month = t
+		}
+	}
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var report taxes.Report
+	if form.Valid() {
+		charges, err := m.DB.TaxChargesForMonth(month)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		report = taxes.MonthlyReport(month, charges)
+	}
+
+	if form.Valid() && query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "taxes-"+month.Format("2006-01")+".csv"))
+		err := taxes.WriteCSV(w, report)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["report"] = report
+
+	stringMap := make(map[string]string)
+	stringMap["month"] = month.Format("2006-01")
+	stringMap["month_name"] = month.Format("January 2006")
+	stringMap["previous"] = month.AddDate(0, -1, 0).Format("2006-01")
+	stringMap["next"] = month.AddDate(0, 1, 0).Format("2006-01")
+
+	render.Template(w, r, "admin-tax-report.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+func TestRepository_AdminTaxReport(t *testing.T) {
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"this month", "/admin/reports/taxes", http.StatusOK, "No taxes were charged"},
+		{"a month with taxes", "/admin/reports/taxes?month=2053-01", http.StatusOK, "$20.00"},
+		{"csv", "/admin/reports/taxes?month=2053-01&format=csv", http.StatusOK, "2053-01,Occupancy Tax,USD,2,200.00,20.00"},
+		{"bad month", "/admin/reports/taxes?month=soon&format=csv", http.StatusOK, "Enter a month like 2050-01"},
+		{"database error", "/admin/reports/taxes?month=2060-01", http.StatusInternalServerError, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req = req.WithContext(GetCtx(req))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminTaxReport)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("failed %s: expected %q in the response", e.name, e.expectedBody)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/reports/taxes?month=2053-01&format=csv", nil)
+	req = req.WithContext(GetCtx(req))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminTaxReport).ServeHTTP(rr, req)
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="taxes-2053-01.csv"` {
+		t.Errorf("expected a CSV download but got %q", cd)
+	}
+}
+
+func TestRepository_PostReservation_Charges(t *testing.T) {
+	tests := []struct {
+		name             string
+		year             int
+		expectedLocation string
+	}{
+		{"taxed", 2053, "/checkout"},
+		{"database error", 2054, "/"},
+	}
+
+	for _, e := range tests {
+		reservation := models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(e.year, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(e.year, 1, 3, 0, 0, 0, 0, time.UTC),
+			Adults:    2,
+		}
+
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("phone", "12345")
+		postedData.Add("email", "john@smith.com")
+		postedData.Add("promo_code", "save10")
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		session.Put(ctx, "reservation", reservation)
+
+		handler := http.HandlerFunc(Repo.PostReservation)
+		handler.ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+			continue
+		}
+		if e.expectedLocation != "/checkout" {
+			continue
+		}
+
+		// the tax is charged on the price after the discount, and the cleaning fee once
+		res := session.Get(ctx, "reservation").(models.Reservation)
+		price := 0
+		for _, n := range res.Nights {
+			price += n.Amount
+		}
+		afterDiscount := price - res.DiscountAmount
+		if len(res.Charges) != 2 {
+			t.Fatalf("failed %s: expected a tax and a fee but got %+v", e.name, res.Charges)
+		}
+		if res.Charges[0].Amount != afterDiscount/10 || res.Charges[1].Amount != 2500 {
+			t.Errorf("failed %s: unexpected charges %+v on %d", e.name, res.Charges, afterDiscount)
+		}
+		if res.TotalAmount != afterDiscount+afterDiscount/10+2500 {
+			t.Errorf("failed %s: expected the charges in the total but got %d", e.name, res.TotalAmount)
+		}
+	}
+}
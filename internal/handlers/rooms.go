@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/pricing"
+	"github.com/eador/bookings/internal/render"
+)
+
+// Rooms displays the list of rooms offered to guests
+func (m *Repository) Rooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.ActiveRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	render.Template(w, r, "rooms.page.html", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// Room displays a single room by its slug
+func (m *Repository) Room(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	slug := exploded[2]
+
+	room, err := m.DB.GetRoomBySlug(slug)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && room.Retired == 1) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	render.Template(w, r, "room.page.html", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRooms lists all rooms, including retired ones, for the admin
+func (m *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	render.Template(w, r, "admin-rooms.page.html", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewRoom displays the form for adding a room
+func (m *Repository) AdminNewRoom(w http.ResponseWriter, r *http.Request) {
+	policies, err := m.DB.AllCancellationPolicies()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = models.Room{Capacity: 2, MaxAdults: 2, MaxChildren: 0, Currency: "USD"}
+	data["cancellation_policies"] = policies
+	data["default_cancellation_policy"] = m.App.CancellationPolicy
+
+	stringMap := make(map[string]string)
+	stringMap["base_rate"] = ""
+	stringMap["photos"] = ""
+
+	render.Template(w, r, "admin-room.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      forms.New(nil),
+	})
+}
+
+// AdminPostNewRoom adds a room
+func (m *Repository) AdminPostNewRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var room models.Room
+	form := m.roomFromForm(r, &room)
+	if !form.Valid() {
+		m.renderRoomForm(w, r, room, form)
+		return
+	}
+
+	_, err = m.DB.InsertRoom(m.actor(r), room)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room added")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminShowRoom displays the form for editing a room
+func (m *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomById(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderRoomForm(w, r, room, forms.New(nil))
+}
+
+// AdminPostShowRoom saves changes to a room
+func (m *Repository) AdminPostShowRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomById(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := m.roomFromForm(r, &room)
+	if !form.Valid() {
+		m.renderRoomForm(w, r, room, form)
+		return
+	}
+
+	err = m.DB.UpdateRoom(m.actor(r), room)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminRetireRoom retires a room, or restores a retired room, so it is hidden from or shown to guests
+func (m *Repository) AdminRetireRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	retired := 1
+	msg := "Room retired"
+	if exploded[4] == "restore" {
+		retired = 0
+		msg = "Room restored"
+	}
+
+	err = m.DB.UpdateRetiredForRoom(m.actor(r), id, retired)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", msg)
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminMoveRoom moves a room one place up or down in the display order
+func (m *Repository) AdminMoveRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+	direction := exploded[5]
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var ids []int
+	pos := -1
+	for i, room := range rooms {
+		ids = append(ids, room.ID)
+		if room.ID == id {
+			pos = i
+		}
+	}
+
+	if pos >= 0 {
+		if direction == "up" && pos > 0 {
+			ids[pos], ids[pos-1] = ids[pos-1], ids[pos]
+		} else if direction == "down" && pos < len(ids)-1 {
+			ids[pos], ids[pos+1] = ids[pos+1], ids[pos]
+		}
+	}
+
+	err = m.DB.ReorderRooms(m.actor(r), ids)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// roomFromForm copies the posted room form into room and returns the validated form
+func (m *Repository) roomFromForm(r *http.Request, room *models.Room) *forms.Form {
+	form := forms.New(r.PostForm)
+	form.Required("room_name", "slug", "capacity", "max_adults", "max_children", "base_rate", "currency")
+	form.IsSlug("slug")
+	form.IsInt("capacity", 1)
+	form.IsInt("max_adults", 1)
+	form.IsInt("max_children", 0)
+
+	room.RoomName = strings.TrimSpace(r.Form.Get("room_name"))
+	room.Slug = strings.TrimSpace(r.Form.Get("slug"))
+	room.Description = strings.TrimSpace(r.Form.Get("description"))
+	room.Amenities = strings.TrimSpace(r.Form.Get("amenities"))
+	room.Currency = strings.ToUpper(strings.TrimSpace(r.Form.Get("currency")))
+	room.Capacity, _ = strconv.Atoi(strings.TrimSpace(r.Form.Get("capacity")))
+	room.MaxAdults, _ = strconv.Atoi(strings.TrimSpace(r.Form.Get("max_adults")))
+	room.MaxChildren, _ = strconv.Atoi(strings.TrimSpace(r.Form.Get("max_children")))
+	room.CancellationPolicyID, _ = strconv.Atoi(r.Form.Get("cancellation_policy_id"))
+
+	if form.Errors.Get("capacity") == "" && form.Errors.Get("max_adults") == "" && room.MaxAdults > room.Capacity {
+		form.Errors.Add("max_adults", "Can not be more than the room sleeps")
+	}
+
+	rate, err := pricing.ParseMoney(r.Form.Get("base_rate"))
+	if err != nil && form.Has("base_rate") {
+		form.Errors.Add("base_rate", "Enter a nightly rate such as 129 or 129.50")
+	}
+	room.BaseRate = rate
+
+	if len(room.Currency) != 3 {
+		form.Errors.Add("currency", "Use a three letter currency code such as USD")
+	}
+
+	if form.Errors.Get("slug") == "" {
+		existing, err := m.DB.GetRoomBySlug(room.Slug)
+		if err == nil && existing.ID != room.ID {
+			form.Errors.Add("slug", "This slug is already used by another room")
+		}
+	}
+
+	room.Photos = nil
+	for _, line := range strings.Split(r.Form.Get("photos"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		photo := models.RoomPhoto{URL: line}
+		if i := strings.Index(line, "|"); i >= 0 {
+			photo.URL = strings.TrimSpace(line[:i])
+			photo.Caption = strings.TrimSpace(line[i+1:])
+		}
+		room.Photos = append(room.Photos, photo)
+	}
+
+	return form
+}
+
+// renderRoomForm displays the room form for a new or existing room
+func (m *Repository) renderRoomForm(w http.ResponseWriter, r *http.Request, room models.Room, form *forms.Form) {
+	policies, err := m.DB.AllCancellationPolicies()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["cancellation_policies"] = policies
+	data["default_cancellation_policy"] = m.App.CancellationPolicy
+
+	var photos []string
+	for _, p := range room.Photos {
+		if p.Caption != "" {
+			photos = append(photos, fmt.Sprintf("%s | %s", p.URL, p.Caption))
+		} else {
+			photos = append(photos, p.URL)
+		}
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["base_rate"] = fmt.Sprintf("%d.%02d", room.BaseRate/100, room.BaseRate%100)
+	stringMap["photos"] = strings.Join(photos, "\n")
+	if room.ID > 0 {
+		stringMap["calendar_url"] = m.calendarFeedURL(room)
+	}
+
+	render.Template(w, r, "admin-room.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func roomPostData() url.Values {
+	postedData := url.Values{}
+	postedData.Add("room_name", "Colonel's Cabin")
+	postedData.Add("slug", "colonels-cabin")
+	postedData.Add("description", "A cosy cabin")
+	postedData.Add("capacity", "2")
+	postedData.Add("max_adults", "2")
+	postedData.Add("max_children", "1")
+	postedData.Add("base_rate", "149.50")
+	postedData.Add("currency", "usd")
+	postedData.Add("amenities", "Queen bed\nFireplace")
+	postedData.Add("photos", "/static/images/outside.png | Outside\n/static/images/tray.png")
+	return postedData
+}
+
+var postRoomTests = []struct {
+	name           string
+	field          string
+	value          string
+	expectedStatus int
+}{
+	{"valid", "", "", http.StatusSeeOther},
+	{"missing name", "room_name", "", http.StatusOK},
+	{"bad slug", "slug", "Colonel's Cabin", http.StatusOK},
+	{"slug in use", "slug", "majors-suite", http.StatusOK},
+	{"bad capacity", "capacity", "0", http.StatusOK},
+	{"missing max adults", "max_adults", "", http.StatusOK},
+	{"more adults than the room sleeps", "max_adults", "3", http.StatusOK},
+	{"bad max children", "max_children", "-1", http.StatusOK},
+	{"bad rate", "base_rate", "lots", http.StatusOK},
+	{"bad currency", "currency", "dollars", http.StatusOK},
+	{"database error", "room_name", "Broken Room", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminPostNewRoom(t *testing.T) {
+	for _, e := range postRoomTests {
+		postedData := roomPostData()
+		if e.field != "" {
+			postedData.Set(e.field, e.value)
+		}
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/new", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostNewRoom)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostShowRoom(t *testing.T) {
+	for _, e := range postRoomTests {
+		postedData := roomPostData()
+		if e.field != "" {
+			postedData.Set(e.field, e.value)
+		}
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/1", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowRoom)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+var roomActionTests = []struct {
+	name string
+	url  string
+	move bool
+}{
+	{"retire", "/admin/rooms/1/retire/do", false},
+	{"restore", "/admin/rooms/1/restore/do", false},
+	{"move up", "/admin/rooms/2/move/up/do", true},
+	{"move down", "/admin/rooms/1/move/down/do", true},
+	{"bad id", "/admin/rooms/fish/retire/do", false},
+}
+
+func TestRepository_AdminRoomActions(t *testing.T) {
+	for _, e := range roomActionTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminRetireRoom)
+		if e.move {
+			handler = http.HandlerFunc(Repo.AdminMoveRoom)
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != "/admin/rooms" {
+			t.Errorf("failed %s: expected location /admin/rooms but got %s", e.name, actualLoc.String())
+		}
+	}
+}
@@ -12,10 +12,20 @@ import (
 	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/eador/bookings/internal/access"
+	"github.com/eador/bookings/internal/cancellation"
 	"github.com/eador/bookings/internal/config"
+	"github.com/eador/bookings/internal/emails"
 	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/lockout"
 	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/pricing"
 	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/status"
+	"github.com/eador/bookings/internal/taxes"
+	"github.com/eador/bookings/internal/tokens"
+	"github.com/eador/bookings/internal/waitlist"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
@@ -26,10 +36,15 @@ var session *scs.SessionManager
 var pathToTemplates = "./../../templates"
 
 var functions = template.FuncMap{
-	"humanDate":  render.HumanDate,
-	"formatDate": render.FormatDate,
-	"iterate":    render.Iterate,
-	"add":        render.Add,
+	"humanDate":         render.HumanDate,
+	"formatDate":        render.FormatDate,
+	"iterate":           render.Iterate,
+	"add":               render.Add,
+	"money":             pricing.FormatMoney,
+	"statusName":        status.Name,
+	"upcoming":          status.Upcoming,
+	"rate":              taxes.FormatRate,
+	"cancellationTerms": cancellation.Describe,
 }
 
 func TestMain(m *testing.M) {
@@ -53,10 +68,8 @@ func TestMain(m *testing.M) {
 	session.Cookie.Secure = app.InProduction
 	app.Session = session
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-	defer close(mailChan)
-	listenForMail()
+	app.MailNotify = make(chan struct{}, 1)
+	app.AdminEmail = "admin@here.com"
 
 	tc, err := CreateTestTemplateCache()
 	if err != nil {
@@ -64,23 +77,47 @@ func TestMain(m *testing.M) {
 	}
 
 	app.TemplateCache = tc
+
+	et, err := emails.New("./../../email-templates")
+	if err != nil {
+		log.Fatal("cannot parse email templates: ", err)
+	}
+	app.EmailTemplates = et
+	app.Tokens = tokens.New([]byte("secret"))
+	app.LoginPolicy = lockout.DefaultPolicy()
+	app.LoginPolicy.BaseDelay = 0
+	app.TrashRetention = 30 * 24 * time.Hour
+	app.DepositPercent = 20
+	app.CheckoutHold = 30 * time.Minute
+	app.CancellationPolicy = cancellation.Default(7)
+	resetPayments()
 	app.UseCache = true
 
+	app.BaseURL = "http://localhost:8080"
+
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
+	app.Waitlist = waitlist.New(repo.DB, 24*time.Hour, repo.SendWaitlistOffer, infoLog, errorLog)
 	render.NewRenderer(&app)
 	helpers.NewHelpers(&app)
 
 	os.Exit(m.Run())
 }
 
-func listenForMail() {
-	go func() {
-		for {
-			_ = <-app.MailChan
-		}
-	}()
+// resetPayments gives the app a fake payment provider holding the payment the test repo
+// records against its paid reservations, pay_000001 for $200.00
+func resetPayments() {
+	fake := payments.NewFake("secret")
+	ref, err := fake.Authorize(20000, "USD", payments.CardOK, "")
+	if err == nil {
+		err = fake.Capture(ref, 20000)
+	}
+	if err != nil {
+		log.Fatal("cannot set up payments: ", err)
+	}
+	app.Payments = fake
 }
+
 func getRoutes() http.Handler {
 	mux := chi.NewRouter()
 
@@ -89,34 +126,104 @@ func getRoutes() http.Handler {
 
 	mux.Get("/", Repo.Home)
 	mux.Get("/about", Repo.About)
-	mux.Get("/generals-quarters", Repo.Generals)
-	mux.Get("/majors-suite", Repo.Majors)
+	mux.Get("/rooms", Repo.Rooms)
+	mux.Get("/rooms/{slug}", Repo.Room)
+	mux.Get("/rooms/{slug}/calendar.ics", Repo.RoomCalendar)
 
 	mux.Get("/make-reservation", Repo.Reservation)
 	mux.Post("/make-reservation", Repo.PostReservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
+	mux.Get("/checkout", Repo.Checkout)
+	mux.Post("/checkout", Repo.PostCheckout)
+	mux.Post("/payments/webhook", Repo.PaymentWebhook)
 
 	mux.Get("/search-availability", Repo.Availability)
 	mux.Post("/search-availability", Repo.PostAvailability)
 	mux.Post("/search-availability-json", Repo.AvailabilityJSON)
 	mux.Get("/choose-room/{id}", Repo.ChooseRoom)
+	mux.Post("/choose-rooms", Repo.PostChooseRooms)
 	mux.Get("/book-room", Repo.BookRoom)
+	mux.Get("/waitlist", Repo.Waitlist)
+	mux.Post("/waitlist", Repo.PostWaitlist)
+	mux.Get("/waitlist/book", Repo.WaitlistBook)
+
+	mux.Get("/find-reservation", Repo.FindReservation)
+	mux.Post("/find-reservation", Repo.PostFindReservation)
+	mux.Get("/manage-reservation", Repo.ManageReservation)
+	mux.Post("/manage-reservation/change-dates", Repo.PostChangeReservationDates)
+	mux.Post("/manage-reservation/cancel", Repo.PostCancelReservation)
+	mux.Post("/manage-reservation/cancel-room", Repo.PostCancelReservationRoom)
 
 	mux.Get("/contact", Repo.Contact)
 
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
 	mux.Get("/user/logout", Repo.Logout)
+	mux.Get("/user/forgot-password", Repo.ForgotPassword)
+	mux.Post("/user/forgot-password", Repo.PostForgotPassword)
+	mux.Get("/user/set-password", Repo.SetPassword)
+	mux.Post("/user/set-password", Repo.PostSetPassword)
+	mux.Get("/user/two-factor", Repo.TwoFactor)
+	mux.Post("/user/two-factor", Repo.PostTwoFactor)
 
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
 	mux.Get("/admin/reservations-new", Repo.AdminNewReservations)
 	mux.Get("/admin/reservations-all", Repo.AdminAllReservations)
 	mux.Get("/admin/reservations-calendar", Repo.AdminReservationsCalender)
 	mux.Post("/admin/reservations-calendar", Repo.AdminPostReservationsCalender)
-	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
+	mux.Get("/admin/reservations/{src}/{id}/status/{status}/do", Repo.AdminReservationStatus)
+	mux.Get("/admin/reservations/{src}/{id}/cancel-group/do", Repo.AdminCancelReservationGroup)
 	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
+	mux.Get("/admin/trash", Repo.AdminTrash)
+	mux.Get("/admin/trash/{id}/restore/do", Repo.AdminRestoreReservation)
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
+	mux.Get("/admin/rooms", Repo.AdminRooms)
+	mux.Get("/admin/rooms/new", Repo.AdminNewRoom)
+	mux.Post("/admin/rooms/new", Repo.AdminPostNewRoom)
+	mux.Get("/admin/rooms/{id}", Repo.AdminShowRoom)
+	mux.Post("/admin/rooms/{id}", Repo.AdminPostShowRoom)
+	mux.Get("/admin/rooms/{id}/retire/do", Repo.AdminRetireRoom)
+	mux.Get("/admin/rooms/{id}/restore/do", Repo.AdminRetireRoom)
+	mux.Get("/admin/rooms/{id}/move/{direction}/do", Repo.AdminMoveRoom)
+	mux.Post("/admin/rooms/{id}/calendar-import", Repo.AdminImportRoomCalendar)
+	mux.Get("/admin/promo-codes", Repo.AdminPromoCodes)
+	mux.Get("/admin/promo-codes/new", Repo.AdminNewPromoCode)
+	mux.Post("/admin/promo-codes/new", Repo.AdminPostNewPromoCode)
+	mux.Get("/admin/promo-codes/{id}", Repo.AdminShowPromoCode)
+	mux.Post("/admin/promo-codes/{id}", Repo.AdminPostShowPromoCode)
+	mux.Get("/admin/guests", Repo.AdminGuests)
+	mux.Get("/admin/guests/{id}", Repo.AdminShowGuest)
+	mux.Post("/admin/guests/{id}", Repo.AdminPostShowGuest)
+	mux.Post("/admin/guests/{id}/merge", Repo.AdminMergeGuest)
+	mux.Get("/admin/mail-failed", Repo.AdminFailedMail)
+	mux.Get("/admin/mail/{id}/resend/do", Repo.AdminResendMail)
+	mux.Get("/admin/email-templates", Repo.AdminEmailTemplates)
+	mux.Get("/admin/email-templates/{name}", Repo.AdminEmailTemplate)
+	mux.Get("/admin/audit", Repo.AdminAuditLog)
+	mux.Get("/admin/reports/taxes", Repo.AdminTaxReport)
+	mux.Get("/admin/two-factor", Repo.AdminTwoFactor)
+	mux.Post("/admin/two-factor/enable", Repo.AdminEnableTwoFactor)
+	mux.Post("/admin/two-factor/disable", Repo.AdminDisableTwoFactor)
+	mux.Post("/admin/two-factor/recovery-codes", Repo.AdminRecoveryCodes)
+	mux.Get("/admin/users", Repo.AdminUsers)
+	mux.Get("/admin/users/new", Repo.AdminNewUser)
+	mux.Post("/admin/users/new", Repo.AdminPostNewUser)
+	mux.Post("/admin/users/two-factor", Repo.AdminPostRequireTwoFactor)
+	mux.Post("/admin/users/{id}/role", Repo.AdminPostUserRole)
+	mux.Get("/admin/users/{id}/invite/do", Repo.AdminInviteUser)
+	mux.Get("/admin/users/{id}/deactivate/do", Repo.AdminActivateUser)
+	mux.Get("/admin/users/{id}/activate/do", Repo.AdminActivateUser)
+	mux.Get("/admin/users/{id}/unlock/do", Repo.AdminUnlockUser)
+
+	mux.Get("/api/v1/openapi.json", Repo.APIOpenAPI)
+	mux.Get("/api/v1/rooms", Repo.APIRooms)
+	mux.Get("/api/v1/rooms/{id}/availability", Repo.APIRoomAvailability)
+	mux.Get("/api/v1/availability", Repo.APIAvailability)
+	mux.Post("/api/v1/reservations", Repo.APICreateReservation)
+	mux.Get("/api/v1/reservations/{code}", Repo.APIGetReservation)
+	mux.Post("/api/v1/reservations/{code}/cancel", Repo.APICancelReservation)
+	mux.With(Repo.RequireAPIPermission(access.ViewReservations)).Get("/api/v1/admin/reservations", Repo.APIAdminReservations)
 
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/repository"
+)
+
+// AdminTrash lists the deleted reservations that can still be restored
+func (m *Repository) AdminTrash(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.DeletedReservations()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	intMap := make(map[string]int)
+	intMap["retention_days"] = int(m.App.TrashRetention.Hours() / 24)
+
+	render.Template(w, r, "admin-trash.page.html", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminRestoreReservation takes a reservation out of the trash, if its dates are still free
+func (m *Repository) AdminRestoreReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.RestoreReservation(m.actor(r), id)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "The room has been booked or blocked for those dates since, so the reservation can't be restored")
+		http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation restored")
+	http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRepository_AdminTrash(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/trash", nil)
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.AdminTrash)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected code %d but got %d", http.StatusOK, rr.Code)
+	}
+	html := rr.Body.String()
+	for _, want := range []string{"Trashed", "30 days"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected html %q", want)
+		}
+	}
+}
+
+var restoreReservationTests = []struct {
+	name           string
+	url            string
+	expectedStatus int
+	expectedKey    string
+}{
+	{"restored", "/admin/trash/1/restore/do", http.StatusSeeOther, "flash"},
+	{"dates taken", "/admin/trash/3/restore/do", http.StatusSeeOther, "error"},
+	{"bad id", "/admin/trash/x/restore/do", http.StatusSeeOther, "error"},
+	{"database error", "/admin/trash/2/restore/do", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_AdminRestoreReservation(t *testing.T) {
+	for _, e := range restoreReservationTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminRestoreReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedKey != "" && session.GetString(ctx, e.expectedKey) == "" {
+			t.Errorf("failed %s: expected a %s message", e.name, e.expectedKey)
+		}
+	}
+}
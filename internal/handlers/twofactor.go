@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/lockout"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/tokens"
+	"github.com/eador/bookings/internal/totp"
+)
+
+// requireTwoFactorSetting is the site setting that, when "1", makes every admin use two-factor login
+const requireTwoFactorSetting = "require_two_factor"
+
+// twoFactorIssuer names the site in authenticator apps
+const twoFactorIssuer = "Bookings"
+
+// recoveryCodeCount is how many recovery codes a user is given at a time
+const recoveryCodeCount = 10
+
+// twoFactorTimeout is how long a user has to give their code after their password
+const twoFactorTimeout = 5 * time.Minute
+
+// TwoFactor displays the form for the second step of logging in
+func (m *Repository) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !m.App.Session.Exists(r.Context(), "two_factor_user_id") {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	render.Template(w, r, "two-factor.page.html", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostTwoFactor checks the code or recovery code given after a password, and logs the user in
+func (m *Repository) PostTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := m.App.Session.GetInt(r.Context(), "two_factor_user_id")
+	started := m.App.Session.GetTime(r.Context(), "two_factor_started")
+	now := time.Now()
+	if id == 0 || now.Sub(started) > twoFactorTimeout {
+		m.clearTwoFactor(r)
+		m.App.Session.Put(r.Context(), "error", "Log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	attempt := models.LoginAttempt{Email: user.Email, IPAddress: helpers.ClientIP(r), UserID: user.ID}
+	if user.Locked(now) {
+		m.clearTwoFactor(r)
+		m.recordLoginAttempt(attempt, lockout.AccountLocked)
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	ok, recovery, err := m.checkSecondFactor(user, r.Form.Get("code"), now)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !ok {
+		m.recordLoginAttempt(attempt, lockout.BadSecondFactor)
+		err = m.countFailedLogin(user, 0, now)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.App.Session.Put(r.Context(), "error", "That code is not right")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.clearTwoFactor(r)
+	m.recordLoginAttempt(attempt, lockout.Succeeded)
+
+	if recovery {
+		left, err := m.DB.CountRecoveryCodes(user.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.App.Session.Put(r.Context(), "warning", recoveryCodesLeftMessage(left))
+	}
+	m.logIn(w, r, user)
+}
+
+// AdminTwoFactor shows the logged in user's two-factor login, or sets it up if it is off
+func (m *Repository) AdminTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	stringMap := make(map[string]string)
+	intMap := make(map[string]int)
+
+	if user.TOTPEnabled == 1 {
+		left, err := m.DB.CountRecoveryCodes(user.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		intMap["recovery_codes"] = left
+	} else {
+		// the secret is kept in the session until a code from it proves the app is set up
+		secret := m.App.Session.GetString(r.Context(), "two_factor_secret")
+		if secret == "" {
+			secret, err = totp.NewSecret()
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			m.App.Session.Put(r.Context(), "two_factor_secret", secret)
+		}
+		stringMap["secret"] = secret
+		stringMap["uri"] = totp.ProvisioningURI(twoFactorIssuer, user.Email, secret)
+	}
+
+	required, err := m.twoFactorRequired()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data["user"] = user
+	data["required"] = required
+
+	render.Template(w, r, "admin-two-factor.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+		Form:      forms.New(nil),
+	})
+}
+
+// AdminEnableTwoFactor turns on two-factor login once the user gives a code from their app,
+// and shows them their recovery codes
+func (m *Repository) AdminEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id := m.App.Session.GetInt(r.Context(), "user_id")
+	secret := m.App.Session.GetString(r.Context(), "two_factor_secret")
+	if secret == "" {
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	counter, ok := totp.Validate(secret, r.Form.Get("code"), time.Now())
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "That code is not right, check the time on your device and try again")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.EnableTOTP(id, secret, hashes)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.UseTOTPCounter(id, counter)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Remove(r.Context(), "two_factor_secret")
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor login is on")
+	m.renderRecoveryCodes(w, r, codes)
+}
+
+// AdminDisableTwoFactor turns off two-factor login, if the user gives a current code and it is not required
+func (m *Repository) AdminDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.confirmSecondFactor(w, r)
+	if !ok {
+		return
+	}
+
+	required, err := m.twoFactorRequired()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if required {
+		m.App.Session.Put(r.Context(), "error", "Two-factor login is required for every admin")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DisableTOTP(user.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor login is off")
+	http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+}
+
+// AdminRecoveryCodes replaces the user's recovery codes, if they give a current code, and shows the new ones
+func (m *Repository) AdminRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.confirmSecondFactor(w, r)
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.ReplaceRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "New recovery codes made, the old ones no longer work")
+	m.renderRecoveryCodes(w, r, codes)
+}
+
+// AdminPostRequireTwoFactor sets whether every admin must use two-factor login
+func (m *Repository) AdminPostRequireTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	value, msg := "0", "Two-factor login is optional"
+	if r.Form.Get("require_two_factor") == "1" {
+		value, msg = "1", "Two-factor login is required for every admin"
+	}
+
+	err = m.DB.UpdateSetting(m.actor(r), requireTwoFactorSetting, value)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", msg)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// confirmSecondFactor checks the code posted with a change to the logged in user's two-factor
+// login. If it is wrong it redirects and reports false.
+func (m *Repository) confirmSecondFactor(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.User{}, false
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return user, false
+	}
+
+	ok, _, err := m.checkSecondFactor(user, r.Form.Get("code"), time.Now())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return user, false
+	}
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "That code is not right")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return user, false
+	}
+	return user, true
+}
+
+// checkSecondFactor reports whether code is a current code from user's app that has not been
+// used before, or one of their unused recovery codes, which is then used up, and which it was
+func (m *Repository) checkSecondFactor(user models.User, code string, now time.Time) (ok, recovery bool, err error) {
+	if user.TOTPEnabled == 0 {
+		return false, false, nil
+	}
+
+	if counter, valid := totp.Validate(user.TOTPSecret, code, now); valid {
+		err = m.DB.UseTOTPCounter(user.ID, counter)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, false, nil
+		}
+		return err == nil, false, err
+	}
+
+	err = m.DB.UseRecoveryCode(user.ID, tokens.Hash(totp.NormalizeRecoveryCode(code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	return err == nil, true, err
+}
+
+// twoFactorRequired reports whether an owner has made two-factor login compulsory
+func (m *Repository) twoFactorRequired() (bool, error) {
+	value, err := m.DB.GetSetting(requireTwoFactorSetting)
+	return value == "1", err
+}
+
+// clearTwoFactor forgets a half finished login
+func (m *Repository) clearTwoFactor(r *http.Request) {
+	m.App.Session.Remove(r.Context(), "two_factor_user_id")
+	m.App.Session.Remove(r.Context(), "two_factor_started")
+}
+
+// renderRecoveryCodes shows a user their new recovery codes, the only time they are shown
+func (m *Repository) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	data := make(map[string]interface{})
+	data["codes"] = codes
+
+	render.Template(w, r, "admin-recovery-codes.page.html", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// newRecoveryCodes returns a new set of recovery codes and the hashes to store for them
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := totp.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = tokens.Hash(c)
+	}
+	return codes, hashes, nil
+}
+
+// recoveryCodesLeftMessage warns a user who logged in with a recovery code how many they have left
+func recoveryCodesLeftMessage(left int) string {
+	switch left {
+	case 0:
+		return "That was your last recovery code, make new ones now"
+	case 1:
+		return "You have 1 recovery code left"
+	default:
+		return fmt.Sprintf("You have %d recovery codes left", left)
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/access"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/repository/dbrepo"
+	"github.com/eador/bookings/internal/totp"
+)
+
+// currentCode returns the code an authenticator app would show for secret right now
+func currentCode(secret string) string {
+	code, _ := totp.Code(secret, totp.Counter(time.Now()))
+	return code
+}
+
+func TestLogin_TwoFactor(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("email", "desk@here.com")
+	postedData.Add("password", "secret")
+
+	req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postedData.Encode()))
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.PostShowLogin)
+	handler.ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "/user/two-factor" {
+		t.Errorf("expected redirect to /user/two-factor but got %q", loc)
+	}
+	if session.GetInt(ctx, "user_id") != 0 {
+		t.Error("user is logged in before giving their second factor")
+	}
+	if session.GetInt(ctx, "two_factor_user_id") != 2 {
+		t.Error("pending two-factor login not put in session")
+	}
+}
+
+var postTwoFactorTests = []struct {
+	name             string
+	code             string
+	started          time.Duration
+	pending          bool
+	expectedLocation string
+	loggedIn         bool
+}{
+	{"valid code", currentCode(dbrepo.TestTOTPSecret), 0, true, "/", true},
+	{"recovery code", strings.ToUpper(dbrepo.TestRecoveryCode), 0, true, "/", true},
+	{"wrong code", "000000", 0, true, "/user/two-factor", false},
+	{"too slow", currentCode(dbrepo.TestTOTPSecret), -10 * time.Minute, true, "/user/login", false},
+	{"no password", currentCode(dbrepo.TestTOTPSecret), 0, false, "/user/login", false},
+}
+
+func TestRepository_PostTwoFactor(t *testing.T) {
+	for _, e := range postTwoFactorTests {
+		postedData := url.Values{}
+		postedData.Add("code", e.code)
+
+		req, _ := http.NewRequest("POST", "/user/two-factor", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if e.pending {
+			session.Put(ctx, "two_factor_user_id", 2)
+			session.Put(ctx, "two_factor_started", time.Now().Add(e.started))
+		}
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostTwoFactor)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+		if loggedIn := session.GetInt(ctx, "user_id") == 2; loggedIn != e.loggedIn {
+			t.Errorf("failed %s: expected logged in to be %t", e.name, e.loggedIn)
+		}
+	}
+}
+
+func TestRepository_AdminTwoFactor(t *testing.T) {
+	tests := []struct {
+		name         string
+		userID       int
+		expectedHTML string
+	}{
+		{"not set up", 1, "otpauth://totp/"},
+		{"set up", 2, "8 unused recovery codes"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/two-factor", nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", e.userID)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminTwoFactor)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, http.StatusOK, rr.Code)
+		}
+		if html := rr.Body.String(); !strings.Contains(html, e.expectedHTML) {
+			t.Errorf("failed %s: expected html %q", e.name, e.expectedHTML)
+		}
+	}
+}
+
+func TestRepository_AdminEnableTwoFactor(t *testing.T) {
+	secret, _ := totp.NewSecret()
+
+	tests := []struct {
+		name             string
+		code             string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"valid code", currentCode(secret), http.StatusOK, ""},
+		{"wrong code", "000000", http.StatusSeeOther, "/admin/two-factor"},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("code", e.code)
+
+		req, _ := http.NewRequest("POST", "/admin/two-factor/enable", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "user_id", 1)
+		session.Put(ctx, "two_factor_secret", secret)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminEnableTwoFactor)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+func TestRepository_RequirePermission_TwoFactorRequired(t *testing.T) {
+	_ = Repo.DB.UpdateSetting(models.Actor{}, requireTwoFactorSetting, "1")
+	defer Repo.DB.UpdateSetting(models.Actor{}, requireTwoFactorSetting, "0")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name             string
+		url              string
+		userID           int
+		expectedLocation string
+	}{
+		{"not set up", "/admin/dashboard", 1, "/admin/two-factor"},
+		{"setting up", "/admin/two-factor", 1, ""},
+		{"set up", "/admin/dashboard", 2, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", e.userID)
+		rr := httptest.NewRecorder()
+
+		handler := Repo.RequirePermission(access.ViewReservations)(next)
+		handler.ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/access"
+	"github.com/eador/bookings/internal/emails"
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/tokens"
+)
+
+// How long invite and password reset links work for
+const (
+	inviteValidFor = 7 * 24 * time.Hour
+	resetValidFor  = time.Hour
+)
+
+// minPasswordLength is the shortest password a user may choose
+const minPasswordLength = 8
+
+// accessCheck is the outcome of checking the user logged in to a request against a permission
+type accessCheck int
+
+const (
+	accessGranted accessCheck = iota
+	accessLoggedOut
+	// accessRevoked means the user has been deleted or deactivated, and their session destroyed
+	accessRevoked
+	// accessNeedsTwoFactor means the user must set up two-factor login before going on
+	accessNeedsTwoFactor
+	accessDenied
+)
+
+// checkAccess works out whether the user logged in to r has permission p. The session of a
+// deleted or deactivated user is destroyed.
+func (m *Repository) checkAccess(r *http.Request, p access.Permission) (accessCheck, error) {
+	id := m.App.Session.GetInt(r.Context(), "user_id")
+	if id == 0 {
+		return accessLoggedOut, nil
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user.Active == 0) {
+		_ = m.App.Session.Destroy(r.Context())
+		return accessRevoked, nil
+	}
+	if err != nil {
+		return accessDenied, err
+	}
+	m.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
+
+	if user.TOTPEnabled == 0 && !strings.HasPrefix(r.URL.Path, "/admin/two-factor") {
+		required, err := m.twoFactorRequired()
+		if err != nil {
+			return accessDenied, err
+		}
+		if required {
+			return accessNeedsTwoFactor, nil
+		}
+	}
+
+	if !access.Can(user.AccessLevel, p) {
+		m.App.InfoLog.Printf("user %d (%s) denied %s %s", user.ID, access.RoleName(user.AccessLevel), r.Method, r.URL.Path)
+		return accessDenied, nil
+	}
+	return accessGranted, nil
+}
+
+// RequirePermission returns middleware that only lets a logged in user with permission p through.
+// The user's role is read from the database on each request, so a change of role applies straight away.
+func (m *Repository) RequirePermission(p access.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			check, err := m.checkAccess(r, p)
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+
+			switch check {
+			case accessLoggedOut:
+				m.App.Session.Put(r.Context(), "error", "Log in first!")
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			case accessRevoked:
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			case accessNeedsTwoFactor:
+				m.App.Session.Put(r.Context(), "warning", "Set up two-factor login to continue")
+				http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+			case accessDenied:
+				m.App.Session.Put(r.Context(), "error", "You do not have permission to do that")
+				http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// AdminUsers lists the users and their roles
+func (m *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := m.DB.AllUsers()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	required, err := m.twoFactorRequired()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["users"] = users
+	data["roles"] = access.Roles()
+	data["two_factor_required"] = required
+
+	intMap := make(map[string]int)
+	intMap["user_id"] = m.App.Session.GetInt(r.Context(), "user_id")
+
+	render.Template(w, r, "admin-users.page.html", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminPostUserRole assigns a role to a user
+func (m *Repository) AdminPostUserRole(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	accessLevel, err := strconv.Atoi(r.Form.Get("access_level"))
+	if err != nil || !access.ValidRole(accessLevel) {
+		m.App.Session.Put(r.Context(), "error", "Choose a valid role")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	// an owner demoting themselves could leave nobody able to manage users
+	if id == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "You can't change your own role")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.UpdateUserAccessLevel(m.actor(r), id, accessLevel)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "User not found")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Role changed to "+access.RoleName(accessLevel))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminNewUser displays the form for adding a user
+func (m *Repository) AdminNewUser(w http.ResponseWriter, r *http.Request) {
+	m.renderUserForm(w, r, models.User{AccessLevel: access.ReadOnly}, forms.New(nil))
+}
+
+// AdminPostNewUser adds a user and emails them an invite to choose their password
+func (m *Repository) AdminPostNewUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	accessLevel, _ := strconv.Atoi(r.Form.Get("access_level"))
+	user := models.User{
+		FirstName:   strings.TrimSpace(r.Form.Get("first_name")),
+		LastName:    strings.TrimSpace(r.Form.Get("last_name")),
+		Email:       strings.TrimSpace(r.Form.Get("email")),
+		AccessLevel: accessLevel,
+		Active:      1,
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	if !access.ValidRole(accessLevel) {
+		form.Errors.Add("access_level", "Choose a valid role")
+	}
+	if form.Valid() {
+		_, err := m.DB.GetUserByEmail(user.Email)
+		if err == nil {
+			form.Errors.Add("email", "There is already a user with this email address")
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+	if !form.Valid() {
+		m.renderUserForm(w, r, user, form)
+		return
+	}
+
+	user.ID, err = m.DB.InsertUser(m.actor(r), user)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.sendUserToken(user, tokens.Invite)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User added and invited by email")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminInviteUser sends a user a new invite, e.g. when the first one expired
+func (m *Repository) AdminInviteUser(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "User not found")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.sendUserToken(user, tokens.Invite)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Invite sent to "+user.Email)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminActivateUser deactivates a user, so they can no longer log in, or activates them again
+func (m *Repository) AdminActivateUser(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	active := 0
+	msg := "User deactivated"
+	if exploded[4] == "activate" {
+		active = 1
+		msg = "User activated"
+	}
+
+	if active == 0 && id == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "You can't deactivate yourself")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.UpdateUserActive(m.actor(r), id, active)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "User not found")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", msg)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminUnlockUser lets a locked out user try logging in again straight away
+func (m *Repository) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url param")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.UnlockUser(m.actor(r), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "User not found")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User unlocked")
+	http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+}
+
+// ForgotPassword displays the form for asking for a password reset link
+func (m *Repository) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "forgot-password.page.html", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostForgotPassword emails a password reset link. It says the same thing whether or not the
+// address belongs to a user, so the form can't be used to find out who has an account.
+func (m *Repository) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "forgot-password.page.html", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	user, err := m.DB.GetUserByEmail(r.Form.Get("email"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServerError(w, err)
+		return
+	}
+	if err == nil && user.Active == 1 {
+		err = m.sendUserToken(user, tokens.PasswordReset)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "If that address belongs to an account, we've sent it a link to reset the password")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// SetPassword displays the form for choosing a password, reached from an invite or reset link
+func (m *Repository) SetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if _, err := m.App.Tokens.Verify(token, time.Now()); err != nil {
+		m.App.Session.Put(r.Context(), "error", badLinkMessage(err))
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	m.renderSetPassword(w, r, token, forms.New(nil))
+}
+
+// PostSetPassword sets a user's password from an invite or reset link, which then stops working
+func (m *Repository) PostSetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	token := r.Form.Get("token")
+	claims, err := m.App.Tokens.Verify(token, time.Now())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", badLinkMessage(err))
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("password", "confirm_password")
+	form.MinLength("password", minPasswordLength)
+	if r.Form.Get("password") != r.Form.Get("confirm_password") {
+		form.Errors.Add("confirm_password", "Passwords don't match")
+	}
+	if !form.Valid() {
+		m.renderSetPassword(w, r, token, form)
+		return
+	}
+
+	userID, err := m.DB.UseUserToken(tokens.Hash(token), claims.Purpose)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && userID != claims.UserID) {
+		m.App.Session.Put(r.Context(), "error", "This link has already been used")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.UpdatePassword(userID, r.Form.Get("password"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Password saved, you can log in now")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// renderUserForm displays the form for adding a user
+func (m *Repository) renderUserForm(w http.ResponseWriter, r *http.Request, user models.User, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["roles"] = access.Roles()
+
+	render.Template(w, r, "admin-user.page.html", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// renderSetPassword displays the form for choosing a password
+func (m *Repository) renderSetPassword(w http.ResponseWriter, r *http.Request, token string, form *forms.Form) {
+	stringMap := make(map[string]string)
+	stringMap["token"] = token
+
+	render.Template(w, r, "set-password.page.html", &models.TemplateData{
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// sendUserToken records a new invite or reset token for user and emails them a link with it
+func (m *Repository) sendUserToken(user models.User, purpose string) error {
+	validFor := resetValidFor
+	if purpose == tokens.Invite {
+		validFor = inviteValidFor
+	}
+	expires := time.Now().Add(validFor)
+
+	token, err := m.App.Tokens.Sign(tokens.Claims{UserID: user.ID, Purpose: purpose, Expires: expires})
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertUserToken(models.UserToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: tokens.Hash(token),
+		ExpiresAt: expires,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := m.siteURL("/user/set-password?token=" + url.QueryEscape(token))
+	if purpose == tokens.Invite {
+		m.queueTemplatedMail(user.Email, emails.UserInviteName, emails.UserInvite{User: user, Link: link, ValidFor: "7 days"})
+		return nil
+	}
+	m.queueTemplatedMail(user.Email, emails.PasswordResetName, emails.PasswordReset{User: user, Link: link, ValidFor: "1 hour"})
+	return nil
+}
+
+// badLinkMessage explains why an invite or reset link was refused
+func badLinkMessage(err error) string {
+	if errors.Is(err, tokens.ErrExpired) {
+		return "This link has expired, ask for a new one"
+	}
+	return "This link is not valid"
+}
+
+// siteURL returns the full address of path on this site, for links in emails and feeds. It is
+// built from the configured base URL and never from the request, whose Host header the client
+// controls.
+func (m *Repository) siteURL(path string) string {
+	return strings.TrimSuffix(m.App.BaseURL, "/") + path
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/access"
+	"github.com/eador/bookings/internal/tokens"
+)
+
+var requirePermissionTests = []struct {
+	name             string
+	userID           int
+	permission       access.Permission
+	expectedStatus   int
+	expectedLocation string
+}{
+	{"owner deletes", 1, access.DeleteReservations, http.StatusOK, ""},
+	{"front desk edits calendar", 2, access.EditCalendar, http.StatusOK, ""},
+	{"front desk deletes", 2, access.DeleteReservations, http.StatusSeeOther, "/admin/dashboard"},
+	{"read only edits calendar", 3, access.EditCalendar, http.StatusSeeOther, "/admin/dashboard"},
+	{"not logged in", 0, access.ViewReservations, http.StatusSeeOther, "/user/login"},
+	{"unknown user", 99, access.ViewReservations, http.StatusSeeOther, "/user/login"},
+	{"deactivated user", 4, access.ViewReservations, http.StatusSeeOther, "/user/login"},
+}
+
+func TestRepository_RequirePermission(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, e := range requirePermissionTests {
+		req, _ := http.NewRequest("GET", "/admin/delete-reservation/all/1/do", nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		if e.userID > 0 {
+			session.Put(ctx, "user_id", e.userID)
+		}
+		rr := httptest.NewRecorder()
+
+		handler := Repo.RequirePermission(e.permission)(next)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+var postUserRoleTests = []struct {
+	name           string
+	url            string
+	accessLevel    string
+	expectedStatus int
+	expectedKey    string
+}{
+	{"valid", "/admin/users/2/role", "1", http.StatusSeeOther, "flash"},
+	{"own role", "/admin/users/1/role", "1", http.StatusSeeOther, "error"},
+	{"bad id", "/admin/users/x/role", "1", http.StatusSeeOther, "error"},
+	{"invalid role", "/admin/users/2/role", "9", http.StatusSeeOther, "error"},
+	{"missing role", "/admin/users/2/role", "", http.StatusSeeOther, "error"},
+	{"unknown user", "/admin/users/6/role", "2", http.StatusSeeOther, "error"},
+	{"database error", "/admin/users/5/role", "2", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_AdminPostUserRole(t *testing.T) {
+	for _, e := range postUserRoleTests {
+		postedData := url.Values{}
+		postedData.Add("access_level", e.accessLevel)
+
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "user_id", 1)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostUserRole)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedKey != "" && session.GetString(ctx, e.expectedKey) == "" {
+			t.Errorf("failed %s: expected a %s message", e.name, e.expectedKey)
+		}
+	}
+}
+
+var postNewUserTests = []struct {
+	name             string
+	email            string
+	accessLevel      string
+	expectedStatus   int
+	expectedLocation string
+}{
+	{"valid", "new@here.com", "2", http.StatusSeeOther, "/admin/users"},
+	{"email taken", "desk@here.com", "2", http.StatusOK, ""},
+	{"invalid email", "new-at-here", "2", http.StatusOK, ""},
+	{"invalid role", "new@here.com", "7", http.StatusOK, ""},
+	{"database error", "broken@here.com", "2", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_AdminPostNewUser(t *testing.T) {
+	for _, e := range postNewUserTests {
+		postedData := url.Values{}
+		postedData.Add("first_name", "New")
+		postedData.Add("last_name", "User")
+		postedData.Add("email", e.email)
+		postedData.Add("access_level", e.accessLevel)
+
+		req, _ := http.NewRequest("POST", "/admin/users/new", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostNewUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+var activateUserTests = []struct {
+	name           string
+	url            string
+	expectedStatus int
+	expectedKey    string
+}{
+	{"deactivate", "/admin/users/2/deactivate/do", http.StatusSeeOther, "flash"},
+	{"activate", "/admin/users/4/activate/do", http.StatusSeeOther, "flash"},
+	{"deactivate self", "/admin/users/1/deactivate/do", http.StatusSeeOther, "error"},
+	{"bad id", "/admin/users/x/deactivate/do", http.StatusSeeOther, "error"},
+	{"unknown user", "/admin/users/6/deactivate/do", http.StatusSeeOther, "error"},
+	{"database error", "/admin/users/5/deactivate/do", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_AdminActivateUser(t *testing.T) {
+	for _, e := range activateUserTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", 1)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminActivateUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedKey != "" && session.GetString(ctx, e.expectedKey) == "" {
+			t.Errorf("failed %s: expected a %s message", e.name, e.expectedKey)
+		}
+	}
+}
+
+var forgotPasswordTests = []struct {
+	name             string
+	email            string
+	expectedStatus   int
+	expectedLocation string
+}{
+	{"known user", "desk@here.com", http.StatusSeeOther, "/user/login"},
+	{"unknown user", "nobody@here.com", http.StatusSeeOther, "/user/login"},
+	{"deactivated user", "gone@here.com", http.StatusSeeOther, "/user/login"},
+	{"invalid email", "nobody", http.StatusOK, ""},
+	{"database error", "broken@here.com", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_PostForgotPassword(t *testing.T) {
+	for _, e := range forgotPasswordTests {
+		postedData := url.Values{}
+		postedData.Add("email", e.email)
+
+		req, _ := http.NewRequest("POST", "/user/forgot-password", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostForgotPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+func TestRepository_SetPassword(t *testing.T) {
+	valid, _ := app.Tokens.Sign(tokens.Claims{UserID: 2, Purpose: tokens.Invite, Expires: time.Now().Add(time.Hour)})
+	expired, _ := app.Tokens.Sign(tokens.Claims{UserID: 2, Purpose: tokens.Invite, Expires: time.Now().Add(-time.Hour)})
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"expired", expired, http.StatusSeeOther},
+		{"forged", "abc.def", http.StatusSeeOther},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/user/set-password?token="+url.QueryEscape(e.token), nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.SetPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestRepository_PostSetPassword(t *testing.T) {
+	sign := func(userID int, expires time.Duration) string {
+		token, err := app.Tokens.Sign(tokens.Claims{UserID: userID, Purpose: tokens.PasswordReset, Expires: time.Now().Add(expires)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name             string
+		token            string
+		password         string
+		confirm          string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"valid", sign(2, time.Hour), "correct horse", "correct horse", http.StatusSeeOther, "/user/login"},
+		{"too short", sign(2, time.Hour), "short", "short", http.StatusOK, ""},
+		{"mismatch", sign(2, time.Hour), "correct horse", "battery staple", http.StatusOK, ""},
+		{"expired", sign(2, -time.Hour), "correct horse", "correct horse", http.StatusSeeOther, "/user/forgot-password"},
+		{"not issued", sign(3, time.Hour), "correct horse", "correct horse", http.StatusSeeOther, "/user/forgot-password"},
+		{"forged", "abc.def", "correct horse", "correct horse", http.StatusSeeOther, "/user/forgot-password"},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("token", e.token)
+		postedData.Add("password", e.password)
+		postedData.Add("confirm_password", e.confirm)
+
+		req, _ := http.NewRequest("POST", "/user/set-password", strings.NewReader(postedData.Encode()))
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostSetPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+var unlockUserTests = []struct {
+	name           string
+	url            string
+	expectedStatus int
+	expectedKey    string
+}{
+	{"valid", "/admin/users/3/unlock/do", http.StatusSeeOther, "flash"},
+	{"bad id", "/admin/users/x/unlock/do", http.StatusSeeOther, "error"},
+	{"unknown user", "/admin/users/6/unlock/do", http.StatusSeeOther, "error"},
+	{"database error", "/admin/users/5/unlock/do", http.StatusInternalServerError, ""},
+}
+
+func TestRepository_AdminUnlockUser(t *testing.T) {
+	for _, e := range unlockUserTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminUnlockUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedKey != "" && session.GetString(ctx, e.expectedKey) == "" {
+			t.Errorf("failed %s: expected a %s message", e.name, e.expectedKey)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/emails"
+	"github.com/eador/bookings/internal/forms"
+	"github.com/eador/bookings/internal/helpers"
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/render"
+	"github.com/eador/bookings/internal/stayrules"
+	"github.com/eador/bookings/internal/tokens"
+	"github.com/eador/bookings/internal/waitlist"
+)
+
+// Waitlist displays the form for joining the waitlist, filled in from the search that found nothing
+func (m *Repository) Waitlist(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	form := forms.New(url.Values{
+		"start":    {q.Get("start")},
+		"end":      {q.Get("end")},
+		"adults":   {q.Get("a")},
+		"children": {q.Get("c")},
+	})
+
+	m.renderWaitlist(w, r, form)
+}
+
+// PostWaitlist puts a guest on the waitlist for a stay
+func (m *Repository) PostWaitlist(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "start", "end", "adults")
+	form.IsEmail("email")
+	form.IsInt("adults", 1)
+	form.IsInt("children", 0)
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, r.Form.Get("start"))
+	if err != nil && form.Has("start") {
+		form.Errors.Add("start", "Please enter a date like 2050-01-31")
+	}
+	endDate, err := time.Parse(layout, r.Form.Get("end"))
+	if err != nil && form.Has("end") {
+		form.Errors.Add("end", "Please enter a date like 2050-01-31")
+	}
+
+	if form.Errors.Get("start") == "" && form.Errors.Get("end") == "" {
+		rules, err := m.DB.GetStayRulesForArrival(startDate)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		addStayErrors(form, stayrules.Check(rules, 0, startDate, endDate, time.Now()), "start", "end")
+	}
+
+	if !form.Valid() {
+		m.renderWaitlist(w, r, form)
+		return
+	}
+
+	entry := models.WaitlistEntry{
+		FirstName: r.Form.Get("first_name"),
+		LastName:  r.Form.Get("last_name"),
+		Email:     r.Form.Get("email"),
+		StartDate: startDate,
+		EndDate:   endDate,
+	}
+	entry.Adults, _ = strconv.Atoi(strings.TrimSpace(r.Form.Get("adults")))
+	entry.Children, _ = strconv.Atoi(strings.TrimSpace(r.Form.Get("children")))
+	for _, v := range r.Form["room_id"] {
+		id, err := strconv.Atoi(v)
+		if err == nil && id > 0 {
+			entry.RoomIDs = append(entry.RoomIDs, id)
+		}
+	}
+
+	_, err = m.DB.InsertWaitlistEntry(entry)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "You're on the waitlist. We'll email you if a room comes free for your stay.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// renderWaitlist shows the waitlist form, offering the rooms that could sleep the party
+func (m *Repository) renderWaitlist(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	rooms, err := m.DB.ActiveRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	adults, err := strconv.Atoi(strings.TrimSpace(form.Get("adults")))
+	if err != nil || adults < 1 {
+		adults = 1
+	}
+	children, _ := strconv.Atoi(strings.TrimSpace(form.Get("children")))
+
+	var fitting []models.Room
+	for _, room := range rooms {
+		if room.Fits(adults, children) {
+			fitting = append(fitting, room)
+		}
+	}
+
+	chosen := make(map[int]bool)
+	for _, v := range form.Values["room_id"] {
+		id, _ := strconv.Atoi(v)
+		chosen[id] = true
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = fitting
+	data["chosen"] = chosen
+
+	render.Template(w, r, "waitlist.page.html", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// WaitlistBook starts booking the room held for a guest on the waitlist, from the link in their offer
+func (m *Repository) WaitlistBook(w http.ResponseWriter, r *http.Request) {
+	claims, err := m.App.Tokens.Verify(r.URL.Query().Get("token"), time.Now())
+	if err == nil && claims.Purpose != tokens.Waitlist {
+		err = tokens.ErrInvalid
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", waitlistLinkMessage(err))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	entry, err := m.DB.GetWaitlistEntryByID(claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", waitlistLinkMessage(tokens.ErrInvalid))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if entry.Status == waitlist.Booked {
+		m.App.Session.Put(r.Context(), "warning", "You have already booked this room. Look it up with your confirmation code.")
+		http.Redirect(w, r, "/find-reservation", http.StatusSeeOther)
+		return
+	}
+	if entry.Status != waitlist.Offered || !time.Now().Before(entry.HoldExpiresAt) {
+		m.App.Session.Put(r.Context(), "error", waitlistLinkMessage(tokens.ErrExpired))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	res := models.Reservation{
+		FirstName: entry.FirstName,
+		LastName:  entry.LastName,
+		Email:     entry.Email,
+		RoomID:    entry.RoomID,
+		StartDate: entry.StartDate,
+		EndDate:   entry.EndDate,
+		Adults:    entry.Adults,
+		Children:  entry.Children,
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Put(r.Context(), "waitlist_entry_id", entry.ID)
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// waitlistLinkMessage explains why the link in a waitlist offer was refused
+func waitlistLinkMessage(err error) string {
+	if errors.Is(err, tokens.ErrExpired) {
+		return "Sorry, the room is no longer being held for you. Please search again."
+	}
+	return "This link is not valid"
+}
+
+// SendWaitlistOffer emails a guest on the waitlist a link to book the room being held for them
+func (m *Repository) SendWaitlistOffer(e models.WaitlistEntry) error {
+	token, err := m.App.Tokens.Sign(tokens.Claims{UserID: e.ID, Purpose: tokens.Waitlist, Expires: e.HoldExpiresAt})
+	if err != nil {
+		return err
+	}
+
+	link := m.siteURL("/waitlist/book?token=" + url.QueryEscape(token))
+	m.queueTemplatedMail(e.Email, emails.WaitlistOfferName, emails.WaitlistOffer{
+		Entry:    e,
+		Link:     link,
+		ValidFor: holdLength(m.App.Waitlist.Hold),
+	})
+	return nil
+}
+
+// holdLength describes how long a room is held for, e.g. "24 hours" or "2 days"
+func holdLength(d time.Duration) string {
+	hours := int(d.Hours())
+	switch {
+	case hours >= 48 && hours%24 == 0:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours == 1:
+		return "1 hour"
+	case hours > 1:
+		return fmt.Sprintf("%d hours", hours)
+	default:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+}
+
+// offerReleased offers the rooms freed by cancelling, moving or deleting reservations to the
+// guests on the waitlist
+func (m *Repository) offerReleased(released ...models.Reservation) {
+	var rr []models.RoomRestriction
+	for _, res := range released {
+		rr = append(rr, models.RoomRestriction{RoomID: res.RoomID, StartDate: res.StartDate, EndDate: res.EndDate})
+	}
+	m.App.Waitlist.Released(rr...)
+}
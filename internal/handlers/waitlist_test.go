@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/tokens"
+)
+
+func TestRepository_PostAvailability_Waitlist(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader("start=2061-01-01&end=2061-01-02&adults=2&children=1"))
+	req = req.WithContext(GetCtx(req))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.PostAvailability)
+	handler.ServeHTTP(rr, req)
+
+	expected := "/waitlist?a=2&c=1&end=2061-01-02&start=2061-01-01"
+	if loc := rr.Header().Get("Location"); loc != expected {
+		t.Errorf("expected redirect to %s but got %s", expected, loc)
+	}
+}
+
+func TestRepository_Waitlist(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/waitlist?start=2050-01-01&end=2050-01-03&a=2&c=2", nil)
+	req = req.WithContext(GetCtx(req))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.Waitlist)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Waitlist returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, `value="2050-01-03"`) {
+		t.Error("expected the dates searched for in the form")
+	}
+	// only the suite sleeps two adults and two children
+	if strings.Contains(body, `id="room_1"`) || !strings.Contains(body, `id="room_2"`) {
+		t.Error("expected only the rooms that sleep the party")
+	}
+}
+
+var postWaitlistTests = []struct {
+	name             string
+	postedData       url.Values
+	expectedStatus   int
+	expectedLocation string
+}{
+	{"joined", url.Values{"start": {"2050-01-01"}, "end": {"2050-01-03"}, "adults": {"2"}, "children": {"0"}, "room_id": {"1", "2"}}, http.StatusSeeOther, "/"},
+	{"any room", url.Values{"start": {"2050-01-01"}, "end": {"2050-01-03"}, "adults": {"2"}, "children": {"0"}}, http.StatusSeeOther, "/"},
+	{"bad date", url.Values{"start": {"soon"}, "end": {"2050-01-03"}, "adults": {"2"}, "children": {"0"}}, http.StatusOK, ""},
+	{"in the past", url.Values{"start": {"2000-01-01"}, "end": {"2000-01-03"}, "adults": {"2"}, "children": {"0"}}, http.StatusOK, ""},
+	{"no adults", url.Values{"start": {"2050-01-01"}, "end": {"2050-01-03"}, "adults": {"0"}, "children": {"0"}}, http.StatusOK, ""},
+	{"rules database error", url.Values{"start": {"2052-01-01"}, "end": {"2052-01-03"}, "adults": {"2"}, "children": {"0"}}, http.StatusInternalServerError, ""},
+	{"database error", url.Values{"start": {"2060-01-01"}, "end": {"2060-01-03"}, "adults": {"2"}, "children": {"0"}}, http.StatusInternalServerError, ""},
+}
+
+func TestRepository_PostWaitlist(t *testing.T) {
+	for _, e := range postWaitlistTests {
+		e.postedData.Set("first_name", "John")
+		e.postedData.Set("last_name", "Smith")
+		e.postedData.Set("email", "john@smith.com")
+
+		req, _ := http.NewRequest("POST", "/waitlist", strings.NewReader(e.postedData.Encode()))
+		req = req.WithContext(GetCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostWaitlist)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+
+	// a missing email is shown on the form
+	req, _ := http.NewRequest("POST", "/waitlist", strings.NewReader("start=2050-01-01&end=2050-01-03&adults=2&first_name=John&last_name=Smith"))
+	req = req.WithContext(GetCtx(req))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostWaitlist).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "This field can not be blank") {
+		t.Errorf("expected the form again with an error but got code %d", rr.Code)
+	}
+}
+
+func TestRepository_WaitlistBook(t *testing.T) {
+	sign := func(id int, purpose string, expires time.Time) string {
+		token, err := app.Tokens.Sign(tokens.Claims{UserID: id, Purpose: purpose, Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	soon := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name             string
+		token            string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"held", sign(1, tokens.Waitlist, soon), http.StatusSeeOther, "/make-reservation"},
+		{"not a waitlist token", sign(1, tokens.Invite, soon), http.StatusSeeOther, "/search-availability"},
+		{"expired token", sign(1, tokens.Waitlist, time.Now().Add(-time.Hour)), http.StatusSeeOther, "/search-availability"},
+		{"bad token", "nonsense", http.StatusSeeOther, "/search-availability"},
+		{"still waiting", sign(2, tokens.Waitlist, soon), http.StatusSeeOther, "/search-availability"},
+		{"hold lapsed", sign(3, tokens.Waitlist, soon), http.StatusSeeOther, "/search-availability"},
+		{"database error", sign(4, tokens.Waitlist, soon), http.StatusInternalServerError, ""},
+		{"unknown entry", sign(99, tokens.Waitlist, soon), http.StatusSeeOther, "/search-availability"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/waitlist/book?token="+url.QueryEscape(e.token), nil)
+		ctx := GetCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.WaitlistBook)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %q but got %q", e.name, e.expectedLocation, loc)
+		}
+		if e.expectedLocation != "/make-reservation" {
+			continue
+		}
+
+		res := session.Get(ctx, "reservation").(models.Reservation)
+		if res.RoomID != 1 || res.Adults != 2 || res.Email != "john@smith.com" {
+			t.Errorf("failed %s: unexpected reservation %+v", e.name, res)
+		}
+		if id := session.GetInt(ctx, "waitlist_entry_id"); id != 1 {
+			t.Errorf("failed %s: expected waitlist entry 1 in the session but got %d", e.name, id)
+		}
+	}
+}
+
+func TestRepository_PostReservation_Waitlist(t *testing.T) {
+	reservation := models.Reservation{
+		RoomID:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		Adults:    2,
+	}
+	postedData := url.Values{}
+	postedData.Add("first_name", "John")
+	postedData.Add("last_name", "Smith")
+	postedData.Add("phone", "12345")
+	postedData.Add("email", "john@smith.com")
+
+	req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx := GetCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", reservation)
+	session.Put(ctx, "waitlist_entry_id", 1)
+
+	handler := http.HandlerFunc(Repo.PostReservation)
+	handler.ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "/checkout" {
+		t.Errorf("expected redirect to /checkout but got %s", loc)
+	}
+	if session.Exists(ctx, "waitlist_entry_id") {
+		t.Error("expected the waitlist entry to be cleared from the session once booked")
+	}
+}
+
+func TestRepository_SendWaitlistOffer(t *testing.T) {
+	e := models.WaitlistEntry{
+		ID:            1,
+		FirstName:     "John",
+		Email:         "john@smith.com",
+		StartDate:     time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		Room:          models.Room{RoomName: "General's Quarters"},
+		HoldExpiresAt: time.Now().Add(24 * time.Hour),
+	}
+	if err := Repo.SendWaitlistOffer(e); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHoldLength(t *testing.T) {
+	tests := map[time.Duration]string{
+		24 * time.Hour:   "24 hours",
+		48 * time.Hour:   "2 days",
+		time.Hour:        "1 hour",
+		30 * time.Minute: "30 minutes",
+	}
+	for d, expected := range tests {
+		if got := holdLength(d); got != expected {
+			t.Errorf("expected %q for %s but got %q", expected, d, got)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package helpers
 
 import (
+	"crypto/rand"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime/debug"
 
@@ -30,3 +32,28 @@ func IsAuthenticated(r *http.Request) bool {
 	exists := app.Session.Exists(r.Context(), "user_id")
 	return exists
 }
+
+// ClientIP returns the address a request came from, without the port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// confirmationCodeChars leaves out characters that are easily confused when read aloud or typed
+const confirmationCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// NewConfirmationCode returns a random code a guest can use to look up their reservation
+func NewConfirmationCode() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = confirmationCodeChars[int(b[i])%len(confirmationCodeChars)]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,241 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// dateLayout is the iCalendar form of an all day date
+const dateLayout = "20060102"
+
+// ErrNoCalendar is returned when the input does not contain a VCALENDAR
+var ErrNoCalendar = errors.New("ical: no calendar found")
+
+// Event is an all day event. End is the day after the last day covered, as in DTEND.
+type Event struct {
+	UID     string
+	Summary string
+	Start   time.Time
+	End     time.Time
+}
+
+// Nights returns the nights an event covers, from Start up to but not including End
+func (e Event) Nights() []time.Time {
+	var nights []time.Time
+	for d := e.Start; d.Before(e.End); d = d.AddDate(0, 0, 1) {
+		nights = append(nights, d)
+	}
+	return nights
+}
+
+// Write writes events as an iCalendar feed named name
+func Write(w io.Writer, name string, events []Event) error {
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//bookings//room calendar//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + escape(name),
+	}
+	for _, e := range events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+escape(e.UID),
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+e.Start.Format(dateLayout),
+			"DTEND;VALUE=DATE:"+e.End.Format(dateLayout),
+			"SUMMARY:"+escape(e.Summary),
+			"TRANSP:OPAQUE",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, fold(line)+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse reads the events from an iCalendar feed. Events that are cancelled or
+// marked as free time are skipped, as they do not make a room unavailable.
+func Parse(r io.Reader) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var cur *Event
+	var skip bool
+	found := false
+
+	for _, line := range lines {
+		name, params, value := splitLine(line)
+		switch {
+		case name == "BEGIN" && value == "VCALENDAR":
+			found = true
+		case name == "BEGIN" && value == "VEVENT":
+			cur = &Event{}
+			skip = false
+		case name == "END" && value == "VEVENT":
+			if cur == nil {
+				continue
+			}
+			if cur.UID == "" {
+				return nil, errors.New("ical: event without a UID")
+			}
+			if cur.Start.IsZero() {
+				return nil, fmt.Errorf("ical: event %s has no DTSTART", cur.UID)
+			}
+			if cur.End.IsZero() || !cur.End.After(cur.Start) {
+				cur.End = cur.Start.AddDate(0, 0, 1)
+			}
+			if !skip {
+				events = append(events, *cur)
+			}
+			cur = nil
+		case cur == nil:
+			continue
+		case name == "UID":
+			cur.UID = unescape(value)
+		case name == "SUMMARY":
+			cur.Summary = unescape(value)
+		case name == "DTSTART":
+			cur.Start, err = parseDate(value, params)
+			if err != nil {
+				return nil, err
+			}
+		case name == "DTEND":
+			cur.End, err = parseDate(value, params)
+			if err != nil {
+				return nil, err
+			}
+		case name == "STATUS" && strings.EqualFold(value, "CANCELLED"):
+			skip = true
+		case name == "TRANSP" && strings.EqualFold(value, "TRANSPARENT"):
+			skip = true
+		}
+	}
+
+	if !found {
+		return nil, ErrNoCalendar
+	}
+	return events, nil
+}
+
+// Open opens a calendar from an http or https URL, or otherwise from a file path
+func Open(source string) (io.ReadCloser, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 15 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("ical: fetching %s returned %s", source, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(source)
+}
+
+// parseDate reads a DTSTART or DTEND value as a date. Date-times are reduced to the
+// date they fall on, in UTC when they end in Z and in their own wall time otherwise.
+func parseDate(value string, params map[string]string) (time.Time, error) {
+	if params["VALUE"] == "DATE" || len(value) == len(dateLayout) {
+		t, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return t, fmt.Errorf("ical: bad date %q", value)
+		}
+		return t, nil
+	}
+
+	layout := "20060102T150405"
+	if strings.HasSuffix(value, "Z") {
+		layout += "Z"
+	}
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return t, fmt.Errorf("ical: bad date %q", value)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// unfold reads content lines, joining lines continued with a leading space or tab
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// splitLine splits a content line such as DTSTART;VALUE=DATE:20500101 into its name, parameters and value
+func splitLine(line string) (string, map[string]string, string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return strings.ToUpper(line), nil, ""
+	}
+	head, value := line[:i], line[i+1:]
+
+	parts := strings.Split(head, ";")
+	params := make(map[string]string)
+	for _, p := range parts[1:] {
+		if j := strings.Index(p, "="); j >= 0 {
+			params[strings.ToUpper(p[:j])] = strings.Trim(p[j+1:], `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, value
+}
+
+// fold splits lines longer than 75 octets, as required by RFC 5545
+func fold(line string) string {
+	if len(line) <= 75 {
+		return line
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	return b.String()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+var unescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func unescape(s string) string {
+	return unescaper.Replace(s)
+}
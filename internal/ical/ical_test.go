@@ -0,0 +1,160 @@
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+const channelFeed = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Channel//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:abc-123@channel.example\r\n" +
+	"DTSTART;VALUE=DATE:20500101\r\n" +
+	"DTEND;VALUE=DATE:20500104\r\n" +
+	"SUMMARY:Reserved\\, via channel\r\n" +
+	"  with a folded line\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:def-456@channel.example\r\n" +
+	"DTSTART:20500110T150000Z\r\n" +
+	"SUMMARY:No end date\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:ghi-789@channel.example\r\n" +
+	"DTSTART;VALUE=DATE:20500120\r\n" +
+	"DTEND;VALUE=DATE:20500121\r\n" +
+	"STATUS:CANCELLED\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParse(t *testing.T) {
+	events, err := Parse(strings.NewReader(channelFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events but got %d", len(events))
+	}
+
+	e := events[0]
+	if e.UID != "abc-123@channel.example" {
+		t.Errorf("expected UID abc-123@channel.example but got %s", e.UID)
+	}
+	if e.Summary != "Reserved, via channel with a folded line" {
+		t.Errorf("unexpected summary %q", e.Summary)
+	}
+	if !e.Start.Equal(date("2050-01-01")) || !e.End.Equal(date("2050-01-04")) {
+		t.Errorf("unexpected dates %s to %s", e.Start, e.End)
+	}
+	if len(e.Nights()) != 3 {
+		t.Errorf("expected 3 nights but got %d", len(e.Nights()))
+	}
+
+	e = events[1]
+	if !e.Start.Equal(date("2050-01-10")) || !e.End.Equal(date("2050-01-11")) {
+		t.Errorf("expected a one night event on 2050-01-10 but got %s to %s", e.Start, e.End)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"not a calendar", "hello"},
+		{"missing uid", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART;VALUE=DATE:20500101\nEND:VEVENT\nEND:VCALENDAR\n"},
+		{"missing start", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:x\nEND:VEVENT\nEND:VCALENDAR\n"},
+		{"bad date", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:x\nDTSTART;VALUE=DATE:2050-01-01\nEND:VEVENT\nEND:VCALENDAR\n"},
+	}
+	for _, e := range tests {
+		_, err := Parse(strings.NewReader(e.input))
+		if err == nil {
+			t.Errorf("%s: expected an error but got none", e.name)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	events := []Event{
+		{UID: UID(7), Summary: "Reserved", Start: date("2050-01-01"), End: date("2050-01-03")},
+		{UID: UID(8), Summary: strings.Repeat("Long summary; ", 10), Start: date("2050-02-01"), End: date("2050-02-02")},
+	}
+
+	var buf bytes.Buffer
+	err := Write(&buf, "General's Quarters", events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line longer than 75 octets: %q", line)
+		}
+	}
+	if !strings.Contains(buf.String(), "DTSTART;VALUE=DATE:20500101\r\n") {
+		t.Error("expected an all day DTSTART")
+	}
+
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(events) {
+		t.Fatalf("expected %d events but got %d", len(events), len(parsed))
+	}
+	for i := range events {
+		if parsed[i].UID != events[i].UID || parsed[i].Summary != events[i].Summary ||
+			!parsed[i].Start.Equal(events[i].Start) || !parsed[i].End.Equal(events[i].End) {
+			t.Errorf("event %d did not survive a round trip: %+v", i, parsed[i])
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/room.ics" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, channelFeed)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "room.ics")
+	err := os.WriteFile(path, []byte(channelFeed), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []string{srv.URL + "/room.ics", path} {
+		rc, err := Open(source)
+		if err != nil {
+			t.Errorf("%s: %s", source, err)
+			continue
+		}
+		body, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(body) != channelFeed {
+			t.Errorf("%s: unexpected body", source)
+		}
+	}
+
+	_, err = Open(srv.URL + "/missing.ics")
+	if err == nil {
+		t.Error("expected an error for a missing feed but got none")
+	}
+}
@@ -0,0 +1,124 @@
+package ical
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// uidSuffix marks the UIDs of events published by our own feeds
+const uidSuffix = "@bookings"
+
+// BlockStore is the part of the database repository used to sync blocks
+type BlockStore interface {
+	InsertBlockForRoom(id int, startDate time.Time) (int, error)
+	DeleteBlockByID(id int) error
+	GetCalendarBlocksForRoom(roomID int, source string) ([]models.CalendarBlock, error)
+	InsertCalendarBlock(b models.CalendarBlock) error
+}
+
+// SyncResult counts the changes made by Sync. Released holds the nights whose blocks were removed.
+type SyncResult struct {
+	Added     int
+	Removed   int
+	Unchanged int
+	Skipped   int
+	Released  []models.RoomRestriction
+}
+
+// UID returns the UID we publish for a room restriction
+func UID(restrictionID int) string {
+	return fmt.Sprintf("restriction-%d%s", restrictionID, uidSuffix)
+}
+
+// IsOwnUID reports whether uid was published by one of our own feeds
+func IsOwnUID(uid string) bool {
+	return strings.HasSuffix(uid, uidSuffix)
+}
+
+// Sync makes the blocks imported into a room from source match events. Each night of each
+// event becomes a block, tracked by the event's UID, so syncing the same calendar again
+// changes nothing, and nights that are no longer in the calendar have their blocks removed.
+// Nights before today are left alone, as are events that came from our own feeds.
+func Sync(store BlockStore, roomID int, source string, events []Event, today time.Time) (SyncResult, error) {
+	var result SyncResult
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+
+	key := func(uid string, night time.Time) string {
+		return uid + "|" + night.Format("2006-01-02")
+	}
+
+	wanted := make(map[string]models.CalendarBlock)
+	var order []string
+	for _, e := range events {
+		if IsOwnUID(e.UID) {
+			result.Skipped++
+			continue
+		}
+		for _, night := range e.Nights() {
+			if night.Before(today) {
+				continue
+			}
+			k := key(e.UID, night)
+			if _, ok := wanted[k]; !ok {
+				order = append(order, k)
+			}
+			wanted[k] = models.CalendarBlock{
+				RoomID: roomID,
+				Source: source,
+				UID:    e.UID,
+				Night:  night,
+			}
+		}
+	}
+
+	existing, err := store.GetCalendarBlocksForRoom(roomID, source)
+	if err != nil {
+		return result, err
+	}
+
+	have := make(map[string]bool)
+	for _, b := range existing {
+		k := key(b.UID, b.Night)
+		if b.Night.Before(today) {
+			continue
+		}
+		if _, ok := wanted[k]; ok {
+			have[k] = true
+			result.Unchanged++
+			continue
+		}
+		// deleting the block cascades to its calendar block record
+		err := store.DeleteBlockByID(b.RoomRestrictionID)
+		if err != nil {
+			return result, err
+		}
+		result.Removed++
+		result.Released = append(result.Released, models.RoomRestriction{
+			RoomID:    roomID,
+			StartDate: b.Night,
+			EndDate:   b.Night.AddDate(0, 0, 1),
+		})
+	}
+
+	for _, k := range order {
+		if have[k] {
+			continue
+		}
+		b := wanted[k]
+		b.RoomRestrictionID, err = store.InsertBlockForRoom(roomID, b.Night)
+		if err != nil {
+			return result, err
+		}
+		err = store.InsertCalendarBlock(b)
+		if err != nil {
+			_ = store.DeleteBlockByID(b.RoomRestrictionID)
+			return result, err
+		}
+		result.Added++
+	}
+
+	return result, nil
+}
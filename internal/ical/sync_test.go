@@ -0,0 +1,116 @@
+package ical
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// memoryStore keeps blocks in memory, deleting calendar blocks with their block as the database does
+type memoryStore struct {
+	nextID       int
+	restrictions map[int]time.Time
+	blocks       []models.CalendarBlock
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{restrictions: make(map[int]time.Time)}
+}
+
+func (s *memoryStore) InsertBlockForRoom(id int, startDate time.Time) (int, error) {
+	s.nextID++
+	s.restrictions[s.nextID] = startDate
+	return s.nextID, nil
+}
+
+func (s *memoryStore) DeleteBlockByID(id int) error {
+	delete(s.restrictions, id)
+	var kept []models.CalendarBlock
+	for _, b := range s.blocks {
+		if b.RoomRestrictionID != id {
+			kept = append(kept, b)
+		}
+	}
+	s.blocks = kept
+	return nil
+}
+
+func (s *memoryStore) GetCalendarBlocksForRoom(roomID int, source string) ([]models.CalendarBlock, error) {
+	var blocks []models.CalendarBlock
+	for _, b := range s.blocks {
+		if b.RoomID == roomID && b.Source == source {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks, nil
+}
+
+func (s *memoryStore) InsertCalendarBlock(b models.CalendarBlock) error {
+	s.blocks = append(s.blocks, b)
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	store := newMemoryStore()
+	today := date("2050-01-01")
+	source := "https://channel.example/room.ics"
+
+	events := []Event{
+		{UID: "a", Start: date("2050-01-02"), End: date("2050-01-05")},
+		{UID: "b", Start: date("2050-01-10"), End: date("2050-01-11")},
+		{UID: "past", Start: date("2049-12-20"), End: date("2049-12-22")},
+		{UID: UID(1), Start: date("2050-01-20"), End: date("2050-01-21")},
+	}
+
+	result, err := Sync(store, 1, source, events, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 4 || result.Removed != 0 || result.Skipped != 1 {
+		t.Errorf("first sync: unexpected result %+v", result)
+	}
+	if len(store.restrictions) != 4 {
+		t.Errorf("first sync: expected 4 blocks but got %d", len(store.restrictions))
+	}
+
+	// syncing the same calendar again changes nothing
+	result, err = Sync(store, 1, source, events, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 0 || result.Removed != 0 || result.Unchanged != 4 {
+		t.Errorf("second sync: unexpected result %+v", result)
+	}
+	if len(store.restrictions) != 4 {
+		t.Errorf("second sync: expected 4 blocks but got %d", len(store.restrictions))
+	}
+
+	// a shortened event and a removed event leave no orphaned blocks
+	events = []Event{
+		{UID: "a", Start: date("2050-01-02"), End: date("2050-01-03")},
+		{UID: "c", Start: date("2050-02-01"), End: date("2050-02-02")},
+	}
+	result, err = Sync(store, 1, source, events, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 1 || result.Removed != 3 || result.Unchanged != 1 {
+		t.Errorf("third sync: unexpected result %+v", result)
+	}
+	if len(result.Released) != 3 || result.Released[0].RoomID != 1 || !result.Released[0].EndDate.Equal(result.Released[0].StartDate.AddDate(0, 0, 1)) {
+		t.Errorf("third sync: expected the 3 removed nights released but got %+v", result.Released)
+	}
+	if len(store.restrictions) != 2 || len(store.blocks) != 2 {
+		t.Errorf("third sync: expected 2 blocks but got %d restrictions and %d records", len(store.restrictions), len(store.blocks))
+	}
+
+	// another source for the same room is kept separate
+	_, err = Sync(store, 1, "other.ics", nil, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.restrictions) != 2 {
+		t.Errorf("expected another source to leave 2 blocks but got %d", len(store.restrictions))
+	}
+}
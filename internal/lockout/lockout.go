@@ -0,0 +1,82 @@
+package lockout
+
+import "time"
+
+// The outcomes recorded for a login attempt
+const (
+	Succeeded        = "succeeded"
+	PasswordAccepted = "password accepted"
+	BadCredentials   = "bad credentials"
+	BadSecondFactor  = "bad two-factor code"
+	AccountLocked    = "account locked"
+	AddressBlocked   = "address blocked"
+)
+
+// Policy decides how failed logins are slowed down and when accounts are locked.
+// Failures are counted per account until a successful login or an admin unlocks it,
+// and per IP address over a sliding Window.
+type Policy struct {
+	// MaxFailures failed logins in a row lock an account
+	MaxFailures int
+	// LockFor is how long the first lock lasts; each further lock lasts twice as long
+	LockFor time.Duration
+	// MaxLock caps how long an account is locked for
+	MaxLock time.Duration
+	// Window is how far back failed logins from an address are counted
+	Window time.Duration
+	// MaxAddressFailures failed logins from one address within Window block it
+	MaxAddressFailures int
+	// BaseDelay is the wait after the first failure, doubling with each failure after that
+	BaseDelay time.Duration
+	// MaxDelay caps the wait after a failure
+	MaxDelay time.Duration
+}
+
+// DefaultPolicy returns the policy used by the site
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxFailures:        5,
+		LockFor:            15 * time.Minute,
+		MaxLock:            24 * time.Hour,
+		Window:             15 * time.Minute,
+		MaxAddressFailures: 20,
+		BaseDelay:          250 * time.Millisecond,
+		MaxDelay:           4 * time.Second,
+	}
+}
+
+// Delay returns how long to wait before answering the failures'th failed login in a row
+func (p Policy) Delay(failures int) time.Duration {
+	if failures < 1 || p.BaseDelay <= 0 {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return d
+}
+
+// LockDuration returns how long to lock an account after failures failed logins in a row,
+// or zero if it should not be locked. It locks at every MaxFailures failures, for longer each time.
+func (p Policy) LockDuration(failures int) time.Duration {
+	if p.MaxFailures < 1 || failures < p.MaxFailures || failures%p.MaxFailures != 0 {
+		return 0
+	}
+	d := p.LockFor
+	for i := p.MaxFailures; i < failures; i += p.MaxFailures {
+		d *= 2
+		if d >= p.MaxLock {
+			return p.MaxLock
+		}
+	}
+	return d
+}
+
+// AddressBlocked reports whether an address with failures recent failed logins is blocked
+func (p Policy) AddressBlocked(failures int) bool {
+	return p.MaxAddressFailures > 0 && failures >= p.MaxAddressFailures
+}
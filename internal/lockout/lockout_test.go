@@ -0,0 +1,55 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicy_Delay(t *testing.T) {
+	p := DefaultPolicy()
+
+	expected := []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+		2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for failures, e := range expected {
+		if got := p.Delay(failures); got != e {
+			t.Errorf("after %d failures expected %s but got %s", failures, e, got)
+		}
+	}
+
+	p.BaseDelay = 0
+	if p.Delay(10) != 0 {
+		t.Error("expected no delay without a base delay")
+	}
+}
+
+func TestPolicy_LockDuration(t *testing.T) {
+	p := DefaultPolicy()
+
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, 15 * time.Minute},
+		{6, 0},
+		{10, 30 * time.Minute},
+		{15, time.Hour},
+		{50, 24 * time.Hour},
+	}
+	for _, e := range tests {
+		if got := p.LockDuration(e.failures); got != e.expected {
+			t.Errorf("after %d failures expected a lock of %s but got %s", e.failures, e.expected, got)
+		}
+	}
+}
+
+func TestPolicy_AddressBlocked(t *testing.T) {
+	p := DefaultPolicy()
+	if p.AddressBlocked(19) {
+		t.Error("expected 19 failures not to block an address")
+	}
+	if !p.AddressBlocked(20) {
+		t.Error("expected 20 failures to block an address")
+	}
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// FileSink writes each message to its own .eml file instead of sending it
+type FileSink struct {
+	dir         string
+	from        string
+	templateDir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewFileSink returns a FileSink writing to cfg.Dir, creating it if needed
+func NewFileSink(cfg Config) (*FileSink, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("mailer: a directory is required for the file driver")
+	}
+	err := os.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{
+		dir:         cfg.Dir,
+		from:        cfg.From,
+		templateDir: cfg.TemplateDir,
+	}, nil
+}
+
+// Send writes m to a file named after the time it was written
+func (f *FileSink) Send(m models.MailData) error {
+	email, err := compose(m, f.from, f.templateDir)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.seq++
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().Format("20060102-150405.000000"), f.seq)
+	f.mu.Unlock()
+
+	return ioutil.WriteFile(filepath.Join(f.dir, name), []byte(email.GetMessage()), 0644)
+}
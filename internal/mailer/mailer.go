@@ -0,0 +1,86 @@
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/eador/bookings/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Mailer delivers a single message
+type Mailer interface {
+	Send(m models.MailData) error
+}
+
+// Config selects and configures a Mailer
+type Config struct {
+	// Driver is smtp, file or memory
+	Driver string
+
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Encryption is none, starttls or tls
+	Encryption string
+
+	// From is used for messages that do not set their own sender
+	From string
+	// Dir is where the file driver writes .eml files
+	Dir string
+	// TemplateDir holds the layouts named by MailData.Template
+	TemplateDir string
+}
+
+// New returns the Mailer described by cfg
+func New(cfg Config) (Mailer, error) {
+	if cfg.TemplateDir == "" {
+		cfg.TemplateDir = "./email-templates"
+	}
+
+	switch cfg.Driver {
+	case "smtp", "":
+		return NewSMTP(cfg)
+	case "file":
+		return NewFileSink(cfg)
+	case "memory":
+		return &Memory{From: cfg.From}, nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown driver %q", cfg.Driver)
+	}
+}
+
+// compose builds the email for m, filling in the default sender and wrapping the content in its template
+func compose(m models.MailData, from, templateDir string) (*mail.Email, error) {
+	if m.From == "" {
+		m.From = from
+	}
+
+	email := mail.NewMSG()
+	email.SetFrom(m.From).AddTo(m.To).SetSubject(m.Subject)
+
+	html := m.Content
+	if m.Template != "" {
+		data, err := ioutil.ReadFile(filepath.Join(templateDir, filepath.Base(m.Template)))
+		if err != nil {
+			return nil, err
+		}
+		html = strings.Replace(string(data), "[%body%]", m.Content, 1)
+	}
+
+	if m.Text == "" {
+		email.SetBody(mail.TextHTML, html)
+	} else {
+		// a multipart/alternative message, with the preferred HTML part last
+		email.SetBody(mail.TextPlain, m.Text)
+		email.AddAlternative(mail.TextHTML, html)
+	}
+
+	if email.Error != nil {
+		return nil, email.Error
+	}
+	return email, nil
+}
@@ -0,0 +1,238 @@
+package mailer
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+var msg = models.MailData{
+	To:       "john@smith.com",
+	Subject:  "Reservation Confirmation",
+	Content:  "<strong>See you soon</strong>",
+	Template: "basic.html",
+}
+
+// templateDir writes a basic.html layout for tests to use
+func templateDir(t *testing.T) string {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "basic.html"), []byte("<html><body>[%body%]</body></html>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"smtp", Config{Driver: "smtp", Host: "localhost", Port: 1025}, true},
+		{"smtp starttls", Config{Driver: "smtp", Host: "localhost", Port: 587, Encryption: "starttls"}, true},
+		{"smtp tls", Config{Driver: "smtp", Host: "localhost", Port: 465, Encryption: "tls"}, true},
+		{"smtp bad encryption", Config{Driver: "smtp", Host: "localhost", Encryption: "ssl3"}, false},
+		{"smtp no host", Config{Driver: "smtp"}, false},
+		{"file", Config{Driver: "file", Dir: t.TempDir()}, true},
+		{"file no dir", Config{Driver: "file"}, false},
+		{"memory", Config{Driver: "memory"}, true},
+		{"unknown", Config{Driver: "pigeon"}, false},
+	}
+	for _, e := range tests {
+		_, err := New(e.cfg)
+		if (err == nil) != e.ok {
+			t.Errorf("%s: expected ok=%t but got error %v", e.name, e.ok, err)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m, err := New(Config{Driver: "file", Dir: dir, From: "bookings@here.com", TemplateDir: templateDir(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := m.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files but got %d", len(files))
+	}
+
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"From: <bookings@here.com>", "To: <john@smith.com>", "Subject: Reservation Confirmation", "<html><body>"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected the message to contain %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestFileSink_Multipart(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New(Config{Driver: "file", Dir: dir, From: "bookings@here.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Send(models.MailData{
+		To:      "john@smith.com",
+		Subject: "Reservation Confirmation",
+		Content: "<p>See you soon</p>",
+		Text:    "See you soon",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file but got %d", len(files))
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"multipart/alternative", "text/plain", "text/html"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected the message to contain %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestFileSink_MissingTemplate(t *testing.T) {
+	m, err := New(Config{Driver: "file", Dir: t.TempDir(), From: "bookings@here.com", TemplateDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send(msg); !os.IsNotExist(err) {
+		t.Errorf("expected a missing template error but got %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := &Memory{From: "bookings@here.com"}
+	if err := m.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	sent := m.Sent()
+	if len(sent) != 1 || sent[0].From != "bookings@here.com" {
+		t.Errorf("unexpected sent mail %+v", sent)
+	}
+
+	m.Err = errors.New("mailbox full")
+	if err := m.Send(msg); err != m.Err {
+		t.Errorf("expected Err to be returned but got %v", err)
+	}
+	if len(m.Sent()) != 1 {
+		t.Errorf("expected a failed message not to be kept")
+	}
+}
+
+// fakeSMTP accepts one message and passes its data down received
+func fakeSMTP(t *testing.T) (int, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port, received
+}
+
+func TestSMTP(t *testing.T) {
+	port, received := fakeSMTP(t)
+
+	m, err := New(Config{Driver: "smtp", Host: "127.0.0.1", Port: port, From: "bookings@here.com", TemplateDir: templateDir(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := <-received
+	if !strings.Contains(data, "Subject: Reservation Confirmation") {
+		t.Errorf("unexpected message data:\n%s", data)
+	}
+}
+
+func TestSMTP_ConnectError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	m, err := New(Config{Driver: "smtp", Host: "127.0.0.1", Port: port, From: "bookings@here.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send(models.MailData{To: "john@smith.com"}); err == nil {
+		t.Error("expected an error connecting to a closed port")
+	}
+}
@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"sync"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// Memory keeps the messages it is given, for tests
+type Memory struct {
+	// From is used for messages that do not set their own sender
+	From string
+	// Err, when set, is returned by Send instead of keeping the message
+	Err error
+
+	mu   sync.Mutex
+	sent []models.MailData
+}
+
+// Send keeps m, or returns Err
+func (mem *Memory) Send(m models.MailData) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if mem.Err != nil {
+		return mem.Err
+	}
+	if m.From == "" {
+		m.From = mem.From
+	}
+	mem.sent = append(mem.sent, m)
+	return nil
+}
+
+// Sent returns the messages sent so far
+func (mem *Memory) Sent() []models.MailData {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	sent := make([]models.MailData, len(mem.sent))
+	copy(sent, mem.sent)
+	return sent
+}
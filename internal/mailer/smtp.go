@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// SMTP sends mail through an SMTP server, connecting once per message
+type SMTP struct {
+	server      *mail.SMTPServer
+	from        string
+	templateDir string
+}
+
+// NewSMTP returns an SMTP mailer for the server described by cfg
+func NewSMTP(cfg Config) (*SMTP, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("mailer: smtp host is required")
+	}
+
+	server := mail.NewSMTPClient()
+	server.Host = cfg.Host
+	server.Port = cfg.Port
+	server.Username = cfg.Username
+	server.Password = cfg.Password
+	server.KeepAlive = false
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+	server.TLSConfig = &tls.Config{ServerName: cfg.Host}
+
+	switch cfg.Encryption {
+	case "none", "":
+		server.Encryption = mail.EncryptionNone
+	case "starttls":
+		server.Encryption = mail.EncryptionSTARTTLS
+	case "tls":
+		server.Encryption = mail.EncryptionSSLTLS
+	default:
+		return nil, fmt.Errorf("mailer: unknown smtp encryption %q", cfg.Encryption)
+	}
+
+	return &SMTP{
+		server:      server,
+		from:        cfg.From,
+		templateDir: cfg.TemplateDir,
+	}, nil
+}
+
+// Send sends m
+func (s *SMTP) Send(m models.MailData) error {
+	email, err := compose(m, s.from, s.templateDir)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.server.Connect()
+	if err != nil {
+		return err
+	}
+
+	return email.Send(client)
+}
@@ -0,0 +1,148 @@
+package mailqueue
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// Store is the part of the database repository that holds the mail outbox
+type Store interface {
+	ClaimMail(limit int, lease time.Duration) ([]models.OutboxMail, error)
+	MarkMailSent(id int) error
+	RetryMail(id, attempts int, next time.Time, lastErr string) error
+	DeadLetterMail(id, attempts int, lastErr string) error
+}
+
+// SendFunc delivers a single message
+type SendFunc func(m models.MailData) error
+
+// Queue sends the messages in the mail outbox with a pool of workers. A message that fails
+// is retried with exponential backoff until MaxAttempts is reached, then it is dead-lettered.
+type Queue struct {
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	PollInterval time.Duration
+	Lease        time.Duration
+	InfoLog      *log.Logger
+	ErrorLog     *log.Logger
+
+	store  Store
+	send   SendFunc
+	notify <-chan struct{}
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New returns a queue with default settings. A receive on notify wakes a waiting worker,
+// so new mail goes out straight away rather than at the next poll.
+func New(store Store, send SendFunc, notify <-chan struct{}, infoLog, errorLog *log.Logger) *Queue {
+	return &Queue{
+		MaxAttempts:  8,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     2 * time.Hour,
+		PollInterval: 10 * time.Second,
+		Lease:        5 * time.Minute,
+		InfoLog:      infoLog,
+		ErrorLog:     errorLog,
+		store:        store,
+		send:         send,
+		notify:       notify,
+		quit:         make(chan struct{}),
+	}
+}
+
+// Start starts workers goroutines sending mail
+func (q *Queue) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+}
+
+// Stop stops the workers, waiting for any message being sent to finish
+func (q *Queue) Stop() {
+	close(q.quit)
+	q.wg.Wait()
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// keep going while there is mail due, then wait to be told about more
+		for q.ProcessOne() {
+			select {
+			case <-q.quit:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-q.quit:
+			return
+		case <-q.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessOne claims and sends one message that is due, reporting whether there was one
+func (q *Queue) ProcessOne() bool {
+	mail, err := q.store.ClaimMail(1, q.Lease)
+	if err != nil {
+		q.ErrorLog.Println(err)
+		return false
+	}
+	if len(mail) == 0 {
+		return false
+	}
+
+	q.deliver(mail[0])
+	return true
+}
+
+func (q *Queue) deliver(o models.OutboxMail) {
+	err := q.send(o.Mail)
+	if err == nil {
+		if err := q.store.MarkMailSent(o.ID); err != nil {
+			q.ErrorLog.Println(err)
+		}
+		q.InfoLog.Printf("email %d sent to %s", o.ID, o.Mail.To)
+		return
+	}
+
+	attempts := o.Attempts + 1
+	if attempts >= q.MaxAttempts {
+		q.ErrorLog.Printf("email %d to %s failed for the last time: %s", o.ID, o.Mail.To, err)
+		if err := q.store.DeadLetterMail(o.ID, attempts, err.Error()); err != nil {
+			q.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	next := time.Now().Add(q.Backoff(attempts))
+	q.ErrorLog.Printf("email %d to %s failed, retrying at %s: %s", o.ID, o.Mail.To, next.Format(time.RFC3339), err)
+	if err := q.store.RetryMail(o.ID, attempts, next, err.Error()); err != nil {
+		q.ErrorLog.Println(err)
+	}
+}
+
+// Backoff returns how long to wait before the next attempt after attempts failures
+func (q *Queue) Backoff(attempts int) time.Duration {
+	d := q.BaseDelay
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= q.MaxDelay {
+			return q.MaxDelay
+		}
+	}
+	return d
+}
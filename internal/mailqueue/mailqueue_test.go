@@ -0,0 +1,165 @@
+package mailqueue
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// memoryStore is an in memory mail outbox
+type memoryStore struct {
+	mu   sync.Mutex
+	mail map[int]*models.OutboxMail
+}
+
+func newMemoryStore(msgs ...models.MailData) *memoryStore {
+	s := &memoryStore{mail: make(map[int]*models.OutboxMail)}
+	for i, msg := range msgs {
+		s.mail[i+1] = &models.OutboxMail{ID: i + 1, Mail: msg, Status: "pending"}
+	}
+	return s
+}
+
+func (s *memoryStore) ClaimMail(limit int, lease time.Duration) ([]models.OutboxMail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []models.OutboxMail
+	for id := 1; id <= len(s.mail) && len(claimed) < limit; id++ {
+		o := s.mail[id]
+		if (o.Status == "pending" || o.Status == "sending") && !o.NextAttemptAt.After(time.Now()) {
+			o.Status = "sending"
+			o.NextAttemptAt = time.Now().Add(lease)
+			claimed = append(claimed, *o)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) MarkMailSent(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mail[id].Status = "sent"
+	return nil
+}
+
+func (s *memoryStore) RetryMail(id, attempts int, next time.Time, lastErr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.mail[id]
+	o.Status = "pending"
+	o.Attempts = attempts
+	o.NextAttemptAt = next
+	o.LastError = lastErr
+	return nil
+}
+
+func (s *memoryStore) DeadLetterMail(id, attempts int, lastErr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.mail[id]
+	o.Status = "dead"
+	o.Attempts = attempts
+	o.LastError = lastErr
+	return nil
+}
+
+func (s *memoryStore) status(id int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mail[id].Status
+}
+
+var discard = log.New(ioutil.Discard, "", 0)
+
+func TestQueue_Backoff(t *testing.T) {
+	q := New(newMemoryStore(), nil, nil, discard, discard)
+	q.BaseDelay = time.Minute
+	q.MaxDelay = 10 * time.Minute
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, e := range expected {
+		if got := q.Backoff(i + 1); got != e {
+			t.Errorf("after %d attempts expected %s but got %s", i+1, e, got)
+		}
+	}
+}
+
+func TestQueue_ProcessOne(t *testing.T) {
+	store := newMemoryStore(models.MailData{To: "john@smith.com"}, models.MailData{To: "jane@smith.com"})
+	send := func(m models.MailData) error {
+		if m.To == "jane@smith.com" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	q := New(store, send, nil, discard, discard)
+	q.BaseDelay = 0
+	q.MaxAttempts = 3
+
+	for q.ProcessOne() {
+	}
+
+	if store.status(1) != "sent" {
+		t.Errorf("expected message 1 to be sent but it is %s", store.status(1))
+	}
+	if store.status(2) != "dead" {
+		t.Errorf("expected message 2 to be dead but it is %s", store.status(2))
+	}
+	if store.mail[2].Attempts != 3 || store.mail[2].LastError != "connection refused" {
+		t.Errorf("unexpected dead message %+v", store.mail[2])
+	}
+}
+
+func TestQueue_Retry(t *testing.T) {
+	store := newMemoryStore(models.MailData{To: "john@smith.com"})
+	q := New(store, func(models.MailData) error { return errors.New("timeout") }, nil, discard, discard)
+
+	if !q.ProcessOne() {
+		t.Fatal("expected a message to be processed")
+	}
+	if store.status(1) != "pending" || store.mail[1].Attempts != 1 {
+		t.Errorf("expected the message to be pending after one attempt but got %+v", store.mail[1])
+	}
+	if q.ProcessOne() {
+		t.Error("expected the message not to be due until after its backoff")
+	}
+}
+
+func TestQueue_StartStop(t *testing.T) {
+	store := newMemoryStore()
+	notify := make(chan struct{}, 1)
+	sent := make(chan string, 1)
+
+	q := New(store, func(m models.MailData) error {
+		sent <- m.To
+		return nil
+	}, notify, discard, discard)
+	q.PollInterval = time.Hour
+	q.Start(2)
+
+	store.mu.Lock()
+	store.mail[1] = &models.OutboxMail{ID: 1, Mail: models.MailData{To: "john@smith.com"}, Status: "pending"}
+	store.mu.Unlock()
+	notify <- struct{}{}
+
+	select {
+	case to := <-sent:
+		if to != "john@smith.com" {
+			t.Errorf("expected mail to john@smith.com but got %s", to)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected the notified worker to send the message")
+	}
+
+	q.Stop()
+	if store.status(1) != "sent" {
+		t.Errorf("expected the message to be sent but it is %s", store.status(1))
+	}
+}
@@ -1,25 +1,85 @@
 package models
 
 import (
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/status"
 )
 
 // User is the user  model
 type User struct {
-	ID          int
-	FirstName   string
-	LastName    string
-	Email       string
-	Password    string
-	AccessLevel int
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID           int
+	FirstName    string
+	LastName     string
+	Email        string
+	Password     string
+	AccessLevel  int
+	Active       int
+	FailedLogins int
+	LockedUntil  *time.Time
+	// TOTPSecret is the base32 two-factor secret, used when TOTPEnabled is 1.
+	// TOTPLastCounter is the time step of the last code accepted, so no code works twice.
+	TOTPSecret      string
+	TOTPEnabled     int
+	TOTPLastCounter int64
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// Locked reports whether the user is locked out at now
+func (u User) Locked(now time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(now)
 }
 
 // Room is the room model
 type Room struct {
+	ID          int
+	RoomName    string
+	Slug        string
+	Description string
+	Capacity    int
+	Amenities   string
+	// MaxAdults and MaxChildren limit who can stay, on top of Capacity
+	MaxAdults   int
+	MaxChildren int
+	SortOrder   int
+	Retired     int
+	BaseRate    int
+	Currency    string
+	// CancellationPolicyID is the policy for stays in the room, or 0 for the default policy
+	CancellationPolicyID int
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+	Photos               []RoomPhoto
+}
+
+// AmenityList returns the room's amenities, which are stored one per line
+func (r Room) AmenityList() []string {
+	var list []string
+	for _, a := range strings.Split(r.Amenities, "\n") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// Fits reports whether a party of adults and children can stay in the room
+func (r Room) Fits(adults, children int) bool {
+	return adults <= r.MaxAdults && children <= r.MaxChildren && adults+children <= r.Capacity
+}
+
+// RoomPhoto is a photo shown on a room's page
+type RoomPhoto struct {
 	ID        int
-	RoomName  string
+	RoomID    int
+	URL       string
+	Caption   string
+	SortOrder int
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -42,10 +102,402 @@ type Reservation struct {
 	StartDate time.Time
 	EndDate   time.Time
 	RoomID    int
+	Adults    int
+	Children  int
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Room      Room
-	Processed int
+
+	// Status is one of the statuses in the status package, and StatusChangedAt when it last changed
+	Status          string
+	StatusChangedAt *time.Time
+	StatusChanges   []ReservationStatusChange
+
+	ConfirmationCode string
+
+	// GuestID is the guest the reservation was matched to by email when it was booked
+	GuestID int
+
+	// PaymentDueAt is when a reservation made on the website is cancelled and its room released
+	// if it has not been paid for, and is cleared once it has
+	PaymentDueAt *time.Time
+
+	// TotalAmount is what the guest pays for the room: the price of its Nights, less
+	// DiscountAmount for the promo code PromoCode, plus the taxes and fees in Charges
+	TotalAmount    int
+	Currency       string
+	Nights         []ReservationNight
+	PromoCodeID    int
+	PromoCode      string
+	DiscountAmount int
+	Charges        []ReservationCharge
+
+	// CancellationPolicy and CancellationTiers are copied from the cancellation policy in force
+	// when the reservation was booked, so later changes to the policy don't alter it. Reservations
+	// booked before policies were recorded have no CancellationPolicy and use the default one.
+	// CancellationReason and CancellationPenalty are recorded when the reservation is cancelled.
+	CancellationPolicyID int
+	CancellationPolicy   string
+	CancellationTiers    []CancellationTier
+	CancellationReason   string
+	CancellationPenalty  int
+
+	// DeletedAt is set while the reservation is in the trash
+	DeletedAt *time.Time
+
+	// Group holds every reservation booked together under the same confirmation code, this one
+	// included, when more than one room was booked
+	Group []Reservation
+
+	// Payments are the charges and refunds for the whole booking. A group's payments are made
+	// against its first reservation.
+	Payments []Payment
+}
+
+// Guests describes who is staying, e.g. "2 adults, 1 child"
+func (r Reservation) Guests() string {
+	s := fmt.Sprintf("%d adult", r.Adults)
+	if r.Adults != 1 {
+		s += "s"
+	}
+	switch {
+	case r.Children == 1:
+		s += ", 1 child"
+	case r.Children > 1:
+		s += fmt.Sprintf(", %d children", r.Children)
+	}
+	return s
+}
+
+// Reservations returns the reservation for each room booked with r: its group if it has one,
+// otherwise r alone
+func (r Reservation) Reservations() []Reservation {
+	if len(r.Group) > 0 {
+		return r.Group
+	}
+	return []Reservation{r}
+}
+
+// BookingTotal returns the price of every room booked with r, leaving out rooms that have
+// been released
+func (r Reservation) BookingTotal() int {
+	total := 0
+	for _, res := range r.Reservations() {
+		if !status.ReleasesRoom(res.Status) {
+			total += res.TotalAmount
+		}
+	}
+	return total
+}
+
+// BookingDiscount returns the promo code discount on every room booked with r, leaving out rooms
+// that have been released
+func (r Reservation) BookingDiscount() int {
+	discount := 0
+	for _, res := range r.Reservations() {
+		if !status.ReleasesRoom(res.Status) {
+			discount += res.DiscountAmount
+		}
+	}
+	return discount
+}
+
+// ChargesAmount returns the taxes and fees on the reservation
+func (r Reservation) ChargesAmount() int {
+	total := 0
+	for _, c := range r.Charges {
+		total += c.Amount
+	}
+	return total
+}
+
+// BookingCharges returns the taxes and fees on every room booked with r, adding together the
+// charges with the same name and leaving out rooms that have been released
+func (r Reservation) BookingCharges() []ReservationCharge {
+	var charges []ReservationCharge
+	index := make(map[string]int)
+	for _, res := range r.Reservations() {
+		if status.ReleasesRoom(res.Status) {
+			continue
+		}
+		for _, c := range res.Charges {
+			i, ok := index[c.Name]
+			if !ok {
+				index[c.Name] = len(charges)
+				charges = append(charges, c)
+				continue
+			}
+			charges[i].Nights += c.Nights
+			charges[i].TaxableAmount += c.TaxableAmount
+			charges[i].Amount += c.Amount
+		}
+	}
+	return charges
+}
+
+// Paid returns what the guest has paid for the booking, less what has been refunded
+func (r Reservation) Paid() int {
+	paid := 0
+	for _, p := range r.Payments {
+		switch {
+		case p.Kind == payments.Refund && p.Status != payments.Failed:
+			paid -= p.Amount
+		case p.Kind != payments.Refund && p.Status == payments.Captured:
+			paid += p.Amount
+		}
+	}
+	return paid
+}
+
+// BalanceDue returns what is left to pay for the booking
+func (r Reservation) BalanceDue() int {
+	return r.BookingTotal() - r.Paid()
+}
+
+// Guest is someone who has booked, matched to their reservations by Email, which is kept in lower
+// case. Notes are for staff only and never shown to the guest. VIP and DoNotRent are 1 when set.
+type Guest struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Email     string
+	Phone     string
+	Notes     string
+	VIP       int
+	DoNotRent int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Stays, Nights and Spend count the reservations the guest kept, leaving out cancellations
+	// and no shows. Spend is in minor units of Currency. Reservations holds all of the guest's
+	// reservations, newest first, and is only loaded for a single guest.
+	Stays        int
+	Nights       int
+	Spend        int
+	Currency     string
+	Reservations []Reservation
+}
+
+// CountStays sets Stays, Nights and Spend from Reservations
+func (g *Guest) CountStays() {
+	g.Stays, g.Nights, g.Spend = 0, 0, 0
+	for _, r := range g.Reservations {
+		if status.ReleasesRoom(r.Status) {
+			continue
+		}
+		g.Stays++
+		g.Nights += int(r.EndDate.Sub(r.StartDate).Hours() / 24)
+		g.Spend += r.TotalAmount
+		if g.Currency == "" {
+			g.Currency = r.Currency
+		}
+	}
+}
+
+// Payment is a charge to a guest's card for a reservation, or a refund of one. Kind and Status
+// are from the payments package; a refund's ParentID is the charge it pays back.
+type Payment struct {
+	ID            int
+	ReservationID int
+	ParentID      int
+	Provider      string
+	Reference     string
+	Kind          string
+	Status        string
+	Amount        int
+	Currency      string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// ReservationStatusChange records a reservation moving from one status to another. UserID is
+// 0 when the guest or the system made the change.
+type ReservationStatusChange struct {
+	ID            int
+	ReservationID int
+	FromStatus    string
+	ToStatus      string
+	UserID        int
+	User          User
+	CreatedAt     time.Time
+}
+
+// ReservationNight is the price charged for one night of a reservation
+type ReservationNight struct {
+	Night    time.Time
+	RateName string
+	Amount   int
+}
+
+// Charge is a tax or fee added to the price of stays in a room, or every room when RoomID is 0,
+// for nights within a date range. Kind and Basis are from the taxes package; Amount is a rate in
+// hundredths of a percent for the Percent basis and minor units otherwise.
+type Charge struct {
+	ID        int
+	RoomID    int
+	Name      string
+	Kind      string
+	Basis     string
+	Amount    int
+	StartDate time.Time
+	EndDate   time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ReservationCharge is a tax or fee charged on a reservation, copied from the Charge it was
+// worked out from so later changes to the charge don't alter it. Nights counts the nights it was
+// charged for and TaxableAmount the room price they cost. Reservation is only filled in for
+// reports.
+type ReservationCharge struct {
+	ID            int
+	ReservationID int
+	ChargeID      int
+	Name          string
+	Kind          string
+	Basis         string
+	Rate          int
+	Nights        int
+	TaxableAmount int
+	Amount        int
+	Reservation   Reservation
+}
+
+// RateOverride replaces a room's base rate for nights within a date range, optionally
+// only on some weekdays. When several overrides match a night the highest priority wins.
+// CancellationPolicyID, when set, replaces the room's cancellation policy for stays that
+// arrive on a night the override prices.
+type RateOverride struct {
+	ID                   int
+	RoomID               int
+	Name                 string
+	StartDate            time.Time
+	EndDate              time.Time
+	Weekdays             string
+	NightlyRate          int
+	Priority             int
+	CancellationPolicyID int
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+// CancellationPolicy decides what a guest pays to cancel a stay. The tier with the most days
+// before arrival that the cancellation still meets sets the penalty; cancelling later than every
+// tier costs the full price.
+type CancellationPolicy struct {
+	ID          int
+	Name        string
+	Description string
+	Tiers       []CancellationTier
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// CancellationTier charges Percent of a room's price for cancelling at least Days days before arrival
+type CancellationTier struct {
+	Days    int
+	Percent int
+}
+
+// Cancellation records why a booking was cancelled and the penalty each cancelled reservation,
+// by id, was charged under its cancellation policy
+type Cancellation struct {
+	Reason    string
+	Penalties map[int]int
+}
+
+// StayRule limits the stays that can be booked with an arrival date within a date range. A
+// RoomID of 0 applies the rule to every room, and a zero limit or empty weekday list is not
+// enforced.
+type StayRule struct {
+	ID                int
+	RoomID            int
+	Name              string
+	StartDate         time.Time
+	EndDate           time.Time
+	MinNights         int
+	MaxNights         int
+	ArrivalWeekdays   string
+	DepartureWeekdays string
+	MinLeadDays       int
+	MaxHorizonDays    int
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// WaitlistEntry is a guest waiting for a room to come free for a stay. RoomIDs lists the rooms
+// they would take, or is empty for any room that sleeps them. Once a room is held for them, RoomID
+// is the room, RoomRestrictionID the hold and HoldExpiresAt when the hold lapses. Status is from
+// the waitlist package.
+type WaitlistEntry struct {
+	ID                int
+	FirstName         string
+	LastName          string
+	Email             string
+	StartDate         time.Time
+	EndDate           time.Time
+	Adults            int
+	Children          int
+	RoomIDs           []int
+	Status            string
+	RoomID            int
+	Room              Room
+	RoomRestrictionID int
+	HoldExpiresAt     time.Time
+	ReservationID     int
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// WantsRoom reports whether the guest would take the room with id
+func (e WaitlistEntry) WantsRoom(id int) bool {
+	if len(e.RoomIDs) == 0 {
+		return true
+	}
+	for _, r := range e.RoomIDs {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PromoCode takes Amount off the price of a stay: a percentage for the promo package's Percent
+// kind, or minor units of Currency for Fixed. The codes can only be used between ValidFrom and
+// ValidUntil, for stays between StayFrom and StayUntil, and for the rooms in RoomIDs; a zero date
+// or empty list is not enforced. MaxUses limits how many bookings use the code and MaxUsesPerGuest
+// how many each guest does, with 0 for no limit. Redemptions counts the bookings that have.
+type PromoCode struct {
+	ID              int
+	Code            string
+	Description     string
+	Kind            string
+	Amount          int
+	Currency        string
+	ValidFrom       time.Time
+	ValidUntil      time.Time
+	StayFrom        time.Time
+	StayUntil       time.Time
+	RoomIDs         []int
+	MaxUses         int
+	MaxUsesPerGuest int
+	Active          int
+	Redemptions     int
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// CoversRoom reports whether the code can be used for the room with id
+func (p PromoCode) CoversRoom(id int) bool {
+	if len(p.RoomIDs) == 0 {
+		return true
+	}
+	for _, r := range p.RoomIDs {
+		if r == id {
+			return true
+		}
+	}
+	return false
 }
 
 // RoomRestriction is the RoomRestriction model
@@ -63,11 +515,93 @@ type RoomRestriction struct {
 	Restriction   Restriction
 }
 
-// MailData holds an email message
+// CalendarBlock records a room block created from one night of an event in an imported calendar
+type CalendarBlock struct {
+	ID                int
+	RoomID            int
+	Source            string
+	UID               string
+	Night             time.Time
+	RoomRestrictionID int
+}
+
+// MailData holds an email message. Content is HTML; Text, when set, is sent alongside it as
+// the plain text alternative. Template names a layout to wrap Content in.
 type MailData struct {
 	To       string
 	From     string
 	Subject  string
 	Content  string
+	Text     string
 	Template string
 }
+
+// OutboxMail is an email waiting in, or sent from, the mail outbox. Status is one of
+// pending, sending, sent or dead; dead messages have used up their attempts.
+type OutboxMail struct {
+	ID            int
+	Mail          MailData
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// UserToken records an invite or password reset token sent to a user. Only a hash of the
+// token is kept, and UsedAt is set when it is redeemed so it works once.
+type UserToken struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// LoginAttempt records an attempt to log in. UserID is 0 when the email address is not a user's.
+// Outcome says why it failed, or "succeeded".
+type LoginAttempt struct {
+	ID        int
+	Email     string
+	IPAddress string
+	UserID    int
+	Succeeded int
+	Outcome   string
+	CreatedAt time.Time
+}
+
+// Actor is who made a change, recorded with it in the audit log. UserID is 0 for changes
+// made by the system.
+type Actor struct {
+	UserID    int
+	IPAddress string
+}
+
+// AuditEvent records one change to the data: who made it, what they did, and the changed
+// record as JSON before and after. Before is empty for something added, After for something deleted.
+type AuditEvent struct {
+	ID        int
+	UserID    int
+	Action    string
+	Entity    string
+	EntityID  int
+	Before    string
+	After     string
+	IPAddress string
+	CreatedAt time.Time
+	User      User
+}
+
+// AuditFilter narrows the audit log. Zero values match everything; End is exclusive.
+type AuditFilter struct {
+	ReservationID int
+	UserID        int
+	Start         time.Time
+	End           time.Time
+	Limit         int
+}
@@ -1,6 +1,9 @@
 package models
 
-import "github.com/eador/bookings/internal/forms"
+import (
+	"github.com/eador/bookings/internal/access"
+	"github.com/eador/bookings/internal/forms"
+)
 
 // TemplateData holds data sent from handlers to template
 type TemplateData struct {
@@ -14,4 +17,10 @@ type TemplateData struct {
 	Error           string
 	Form            *forms.Form
 	IsAuthenticated int
+	AccessLevel     int
+}
+
+// Can reports whether the logged in user has permission, so templates can hide what they may not do
+func (td *TemplateData) Can(permission string) bool {
+	return access.Can(td.AccessLevel, access.Permission(permission))
 }
@@ -0,0 +1,169 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// The card tokens the fake provider understands
+const (
+	CardOK       = "tok_visa"
+	CardDeclined = "tok_declined"
+)
+
+// TestCard describes a card token for choosing one by hand
+type TestCard struct {
+	Token string
+	Name  string
+}
+
+// TestCards lists the card tokens the fake provider understands
+var TestCards = []TestCard{
+	{CardOK, "Visa ending 4242 (succeeds)"},
+	{CardDeclined, "Visa ending 0002 (declined)"},
+}
+
+// Fake is a Provider that keeps payments in memory, for development and tests. Webhooks are
+// signed with an HMAC-SHA256 of the body, hex encoded.
+type Fake struct {
+	webhookSecret []byte
+
+	mu       sync.Mutex
+	seq      int
+	payments map[string]*fakePayment
+}
+
+type fakePayment struct {
+	authorized int
+	captured   int
+	refunded   int
+}
+
+// NewFake returns a Fake that signs webhooks with secret
+func NewFake(secret string) *Fake {
+	return &Fake{
+		webhookSecret: []byte(secret),
+		payments:      make(map[string]*fakePayment),
+	}
+}
+
+// Name identifies the provider
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// Authorize holds amount on a test card
+func (f *Fake) Authorize(amount int, currency, token, description string) (string, error) {
+	if amount <= 0 {
+		return "", errors.New("payments: amount must be positive")
+	}
+	switch token {
+	case CardOK:
+	case CardDeclined:
+		return "", ErrDeclined
+	default:
+		return "", fmt.Errorf("payments: unknown card token %q", token)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	ref := fmt.Sprintf("pay_%06d", f.seq)
+	f.payments[ref] = &fakePayment{authorized: amount}
+	return ref, nil
+}
+
+// Capture takes up to the amount held by an authorization
+func (f *Fake) Capture(reference string, amount int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[reference]
+	if !ok {
+		return fmt.Errorf("payments: unknown payment %q", reference)
+	}
+	if p.captured > 0 {
+		return errors.New("payments: already captured")
+	}
+	if amount <= 0 || amount > p.authorized {
+		return errors.New("payments: capture amount is more than was authorized")
+	}
+	p.captured = amount
+	return nil
+}
+
+// Refund pays back some of a captured payment, or releases an authorization
+func (f *Fake) Refund(reference string, amount int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[reference]
+	if !ok {
+		return "", fmt.Errorf("payments: unknown payment %q", reference)
+	}
+	if p.captured == 0 {
+		p.authorized = 0
+	} else {
+		if amount <= 0 || amount > p.captured-p.refunded {
+			return "", errors.New("payments: refund amount is more than is left of the payment")
+		}
+		p.refunded += amount
+	}
+
+	f.seq++
+	return fmt.Sprintf("re_%06d", f.seq), nil
+}
+
+// fakeEvents maps the fake provider's event types to the payment status they report
+var fakeEvents = map[string]string{
+	"payment.captured": Captured,
+	"payment.failed":   Failed,
+	"refund.succeeded": Succeeded,
+	"refund.failed":    Failed,
+}
+
+// VerifyWebhook checks a webhook's signature and reads its event, a JSON object with a type
+// and a reference
+func (f *Fake) VerifyWebhook(body []byte, signature string) (Event, error) {
+	var e Event
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, f.sign(body)) {
+		return e, ErrInvalidSignature
+	}
+
+	var payload struct {
+		Type      string `json:"type"`
+		Reference string `json:"reference"`
+	}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return e, err
+	}
+	status, ok := fakeEvents[payload.Type]
+	if !ok {
+		return e, fmt.Errorf("payments: unknown event type %q", payload.Type)
+	}
+
+	e.Type = payload.Type
+	e.Reference = payload.Reference
+	e.Status = status
+	return e, nil
+}
+
+// Sign returns the signature the fake provider sends with a webhook body
+func (f *Fake) Sign(body []byte) string {
+	return hex.EncodeToString(f.sign(body))
+}
+
+func (f *Fake) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, f.webhookSecret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
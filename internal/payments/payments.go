@@ -0,0 +1,100 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of payment recorded against a reservation. Deposits and full payments are
+// charges to the guest's card; refunds pay some of a charge back.
+const (
+	Deposit = "deposit"
+	Full    = "full"
+	Refund  = "refund"
+)
+
+// The statuses a payment moves through. Charges are Authorized and then Captured; refunds
+// are Pending until the provider reports they Succeeded. Either can fail.
+const (
+	Authorized = "authorized"
+	Captured   = "captured"
+	Pending    = "pending"
+	Succeeded  = "succeeded"
+	Failed     = "failed"
+)
+
+var (
+	// ErrDeclined is returned when the guest's card is declined
+	ErrDeclined = errors.New("payments: card declined")
+	// ErrInvalidSignature is returned when a webhook was not signed by the provider
+	ErrInvalidSignature = errors.New("payments: invalid webhook signature")
+	// ErrFakeInProduction is returned by New when asked for the fake provider in production
+	ErrFakeInProduction = errors.New("payments: the fake provider can't be used in production")
+	// ErrNoWebhookSecret is returned by New when there is no webhook secret in production
+	ErrNoWebhookSecret = errors.New("payments: a webhook secret is required in production")
+)
+
+// Provider takes payments from guests' cards. Amounts are in minor units (cents).
+type Provider interface {
+	// Name identifies the provider in payment records
+	Name() string
+	// Authorize holds amount on the card a token stands for, returning the provider's reference for the payment
+	Authorize(amount int, currency, token, description string) (string, error)
+	// Capture takes up to the amount held by an authorization
+	Capture(reference string, amount int) error
+	// Refund pays amount of a captured payment back to the card, or releases an authorization that
+	// was never captured, returning the provider's reference for the refund
+	Refund(reference string, amount int) (string, error)
+	// VerifyWebhook checks that a webhook body was signed by the provider and reads the event it reports
+	VerifyWebhook(body []byte, signature string) (Event, error)
+}
+
+// Event is a change to a payment or refund reported by a provider's webhook
+type Event struct {
+	Type      string
+	Reference string
+	// Status is the payment's new status
+	Status string
+}
+
+// Config selects and configures a Provider
+type Config struct {
+	// Driver is the provider to use. Only fake is built in, and it is the default outside
+	// production.
+	Driver string
+	// WebhookSecret is shared with the provider to sign webhooks
+	WebhookSecret string
+	// Production refuses the fake provider, which accepts its test cards from anyone and forgets
+	// payments on restart, and an empty webhook secret, which would let anyone sign webhooks
+	Production bool
+}
+
+// New returns the Provider described by cfg
+func New(cfg Config) (Provider, error) {
+	driver := cfg.Driver
+	if driver == "" && !cfg.Production {
+		driver = "fake"
+	}
+	if cfg.Production {
+		if driver == "fake" {
+			return nil, ErrFakeInProduction
+		}
+		if cfg.WebhookSecret == "" {
+			return nil, ErrNoWebhookSecret
+		}
+	}
+
+	switch driver {
+	case "fake":
+		return NewFake(cfg.WebhookSecret), nil
+	case "":
+		return nil, errors.New("payments: no driver configured")
+	default:
+		return nil, fmt.Errorf("payments: unknown driver %q", cfg.Driver)
+	}
+}
+
+// DepositAmount returns percent of total, rounded up to the next cent
+func DepositAmount(total, percent int) int {
+	return (total*percent + 99) / 100
+}
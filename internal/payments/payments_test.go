@@ -0,0 +1,110 @@
+package payments
+
+import "testing"
+
+func TestFake_Payment(t *testing.T) {
+	f := NewFake("secret")
+
+	ref, err := f.Authorize(10000, "USD", CardOK, "Reservation ABCD2345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Capture(ref, 12000); err == nil {
+		t.Error("expected an error capturing more than was authorized")
+	}
+	if err = f.Capture(ref, 10000); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Capture(ref, 10000); err == nil {
+		t.Error("expected an error capturing twice")
+	}
+
+	if _, err = f.Refund(ref, 6000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Refund(ref, 6000); err == nil {
+		t.Error("expected an error refunding more than was left")
+	}
+	if _, err = f.Refund("pay_unknown", 100); err == nil {
+		t.Error("expected an error refunding an unknown payment")
+	}
+}
+
+func TestFake_Declined(t *testing.T) {
+	f := NewFake("secret")
+
+	if _, err := f.Authorize(10000, "USD", CardDeclined, ""); err != ErrDeclined {
+		t.Errorf("expected ErrDeclined but got %v", err)
+	}
+	if _, err := f.Authorize(10000, "USD", "tok_stolen", ""); err == nil {
+		t.Error("expected an error for an unknown card")
+	}
+	if _, err := f.Authorize(0, "USD", CardOK, ""); err == nil {
+		t.Error("expected an error for a zero amount")
+	}
+}
+
+func TestFake_VerifyWebhook(t *testing.T) {
+	f := NewFake("secret")
+	body := []byte(`{"type":"refund.succeeded","reference":"re_000002"}`)
+
+	e, err := f.VerifyWebhook(body, f.Sign(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Reference != "re_000002" || e.Status != Succeeded {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if _, err = f.VerifyWebhook(body, NewFake("other").Sign(body)); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature but got %v", err)
+	}
+	if _, err = f.VerifyWebhook(body, "not hex"); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature but got %v", err)
+	}
+
+	unknown := []byte(`{"type":"payment.disputed","reference":"pay_000001"}`)
+	if _, err = f.VerifyWebhook(unknown, f.Sign(unknown)); err == nil {
+		t.Error("expected an error for an unknown event type")
+	}
+}
+
+func TestDepositAmount(t *testing.T) {
+	if d := DepositAmount(38000, 20); d != 7600 {
+		t.Errorf("expected 7600 but got %d", d)
+	}
+	if d := DepositAmount(12999, 20); d != 2600 {
+		t.Errorf("expected the deposit rounded up to 2600 but got %d", d)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   Config
+		fails bool
+	}{
+		{"default outside production", Config{}, false},
+		{"fake outside production", Config{Driver: "fake"}, false},
+		{"fake in production", Config{Driver: "fake", WebhookSecret: "secret", Production: true}, true},
+		{"no driver in production", Config{WebhookSecret: "secret", Production: true}, true},
+		{"no secret in production", Config{Driver: "fake", Production: true}, true},
+		{"unknown driver", Config{Driver: "nope"}, true},
+	}
+	for _, e := range tests {
+		p, err := New(e.cfg)
+		if e.fails && err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+		if !e.fails && (err != nil || p == nil) {
+			t.Errorf("%s: unexpected error %v", e.name, err)
+		}
+	}
+
+	if _, err := New(Config{Driver: "fake", WebhookSecret: "secret", Production: true}); err != ErrFakeInProduction {
+		t.Errorf("expected ErrFakeInProduction but got %v", err)
+	}
+	if _, err := New(Config{Driver: "other", Production: true}); err != ErrNoWebhookSecret {
+		t.Errorf("expected ErrNoWebhookSecret but got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// BaseRateName is the rate name recorded for nights charged at the room's base rate
+const BaseRateName = "Standard"
+
+// ErrInvalidDates is returned when the departure date is not after the arrival date
+var ErrInvalidDates = errors.New("departure must be after arrival")
+
+// Quote holds the price of a stay, broken down by night
+type Quote struct {
+	RoomID   int
+	Currency string
+	Nights   []models.ReservationNight
+	Total    int
+}
+
+// Calculate prices a stay in room from start up to, but not including, end. Each night is
+// charged at the highest priority override that covers it, or the room's base rate if none do.
+func Calculate(room models.Room, overrides []models.RateOverride, start, end time.Time) (Quote, error) {
+	q := Quote{
+		RoomID:   room.ID,
+		Currency: room.Currency,
+	}
+	if q.Currency == "" {
+		q.Currency = "USD"
+	}
+
+	if !end.After(start) {
+		return q, ErrInvalidDates
+	}
+
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		night := models.ReservationNight{
+			Night:    d,
+			RateName: BaseRateName,
+			Amount:   room.BaseRate,
+		}
+
+		if best := RateFor(overrides, d); best != nil {
+			night.RateName = best.Name
+			night.Amount = best.NightlyRate
+		}
+
+		q.Nights = append(q.Nights, night)
+		q.Total += night.Amount
+	}
+
+	return q, nil
+}
+
+// RateFor returns the highest priority override that covers the night starting on d, or nil if
+// the night is charged at the room's base rate
+func RateFor(overrides []models.RateOverride, d time.Time) *models.RateOverride {
+	var best *models.RateOverride
+	for i := range overrides {
+		o := &overrides[i]
+		if !Applies(*o, d) {
+			continue
+		}
+		if best == nil || o.Priority > best.Priority {
+			best = o
+		}
+	}
+	return best
+}
+
+// Applies reports whether an override covers the night starting on d. The override's
+// date range is inclusive and an empty Weekdays list matches every day of the week.
+func Applies(o models.RateOverride, d time.Time) bool {
+	if d.Before(o.StartDate) || d.After(o.EndDate) {
+		return false
+	}
+	if strings.TrimSpace(o.Weekdays) == "" {
+		return true
+	}
+	for _, w := range strings.Split(o.Weekdays, ",") {
+		day, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil {
+			continue
+		}
+		if time.Weekday(day) == d.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatMoney formats an amount in minor units (cents) for display, e.g. 12900 USD is "$129.00"
+func FormatMoney(amount int, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	value := fmt.Sprintf("%d.%02d", amount/100, amount%100)
+
+	switch currency {
+	case "USD", "":
+		return sign + "$" + value
+	case "EUR":
+		return sign + "€" + value
+	case "GBP":
+		return sign + "£" + value
+	default:
+		return sign + value + " " + currency
+	}
+}
+
+// ParseMoney converts an amount typed in major units, such as "129" or "129.50", into minor units (cents)
+func ParseMoney(s string) (int, error) {
+	s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), "$"))
+	if s == "" {
+		return 0, errors.New("amount is empty")
+	}
+
+	whole, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if len(frac) > 2 {
+		return 0, errors.New("amount has more than two decimal places")
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	if whole == "" {
+		whole = "0"
+	}
+
+	w, err := strconv.Atoi(whole)
+	if err != nil || w < 0 {
+		return 0, errors.New("amount is not a valid number")
+	}
+	f, err := strconv.Atoi(frac)
+	if err != nil || f < 0 {
+		return 0, errors.New("amount is not a valid number")
+	}
+	return w*100 + f, nil
+}
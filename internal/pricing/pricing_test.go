@@ -0,0 +1,122 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+var room = models.Room{
+	ID:       1,
+	RoomName: "General's Quarters",
+	BaseRate: 10000,
+	Currency: "USD",
+}
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestCalculate_BaseRate(t *testing.T) {
+	q, err := Calculate(room, nil, date("2050-01-03"), date("2050-01-06"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Nights) != 3 {
+		t.Errorf("expected 3 nights but got %d", len(q.Nights))
+	}
+	if q.Total != 30000 {
+		t.Errorf("expected total of 30000 but got %d", q.Total)
+	}
+	if q.Currency != "USD" {
+		t.Errorf("expected currency USD but got %s", q.Currency)
+	}
+}
+
+func TestCalculate_Overrides(t *testing.T) {
+	overrides := []models.RateOverride{
+		{Name: "Winter", StartDate: date("2050-01-01"), EndDate: date("2050-01-31"), NightlyRate: 8000, Priority: 1},
+		// 2050-01-07 is a Friday and 2050-01-08 a Saturday
+		{Name: "Weekend", StartDate: date("2050-01-01"), EndDate: date("2050-12-31"), Weekdays: "5,6", NightlyRate: 12000, Priority: 10},
+		{Name: "Holiday", StartDate: date("2050-01-08"), EndDate: date("2050-01-08"), NightlyRate: 20000, Priority: 20},
+	}
+
+	q, err := Calculate(room, overrides, date("2050-01-06"), date("2050-01-10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		rate   string
+		amount int
+	}{
+		{"Winter", 8000},
+		{"Weekend", 12000},
+		{"Holiday", 20000},
+		{"Winter", 8000},
+	}
+	if len(q.Nights) != len(expected) {
+		t.Fatalf("expected %d nights but got %d", len(expected), len(q.Nights))
+	}
+	for i, e := range expected {
+		if q.Nights[i].RateName != e.rate || q.Nights[i].Amount != e.amount {
+			t.Errorf("night %d: expected %s %d but got %s %d", i, e.rate, e.amount, q.Nights[i].RateName, q.Nights[i].Amount)
+		}
+	}
+	if q.Total != 48000 {
+		t.Errorf("expected total of 48000 but got %d", q.Total)
+	}
+}
+
+func TestCalculate_InvalidDates(t *testing.T) {
+	_, err := Calculate(room, nil, date("2050-01-06"), date("2050-01-06"))
+	if err != ErrInvalidDates {
+		t.Errorf("expected ErrInvalidDates but got %v", err)
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int
+		currency string
+		expected string
+	}{
+		{12900, "USD", "$129.00"},
+		{5, "USD", "$0.05"},
+		{-1050, "EUR", "-€10.50"},
+		{100000, "CHF", "1000.00 CHF"},
+	}
+	for _, e := range tests {
+		if got := FormatMoney(e.amount, e.currency); got != e.expected {
+			t.Errorf("FormatMoney(%d, %s): expected %s but got %s", e.amount, e.currency, e.expected, got)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+		ok       bool
+	}{
+		{"129", 12900, true},
+		{"129.5", 12950, true},
+		{"$129.05", 12905, true},
+		{".99", 99, true},
+		{"", 0, false},
+		{"12.345", 0, false},
+		{"abc", 0, false},
+		{"-5", 0, false},
+	}
+	for _, e := range tests {
+		got, err := ParseMoney(e.input)
+		if (err == nil) != e.ok {
+			t.Errorf("ParseMoney(%q): expected ok=%t but got error %v", e.input, e.ok, err)
+		}
+		if e.ok && got != e.expected {
+			t.Errorf("ParseMoney(%q): expected %d but got %d", e.input, e.expected, got)
+		}
+	}
+}
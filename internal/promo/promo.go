@@ -0,0 +1,143 @@
+package promo
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// The kinds of discount a promo code gives
+const (
+	Percent = "percent"
+	Fixed   = "fixed"
+)
+
+// The reasons a promo code can't be used
+var (
+	ErrInvalid    = errors.New("promo code not valid")
+	ErrNotStarted = errors.New("promo code not valid yet")
+	ErrExpired    = errors.New("promo code expired")
+	ErrStayDates  = errors.New("promo code not valid for the stay dates")
+	ErrRoom       = errors.New("promo code not valid for the rooms")
+	ErrUsedUp     = errors.New("promo code used up")
+	ErrGuestLimit = errors.New("promo code already used by the guest")
+)
+
+var codeRegex = regexp.MustCompile(`^[A-Z0-9]+(-[A-Z0-9]+)*$`)
+
+// ValidCode reports whether a normalized code only has letters, numbers and single dashes
+func ValidCode(code string) bool {
+	return codeRegex.MatchString(code)
+}
+
+// Normalize tidies a code as typed by a guest so it matches however they capitalised it
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Check returns why code can't be used for a stay in the rooms roomIDs from start up to end, or
+// nil if it can. uses is how many bookings have used the code and guestUses how many of them were
+// the guest's. The code's date ranges are inclusive and now is the current time.
+func Check(code models.PromoCode, roomIDs []int, start, end, now time.Time, uses, guestUses int) error {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	if code.Active != 1 {
+		return ErrInvalid
+	}
+	if !code.ValidFrom.IsZero() && today.Before(code.ValidFrom) {
+		return ErrNotStarted
+	}
+	if !code.ValidUntil.IsZero() && today.After(code.ValidUntil) {
+		return ErrExpired
+	}
+
+	if !CoversStay(code, start, end) {
+		return ErrStayDates
+	}
+
+	covered := false
+	for _, id := range roomIDs {
+		if code.CoversRoom(id) {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return ErrRoom
+	}
+
+	if code.MaxUses > 0 && uses >= code.MaxUses {
+		return ErrUsedUp
+	}
+	if code.MaxUsesPerGuest > 0 && guestUses >= code.MaxUsesPerGuest {
+		return ErrGuestLimit
+	}
+	return nil
+}
+
+// CoversStay reports whether every night of a stay from start up to end falls within the code's
+// stay dates
+func CoversStay(code models.PromoCode, start, end time.Time) bool {
+	lastNight := end.AddDate(0, 0, -1)
+	if !code.StayFrom.IsZero() && start.Before(code.StayFrom) {
+		return false
+	}
+	return code.StayUntil.IsZero() || !lastNight.After(code.StayUntil)
+}
+
+// Apply takes code's discount off the rooms in group it covers, recording it on each reservation,
+// and returns the discount in all. Each room is discounted by a percentage code, while a fixed
+// code is taken off once for the booking, from the rooms in order. No room goes below nothing.
+func Apply(code models.PromoCode, group []models.Reservation) int {
+	left := code.Amount
+	discount := 0
+	for i := range group {
+		res := &group[i]
+		res.PromoCodeID = code.ID
+		res.PromoCode = code.Code
+		res.DiscountAmount = 0
+		if !code.CoversRoom(res.RoomID) {
+			continue
+		}
+
+		var d int
+		switch code.Kind {
+		case Percent:
+			d = (res.TotalAmount*code.Amount + 50) / 100
+		case Fixed:
+			d = left
+		}
+		if d > res.TotalAmount {
+			d = res.TotalAmount
+		}
+		left -= d
+
+		res.DiscountAmount = d
+		res.TotalAmount -= d
+		discount += d
+	}
+	return discount
+}
+
+// Message explains to a guest why the code they entered was refused
+func Message(err error) string {
+	switch {
+	case errors.Is(err, ErrNotStarted):
+		return "This promo code can't be used yet"
+	case errors.Is(err, ErrExpired):
+		return "This promo code has expired"
+	case errors.Is(err, ErrStayDates):
+		return "This promo code can't be used for these dates"
+	case errors.Is(err, ErrRoom):
+		return "This promo code can't be used for the room you chose"
+	case errors.Is(err, ErrUsedUp):
+		return "This promo code has been used up"
+	case errors.Is(err, ErrGuestLimit):
+		return "You have already used this promo code"
+	default:
+		return "This promo code is not valid"
+	}
+}
@@ -0,0 +1,134 @@
+package promo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestCheck(t *testing.T) {
+	summer := models.PromoCode{
+		Kind:            Percent,
+		Amount:          10,
+		ValidFrom:       date("2050-01-01"),
+		ValidUntil:      date("2050-05-31"),
+		StayFrom:        date("2050-06-01"),
+		StayUntil:       date("2050-08-31"),
+		RoomIDs:         []int{1},
+		MaxUses:         100,
+		MaxUsesPerGuest: 1,
+		Active:          1,
+	}
+	now := date("2050-03-01").Add(15 * time.Hour)
+
+	tests := []struct {
+		name      string
+		change    func(p *models.PromoCode)
+		rooms     []int
+		start     string
+		end       string
+		now       time.Time
+		uses      int
+		guestUses int
+		expected  error
+	}{
+		{"valid", nil, []int{1}, "2050-06-01", "2050-06-03", now, 0, 0, nil},
+		{"one of the rooms", nil, []int{2, 1}, "2050-06-01", "2050-06-03", now, 0, 0, nil},
+		{"last night is the last stay date", nil, []int{1}, "2050-08-30", "2050-09-01", now, 0, 0, nil},
+		{"last day it can be used", nil, []int{1}, "2050-06-01", "2050-06-03", date("2050-05-31").Add(23 * time.Hour), 0, 0, nil},
+		{"inactive", func(p *models.PromoCode) { p.Active = 0 }, []int{1}, "2050-06-01", "2050-06-03", now, 0, 0, ErrInvalid},
+		{"too soon", nil, []int{1}, "2050-06-01", "2050-06-03", date("2049-12-31"), 0, 0, ErrNotStarted},
+		{"too late", nil, []int{1}, "2050-06-01", "2050-06-03", date("2050-06-01"), 0, 0, ErrExpired},
+		{"arrives before the stay dates", nil, []int{1}, "2050-05-31", "2050-06-03", now, 0, 0, ErrStayDates},
+		{"stays past the stay dates", nil, []int{1}, "2050-08-31", "2050-09-02", now, 0, 0, ErrStayDates},
+		{"another room", nil, []int{2}, "2050-06-01", "2050-06-03", now, 0, 0, ErrRoom},
+		{"used up", nil, []int{1}, "2050-06-01", "2050-06-03", now, 100, 0, ErrUsedUp},
+		{"guest used it already", nil, []int{1}, "2050-06-01", "2050-06-03", now, 5, 1, ErrGuestLimit},
+		{"no limits", func(p *models.PromoCode) {
+			*p = models.PromoCode{Kind: Fixed, Amount: 1000, Active: 1}
+		}, []int{2}, "2000-01-01", "2000-01-02", now, 1000, 1000, nil},
+	}
+
+	for _, e := range tests {
+		p := summer
+		if e.change != nil {
+			e.change(&p)
+		}
+		err := Check(p, e.rooms, date(e.start), date(e.end), e.now, e.uses, e.guestUses)
+		if !errors.Is(err, e.expected) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	group := func() []models.Reservation {
+		return []models.Reservation{
+			{RoomID: 1, TotalAmount: 30000},
+			{RoomID: 2, TotalAmount: 20000},
+			{RoomID: 3, TotalAmount: 3000},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		code     models.PromoCode
+		expected []int
+	}{
+		{"percent off each room", models.PromoCode{ID: 1, Code: "TEN", Kind: Percent, Amount: 10}, []int{3000, 2000, 300}},
+		{"percent off some rooms", models.PromoCode{ID: 1, Code: "TEN", Kind: Percent, Amount: 10, RoomIDs: []int{2}}, []int{0, 2000, 0}},
+		{"fixed off the booking", models.PromoCode{ID: 1, Code: "FLAT", Kind: Fixed, Amount: 5000}, []int{5000, 0, 0}},
+		{"fixed spread over the rooms", models.PromoCode{ID: 1, Code: "FLAT", Kind: Fixed, Amount: 32000, RoomIDs: []int{1, 3}}, []int{30000, 0, 2000}},
+		{"fixed more than the booking", models.PromoCode{ID: 1, Code: "FLAT", Kind: Fixed, Amount: 100000}, []int{30000, 20000, 3000}},
+	}
+
+	for _, e := range tests {
+		g := group()
+		before := group()
+		total := Apply(e.code, g)
+
+		sum := 0
+		for i, res := range g {
+			if res.DiscountAmount != e.expected[i] {
+				t.Errorf("%s: expected room %d discounted by %d but got %d", e.name, res.RoomID, e.expected[i], res.DiscountAmount)
+			}
+			if res.TotalAmount != before[i].TotalAmount-e.expected[i] {
+				t.Errorf("%s: expected room %d to cost %d but got %d", e.name, res.RoomID, before[i].TotalAmount-e.expected[i], res.TotalAmount)
+			}
+			if res.PromoCodeID != e.code.ID || res.PromoCode != e.code.Code {
+				t.Errorf("%s: expected the code recorded on room %d", e.name, res.RoomID)
+			}
+			sum += e.expected[i]
+		}
+		if total != sum {
+			t.Errorf("%s: expected a discount of %d but got %d", e.name, sum, total)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if code := Normalize("  summer-50 "); code != "SUMMER-50" || !ValidCode(code) {
+		t.Errorf("unexpected code %q", code)
+	}
+	for _, code := range []string{"", "SUMMER 50", "-SUMMER", "SUMMER--50", "SÜMMER"} {
+		if ValidCode(code) {
+			t.Errorf("expected %q not to be valid", code)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	if Message(ErrUsedUp) != "This promo code has been used up" {
+		t.Errorf("unexpected message %q", Message(ErrUsedUp))
+	}
+	if Message(errors.New("some error")) != "This promo code is not valid" {
+		t.Errorf("unexpected message %q", Message(errors.New("some error")))
+	}
+}
@@ -9,16 +9,25 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/eador/bookings/internal/cancellation"
 	"github.com/eador/bookings/internal/config"
 	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/pricing"
+	"github.com/eador/bookings/internal/status"
+	"github.com/eador/bookings/internal/taxes"
 	"github.com/justinas/nosurf"
 )
 
 var functions = template.FuncMap{
-	"humanDate":  HumanDate,
-	"formatDate": FormatDate,
-	"iterate":    Iterate,
-	"add":        Add,
+	"humanDate":         HumanDate,
+	"formatDate":        FormatDate,
+	"iterate":           Iterate,
+	"add":               Add,
+	"money":             pricing.FormatMoney,
+	"statusName":        status.Name,
+	"upcoming":          status.Upcoming,
+	"rate":              taxes.FormatRate,
+	"cancellationTerms": cancellation.Describe,
 }
 
 var app *config.AppConfig
@@ -58,6 +67,7 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	td.CSRFToken = nosurf.Token(r)
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
+		td.AccessLevel = app.Session.GetInt(r.Context(), "access_level")
 	}
 
 	return td
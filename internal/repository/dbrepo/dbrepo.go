@@ -13,8 +13,9 @@ type postgresDBRepo struct {
 }
 
 type testDBRepo struct {
-	App *config.AppConfig
-	DB  *sql.DB
+	App      *config.AppConfig
+	DB       *sql.DB
+	settings map[string]string
 }
 
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
@@ -26,6 +27,7 @@ func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo
 
 func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 	return &testDBRepo{
-		App: a,
+		App:      a,
+		settings: make(map[string]string),
 	}
 }
@@ -2,16 +2,60 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/eador/bookings/internal/cancellation"
 	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/promo"
+	"github.com/eador/bookings/internal/repository"
+	"github.com/eador/bookings/internal/status"
+	"github.com/eador/bookings/internal/taxes"
+	"github.com/eador/bookings/internal/waitlist"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
-	return true
+// AllUsers returns all users, ordered by name
+func (m *postgresDBRepo) AllUsers() ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []models.User
+
+	query := `select ` + userColumns + ` from users order by last_name, first_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+	return users, nil
+}
+
+// UpdateUserAccessLevel sets the access level (role) of a user
+func (m *postgresDBRepo) UpdateUserAccessLevel(actor models.Actor, id, accessLevel int) error {
+	return m.changeUser(actor, id, "role", `update users set access_level = $1, updated_at = $2 where id = $3`,
+		accessLevel, time.Now())
 }
 
 // InsertReservation inserts a reservation into the database
@@ -22,8 +66,8 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 	var newID int
 
 	stmt := `insert into reservations (first_name, last_name, email, phone, start_date,
-		end_date, room_id, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+		end_date, room_id, confirmation_code, total_amount, currency, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id`
 
 	err := m.DB.QueryRowContext(ctx, stmt,
 		res.FirstName,
@@ -33,6 +77,9 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 		res.StartDate,
 		res.EndDate,
 		res.RoomID,
+		res.ConfirmationCode,
+		res.TotalAmount,
+		res.Currency,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -66,6 +113,193 @@ func (m *postgresDBRepo) InsertRoomRestricition(r models.RoomRestriction) error
 	return nil
 }
 
+// CreateReservation inserts a reservation and its room restriction in a single transaction.
+// The room row is locked for the duration of the transaction so that concurrent bookings for
+// the same room are serialised, and availability is checked again before anything is written.
+func (m *postgresDBRepo) CreateReservation(res models.Reservation) (int, error) {
+	ids, err := m.CreateReservations([]models.Reservation{res})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// CreateReservations books several rooms at once, inserting each reservation and its room
+// restriction in a single transaction so either every room is booked or none is. It returns
+// repository.ErrRoomUnavailable if any of the rooms has been taken for its dates.
+func (m *postgresDBRepo) CreateReservations(group []models.Reservation) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = lockRooms(ctx, tx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkPromoCodeUses(ctx, tx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := insertReservations(ctx, tx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// lockRooms locks the rooms booked by group until tx ends, in the same order every time so two
+// group bookings can't deadlock
+func lockRooms(ctx context.Context, tx *sql.Tx, group []models.Reservation) error {
+	roomIDs := make([]int, 0, len(group))
+	for _, res := range group {
+		roomIDs = append(roomIDs, res.RoomID)
+	}
+	sort.Ints(roomIDs)
+	for _, id := range roomIDs {
+		var roomID int
+		err := tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, id).Scan(&roomID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPromoCodeUses locks the promo code used by group, if it has one, until tx ends and checks
+// the booking would not take it over its limits, returning promo.ErrUsedUp or promo.ErrGuestLimit
+// if it would
+func checkPromoCodeUses(ctx context.Context, tx *sql.Tx, group []models.Reservation) error {
+	res := group[0]
+	if res.PromoCodeID == 0 {
+		return nil
+	}
+
+	var maxUses, maxUsesPerGuest int
+	query := `select max_uses, max_uses_per_guest from promo_codes where id = $1 for update`
+	err := tx.QueryRowContext(ctx, query, res.PromoCodeID).Scan(&maxUses, &maxUsesPerGuest)
+	if err != nil {
+		return err
+	}
+
+	uses, guestUses, err := countPromoCodeUses(ctx, tx, res.PromoCodeID, res.Email)
+	if err != nil {
+		return err
+	}
+	if maxUses > 0 && uses >= maxUses {
+		return promo.ErrUsedUp
+	}
+	if maxUsesPerGuest > 0 && guestUses >= maxUsesPerGuest {
+		return promo.ErrGuestLimit
+	}
+	return nil
+}
+
+// insertReservations inserts each reservation in group with its room restriction and nights,
+// returning repository.ErrRoomUnavailable if any of the rooms has been taken for its dates. The
+// rooms must already be locked.
+func insertReservations(ctx context.Context, tx *sql.Tx, group []models.Reservation) ([]int, error) {
+	var ids []int
+	for _, res := range group {
+		var numRows int
+		query := `
+			select
+				count(id)
+			from
+				room_restrictions
+			where
+				room_id = $1 and
+				$2 < end_date and $3 > start_date`
+		err := tx.QueryRowContext(ctx, query, res.RoomID, res.StartDate, res.EndDate).Scan(&numRows)
+		if err != nil {
+			return nil, err
+		}
+		if numRows > 0 {
+			return nil, repository.ErrRoomUnavailable
+		}
+
+		guestID, err := matchGuest(ctx, tx, res)
+		if err != nil {
+			return nil, err
+		}
+
+		var newID int
+		stmt := `insert into reservations (first_name, last_name, email, phone, start_date,
+			end_date, room_id, adults, children, confirmation_code, total_amount, currency,
+			promo_code_id, discount_amount, cancellation_policy_id, cancellation_policy, cancellation_tiers,
+			guest_id, payment_due_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+			returning id`
+
+		err = tx.QueryRowContext(ctx, stmt,
+			res.FirstName,
+			res.LastName,
+			res.Email,
+			res.Phone,
+			res.StartDate,
+			res.EndDate,
+			res.RoomID,
+			res.Adults,
+			res.Children,
+			res.ConfirmationCode,
+			res.TotalAmount,
+			res.Currency,
+			nullInt(res.PromoCodeID),
+			res.DiscountAmount,
+			nullInt(res.CancellationPolicyID),
+			res.CancellationPolicy,
+			cancellation.FormatTiers(res.CancellationTiers),
+			nullInt(guestID),
+			res.PaymentDueAt,
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+		if err != nil {
+			return nil, err
+		}
+
+		stmt = `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+			created_at, updated_at, restriction_id)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+
+		_, err = tx.ExecContext(ctx, stmt,
+			res.StartDate,
+			res.EndDate,
+			res.RoomID,
+			newID,
+			time.Now(),
+			time.Now(),
+			1,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = insertReservationNights(ctx, tx, newID, res.Nights)
+		if err != nil {
+			return nil, err
+		}
+
+		err = insertReservationCharges(ctx, tx, newID, res.Charges)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, newID)
+	}
+	return ids, nil
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if availability exists for roomID, and false if no availability exists
 func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start time.Time, end time.Time, roomID int) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -92,7 +326,8 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start time.Time, end
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms if any for a given start and end date
-func (m *postgresDBRepo) SearchAvailablitiyForAllRooms(start, end time.Time) ([]models.Room, error) {
+// that can sleep a party of adults and children
+func (m *postgresDBRepo) SearchAvailablitiyForAllRooms(start, end time.Time, adults, children int) ([]models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -100,20 +335,24 @@ func (m *postgresDBRepo) SearchAvailablitiyForAllRooms(start, end time.Time) ([]
 
 	query := `
 		select
-			r.id, r.room_name
+			` + roomColumns + `
 		from
 			rooms r
 		where
+			r.retired = 0 and
+			r.max_adults >= $3 and r.max_children >= $4 and r.capacity >= $3 + $4 and
 			r.id not in 
-			(select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date)`
+			(select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date)
+		order by r.sort_order, r.room_name`
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	rows, err := m.DB.QueryContext(ctx, query, start, end, adults, children)
 	if err != nil {
 		return rooms, err
 	}
+	defer rows.Close()
+
 	for rows.Next() {
-		var room models.Room
-		err := rows.Scan(&room.ID, &room.RoomName)
+		room, err := scanRoom(rows)
 		if err != nil {
 			return rooms, err
 		}
@@ -130,17 +369,15 @@ func (m *postgresDBRepo) GetRoomById(id int) (models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var room models.Room
-
 	query := `
-		select id, room_name, created_at, updated_at from rooms where id = $1`
+		select ` + roomColumns + ` from rooms where id = $1`
 	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&room.ID,
-		&room.RoomName,
-		&room.CreatedAt,
-		&room.UpdatedAt,
-	)
+	room, err := scanRoom(row)
+	if err != nil {
+		return room, err
+	}
+
+	room.Photos, err = m.getRoomPhotos(ctx, room.ID)
 	if err != nil {
 		return room, err
 	}
@@ -152,26 +389,9 @@ func (m *postgresDBRepo) GetUserByID(id int) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var user models.User
-
-	query := `
-		select id, first_name, last_name, email, password, access_level, created_at, updated_at from users where id = $1`
+	query := `select ` + userColumns + ` from users where id = $1`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&user.ID,
-		&user.FirstName,
-		&user.LastName,
-		&user.Email,
-		&user.Password,
-		&user.AccessLevel,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-	if err != nil {
-		return user, err
-	}
-	return user, nil
+	return scanUser(m.DB.QueryRowContext(ctx, query, id))
 }
 
 // UpdateUser updates a user in the database
@@ -180,7 +400,8 @@ func (m *postgresDBRepo) UpdateUser(u models.User) error {
 	defer cancel()
 
 	query := `
-		update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5`
+		update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
+		where id = $6`
 
 	_, err := m.DB.ExecContext(ctx, query,
 		u.FirstName,
@@ -188,6 +409,7 @@ func (m *postgresDBRepo) UpdateUser(u models.User) error {
 		u.Email,
 		u.AccessLevel,
 		time.Now(),
+		u.ID,
 	)
 	if err != nil {
 		return err
@@ -195,321 +417,3937 @@ func (m *postgresDBRepo) UpdateUser(u models.User) error {
 	return nil
 }
 
-// Authenticate authentices a user
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+// GetUserByEmail returns a user by email address
+func (m *postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var id int
-	var hashedPassword string
-
-	row := m.DB.QueryRowContext(ctx, "select id, password from users where email = $1", email)
-	err := row.Scan(&id, &hashedPassword)
-	if err != nil {
-		return 0, "", err
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
-	} else if err != nil {
-		return 0, "", err
-	}
+	query := `select ` + userColumns + ` from users where lower(email) = lower($1)`
 
-	return id, hashedPassword, nil
+	return scanUser(m.DB.QueryRowContext(ctx, query, email))
 }
 
-// AllReservations returns a slice of all reservations
-func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
+// InsertUser adds a user, without a password; they choose one when they accept their invite
+func (m *postgresDBRepo) InsertUser(actor models.Actor, u models.User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var reservations []models.Reservation
-	query := `select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		order by r.start_date asc`
-
-	rows, err := m.DB.QueryContext(ctx, query)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return reservations, err
+		return 0, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var i models.Reservation
-		err := rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Processed,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
-		if err != nil {
-			return reservations, err
-		}
-		reservations = append(reservations, i)
+	defer tx.Rollback()
 
-	}
+	stmt := `insert into users (first_name, last_name, email, password, access_level, active, created_at, updated_at)
+		values ($1, $2, $3, '', $4, 1, $5, $6) returning ` + userColumns
 
-	if err = rows.Err(); err != nil {
-		return reservations, err
+	after, err := scanUser(tx.QueryRowContext(ctx, stmt,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.AccessLevel,
+		time.Now(),
+		time.Now(),
+	))
+	if err != nil {
+		return 0, err
 	}
 
-	return reservations, nil
-}
-
-// NewReservations returns a slice of all reservations
-func (m *postgresDBRepo) NewReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var reservations []models.Reservation
-	query := `select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		where processed = 0
-		order by r.start_date asc`
-
-	rows, err := m.DB.QueryContext(ctx, query)
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "create",
+		Entity:   "user",
+		EntityID: after.ID,
+	}, nil, userSnapshot(after))
 	if err != nil {
-		return reservations, err
+		return 0, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var i models.Reservation
-		err := rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Processed,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
-		if err != nil {
-			return reservations, err
-		}
-		reservations = append(reservations, i)
 
+	if err = tx.Commit(); err != nil {
+		return 0, err
 	}
+	return after.ID, nil
+}
 
-	if err = rows.Err(); err != nil {
-		return reservations, err
+// UpdateUserActive activates (1) or deactivates (0) a user. A deactivated user can't log in.
+func (m *postgresDBRepo) UpdateUserActive(actor models.Actor, id, active int) error {
+	action := "deactivate"
+	if active == 1 {
+		action = "activate"
 	}
-
-	return reservations, nil
+	return m.changeUser(actor, id, action, `update users set active = $1, updated_at = $2 where id = $3`,
+		active, time.Now())
 }
 
-// GetReservationByID gets a reservation from the database using the ID
-func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
+// UpdatePassword hashes password with bcrypt and stores it for a user
+func (m *postgresDBRepo) UpdatePassword(id int, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var reservation models.Reservation
-	query := `select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		where r.id = $1
-		order by r.start_date asc`
-
-	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&reservation.ID,
-		&reservation.FirstName,
-		&reservation.LastName,
-		&reservation.Email,
-		&reservation.Phone,
-		&reservation.StartDate,
-		&reservation.EndDate,
-		&reservation.RoomID,
-		&reservation.CreatedAt,
-		&reservation.UpdatedAt,
-		&reservation.Processed,
-		&reservation.Room.ID,
-		&reservation.Room.RoomName,
-	)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
-		return reservation, err
+		return err
 	}
-	return reservation, nil
-
-}
 
-// UpdateReservation updates a user in the database
-func (m *postgresDBRepo) UpdateReservation(r models.Reservation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `
-		update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
-		where id = $6`
+	query := `update users set password = $1, updated_at = $2 where id = $3`
 
-	_, err := m.DB.ExecContext(ctx, query,
-		r.FirstName,
-		r.LastName,
-		r.Email,
-		r.Phone,
-		time.Now(),
-		r.ID,
-	)
+	_, err = m.DB.ExecContext(ctx, query, string(hashedPassword), time.Now(), id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// DeleteReservation deletes one reservation by id
-func (m *postgresDBRepo) DeleteReservation(id int) error {
+// InsertUserToken records an invite or password reset token
+func (m *postgresDBRepo) InsertUserToken(t models.UserToken) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `delete from reservations where id = $1`
+	stmt := `insert into user_tokens (user_id, purpose, token_hash, expires_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6)`
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	_, err := m.DB.ExecContext(ctx, stmt,
+		t.UserID,
+		t.Purpose,
+		t.TokenHash,
+		t.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// UpdatedProcessedForReservation updates processed for a reservation by id
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
+// UseUserToken marks an unused, unexpired token as used and returns the user it was issued to.
+// It returns sql.ErrNoRows if there is no such token, so each token works only once.
+func (m *postgresDBRepo) UseUserToken(hash, purpose string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `update reservations set processed = $1 where id = $2`
+	var userID int
 
-	_, err := m.DB.ExecContext(ctx, query, processed, id)
+	stmt := `
+		update user_tokens set used_at = $1, updated_at = $1
+		where token_hash = $2 and purpose = $3 and used_at is null and expires_at > $1
+		returning user_id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, time.Now(), hash, purpose).Scan(&userID)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return userID, nil
 }
 
-func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
+// dummyPasswordHash is compared against when no user has the email address, so an unknown
+// address takes as long to refuse as a wrong password
+var dummyPasswordHash = []byte("$2a$12$Hp3HQuODF.D0dl3xf5HWaOW3JbtMYjHQ8zNgU00cSTBvLdErCT0Mq")
+
+// Authenticate authentices a user. It returns repository.ErrInvalidCredentials, after the same
+// amount of work, for an unknown or deactivated email address and for a wrong password.
+func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var rooms []models.Room
-
-	query := `select id, room_name, created_at, updated_at from rooms order by room_name`
+	var id int
+	var hashedPassword string
 
-	rows, err := m.DB.QueryContext(ctx, query)
-	if err != nil {
-		return rooms, err
+	row := m.DB.QueryRowContext(ctx, "select id, password from users where lower(email) = lower($1) and active = 1", email)
+	err := row.Scan(&id, &hashedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(testPassword))
+		return 0, "", repository.ErrInvalidCredentials
+	} else if err != nil {
+		return 0, "", err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var rm models.Room
-		err := rows.Scan(
-			&rm.ID,
-			&rm.RoomName,
-			&rm.CreatedAt,
-			&rm.UpdatedAt,
-		)
-		if err != nil {
-			return rooms, err
-		}
-		rooms = append(rooms, rm)
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword || err == bcrypt.ErrHashTooShort {
+		// users who have not accepted their invite have no password yet
+		return 0, "", repository.ErrInvalidCredentials
+	} else if err != nil {
+		return 0, "", err
 	}
 
-	if err = rows.Err(); err != nil {
-		return rooms, err
-	}
+	return id, hashedPassword, nil
+}
 
-	return rooms, nil
+// userColumns is the column list scanned by scanUser. It leaves out the password hash,
+// which only Authenticate reads.
+const userColumns = `id, first_name, last_name, email, access_level, active, failed_logins,
+	locked_until, totp_secret, totp_enabled, totp_last_counter, created_at, updated_at`
+
+// scanUser scans a row selected with userColumns into a user
+func scanUser(row scanner) (models.User, error) {
+	var u models.User
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.AccessLevel,
+		&u.Active,
+		&u.FailedLogins,
+		&u.LockedUntil,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastCounter,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	)
+	return u, err
 }
 
-// GetRestrictionsForRoomByDate resturns restrictions for a room by a date range
-func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+// RecordFailedLogin counts a failed login against a user and returns how many there have been in a row
+func (m *postgresDBRepo) RecordFailedLogin(id int) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var restrictions []models.RoomRestriction
+	var failures int
 
-	query := `select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
-			from room_restrictions where $1 < end_date and $2 >= start_date
-			and room_id = $3`
+	stmt := `update users set failed_logins = failed_logins + 1, updated_at = $1 where id = $2 returning failed_logins`
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	err := m.DB.QueryRowContext(ctx, stmt, time.Now(), id).Scan(&failures)
 	if err != nil {
-		return restrictions, err
+		return 0, err
+	}
+	return failures, nil
+}
+
+// LockUser stops a user logging in until the given time
+func (m *postgresDBRepo) LockUser(id int, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update users set locked_until = $1, updated_at = $2 where id = $3`, until, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnlockUser lifts any lock on a user and clears their count of failed logins
+func (m *postgresDBRepo) UnlockUser(actor models.Actor, id int) error {
+	return m.changeUser(actor, id, "unlock", `update users set failed_logins = 0, locked_until = null, updated_at = $1
+		where id = $2`, time.Now())
+}
+
+// changeUser runs stmt, an update whose last placeholder is the id of the user it changes, and
+// records the change in the audit log as action. It returns sql.ErrNoRows if there is no such user.
+func (m *postgresDBRepo) changeUser(actor models.Actor, id int, action, stmt string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `select ` + userColumns + ` from users where id = $1`
+
+	before, err := scanUser(tx.QueryRowContext(ctx, query+` for update`, id))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, stmt, append(args, id)...)
+	if err != nil {
+		return err
+	}
+
+	after, err := scanUser(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return err
+	}
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   action,
+		Entity:   "user",
+		EntityID: id,
+	}, userSnapshot(before), userSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditUser is the part of a user kept in the audit log. It leaves out their two-factor secret.
+type auditUser struct {
+	ID           int    `json:"id"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Email        string `json:"email"`
+	AccessLevel  int    `json:"access_level"`
+	Active       int    `json:"active"`
+	FailedLogins int    `json:"failed_logins"`
+	LockedUntil  string `json:"locked_until,omitempty"`
+	TOTPEnabled  int    `json:"totp_enabled"`
+}
+
+// userSnapshot returns u as it is recorded in the audit log
+func userSnapshot(u models.User) auditUser {
+	a := auditUser{
+		ID:           u.ID,
+		FirstName:    u.FirstName,
+		LastName:     u.LastName,
+		Email:        u.Email,
+		AccessLevel:  u.AccessLevel,
+		Active:       u.Active,
+		FailedLogins: u.FailedLogins,
+		TOTPEnabled:  u.TOTPEnabled,
+	}
+	if u.LockedUntil != nil {
+		a.LockedUntil = u.LockedUntil.Format(time.RFC3339)
+	}
+	return a
+}
+
+// LockedUsers returns the users who are locked out now
+func (m *postgresDBRepo) LockedUsers() ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []models.User
+
+	query := `select ` + userColumns + ` from users where locked_until > $1 order by locked_until desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return users, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var r models.RoomRestriction
+		u, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+	return users, nil
+}
+
+// InsertLoginAttempt records a login attempt
+func (m *postgresDBRepo) InsertLoginAttempt(a models.LoginAttempt) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID interface{}
+	if a.UserID > 0 {
+		userID = a.UserID
+	}
+
+	stmt := `insert into login_attempts (email, ip_address, user_id, succeeded, outcome, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		a.Email,
+		a.IPAddress,
+		userID,
+		a.Succeeded,
+		a.Outcome,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CountFailedLoginsFromIP returns how many failed logins came from an address since a time
+func (m *postgresDBRepo) CountFailedLoginsFromIP(ip string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+
+	query := `select count(id) from login_attempts where ip_address = $1 and succeeded = 0 and created_at > $2`
+
+	err := m.DB.QueryRowContext(ctx, query, ip, since).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// RecentLoginAttempts returns the latest login attempts, newest first
+func (m *postgresDBRepo) RecentLoginAttempts(limit int) ([]models.LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var attempts []models.LoginAttempt
+
+	query := `
+		select id, email, ip_address, coalesce(user_id, 0), succeeded, outcome, created_at
+		from login_attempts order by created_at desc, id desc limit $1`
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return attempts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.LoginAttempt
 		err := rows.Scan(
-			&r.ID,
-			&r.ReservationID,
-			&r.RestrictionID,
-			&r.RoomID,
-			&r.StartDate,
-			&r.EndDate,
+			&a.ID,
+			&a.Email,
+			&a.IPAddress,
+			&a.UserID,
+			&a.Succeeded,
+			&a.Outcome,
+			&a.CreatedAt,
 		)
 		if err != nil {
-			return restrictions, err
+			return attempts, err
 		}
-		restrictions = append(restrictions, r)
+		attempts = append(attempts, a)
 	}
 
 	if err = rows.Err(); err != nil {
-		return restrictions, err
+		return attempts, err
 	}
+	return attempts, nil
+}
 
-	return restrictions, nil
+// reservationColumns are the columns of a reservation and its room's name, selected from
+// reservations r left joined to rooms rm
+const reservationColumns = `r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+	r.end_date, r.room_id, r.adults, r.children, r.created_at, r.updated_at, r.status, r.status_changed_at,
+	r.confirmation_code, coalesce(r.guest_id, 0), r.payment_due_at, r.total_amount, r.currency, coalesce(r.promo_code_id, 0),
+	coalesce((select pc.code from promo_codes pc where pc.id = r.promo_code_id), ''), r.discount_amount,
+	coalesce(r.cancellation_policy_id, 0), r.cancellation_policy, r.cancellation_tiers, r.cancellation_reason,
+	r.cancellation_penalty, r.deleted_at, rm.id, rm.room_name`
+
+// scanReservation scans a row selected with reservationColumns into a reservation
+func scanReservation(row scanner) (models.Reservation, error) {
+	var r models.Reservation
+	var tiers string
+	err := row.Scan(
+		&r.ID,
+		&r.FirstName,
+		&r.LastName,
+		&r.Email,
+		&r.Phone,
+		&r.StartDate,
+		&r.EndDate,
+		&r.RoomID,
+		&r.Adults,
+		&r.Children,
+		&r.CreatedAt,
+		&r.UpdatedAt,
+		&r.Status,
+		&r.StatusChangedAt,
+		&r.ConfirmationCode,
+		&r.GuestID,
+		&r.PaymentDueAt,
+		&r.TotalAmount,
+		&r.Currency,
+		&r.PromoCodeID,
+		&r.PromoCode,
+		&r.DiscountAmount,
+		&r.CancellationPolicyID,
+		&r.CancellationPolicy,
+		&tiers,
+		&r.CancellationReason,
+		&r.CancellationPenalty,
+		&r.DeletedAt,
+		&r.Room.ID,
+		&r.Room.RoomName,
+	)
+	if err != nil {
+		return r, err
+	}
+	r.CancellationTiers, err = cancellation.ParseTiers(tiers)
+	return r, err
+}
+
+// AllReservations returns a slice of all reservations, except those in the trash
+func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
+	return m.listReservations(`select ` + reservationColumns + `
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.deleted_at is null
+		order by r.start_date asc`)
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+// NewReservations returns the reservations still pending, except those in the trash
+func (m *postgresDBRepo) NewReservations() ([]models.Reservation, error) {
+	return m.ReservationsByStatus(status.Pending)
+}
+
+// ReservationsByStatus returns the reservations with a status, except those in the trash
+func (m *postgresDBRepo) ReservationsByStatus(st string) ([]models.Reservation, error) {
+	return m.listReservations(`select `+reservationColumns+`
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.status = $1 and r.deleted_at is null
+		order by r.start_date asc`, st)
+}
+
+// listReservations runs a query that selects reservationColumns and returns the reservations
+func (m *postgresDBRepo) listReservations(query string, args ...interface{}) ([]models.Reservation, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id,
-		created_at, updated_at) values ($1, $2, $3, $4, $5, $6)`
+	var reservations []models.Reservation
 
-	_, err := m.DB.ExecContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		log.Println(err)
-		return err
+		return reservations, err
 	}
-	return nil
+	defer rows.Close()
+
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, res)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
 }
 
-// DeleteBlockByID deletes a room restriction
-func (m *postgresDBRepo) DeleteBlockByID(id int) error {
+// GetReservationByID gets a reservation from the database using the ID, even if it is in the
+// trash, with its nights, taxes and fees and status history
+func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `delete from room_restrictions where id = $1`
+	query := `select ` + reservationColumns + `
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.id = $1`
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	reservation, err := scanReservation(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return reservation, err
+	}
+
+	reservation.Nights, err = m.getReservationNights(ctx, reservation.ID)
+	if err != nil {
+		return reservation, err
+	}
+
+	reservation.StatusChanges, err = m.getReservationStatusChanges(ctx, reservation.ID)
+	if err != nil {
+		return reservation, err
+	}
+
+	reservation.Charges, err = m.getReservationCharges(ctx, reservation.ID)
+	if err != nil {
+		return reservation, err
+	}
+
+	reservation.Group, err = m.getReservationGroup(ctx, reservation)
+	if err != nil {
+		return reservation, err
+	}
+	for i := range reservation.Group {
+		reservation.Group[i].Charges, err = m.getReservationCharges(ctx, reservation.Group[i].ID)
+		if err != nil {
+			return reservation, err
+		}
+	}
+
+	reservation.Payments, err = m.getPayments(ctx, reservation.Reservations()[0].ID)
+	if err != nil {
+		return reservation, err
+	}
+	return reservation, nil
+}
+
+// getPayments returns the charges and refunds made against a reservation, oldest first
+func (m *postgresDBRepo) getPayments(ctx context.Context, reservationID int) ([]models.Payment, error) {
+	var list []models.Payment
+
+	query := `select id, reservation_id, coalesce(parent_id, 0), provider, reference, kind, status,
+		amount, currency, created_at, updated_at
+		from payments where reservation_id = $1 order by id`
+
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.Payment
+		err := rows.Scan(
+			&p.ID,
+			&p.ReservationID,
+			&p.ParentID,
+			&p.Provider,
+			&p.Reference,
+			&p.Kind,
+			&p.Status,
+			&p.Amount,
+			&p.Currency,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return list, err
+	}
+
+	return list, nil
+}
+
+// InsertPayment records a payment against a reservation. A charge clears the payment deadline of
+// the reservations booked with it, and returns repository.ErrPaymentTooLate if they have already
+// been released for not being paid in time, or repository.ErrAlreadyPaid if the booking already
+// has a captured charge.
+func (m *postgresDBRepo) InsertPayment(p models.Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if p.Kind != payments.Refund {
+		var st, code string
+		query := `select status, confirmation_code from reservations where id = $1 for update`
+		err = tx.QueryRowContext(ctx, query, p.ReservationID).Scan(&st, &code)
+		if err != nil {
+			return 0, err
+		}
+		if status.ReleasesRoom(st) {
+			return 0, repository.ErrPaymentTooLate
+		}
+
+		// the lock on the reservation makes a second checkout of the booking wait here until the
+		// first has recorded its charge
+		var paid bool
+		query = `select exists (select 1 from payments p join reservations r on r.id = p.reservation_id
+			where (r.id = $1 or (r.confirmation_code = $2 and r.confirmation_code <> ''))
+				and p.kind <> $3 and p.status = $4)`
+		err = tx.QueryRowContext(ctx, query, p.ReservationID, code, payments.Refund, payments.Captured).Scan(&paid)
+		if err != nil {
+			return 0, err
+		}
+		if paid {
+			return 0, repository.ErrAlreadyPaid
+		}
+
+		_, err = tx.ExecContext(ctx, `update reservations set payment_due_at = null, updated_at = $1
+			where (id = $2 or (confirmation_code = $3 and confirmation_code <> '')) and payment_due_at is not null`,
+			time.Now(), p.ReservationID, code)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var parentID interface{}
+	if p.ParentID != 0 {
+		parentID = p.ParentID
+	}
+
+	var newID int
+	stmt := `insert into payments (reservation_id, parent_id, provider, reference, kind, status,
+		amount, currency, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		p.ReservationID,
+		parentID,
+		p.Provider,
+		p.Reference,
+		p.Kind,
+		p.Status,
+		p.Amount,
+		p.Currency,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// UpdatePaymentStatus sets the status of the payment a provider knows by reference, returning
+// sql.ErrNoRows if there is none
+func (m *postgresDBRepo) UpdatePaymentStatus(provider, reference, to string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update payments set status = $1, updated_at = $2 where provider = $3 and reference = $4`
+
+	result, err := m.DB.ExecContext(ctx, query, to, time.Now(), provider, reference)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
+
+// getReservationGroup returns the reservations booked together with res, res included, or nil
+// if res was booked on its own. Reservations in the trash are left out.
+func (m *postgresDBRepo) getReservationGroup(ctx context.Context, res models.Reservation) ([]models.Reservation, error) {
+	if res.ConfirmationCode == "" {
+		return nil, nil
+	}
+
+	query := `select ` + reservationColumns + `
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.confirmation_code = $1 and (r.deleted_at is null or r.id = $2)
+		order by r.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, res.ConfirmationCode, res.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var group []models.Reservation
+	for rows.Next() {
+		r, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		group = append(group, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(group) < 2 {
+		return nil, nil
+	}
+	return group, nil
+}
+
+// getReservationStatusChanges returns a reservation's status history, oldest first
+func (m *postgresDBRepo) getReservationStatusChanges(ctx context.Context, reservationID int) ([]models.ReservationStatusChange, error) {
+	var changes []models.ReservationStatusChange
+
+	query := `select c.id, c.reservation_id, c.from_status, c.to_status, coalesce(c.user_id, 0),
+		coalesce(u.first_name, ''), coalesce(u.last_name, ''), c.created_at
+		from reservation_status_changes c
+		left join users u on (c.user_id = u.id)
+		where c.reservation_id = $1
+		order by c.created_at, c.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return changes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ReservationStatusChange
+		err := rows.Scan(
+			&c.ID,
+			&c.ReservationID,
+			&c.FromStatus,
+			&c.ToStatus,
+			&c.UserID,
+			&c.User.FirstName,
+			&c.User.LastName,
+			&c.CreatedAt,
+		)
+		if err != nil {
+			return changes, err
+		}
+		c.User.ID = c.UserID
+		changes = append(changes, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return changes, err
+	}
+
+	return changes, nil
+}
+
+// UpdateReservation updates a reservation's guest details, recording the change in the audit log
+func (m *postgresDBRepo) UpdateReservation(actor models.Actor, r models.Reservation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getReservationForUpdate(ctx, tx, r.ID)
+	if err != nil {
+		return err
+	}
+
+	// a new email address may belong to another guest
+	guestID := before.GuestID
+	if guestEmail(r.Email) != guestEmail(before.Email) {
+		guestID, err = matchGuest(ctx, tx, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, guest_id = $5,
+		updated_at = $6
+		where id = $7`
+
+	_, err = tx.ExecContext(ctx, query,
+		r.FirstName,
+		r.LastName,
+		r.Email,
+		r.Phone,
+		nullInt(guestID),
+		time.Now(),
+		r.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.FirstName = r.FirstName
+	after.LastName = r.LastName
+	after.Email = r.Email
+	after.Phone = r.Phone
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "update",
+		Entity:   "reservation",
+		EntityID: r.ID,
+	}, reservationSnapshot(before), reservationSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteReservation moves a reservation to the trash and releases its room restrictions,
+// recording it in the audit log
+func (m *postgresDBRepo) DeleteReservation(actor models.Actor, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getReservationForUpdate(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `update reservations set deleted_at = $1, updated_at = $1 where id = $2`, now, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from room_restrictions where reservation_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.DeletedAt = &now
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "delete",
+		Entity:   "reservation",
+		EntityID: id,
+	}, reservationSnapshot(before), reservationSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeletedReservations returns the reservations in the trash, most recently deleted first
+func (m *postgresDBRepo) DeletedReservations() ([]models.Reservation, error) {
+	return m.listReservations(`select ` + reservationColumns + `
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.deleted_at is not null
+		order by r.deleted_at desc`)
+}
+
+// RestoreReservation takes a reservation out of the trash and books its room again, returning
+// repository.ErrRoomUnavailable if its dates have been taken since it was deleted
+func (m *postgresDBRepo) RestoreReservation(actor models.Actor, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getReservationForUpdate(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt == nil {
+		return nil
+	}
+
+	// a cancelled or no show reservation released its room already, so has nothing to book
+	if !status.ReleasesRoom(before.Status) {
+		var roomID int
+		err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, before.RoomID).Scan(&roomID)
+		if err != nil {
+			return err
+		}
+
+		var numRows int
+		query := `
+			select
+				count(id)
+			from
+				room_restrictions
+			where
+				room_id = $1 and
+				$2 < end_date and $3 > start_date`
+		err = tx.QueryRowContext(ctx, query, before.RoomID, before.StartDate, before.EndDate).Scan(&numRows)
+		if err != nil {
+			return err
+		}
+		if numRows > 0 {
+			return repository.ErrRoomUnavailable
+		}
+
+		stmt := `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+			created_at, updated_at, restriction_id)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+		_, err = tx.ExecContext(ctx, stmt, before.StartDate, before.EndDate, before.RoomID, id, time.Now(), time.Now(), 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `update reservations set deleted_at = null, updated_at = $1 where id = $2`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.DeletedAt = nil
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "restore",
+		Entity:   "reservation",
+		EntityID: id,
+	}, reservationSnapshot(before), reservationSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeDeletedReservations removes for good the reservations put in the trash before before,
+// recording each in the audit log, and returns how many were removed. Reservations with payments
+// or charges are kept, as deleting them would delete those too and take them out of the
+// accounts and tax report.
+func (m *postgresDBRepo) PurgeDeletedReservations(before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select id from reservations r
+		where r.deleted_at < $1
+			and not exists (select 1 from payments p where p.reservation_id = r.id)
+			and not exists (select 1 from reservation_charges rc where rc.reservation_id = r.id)
+		for update`
+
+	rows, err := tx.QueryContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		res, err := getReservationForUpdate(ctx, tx, id)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from reservations where id = $1`, id)
+		if err != nil {
+			return 0, err
+		}
+
+		err = insertAuditEvent(ctx, tx, models.Actor{}, models.AuditEvent{
+			Action:   "purge",
+			Entity:   "reservation",
+			EntityID: id,
+		}, reservationSnapshot(res), nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// UpdateReservationStatus moves a reservation to status to, recording the change in its status
+// history and the audit log. It returns repository.ErrInvalidStatusChange if the reservation
+// can't move to to from its current status. A reservation moved to a status that releases its
+// room has its room restrictions removed.
+func (m *postgresDBRepo) UpdateReservationStatus(actor models.Actor, id int, to string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getReservationForUpdate(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt != nil || !status.CanChange(before.Status, to) {
+		return repository.ErrInvalidStatusChange
+	}
+
+	err = changeReservationStatus(ctx, tx, actor, before, to)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ExpireUnpaidReservations cancels the pending reservations whose payment was due by now,
+// releasing their rooms, and returns the rooms and dates released
+func (m *postgresDBRepo) ExpireUnpaidReservations(now time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `select id from reservations
+		where payment_due_at <= $1 and status = $2 and deleted_at is null
+		order by id for update`, now, status.Pending)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var released []models.RoomRestriction
+	for _, id := range ids {
+		before, err := getReservationForUpdate(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		err = changeReservationStatus(ctx, tx, models.Actor{}, before, status.Cancelled)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, `update reservations set payment_due_at = null, cancellation_reason = $1
+			where id = $2`, "Not paid in time", id)
+		if err != nil {
+			return nil, err
+		}
+
+		released = append(released, models.RoomRestriction{
+			RoomID:        before.RoomID,
+			ReservationID: id,
+			StartDate:     before.StartDate,
+			EndDate:       before.EndDate,
+		})
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+// CancelReservation cancels a reservation like UpdateReservationStatus, recording the reason
+// and penalty in c
+func (m *postgresDBRepo) CancelReservation(actor models.Actor, id int, c models.Cancellation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getReservationForUpdate(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt != nil || !status.CanChange(before.Status, status.Cancelled) {
+		return repository.ErrInvalidStatusChange
+	}
+
+	err = changeReservationStatus(ctx, tx, actor, before, status.Cancelled)
+	if err != nil {
+		return err
+	}
+
+	err = recordCancellation(ctx, tx, id, c)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelReservationGroup cancels every reservation booked under a confirmation code that can
+// still be cancelled, in a single transaction, recording the reason and penalties in c, and
+// returns how many were cancelled. It returns repository.ErrInvalidStatusChange if none of them
+// could be.
+func (m *postgresDBRepo) CancelReservationGroup(actor models.Actor, code string, c models.Cancellation) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `select id from reservations
+		where confirmation_code = $1 and confirmation_code <> '' and deleted_at is null
+		order by id for update`, code)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	cancelled := 0
+	for _, id := range ids {
+		before, err := getReservationForUpdate(ctx, tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if !status.CanChange(before.Status, status.Cancelled) {
+			continue
+		}
+
+		err = changeReservationStatus(ctx, tx, actor, before, status.Cancelled)
+		if err != nil {
+			return 0, err
+		}
+		err = recordCancellation(ctx, tx, id, c)
+		if err != nil {
+			return 0, err
+		}
+		cancelled++
+	}
+	if cancelled == 0 {
+		return 0, repository.ErrInvalidStatusChange
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return cancelled, nil
+}
+
+// recordCancellation stores why reservation id was cancelled and the penalty it was charged
+func recordCancellation(ctx context.Context, tx *sql.Tx, id int, c models.Cancellation) error {
+	_, err := tx.ExecContext(ctx, `update reservations set cancellation_reason = $1, cancellation_penalty = $2
+		where id = $3`, c.Reason, c.Penalties[id], id)
+	return err
+}
+
+// changeReservationStatus moves the reservation before to status to as part of tx, recording
+// the change in its status history and the audit log and releasing its room if to calls for it
+func changeReservationStatus(ctx context.Context, tx *sql.Tx, actor models.Actor, before models.Reservation, to string) error {
+	now := time.Now()
+	_, err := tx.ExecContext(ctx, `update reservations set status = $1, status_changed_at = $2, updated_at = $2 where id = $3`, to, now, before.ID)
+	if err != nil {
+		return err
+	}
+
+	var userID interface{}
+	if actor.UserID > 0 {
+		userID = actor.UserID
+	}
+	stmt := `insert into reservation_status_changes (reservation_id, from_status, to_status, user_id,
+		created_at, updated_at) values ($1, $2, $3, $4, $5, $6)`
+	_, err = tx.ExecContext(ctx, stmt, before.ID, before.Status, to, userID, now, now)
+	if err != nil {
+		return err
+	}
+
+	if status.ReleasesRoom(to) {
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where reservation_id = $1`, before.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	after := before
+	after.Status = to
+	after.StatusChangedAt = &now
+
+	return insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "status",
+		Entity:   "reservation",
+		EntityID: before.ID,
+	}, reservationSnapshot(before), reservationSnapshot(after))
+}
+
+// getReservationForUpdate reads a reservation's own columns as part of tx, locking the row
+// until tx ends
+func getReservationForUpdate(ctx context.Context, tx *sql.Tx, id int) (models.Reservation, error) {
+	var r models.Reservation
+
+	query := `select id, first_name, last_name, email, phone, start_date, end_date, room_id,
+		status, status_changed_at, confirmation_code, coalesce(guest_id, 0), total_amount, currency, deleted_at
+		from reservations where id = $1 for update`
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(
+		&r.ID,
+		&r.FirstName,
+		&r.LastName,
+		&r.Email,
+		&r.Phone,
+		&r.StartDate,
+		&r.EndDate,
+		&r.RoomID,
+		&r.Status,
+		&r.StatusChangedAt,
+		&r.ConfirmationCode,
+		&r.GuestID,
+		&r.TotalAmount,
+		&r.Currency,
+		&r.DeletedAt,
+	)
+	return r, err
+}
+
+// AllRooms returns every room, including retired rooms, in display order
+func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
+	return m.listRooms(`select ` + roomColumns + ` from rooms order by sort_order, room_name`)
+}
+
+// ActiveRooms returns the rooms that are still offered to guests, in display order
+func (m *postgresDBRepo) ActiveRooms() ([]models.Room, error) {
+	return m.listRooms(`select ` + roomColumns + ` from rooms where retired = 0 order by sort_order, room_name`)
+}
+
+// listRooms runs a query that selects roomColumns and returns the rooms with their photos
+func (m *postgresDBRepo) listRooms(query string) ([]models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rooms []models.Room
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rm, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, rm)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	for i := range rooms {
+		rooms[i].Photos, err = m.getRoomPhotos(ctx, rooms[i].ID)
+		if err != nil {
+			return rooms, err
+		}
+	}
+
+	return rooms, nil
+}
+
+// GetRestrictionsForRoomByDate resturns restrictions for a room by a date range
+func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	query := `select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
+			from room_restrictions where $1 < end_date and $2 >= start_date
+			and room_id = $3`
+
+	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	if err != nil {
+		return restrictions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+		)
+		if err != nil {
+			return restrictions, err
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return restrictions, err
+	}
+
+	return restrictions, nil
+}
+
+// InsertBlockForRoom inserts a room restriction and returns its id
+func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id,
+		created_at, updated_at) values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := m.DB.QueryRowContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return newID, nil
+}
+
+// DeleteBlockByID deletes a room restriction
+func (m *postgresDBRepo) DeleteBlockByID(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `delete from room_restrictions where id = $1`
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// UpdateBlocks adds and removes owner blocks on rooms' calendars in one transaction, recording
+// each change in the audit log. Each block to add covers the night of its StartDate.
+func (m *postgresDBRepo) UpdateBlocks(actor models.Actor, add []models.RoomRestriction, remove []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range remove {
+		var b models.RoomRestriction
+		query := `select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
+			from room_restrictions where id = $1 for update`
+		err = tx.QueryRowContext(ctx, query, id).Scan(
+			&b.ID,
+			&b.ReservationID,
+			&b.RestrictionID,
+			&b.RoomID,
+			&b.StartDate,
+			&b.EndDate,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			// already gone, perhaps removed in another tab
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+			Action:   "unblock",
+			Entity:   "room_restriction",
+			EntityID: id,
+		}, blockSnapshot(b), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, b := range add {
+		b.EndDate = b.StartDate.AddDate(0, 0, 1)
+		b.RestrictionID = 2
+
+		query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id,
+			created_at, updated_at) values ($1, $2, $3, $4, $5, $6) returning id`
+		err = tx.QueryRowContext(ctx, query, b.StartDate, b.EndDate, b.RoomID, b.RestrictionID, time.Now(), time.Now()).Scan(&b.ID)
+		if err != nil {
+			return err
+		}
+
+		err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+			Action:   "block",
+			Entity:   "room_restriction",
+			EntityID: b.ID,
+		}, nil, blockSnapshot(b))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCalendarBlocksForRoom returns the blocks imported into a room from a calendar source
+func (m *postgresDBRepo) GetCalendarBlocksForRoom(roomID int, source string) ([]models.CalendarBlock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var blocks []models.CalendarBlock
+
+	query := `select id, room_id, source, uid, night, room_restriction_id
+			from room_calendar_blocks where room_id = $1 and source = $2
+			order by night, uid`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID, source)
+	if err != nil {
+		return blocks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b models.CalendarBlock
+		err := rows.Scan(
+			&b.ID,
+			&b.RoomID,
+			&b.Source,
+			&b.UID,
+			&b.Night,
+			&b.RoomRestrictionID,
+		)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return blocks, err
+	}
+
+	return blocks, nil
+}
+
+// InsertCalendarBlock records a block imported from a calendar source
+func (m *postgresDBRepo) InsertCalendarBlock(b models.CalendarBlock) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `insert into room_calendar_blocks (room_id, source, uid, night, room_restriction_id,
+		created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := m.DB.ExecContext(ctx, query, b.RoomID, b.Source, b.UID, b.Night, b.RoomRestrictionID, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetReservationByConfirmationCode gets a reservation using the confirmation code and the guest's
+// email. For a group booking it returns the first room booked.
+func (m *postgresDBRepo) GetReservationByConfirmationCode(code, email string) (models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + reservationColumns + `
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.confirmation_code = upper($1) and lower(r.email) = lower($2) and r.deleted_at is null
+		order by r.id
+		limit 1`
+
+	return scanReservation(m.DB.QueryRowContext(ctx, query, code, email))
+}
+
+// UpdateReservationDates moves a reservation and its room restriction to new dates in a single
+// transaction, returning repository.ErrRoomUnavailable if the new dates clash with another booking,
+// or repository.ErrInvalidStatusChange if the reservation has released its room or is in the trash
+func (m *postgresDBRepo) UpdateReservationDates(actor models.Actor, res models.Reservation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the reservation may have been cancelled, trashed or expired since the caller read it
+	before, err := getReservationForUpdate(ctx, tx, res.ID)
+	if err != nil {
+		return err
+	}
+	if status.ReleasesRoom(before.Status) || before.DeletedAt != nil {
+		return repository.ErrInvalidStatusChange
+	}
+
+	var roomID int
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, res.RoomID).Scan(&roomID)
+	if err != nil {
+		return err
+	}
+
+	var numRows int
+	query := `
+		select
+			count(id)
+		from
+			room_restrictions
+		where
+			room_id = $1 and
+			$2 < end_date and $3 > start_date and
+			coalesce(reservation_id, 0) <> $4`
+	err = tx.QueryRowContext(ctx, query, res.RoomID, res.StartDate, res.EndDate, res.ID).Scan(&numRows)
+	if err != nil {
+		return err
+	}
+	if numRows > 0 {
+		return repository.ErrRoomUnavailable
+	}
+
+	stmt := `update reservations set start_date = $1, end_date = $2, total_amount = $3, currency = $4,
+		promo_code_id = $5, discount_amount = $6, updated_at = $7 where id = $8`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.TotalAmount, res.Currency,
+		nullInt(res.PromoCodeID), res.DiscountAmount, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from reservation_nights where reservation_id = $1`, res.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertReservationNights(ctx, tx, res.ID, res.Nights)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from reservation_charges where reservation_id = $1`, res.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertReservationCharges(ctx, tx, res.ID, res.Charges)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update room_restrictions set start_date = $1, end_date = $2, updated_at = $3 where reservation_id = $4`
+	result, err := tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("reservation %d has no room restriction to move", res.ID)
+	}
+
+	after := before
+	after.StartDate = res.StartDate
+	after.EndDate = res.EndDate
+	after.TotalAmount = res.TotalAmount
+	after.Currency = res.Currency
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "update",
+		Entity:   "reservation",
+		EntityID: res.ID,
+	}, reservationSnapshot(before), reservationSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRateOverridesForRoom returns the rate overrides for a room that overlap a date range
+func (m *postgresDBRepo) GetRateOverridesForRoom(roomID int, start, end time.Time) ([]models.RateOverride, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var overrides []models.RateOverride
+
+	query := `select id, room_id, name, start_date, end_date, weekdays, nightly_rate, priority,
+			coalesce(cancellation_policy_id, 0), created_at, updated_at
+			from rate_overrides where room_id = $1 and start_date < $3 and end_date >= $2
+			order by priority desc, start_date`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID, start, end)
+	if err != nil {
+		return overrides, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o models.RateOverride
+		err := rows.Scan(
+			&o.ID,
+			&o.RoomID,
+			&o.Name,
+			&o.StartDate,
+			&o.EndDate,
+			&o.Weekdays,
+			&o.NightlyRate,
+			&o.Priority,
+			&o.CancellationPolicyID,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+		)
+		if err != nil {
+			return overrides, err
+		}
+		overrides = append(overrides, o)
+	}
+
+	if err = rows.Err(); err != nil {
+		return overrides, err
+	}
+
+	return overrides, nil
+}
+
+// GetStayRulesForArrival returns the stay rules, for any room, that cover an arrival date
+func (m *postgresDBRepo) GetStayRulesForArrival(arrival time.Time) ([]models.StayRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rules []models.StayRule
+
+	query := `select id, coalesce(room_id, 0), name, start_date, end_date, min_nights, max_nights,
+			arrival_weekdays, departure_weekdays, min_lead_days, max_horizon_days, created_at, updated_at
+			from stay_rules where start_date <= $1 and end_date >= $1
+			order by room_id nulls first, start_date`
+
+	rows, err := m.DB.QueryContext(ctx, query, arrival)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.StayRule
+		err := rows.Scan(
+			&s.ID,
+			&s.RoomID,
+			&s.Name,
+			&s.StartDate,
+			&s.EndDate,
+			&s.MinNights,
+			&s.MaxNights,
+			&s.ArrivalWeekdays,
+			&s.DepartureWeekdays,
+			&s.MinLeadDays,
+			&s.MaxHorizonDays,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+		)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+// getReservationNights returns the per night price breakdown for a reservation
+func (m *postgresDBRepo) getReservationNights(ctx context.Context, reservationID int) ([]models.ReservationNight, error) {
+	var nights []models.ReservationNight
+
+	query := `select night, rate_name, amount from reservation_nights where reservation_id = $1 order by night`
+
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return nights, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n models.ReservationNight
+		err := rows.Scan(&n.Night, &n.RateName, &n.Amount)
+		if err != nil {
+			return nights, err
+		}
+		nights = append(nights, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nights, err
+	}
+
+	return nights, nil
+}
+
+// insertReservationNights stores the per night price breakdown for a reservation
+func insertReservationNights(ctx context.Context, tx *sql.Tx, reservationID int, nights []models.ReservationNight) error {
+	stmt := `insert into reservation_nights (reservation_id, night, rate_name, amount, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	for _, n := range nights {
+		_, err := tx.ExecContext(ctx, stmt, reservationID, n.Night, n.RateName, n.Amount, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getReservationCharges returns the taxes and fees charged on a reservation
+func (m *postgresDBRepo) getReservationCharges(ctx context.Context, reservationID int) ([]models.ReservationCharge, error) {
+	var charges []models.ReservationCharge
+
+	query := `select id, reservation_id, coalesce(charge_id, 0), name, kind, basis, rate, nights,
+		taxable_amount, amount
+		from reservation_charges where reservation_id = $1 order by id`
+
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return charges, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ReservationCharge
+		err := rows.Scan(
+			&c.ID,
+			&c.ReservationID,
+			&c.ChargeID,
+			&c.Name,
+			&c.Kind,
+			&c.Basis,
+			&c.Rate,
+			&c.Nights,
+			&c.TaxableAmount,
+			&c.Amount,
+		)
+		if err != nil {
+			return charges, err
+		}
+		charges = append(charges, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return charges, err
+	}
+
+	return charges, nil
+}
+
+// cancellationPolicyColumns is the column list scanned by scanCancellationPolicy
+const cancellationPolicyColumns = `id, name, description, tiers, created_at, updated_at`
+
+// scanCancellationPolicy scans a row selected with cancellationPolicyColumns into a policy
+func scanCancellationPolicy(row scanner) (models.CancellationPolicy, error) {
+	var p models.CancellationPolicy
+	var tiers string
+	err := row.Scan(
+		&p.ID,
+		&p.Name,
+		&p.Description,
+		&tiers,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return p, err
+	}
+	p.Tiers, err = cancellation.ParseTiers(tiers)
+	return p, err
+}
+
+// AllCancellationPolicies returns the cancellation policies, ordered by name
+func (m *postgresDBRepo) AllCancellationPolicies() ([]models.CancellationPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var policies []models.CancellationPolicy
+
+	rows, err := m.DB.QueryContext(ctx, `select `+cancellationPolicyColumns+` from cancellation_policies order by name`)
+	if err != nil {
+		return policies, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanCancellationPolicy(rows)
+		if err != nil {
+			return policies, err
+		}
+		policies = append(policies, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return policies, err
+	}
+
+	return policies, nil
+}
+
+// GetCancellationPolicyByID returns a cancellation policy by id
+func (m *postgresDBRepo) GetCancellationPolicyByID(id int) (models.CancellationPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + cancellationPolicyColumns + ` from cancellation_policies where id = $1`
+	return scanCancellationPolicy(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// insertReservationCharges stores the taxes and fees charged on a reservation
+func insertReservationCharges(ctx context.Context, tx *sql.Tx, reservationID int, charges []models.ReservationCharge) error {
+	stmt := `insert into reservation_charges (reservation_id, charge_id, name, kind, basis, rate, nights,
+		taxable_amount, amount, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	for _, c := range charges {
+		_, err := tx.ExecContext(ctx, stmt, reservationID, nullInt(c.ChargeID), c.Name, c.Kind, c.Basis,
+			c.Rate, c.Nights, c.TaxableAmount, c.Amount, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChargesForStay returns the taxes and fees, for any room, that cover a night of a stay from
+// start up to end, taxes first
+func (m *postgresDBRepo) GetChargesForStay(start, end time.Time) ([]models.Charge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var charges []models.Charge
+
+	query := `select id, coalesce(room_id, 0), name, kind, basis, amount, start_date, end_date,
+			created_at, updated_at
+			from charges where start_date < $2 and end_date >= $1
+			order by kind desc, name, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return charges, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.Charge
+		err := rows.Scan(
+			&c.ID,
+			&c.RoomID,
+			&c.Name,
+			&c.Kind,
+			&c.Basis,
+			&c.Amount,
+			&c.StartDate,
+			&c.EndDate,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+		)
+		if err != nil {
+			return charges, err
+		}
+		charges = append(charges, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return charges, err
+	}
+
+	return charges, nil
+}
+
+// TaxChargesForMonth returns the taxes charged on reservations, not in the trash, with nights in
+// the month starting on month, along with each reservation's dates, status and currency
+func (m *postgresDBRepo) TaxChargesForMonth(month time.Time) ([]models.ReservationCharge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var charges []models.ReservationCharge
+
+	query := `select c.id, c.reservation_id, coalesce(c.charge_id, 0), c.name, c.kind, c.basis, c.rate,
+			c.nights, c.taxable_amount, c.amount, r.start_date, r.end_date, r.status, r.currency
+			from reservation_charges c
+			left join reservations r on (c.reservation_id = r.id)
+			where c.kind = $1 and r.start_date < $3 and r.end_date > $2 and r.deleted_at is null
+			order by r.start_date, c.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, taxes.Tax, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return charges, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ReservationCharge
+		err := rows.Scan(
+			&c.ID,
+			&c.ReservationID,
+			&c.ChargeID,
+			&c.Name,
+			&c.Kind,
+			&c.Basis,
+			&c.Rate,
+			&c.Nights,
+			&c.TaxableAmount,
+			&c.Amount,
+			&c.Reservation.StartDate,
+			&c.Reservation.EndDate,
+			&c.Reservation.Status,
+			&c.Reservation.Currency,
+		)
+		if err != nil {
+			return charges, err
+		}
+		c.Reservation.ID = c.ReservationID
+		charges = append(charges, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return charges, err
+	}
+
+	return charges, nil
+}
+
+// roomColumns is the column list scanned by scanRoom
+const roomColumns = `id, room_name, slug, description, capacity, amenities, max_adults, max_children,
+	sort_order, retired, base_rate, currency, coalesce(cancellation_policy_id, 0), created_at, updated_at`
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRoom scans a row selected with roomColumns into a room
+func scanRoom(row scanner) (models.Room, error) {
+	var room models.Room
+	err := row.Scan(
+		&room.ID,
+		&room.RoomName,
+		&room.Slug,
+		&room.Description,
+		&room.Capacity,
+		&room.Amenities,
+		&room.MaxAdults,
+		&room.MaxChildren,
+		&room.SortOrder,
+		&room.Retired,
+		&room.BaseRate,
+		&room.Currency,
+		&room.CancellationPolicyID,
+		&room.CreatedAt,
+		&room.UpdatedAt,
+	)
+	return room, err
+}
+
+// GetRoomBySlug gets a room by its slug
+func (m *postgresDBRepo) GetRoomBySlug(slug string) (models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where slug = $1`
+	room, err := scanRoom(m.DB.QueryRowContext(ctx, query, slug))
+	if err != nil {
+		return room, err
+	}
+
+	room.Photos, err = m.getRoomPhotos(ctx, room.ID)
+	if err != nil {
+		return room, err
+	}
+	return room, nil
+}
+
+// InsertRoom inserts a room and its photos, placing it after the existing rooms
+func (m *postgresDBRepo) InsertRoom(actor models.Actor, room models.Room) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into rooms (room_name, slug, description, capacity, amenities, max_adults, max_children,
+		sort_order, retired, base_rate, currency, cancellation_policy_id, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, (select coalesce(max(sort_order), 0) + 1 from rooms), 0, $8, $9, $10,
+		$11, $12)
+		returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.Capacity,
+		room.Amenities,
+		room.MaxAdults,
+		room.MaxChildren,
+		room.BaseRate,
+		room.Currency,
+		nullInt(room.CancellationPolicyID),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertRoomPhotos(ctx, tx, newID, room.Photos)
+	if err != nil {
+		return 0, err
+	}
+
+	after, err := getRoomForUpdate(ctx, tx, newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "create",
+		Entity:   "room",
+		EntityID: newID,
+	}, nil, roomSnapshot(after))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// UpdateRoom updates a room and replaces its photos
+func (m *postgresDBRepo) UpdateRoom(actor models.Actor, room models.Room) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getRoomForUpdate(ctx, tx, room.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update rooms set room_name = $1, slug = $2, description = $3, capacity = $4,
+		amenities = $5, max_adults = $6, max_children = $7, base_rate = $8, currency = $9,
+		cancellation_policy_id = $10, updated_at = $11
+		where id = $12`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.Capacity,
+		room.Amenities,
+		room.MaxAdults,
+		room.MaxChildren,
+		room.BaseRate,
+		room.Currency,
+		nullInt(room.CancellationPolicyID),
+		time.Now(),
+		room.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from room_photos where room_id = $1`, room.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertRoomPhotos(ctx, tx, room.ID, room.Photos)
+	if err != nil {
+		return err
+	}
+
+	after, err := getRoomForUpdate(ctx, tx, room.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "update",
+		Entity:   "room",
+		EntityID: room.ID,
+	}, roomSnapshot(before), roomSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateRetiredForRoom retires a room, or brings a retired room back, by id
+func (m *postgresDBRepo) UpdateRetiredForRoom(actor models.Actor, id, retired int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getRoomForUpdate(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update rooms set retired = $1, updated_at = $2 where id = $3`, retired, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.Retired = retired
+
+	action := "restore"
+	if retired == 1 {
+		action = "retire"
+	}
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   action,
+		Entity:   "room",
+		EntityID: id,
+	}, roomSnapshot(before), roomSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReorderRooms sets the display order of rooms to the order of ids, recording each room that
+// moves in the audit log
+func (m *postgresDBRepo) ReorderRooms(actor models.Actor, ids []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		before, err := getRoomForUpdate(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if before.SortOrder == i+1 {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `update rooms set sort_order = $1, updated_at = $2 where id = $3`, i+1, time.Now(), id)
+		if err != nil {
+			return err
+		}
+
+		after := before
+		after.SortOrder = i + 1
+
+		err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+			Action:   "reorder",
+			Entity:   "room",
+			EntityID: id,
+		}, roomSnapshot(before), roomSnapshot(after))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// getRoomForUpdate returns a room and its photos as part of tx, locking the room until tx ends
+func getRoomForUpdate(ctx context.Context, tx *sql.Tx, id int) (models.Room, error) {
+	room, err := scanRoom(tx.QueryRowContext(ctx, `select `+roomColumns+` from rooms where id = $1 for update`, id))
+	if err != nil {
+		return room, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `select url, caption from room_photos where room_id = $1 order by sort_order, id`, id)
+	if err != nil {
+		return room, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.RoomPhoto
+		err := rows.Scan(&p.URL, &p.Caption)
+		if err != nil {
+			return room, err
+		}
+		room.Photos = append(room.Photos, p)
+	}
+	return room, rows.Err()
+}
+
+// auditRoom is the part of a room kept in the audit log
+type auditRoom struct {
+	ID                   int      `json:"id"`
+	RoomName             string   `json:"room_name"`
+	Slug                 string   `json:"slug"`
+	Description          string   `json:"description"`
+	Capacity             int      `json:"capacity"`
+	Amenities            string   `json:"amenities"`
+	MaxAdults            int      `json:"max_adults"`
+	MaxChildren          int      `json:"max_children"`
+	SortOrder            int      `json:"sort_order"`
+	Retired              int      `json:"retired"`
+	BaseRate             int      `json:"base_rate"`
+	Currency             string   `json:"currency"`
+	CancellationPolicyID int      `json:"cancellation_policy_id,omitempty"`
+	Photos               []string `json:"photos,omitempty"`
+}
+
+// roomSnapshot returns room as it is recorded in the audit log
+func roomSnapshot(room models.Room) auditRoom {
+	a := auditRoom{
+		ID:                   room.ID,
+		RoomName:             room.RoomName,
+		Slug:                 room.Slug,
+		Description:          room.Description,
+		Capacity:             room.Capacity,
+		Amenities:            room.Amenities,
+		MaxAdults:            room.MaxAdults,
+		MaxChildren:          room.MaxChildren,
+		SortOrder:            room.SortOrder,
+		Retired:              room.Retired,
+		BaseRate:             room.BaseRate,
+		Currency:             room.Currency,
+		CancellationPolicyID: room.CancellationPolicyID,
+	}
+	for _, p := range room.Photos {
+		a.Photos = append(a.Photos, p.URL)
+	}
+	return a
+}
+
+// getRoomPhotos returns the photos for a room in display order
+func (m *postgresDBRepo) getRoomPhotos(ctx context.Context, roomID int) ([]models.RoomPhoto, error) {
+	var photos []models.RoomPhoto
+
+	query := `select id, room_id, url, caption, sort_order, created_at, updated_at
+		from room_photos where room_id = $1 order by sort_order, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return photos, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.RoomPhoto
+		err := rows.Scan(&p.ID, &p.RoomID, &p.URL, &p.Caption, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			return photos, err
+		}
+		photos = append(photos, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return photos, err
+	}
+
+	return photos, nil
+}
+
+// insertRoomPhotos stores the photos for a room in the order given
+func insertRoomPhotos(ctx context.Context, tx *sql.Tx, roomID int, photos []models.RoomPhoto) error {
+	stmt := `insert into room_photos (room_id, url, caption, sort_order, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	for i, p := range photos {
+		_, err := tx.ExecContext(ctx, stmt, roomID, p.URL, p.Caption, i+1, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const outboxColumns = `id, to_address, from_address, subject, content, text_content, template, status,
+	attempts, next_attempt_at, last_error, sent_at, created_at, updated_at`
+
+func scanOutboxMail(row scanner) (models.OutboxMail, error) {
+	var o models.OutboxMail
+	err := row.Scan(
+		&o.ID,
+		&o.Mail.To,
+		&o.Mail.From,
+		&o.Mail.Subject,
+		&o.Mail.Content,
+		&o.Mail.Text,
+		&o.Mail.Template,
+		&o.Status,
+		&o.Attempts,
+		&o.NextAttemptAt,
+		&o.LastError,
+		&o.SentAt,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+	)
+	return o, err
+}
+
+// EnqueueMail adds a message to the mail outbox
+func (m *postgresDBRepo) EnqueueMail(msg models.MailData) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	query := `insert into mail_outbox (to_address, from_address, subject, content, text_content, template,
+		status, attempts, next_attempt_at, last_error, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, 'pending', 0, $7, '', $7, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, query, msg.To, msg.From, msg.Subject, msg.Content, msg.Text, msg.Template, time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// ClaimMail takes up to limit messages that are due from the mail outbox. Claimed messages are
+// leased for the given time, after which they are due again in case the sender died part way.
+func (m *postgresDBRepo) ClaimMail(limit int, lease time.Duration) ([]models.OutboxMail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var mail []models.OutboxMail
+	now := time.Now()
+
+	query := `update mail_outbox set status = 'sending', next_attempt_at = $2, updated_at = $3
+		where id in (
+			select id from mail_outbox
+			where status in ('pending', 'sending') and next_attempt_at <= $3
+			order by next_attempt_at, id
+			limit $1
+			for update skip locked
+		)
+		returning ` + outboxColumns
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, now.Add(lease), now)
+	if err != nil {
+		return mail, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o, err := scanOutboxMail(rows)
+		if err != nil {
+			return mail, err
+		}
+		mail = append(mail, o)
+	}
+
+	if err = rows.Err(); err != nil {
+		return mail, err
+	}
+
+	return mail, nil
+}
+
+// MarkMailSent records that a message has been sent
+func (m *postgresDBRepo) MarkMailSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update mail_outbox set status = 'sent', attempts = attempts + 1, last_error = '',
+		sent_at = $1, updated_at = $1 where id = $2`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RetryMail records a failed attempt to send a message and when to try again
+func (m *postgresDBRepo) RetryMail(id, attempts int, next time.Time, lastErr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update mail_outbox set status = 'pending', attempts = $1, next_attempt_at = $2,
+		last_error = $3, updated_at = $4 where id = $5`
+
+	_, err := m.DB.ExecContext(ctx, query, attempts, next, lastErr, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeadLetterMail records that a message has failed for the last time
+func (m *postgresDBRepo) DeadLetterMail(id, attempts int, lastErr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update mail_outbox set status = 'dead', attempts = $1, last_error = $2,
+		updated_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(ctx, query, attempts, lastErr, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// FailedMail returns the messages that could not be sent, most recent first
+func (m *postgresDBRepo) FailedMail() ([]models.OutboxMail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var mail []models.OutboxMail
+
+	query := `select ` + outboxColumns + ` from mail_outbox where status = 'dead' order by updated_at desc`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return mail, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o, err := scanOutboxMail(rows)
+		if err != nil {
+			return mail, err
+		}
+		mail = append(mail, o)
+	}
+
+	if err = rows.Err(); err != nil {
+		return mail, err
+	}
+
+	return mail, nil
+}
+
+// ResendMail puts a failed message back in the outbox to be sent again, recording it in the
+// audit log. A message that hasn't failed, or no longer exists, is left alone.
+func (m *postgresDBRepo) ResendMail(actor models.Actor, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanOutboxMail(tx.QueryRowContext(ctx,
+		`select `+outboxColumns+` from mail_outbox where id = $1 for update`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if before.Status != "dead" {
+		return nil
+	}
+
+	query := `update mail_outbox set status = 'pending', attempts = 0, next_attempt_at = $1,
+		updated_at = $1 where id = $2`
+
+	_, err = tx.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.Status = "pending"
+	after.Attempts = 0
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "resend",
+		Entity:   "mail",
+		EntityID: id,
+	}, mailSnapshot(before), mailSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditMail is the part of a message in the outbox kept in the audit log. It leaves out the
+// message itself.
+type auditMail struct {
+	ID        int    `json:"id"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Template  string `json:"template,omitempty"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// mailSnapshot returns o as it is recorded in the audit log
+func mailSnapshot(o models.OutboxMail) auditMail {
+	return auditMail{
+		ID:        o.ID,
+		To:        o.Mail.To,
+		Subject:   o.Mail.Subject,
+		Template:  o.Mail.Template,
+		Status:    o.Status,
+		Attempts:  o.Attempts,
+		LastError: o.LastError,
+	}
+}
+
+// EnableTOTP turns on two-factor login for a user with secret, replacing their recovery codes
+func (m *postgresDBRepo) EnableTOTP(id int, secret string, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `update users set totp_secret = $1, totp_enabled = 1, totp_last_counter = 0, updated_at = $2 where id = $3`
+
+	_, err = tx.ExecContext(ctx, query, secret, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, id, recoveryCodeHashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP turns off two-factor login for a user and removes their recovery codes
+func (m *postgresDBRepo) DisableTOTP(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `update users set totp_secret = '', totp_enabled = 0, totp_last_counter = 0, updated_at = $1 where id = $2`
+
+	_, err = tx.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPCounter records that a user's code for a time step was accepted. It returns sql.ErrNoRows
+// if a code for that or a later step was accepted already, so a code can't be replayed.
+func (m *postgresDBRepo) UseTOTPCounter(id int, counter int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update users set totp_last_counter = $1 where id = $2 and totp_last_counter < $1`
+
+	result, err := m.DB.ExecContext(ctx, query, counter, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces a user's recovery codes with new ones
+func (m *postgresDBRepo) ReplaceRecoveryCodes(id int, hashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(ctx, tx, id, hashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and inserts new ones inside tx
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, id int, hashes []string) error {
+	_, err := tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into recovery_codes (user_id, code_hash, created_at, updated_at) values ($1, $2, $3, $4)`
+
+	for _, h := range hashes {
+		_, err := tx.ExecContext(ctx, stmt, id, h, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks one of a user's unused recovery codes as used. It returns sql.ErrNoRows
+// if the user has no such unused code.
+func (m *postgresDBRepo) UseRecoveryCode(id int, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update recovery_codes set used_at = $1, updated_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), id, hash)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (m *postgresDBRepo) CountRecoveryCodes(id int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+
+	query := `select count(id) from recovery_codes where user_id = $1 and used_at is null`
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetSetting returns the value of a site setting, or "" if it has not been set
+func (m *postgresDBRepo) GetSetting(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var value string
+
+	err := m.DB.QueryRowContext(ctx, `select value from settings where name = $1`, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// UpdateSetting sets the value of a site setting
+func (m *postgresDBRepo) UpdateSetting(actor models.Actor, name, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before interface{}
+	var old string
+	err = tx.QueryRowContext(ctx, `select value from settings where name = $1 for update`, name).Scan(&old)
+	switch {
+	case err == nil:
+		before = auditSetting{Name: name, Value: old}
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	stmt := `
+		insert into settings (name, value, created_at, updated_at) values ($1, $2, $3, $3)
+		on conflict (name) do update set value = excluded.value, updated_at = excluded.updated_at`
+
+	_, err = tx.ExecContext(ctx, stmt, name, value, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action: "update",
+		Entity: "setting",
+	}, before, auditSetting{Name: name, Value: value})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditSetting is a site setting as it is kept in the audit log. Settings have no id, so the
+// name is kept with the value.
+type auditSetting struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// auditReservation is the part of a reservation kept in the audit log
+type auditReservation struct {
+	ID               int    `json:"id"`
+	FirstName        string `json:"first_name"`
+	LastName         string `json:"last_name"`
+	Email            string `json:"email"`
+	Phone            string `json:"phone"`
+	StartDate        string `json:"start_date"`
+	EndDate          string `json:"end_date"`
+	RoomID           int    `json:"room_id"`
+	Status           string `json:"status"`
+	ConfirmationCode string `json:"confirmation_code"`
+	TotalAmount      int    `json:"total_amount"`
+	Currency         string `json:"currency"`
+	DeletedAt        string `json:"deleted_at,omitempty"`
+}
+
+// reservationSnapshot returns r as it is recorded in the audit log
+func reservationSnapshot(r models.Reservation) auditReservation {
+	a := auditReservation{
+		ID:               r.ID,
+		FirstName:        r.FirstName,
+		LastName:         r.LastName,
+		Email:            r.Email,
+		Phone:            r.Phone,
+		StartDate:        r.StartDate.Format("2006-01-02"),
+		EndDate:          r.EndDate.Format("2006-01-02"),
+		RoomID:           r.RoomID,
+		Status:           r.Status,
+		ConfirmationCode: r.ConfirmationCode,
+		TotalAmount:      r.TotalAmount,
+		Currency:         r.Currency,
+	}
+	if r.DeletedAt != nil {
+		a.DeletedAt = r.DeletedAt.Format(time.RFC3339)
+	}
+	return a
+}
+
+// auditBlock is the part of a room restriction kept in the audit log
+type auditBlock struct {
+	ID            int    `json:"id"`
+	RoomID        int    `json:"room_id"`
+	ReservationID int    `json:"reservation_id,omitempty"`
+	RestrictionID int    `json:"restriction_id"`
+	StartDate     string `json:"start_date"`
+	EndDate       string `json:"end_date"`
+}
+
+// blockSnapshot returns b as it is recorded in the audit log
+func blockSnapshot(b models.RoomRestriction) auditBlock {
+	return auditBlock{
+		ID:            b.ID,
+		RoomID:        b.RoomID,
+		ReservationID: b.ReservationID,
+		RestrictionID: b.RestrictionID,
+		StartDate:     b.StartDate.Format("2006-01-02"),
+		EndDate:       b.EndDate.Format("2006-01-02"),
+	}
+}
+
+// insertAuditEvent records a change in the audit log as part of tx, so it is only kept if the
+// change is. before and after are stored as JSON; nil stores null.
+func insertAuditEvent(ctx context.Context, tx *sql.Tx, actor models.Actor, e models.AuditEvent, before, after interface{}) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+
+	var userID interface{}
+	if actor.UserID > 0 {
+		userID = actor.UserID
+	}
+
+	query := `insert into audit_events (user_id, action, entity, entity_id, before, after, ip_address,
+		created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = tx.ExecContext(ctx, query,
+		userID,
+		e.Action,
+		e.Entity,
+		e.EntityID,
+		beforeJSON,
+		afterJSON,
+		actor.IPAddress,
+		time.Now(),
+		time.Now(),
+	)
+	return err
+}
+
+// auditJSON encodes v for a jsonb column, returning nil for a nil v
+func auditJSON(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// AuditEvents returns the audit log matching f, newest first
+func (m *postgresDBRepo) AuditEvents(f models.AuditFilter) ([]models.AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var events []models.AuditEvent
+
+	query := `select a.id, coalesce(a.user_id, 0), a.action, a.entity, a.entity_id,
+		coalesce(a.before::text, ''), coalesce(a.after::text, ''), a.ip_address, a.created_at,
+		coalesce(u.first_name, ''), coalesce(u.last_name, ''), coalesce(u.email, '')
+		from audit_events a
+		left join users u on (a.user_id = u.id)
+		where ($1 = 0 or (a.entity = 'reservation' and a.entity_id = $1))
+		and ($2 = 0 or a.user_id = $2)
+		and ($3::timestamp is null or a.created_at >= $3)
+		and ($4::timestamp is null or a.created_at < $4)
+		order by a.created_at desc, a.id desc
+		limit $5`
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 200
+	}
+
+	rows, err := m.DB.QueryContext(ctx, query, f.ReservationID, f.UserID, nullTime(f.Start), nullTime(f.End), limit)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditEvent
+		err := rows.Scan(
+			&e.ID,
+			&e.UserID,
+			&e.Action,
+			&e.Entity,
+			&e.EntityID,
+			&e.Before,
+			&e.After,
+			&e.IPAddress,
+			&e.CreatedAt,
+			&e.User.FirstName,
+			&e.User.LastName,
+			&e.User.Email,
+		)
+		if err != nil {
+			return events, err
+		}
+		e.User.ID = e.UserID
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return events, err
+	}
+
+	return events, nil
+}
+
+// nullInt returns nil for 0, so an unset id is stored as null
+func nullInt(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// nullTime returns nil for the zero time, so it is stored or compared as null
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// waitlistColumns are the columns scanned by scanWaitlistEntry
+const waitlistColumns = `w.id, w.first_name, w.last_name, w.email, w.start_date, w.end_date, w.adults,
+	w.children, w.room_ids, w.status, coalesce(w.room_id, 0), coalesce(rm.room_name, ''),
+	coalesce(w.room_restriction_id, 0), coalesce(w.hold_expires_at, '0001-01-01'),
+	coalesce(w.reservation_id, 0), w.created_at, w.updated_at`
+
+// scanWaitlistEntry reads a row selected with waitlistColumns
+func scanWaitlistEntry(row scanner) (models.WaitlistEntry, error) {
+	var e models.WaitlistEntry
+	var roomIDs string
+	err := row.Scan(
+		&e.ID,
+		&e.FirstName,
+		&e.LastName,
+		&e.Email,
+		&e.StartDate,
+		&e.EndDate,
+		&e.Adults,
+		&e.Children,
+		&roomIDs,
+		&e.Status,
+		&e.RoomID,
+		&e.Room.RoomName,
+		&e.RoomRestrictionID,
+		&e.HoldExpiresAt,
+		&e.ReservationID,
+		&e.CreatedAt,
+		&e.UpdatedAt,
+	)
+	e.RoomIDs = splitIDs(roomIDs)
+	e.Room.ID = e.RoomID
+	return e, err
+}
+
+// joinIDs writes a list of ids as stored in a text column, e.g. 1,2
+func joinIDs(ids []int) string {
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitIDs reads a list of ids written by joinIDs
+func splitIDs(s string) []int {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist
+func (m *postgresDBRepo) InsertWaitlistEntry(e models.WaitlistEntry) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into waitlist_entries (first_name, last_name, email, start_date, end_date, adults,
+		children, room_ids, status, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		e.FirstName,
+		e.LastName,
+		e.Email,
+		e.StartDate,
+		e.EndDate,
+		e.Adults,
+		e.Children,
+		joinIDs(e.RoomIDs),
+		waitlist.Waiting,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// GetWaitlistEntryByID returns a waitlist entry, with the name of the room held for it
+func (m *postgresDBRepo) GetWaitlistEntryByID(id int) (models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + waitlistColumns + `
+		from waitlist_entries w
+		left join rooms rm on (w.room_id = rm.id)
+		where w.id = $1`
+
+	return scanWaitlistEntry(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// WaitlistEntriesForRoom returns the guests still waiting for a stay arriving from today that
+// overlaps start to end and would take the room, oldest first
+func (m *postgresDBRepo) WaitlistEntriesForRoom(roomID int, start, end time.Time) ([]models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var entries []models.WaitlistEntry
+
+	query := `select ` + waitlistColumns + `
+		from waitlist_entries w
+		left join rooms rm on (w.room_id = rm.id)
+		where w.status = $1 and w.start_date >= current_date and
+			w.start_date < $4 and w.end_date > $3 and
+			(w.room_ids = '' or $2::text = any(string_to_array(w.room_ids, ',')))
+		order by w.created_at, w.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, waitlist.Waiting, roomID, start, end)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanWaitlistEntry(rows)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// HoldRoomForWaitlist holds a room for the whole of a waiting guest's stay until until, returning
+// the hold's room restriction id, or repository.ErrRoomUnavailable if any night of it is taken
+func (m *postgresDBRepo) HoldRoomForWaitlist(entryID, roomID int, until time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, roomID).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	var start, end time.Time
+	query := `select start_date, end_date from waitlist_entries where id = $1 and status = $2 for update`
+	err = tx.QueryRowContext(ctx, query, entryID, waitlist.Waiting).Scan(&start, &end)
+	if err != nil {
+		return 0, err
+	}
+
+	var numRows int
+	query = `select count(id) from room_restrictions where room_id = $1 and $2 < end_date and $3 > start_date`
+	err = tx.QueryRowContext(ctx, query, roomID, start, end).Scan(&numRows)
+	if err != nil {
+		return 0, err
+	}
+	if numRows > 0 {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	// restriction 3 is a waitlist hold
+	var restrictionID int
+	stmt := `insert into room_restrictions (start_date, end_date, room_id, restriction_id,
+		created_at, updated_at) values ($1, $2, $3, 3, $4, $5) returning id`
+	err = tx.QueryRowContext(ctx, stmt, start, end, roomID, time.Now(), time.Now()).Scan(&restrictionID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `update waitlist_entries set status = $1, room_id = $2, room_restriction_id = $3,
+		hold_expires_at = $4, updated_at = $5 where id = $6`
+	_, err = tx.ExecContext(ctx, stmt, waitlist.Offered, roomID, restrictionID, until, time.Now(), entryID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return restrictionID, nil
+}
+
+// ExpireWaitlistOffers releases the holds that had lapsed at now, returning the rooms and dates
+// that came free
+func (m *postgresDBRepo) ExpireWaitlistOffers(now time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `select rr.id, rr.room_id, rr.start_date, rr.end_date
+		from waitlist_entries w
+		join room_restrictions rr on (w.room_restriction_id = rr.id)
+		where w.status = $1 and w.hold_expires_at <= $2
+		for update of w`
+
+	rows, err := tx.QueryContext(ctx, query, waitlist.Offered, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var released []models.RoomRestriction
+	for rows.Next() {
+		var rr models.RoomRestriction
+		err = rows.Scan(&rr.ID, &rr.RoomID, &rr.StartDate, &rr.EndDate)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		released = append(released, rr)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stmt := `update waitlist_entries set status = $1, room_restriction_id = null, updated_at = $2
+		where status = $3 and hold_expires_at <= $4`
+	_, err = tx.ExecContext(ctx, stmt, waitlist.Expired, time.Now(), waitlist.Offered, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rr := range released {
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1`, rr.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+// BookWaitlistOffer books group like CreateReservations, first releasing the room held for a
+// waitlist entry if the group is the stay it was held for, so the guest can book it
+func (m *postgresDBRepo) BookWaitlistOffer(entryID int, group []models.Reservation) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = lockRooms(ctx, tx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkPromoCodeUses(ctx, tx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	var restrictionID int
+	query := `select room_restriction_id from waitlist_entries
+		where id = $1 and status = $2 and hold_expires_at > $3 and
+			room_id = $4 and start_date = $5 and end_date = $6
+		for update`
+	err = tx.QueryRowContext(ctx, query, entryID, waitlist.Offered, time.Now(),
+		group[0].RoomID, group[0].StartDate, group[0].EndDate).Scan(&restrictionID)
+	held := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if held {
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1`, restrictionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ids, err := insertReservations(ctx, tx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	if held {
+		stmt := `update waitlist_entries set status = $1, room_restriction_id = null, reservation_id = $2,
+			updated_at = $3 where id = $4`
+		_, err = tx.ExecContext(ctx, stmt, waitlist.Booked, ids[0], time.Now(), entryID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// promoCodeColumns are the columns scanned by scanPromoCode, with the number of bookings that have
+// used the code
+const promoCodeColumns = `pc.id, pc.code, pc.description, pc.kind, pc.amount, pc.currency,
+	coalesce(pc.valid_from, '0001-01-01'), coalesce(pc.valid_until, '0001-01-01'),
+	coalesce(pc.stay_from, '0001-01-01'), coalesce(pc.stay_until, '0001-01-01'), pc.room_ids,
+	pc.max_uses, pc.max_uses_per_guest, pc.active,
+	(select count(distinct r.confirmation_code) from reservations r
+		where r.promo_code_id = pc.id and r.status <> '` + status.Cancelled + `' and r.deleted_at is null),
+	pc.created_at, pc.updated_at`
+
+// scanPromoCode reads a row selected with promoCodeColumns
+func scanPromoCode(row scanner) (models.PromoCode, error) {
+	var p models.PromoCode
+	var roomIDs string
+	err := row.Scan(
+		&p.ID,
+		&p.Code,
+		&p.Description,
+		&p.Kind,
+		&p.Amount,
+		&p.Currency,
+		&p.ValidFrom,
+		&p.ValidUntil,
+		&p.StayFrom,
+		&p.StayUntil,
+		&roomIDs,
+		&p.MaxUses,
+		&p.MaxUsesPerGuest,
+		&p.Active,
+		&p.Redemptions,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	p.RoomIDs = splitIDs(roomIDs)
+	return p, err
+}
+
+// AllPromoCodes returns every promo code, newest first, with how many bookings have used each
+func (m *postgresDBRepo) AllPromoCodes() ([]models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var codes []models.PromoCode
+
+	rows, err := m.DB.QueryContext(ctx, `select `+promoCodeColumns+` from promo_codes pc order by pc.id desc`)
+	if err != nil {
+		return codes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPromoCode(rows)
+		if err != nil {
+			return codes, err
+		}
+		codes = append(codes, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return codes, err
+	}
+	return codes, nil
+}
+
+// GetPromoCodeByID returns a promo code by id
+func (m *postgresDBRepo) GetPromoCodeByID(id int) (models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + promoCodeColumns + ` from promo_codes pc where pc.id = $1`
+	return scanPromoCode(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// GetPromoCodeByCode returns the promo code a guest entered, whatever its case
+func (m *postgresDBRepo) GetPromoCodeByCode(code string) (models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + promoCodeColumns + ` from promo_codes pc where pc.code = upper($1)`
+	return scanPromoCode(m.DB.QueryRowContext(ctx, query, code))
+}
+
+// PromoCodeUses returns how many bookings have used a promo code, and how many of them were made
+// with email. Cancelled bookings and those in the trash don't count.
+func (m *postgresDBRepo) PromoCodeUses(id int, email string) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return countPromoCodeUses(ctx, m.DB, id, email)
+}
+
+// queryer is a database or transaction that can run a query
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func countPromoCodeUses(ctx context.Context, q queryer, id int, email string) (int, int, error) {
+	var uses, guestUses int
+	query := `
+		select
+			count(distinct confirmation_code),
+			count(distinct case when lower(email) = lower($2) then confirmation_code end)
+		from
+			reservations
+		where
+			promo_code_id = $1 and status <> $3 and deleted_at is null`
+	err := q.QueryRowContext(ctx, query, id, email, status.Cancelled).Scan(&uses, &guestUses)
+	return uses, guestUses, err
+}
+
+// InsertPromoCode adds a promo code
+func (m *postgresDBRepo) InsertPromoCode(actor models.Actor, p models.PromoCode) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into promo_codes (code, description, kind, amount, currency, valid_from, valid_until,
+		stay_from, stay_until, room_ids, max_uses, max_uses_per_guest, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		p.Code,
+		p.Description,
+		p.Kind,
+		p.Amount,
+		p.Currency,
+		nullTime(p.ValidFrom),
+		nullTime(p.ValidUntil),
+		nullTime(p.StayFrom),
+		nullTime(p.StayUntil),
+		joinIDs(p.RoomIDs),
+		p.MaxUses,
+		p.MaxUsesPerGuest,
+		p.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	p.ID = newID
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "create",
+		Entity:   "promo_code",
+		EntityID: newID,
+	}, nil, promoCodeSnapshot(p))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// UpdatePromoCode saves changes to a promo code
+func (m *postgresDBRepo) UpdatePromoCode(actor models.Actor, p models.PromoCode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanPromoCode(tx.QueryRowContext(ctx,
+		`select `+promoCodeColumns+` from promo_codes pc where pc.id = $1 for update of pc`, p.ID))
+	if err != nil {
+		return err
+	}
+
+	stmt := `update promo_codes set code = $1, description = $2, kind = $3, amount = $4, currency = $5,
+		valid_from = $6, valid_until = $7, stay_from = $8, stay_until = $9, room_ids = $10, max_uses = $11,
+		max_uses_per_guest = $12, active = $13, updated_at = $14
+		where id = $15`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		p.Code,
+		p.Description,
+		p.Kind,
+		p.Amount,
+		p.Currency,
+		nullTime(p.ValidFrom),
+		nullTime(p.ValidUntil),
+		nullTime(p.StayFrom),
+		nullTime(p.StayUntil),
+		joinIDs(p.RoomIDs),
+		p.MaxUses,
+		p.MaxUsesPerGuest,
+		p.Active,
+		time.Now(),
+		p.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "update",
+		Entity:   "promo_code",
+		EntityID: p.ID,
+	}, promoCodeSnapshot(before), promoCodeSnapshot(p))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditPromoCode is the part of a promo code kept in the audit log
+type auditPromoCode struct {
+	ID              int    `json:"id"`
+	Code            string `json:"code"`
+	Description     string `json:"description"`
+	Kind            string `json:"kind"`
+	Amount          int    `json:"amount"`
+	Currency        string `json:"currency"`
+	ValidFrom       string `json:"valid_from,omitempty"`
+	ValidUntil      string `json:"valid_until,omitempty"`
+	StayFrom        string `json:"stay_from,omitempty"`
+	StayUntil       string `json:"stay_until,omitempty"`
+	RoomIDs         []int  `json:"room_ids,omitempty"`
+	MaxUses         int    `json:"max_uses"`
+	MaxUsesPerGuest int    `json:"max_uses_per_guest"`
+	Active          int    `json:"active"`
+}
+
+// promoCodeSnapshot returns p as it is recorded in the audit log
+func promoCodeSnapshot(p models.PromoCode) auditPromoCode {
+	return auditPromoCode{
+		ID:              p.ID,
+		Code:            p.Code,
+		Description:     p.Description,
+		Kind:            p.Kind,
+		Amount:          p.Amount,
+		Currency:        p.Currency,
+		ValidFrom:       auditDate(p.ValidFrom),
+		ValidUntil:      auditDate(p.ValidUntil),
+		StayFrom:        auditDate(p.StayFrom),
+		StayUntil:       auditDate(p.StayUntil),
+		RoomIDs:         p.RoomIDs,
+		MaxUses:         p.MaxUses,
+		MaxUsesPerGuest: p.MaxUsesPerGuest,
+		Active:          p.Active,
+	}
+}
+
+// auditDate formats a date for the audit log, leaving out a zero date
+func auditDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// guestEmail returns email as it is kept on a guest, so bookings match whatever its case
+func guestEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// matchGuest returns the id of the guest res belongs to as part of tx, creating one if it is
+// the first booking with its email. An email that was merged into another guest still matches
+// that guest through its earlier reservations. It returns 0 for a reservation with no email.
+func matchGuest(ctx context.Context, tx *sql.Tx, res models.Reservation) (int, error) {
+	email := guestEmail(res.Email)
+	if email == "" {
+		return 0, nil
+	}
+
+	var id int
+	err := tx.QueryRowContext(ctx, `select id from guests where email = $1`, email).Scan(&id)
+	if err == sql.ErrNoRows {
+		query := `
+			select
+				guest_id
+			from
+				reservations
+			where
+				lower(trim(email)) = $1 and guest_id is not null
+			order by id desc
+			limit 1`
+		err = tx.QueryRowContext(ctx, query, email).Scan(&id)
+	}
+	switch {
+	case err == nil:
+		_, err = tx.ExecContext(ctx, `update guests set phone = $1, updated_at = $2 where id = $3 and phone = ''`,
+			res.Phone, time.Now(), id)
+		return id, err
+	case err != sql.ErrNoRows:
+		return 0, err
+	}
+
+	// two bookings by a new guest at once both insert; the second updates the first's row
+	stmt := `insert into guests (first_name, last_name, email, phone, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6)
+		on conflict (email) do update set updated_at = excluded.updated_at
+		returning id`
+	err = tx.QueryRowContext(ctx, stmt,
+		res.FirstName,
+		res.LastName,
+		email,
+		res.Phone,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+	return id, err
+}
+
+// guestColumns are the columns of a guest, selected from guests g
+const guestColumns = `g.id, g.first_name, g.last_name, g.email, g.phone, g.notes, g.vip, g.do_not_rent,
+	g.created_at, g.updated_at`
+
+// scanGuest scans a row selected with guestColumns into a guest
+func scanGuest(row scanner) (models.Guest, error) {
+	var g models.Guest
+	err := row.Scan(
+		&g.ID,
+		&g.FirstName,
+		&g.LastName,
+		&g.Email,
+		&g.Phone,
+		&g.Notes,
+		&g.VIP,
+		&g.DoNotRent,
+		&g.CreatedAt,
+		&g.UpdatedAt,
+	)
+	return g, err
+}
+
+// AllGuests returns the guests whose name, email or phone contains search, or every guest for an
+// empty search, by name, with their stays, nights and spend counted
+func (m *postgresDBRepo) AllGuests(search string) ([]models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var guests []models.Guest
+
+	query := `
+		select
+			` + guestColumns + `, count(r.id), coalesce(sum(r.end_date - r.start_date), 0),
+			coalesce(sum(r.total_amount), 0), coalesce(max(r.currency), '')
+		from
+			guests g
+			left join reservations r on (r.guest_id = g.id and r.deleted_at is null and
+				r.status not in ($2, $3))
+		where
+			$1 = '' or
+			g.first_name || ' ' || g.last_name ilike '%' || $1 || '%' or
+			g.email ilike '%' || $1 || '%' or
+			g.phone ilike '%' || $1 || '%'
+		group by g.id
+		order by g.last_name, g.first_name, g.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, strings.TrimSpace(search), status.Cancelled, status.NoShow)
+	if err != nil {
+		return guests, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g models.Guest
+		err = rows.Scan(
+			&g.ID,
+			&g.FirstName,
+			&g.LastName,
+			&g.Email,
+			&g.Phone,
+			&g.Notes,
+			&g.VIP,
+			&g.DoNotRent,
+			&g.CreatedAt,
+			&g.UpdatedAt,
+			&g.Stays,
+			&g.Nights,
+			&g.Spend,
+			&g.Currency,
+		)
+		if err != nil {
+			return guests, err
+		}
+		guests = append(guests, g)
+	}
+
+	if err = rows.Err(); err != nil {
+		return guests, err
+	}
+	return guests, nil
+}
+
+// GetGuestByID returns a guest by id with all of their reservations outside the trash, newest
+// first, and their stays counted
+func (m *postgresDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	g, err := scanGuest(m.DB.QueryRowContext(ctx, `select `+guestColumns+` from guests g where g.id = $1`, id))
+	if err != nil {
+		return g, err
+	}
+
+	g.Reservations, err = m.listReservations(`select `+reservationColumns+`
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.guest_id = $1 and r.deleted_at is null
+		order by r.start_date desc, r.id desc`, id)
+	if err != nil {
+		return g, err
+	}
+	g.CountStays()
+	return g, nil
+}
+
+// SimilarGuests returns the other guests who might be the same person as g: those with the same
+// name or phone number
+func (m *postgresDBRepo) SimilarGuests(g models.Guest) ([]models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var guests []models.Guest
+
+	query := `
+		select
+			` + guestColumns + `
+		from
+			guests g
+		where
+			g.id <> $1 and (
+				(lower(g.first_name) = lower($2) and lower(g.last_name) = lower($3)) or
+				($4 <> '' and g.phone = $4))
+		order by g.last_name, g.first_name, g.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, g.ID, g.FirstName, g.LastName, g.Phone)
+	if err != nil {
+		return guests, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		similar, err := scanGuest(rows)
+		if err != nil {
+			return guests, err
+		}
+		guests = append(guests, similar)
+	}
+
+	if err = rows.Err(); err != nil {
+		return guests, err
+	}
+	return guests, nil
+}
+
+// UpdateGuest updates a guest's name, phone number, notes and flags, recording the change in the
+// audit log. The email address can't be changed, as bookings are matched by it.
+func (m *postgresDBRepo) UpdateGuest(actor models.Actor, g models.Guest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanGuest(tx.QueryRowContext(ctx, `select `+guestColumns+` from guests g where g.id = $1 for update`, g.ID))
+	if err != nil {
+		return err
+	}
+
+	stmt := `update guests set first_name = $1, last_name = $2, phone = $3, notes = $4, vip = $5,
+		do_not_rent = $6, updated_at = $7
+		where id = $8`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		g.FirstName,
+		g.LastName,
+		g.Phone,
+		g.Notes,
+		g.VIP,
+		g.DoNotRent,
+		time.Now(),
+		g.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	after := before
+	after.FirstName = g.FirstName
+	after.LastName = g.LastName
+	after.Phone = g.Phone
+	after.Notes = g.Notes
+	after.VIP = g.VIP
+	after.DoNotRent = g.DoNotRent
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "update",
+		Entity:   "guest",
+		EntityID: g.ID,
+	}, guestSnapshot(before), guestSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MergeGuests merges the guest with mergeID into the one with keepID, a duplicate record of the
+// same person: the duplicate's reservations move over, its notes are added to the kept guest's
+// and its flags kept, and then it is deleted. The merge is recorded in the audit log.
+func (m *postgresDBRepo) MergeGuests(actor models.Actor, keepID, mergeID int) error {
+	if keepID == mergeID {
+		return repository.ErrSameGuest
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock both guests in id order, so two merges of the same pair can't deadlock
+	locked := map[int]models.Guest{}
+	ids := []int{keepID, mergeID}
+	sort.Ints(ids)
+	for _, id := range ids {
+		g, err := scanGuest(tx.QueryRowContext(ctx, `select `+guestColumns+` from guests g where g.id = $1 for update`, id))
+		if err != nil {
+			return err
+		}
+		locked[id] = g
+	}
+	keep, merge := locked[keepID], locked[mergeID]
+
+	after := keep
+	switch {
+	case after.Notes == "":
+		after.Notes = merge.Notes
+	case merge.Notes != "":
+		after.Notes += "\n\n" + merge.Notes
+	}
+	if after.Phone == "" {
+		after.Phone = merge.Phone
+	}
+	if merge.VIP == 1 {
+		after.VIP = 1
+	}
+	if merge.DoNotRent == 1 {
+		after.DoNotRent = 1
+	}
+
+	_, err = tx.ExecContext(ctx, `update reservations set guest_id = $1, updated_at = $2 where guest_id = $3`,
+		keepID, time.Now(), mergeID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update guests set phone = $1, notes = $2, vip = $3, do_not_rent = $4, updated_at = $5
+		where id = $6`
+	_, err = tx.ExecContext(ctx, stmt, after.Phone, after.Notes, after.VIP, after.DoNotRent, time.Now(), keepID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from guests where id = $1`, mergeID)
+	if err != nil {
+		return err
+	}
+
+	err = insertAuditEvent(ctx, tx, actor, models.AuditEvent{
+		Action:   "merge",
+		Entity:   "guest",
+		EntityID: keepID,
+	}, []auditGuest{guestSnapshot(keep), guestSnapshot(merge)}, guestSnapshot(after))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditGuest is the part of a guest kept in the audit log
+type auditGuest struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	Notes     string `json:"notes"`
+	VIP       int    `json:"vip"`
+	DoNotRent int    `json:"do_not_rent"`
+}
+
+// guestSnapshot returns g as it is recorded in the audit log
+func guestSnapshot(g models.Guest) auditGuest {
+	return auditGuest{
+		ID:        g.ID,
+		FirstName: g.FirstName,
+		LastName:  g.LastName,
+		Email:     g.Email,
+		Phone:     g.Phone,
+		Notes:     g.Notes,
+		VIP:       g.VIP,
+		DoNotRent: g.DoNotRent,
+	}
+}
@@ -1,14 +1,54 @@
 package dbrepo
 
 import (
+	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/payments"
+	"github.com/eador/bookings/internal/promo"
+	"github.com/eador/bookings/internal/repository"
+	"github.com/eador/bookings/internal/status"
+	"github.com/eador/bookings/internal/tokens"
+	"github.com/eador/bookings/internal/waitlist"
 )
 
-func (m *testDBRepo) AllUsers() bool {
-	return true
+// lockedUntil is when the locked test user can log in again
+var lockedUntil = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TestTOTPSecret is the two-factor secret of the front desk test user
+const TestTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// TestRecoveryCode is the front desk test user's one unused recovery code
+const TestRecoveryCode = "abcde-fghjk"
+
+// testUsers are the users known to the test repository, one for each role. The front desk user
+// has two-factor login turned on, the read only user is locked out and the fourth user has been deactivated.
+var testUsers = []models.User{
+	{ID: 1, FirstName: "Owen", LastName: "Owner", Email: "me@here.com", AccessLevel: 3, Active: 1},
+	{ID: 2, FirstName: "Fran", LastName: "Desk", Email: "desk@here.com", AccessLevel: 2, Active: 1,
+		TOTPSecret: TestTOTPSecret, TOTPEnabled: 1},
+	{ID: 3, FirstName: "Rita", LastName: "Reader", Email: "reader@here.com", AccessLevel: 1, Active: 1,
+		FailedLogins: 5, LockedUntil: &lockedUntil},
+	{ID: 4, FirstName: "Gone", LastName: "Away", Email: "gone@here.com", AccessLevel: 2, Active: 0},
+}
+
+// AllUsers returns all users, ordered by name
+func (m *testDBRepo) AllUsers() ([]models.User, error) {
+	return testUsers, nil
+}
+
+// UpdateUserAccessLevel sets the access level (role) of a user
+func (m *testDBRepo) UpdateUserAccessLevel(actor models.Actor, id, accessLevel int) error {
+	if id == 5 {
+		return errors.New("some error")
+	}
+	if id > len(testUsers) {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 // InsertReservation inserts a reservation into the database
@@ -27,6 +67,35 @@ func (m *testDBRepo) InsertRoomRestricition(r models.RoomRestriction) error {
 	return nil
 }
 
+// CreateReservation inserts a reservation and its room restriction in a single transaction
+func (m *testDBRepo) CreateReservation(res models.Reservation) (int, error) {
+	if res.RoomID == 2 {
+		return 0, errors.New("some error")
+	}
+	if res.RoomID == 3 {
+		return 0, repository.ErrRoomUnavailable
+	}
+	return 1, nil
+}
+
+// CreateReservations books several rooms at once in a single transaction
+func (m *testDBRepo) CreateReservations(group []models.Reservation) ([]int, error) {
+	var ids []int
+	for i, res := range group {
+		if res.RoomID == 2 {
+			return nil, errors.New("some error")
+		}
+		if res.RoomID == 3 {
+			return nil, repository.ErrRoomUnavailable
+		}
+		if res.PromoCodeID == 6 {
+			return nil, promo.ErrUsedUp
+		}
+		ids = append(ids, i+1)
+	}
+	return ids, nil
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if availability exists for roomID, and false if no availability exists
 func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start time.Time, end time.Time, roomID int) (bool, error) {
 	if roomID == 2 {
@@ -39,34 +108,51 @@ func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start time.Time, end time
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms if any for a given start and end date
-func (m *testDBRepo) SearchAvailablitiyForAllRooms(start, end time.Time) ([]models.Room, error) {
+// that can sleep a party of adults and children
+func (m *testDBRepo) SearchAvailablitiyForAllRooms(start, end time.Time, adults, children int) ([]models.Room, error) {
 	var rooms []models.Room
-	if start.Before(time.Now()) {
-		if end.Before(time.Now()) {
-			return rooms, errors.New("some error")
-		} else {
-			return rooms, nil
-		}
+	if start.Year() == 2060 {
+		return rooms, errors.New("some error")
+	}
+	if start.Year() == 2061 {
+		return rooms, nil
 	}
-	var room models.Room
 
-	rooms = append(rooms, room)
+	active, _ := m.ActiveRooms()
+	for _, room := range active {
+		if room.Fits(adults, children) {
+			rooms = append(rooms, room)
+		}
+	}
 	return rooms, nil
 }
 
 // GetRoomById gets a room by id
 func (m *testDBRepo) GetRoomById(id int) (models.Room, error) {
 	var room models.Room
-	if id > 2 {
+	if id > 3 {
 		return room, errors.New("some error")
 	}
+	if id == 3 {
+		room.CancellationPolicyID = 3
+	}
+	room.ID = id
+	room.Capacity = 4
+	room.MaxAdults = 2
+	room.MaxChildren = 2
+	room.BaseRate = 10000
+	room.Currency = "USD"
 	return room, nil
 }
 
 // GetUserByID returns a user by id
 func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
-	var user models.User
-	return user, nil
+	for _, u := range testUsers {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
 }
 
 // UpdateUser updates a user in the database
@@ -74,12 +160,128 @@ func (m *testDBRepo) UpdateUser(u models.User) error {
 	return nil
 }
 
+// GetUserByEmail returns a user by email address
+func (m *testDBRepo) GetUserByEmail(email string) (models.User, error) {
+	if email == "broken@here.com" {
+		return models.User{}, errors.New("some error")
+	}
+	for _, u := range testUsers {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// InsertUser adds a user, without a password; they choose one when they accept their invite
+func (m *testDBRepo) InsertUser(actor models.Actor, u models.User) (int, error) {
+	for _, existing := range testUsers {
+		if existing.Email == u.Email {
+			return 0, errors.New("duplicate key value violates unique constraint")
+		}
+	}
+	return len(testUsers) + 1, nil
+}
+
+// UpdateUserActive activates (1) or deactivates (0) a user. A deactivated user can't log in.
+func (m *testDBRepo) UpdateUserActive(actor models.Actor, id, active int) error {
+	if id == 5 {
+		return errors.New("some error")
+	}
+	if id > len(testUsers) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdatePassword hashes password with bcrypt and stores it for a user
+func (m *testDBRepo) UpdatePassword(id int, password string) error {
+	return nil
+}
+
+// InsertUserToken records an invite or password reset token
+func (m *testDBRepo) InsertUserToken(t models.UserToken) error {
+	return nil
+}
+
+// UseUserToken marks an unused, unexpired token as used and returns the user it was issued to.
+// Every token in the test repository was issued to user 2.
+func (m *testDBRepo) UseUserToken(hash, purpose string) (int, error) {
+	return 2, nil
+}
+
+// RecordFailedLogin counts a failed login against a user and returns how many there have been in a row
+func (m *testDBRepo) RecordFailedLogin(id int) (int, error) {
+	for _, u := range testUsers {
+		if u.ID == id {
+			return u.FailedLogins + 1, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+// LockUser stops a user logging in until the given time
+func (m *testDBRepo) LockUser(id int, until time.Time) error {
+	return nil
+}
+
+// UnlockUser lifts any lock on a user and clears their count of failed logins
+func (m *testDBRepo) UnlockUser(actor models.Actor, id int) error {
+	if id == 5 {
+		return errors.New("some error")
+	}
+	if id > len(testUsers) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// LockedUsers returns the users who are locked out now
+func (m *testDBRepo) LockedUsers() ([]models.User, error) {
+	var users []models.User
+	for _, u := range testUsers {
+		if u.Locked(time.Now()) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// InsertLoginAttempt records a login attempt
+func (m *testDBRepo) InsertLoginAttempt(a models.LoginAttempt) error {
+	return nil
+}
+
+// CountFailedLoginsFromIP returns how many failed logins came from an address since a time.
+// The address 192.0.2.66 has failed too often.
+func (m *testDBRepo) CountFailedLoginsFromIP(ip string, since time.Time) (int, error) {
+	if ip == "192.0.2.66" {
+		return 100, nil
+	}
+	return 0, nil
+}
+
+// RecentLoginAttempts returns the latest login attempts, newest first
+func (m *testDBRepo) RecentLoginAttempts(limit int) ([]models.LoginAttempt, error) {
+	attempts := []models.LoginAttempt{
+		{ID: 2, Email: "reader@here.com", IPAddress: "192.0.2.66", UserID: 3, Outcome: "account locked", CreatedAt: time.Now()},
+		{ID: 1, Email: "me@here.com", IPAddress: "192.0.2.1", UserID: 1, Succeeded: 1, Outcome: "succeeded", CreatedAt: time.Now()},
+	}
+	return attempts, nil
+}
+
 // Authenticate authentices a user
 func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
 	if email == "me@here.com" {
 		return 1, "", nil
 	}
-	return 0, "", errors.New("some error")
+	if email == "desk@here.com" && testPassword == "secret" {
+		return 2, "", nil
+	}
+	if email == "broken@here.com" {
+		return 0, "", errors.New("some error")
+	}
+	return 0, "", repository.ErrInvalidCredentials
 }
 
 // AllReservations returns a slice of all reservations
@@ -88,35 +290,151 @@ func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
 	return reservations, nil
 }
 
-// NewReservations returns a slice of all reservations
+// NewReservations returns the reservations still pending
 func (m *testDBRepo) NewReservations() ([]models.Reservation, error) {
 	var reservations []models.Reservation
 	return reservations, nil
 }
 
+// ReservationsByStatus returns the reservations with a status
+func (m *testDBRepo) ReservationsByStatus(st string) ([]models.Reservation, error) {
+	if st == status.NoShow {
+		return nil, errors.New("some error")
+	}
+	reservations := []models.Reservation{
+		{ID: 1, LastName: "Smith", Status: st, Room: models.Room{ID: 1, RoomName: "General's Quarters"}},
+	}
+	return reservations, nil
+}
+
 // GetReservationByID gets a reservation from the database using the ID
 func (m *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-	var reservation models.Reservation
+	reservation := models.Reservation{ID: id, Status: status.Pending}
+	if id == 4 {
+		reservation.Status = status.CheckedOut
+	}
+	if id == 8 || id == 9 {
+		// a group booking of two rooms, the second already cancelled
+		reservation.ConfirmationCode = "GROUP234"
+		if id == 9 {
+			reservation.Status = status.Cancelled
+		}
+		reservation.Group = []models.Reservation{
+			{ID: 8, RoomID: 1, Room: models.Room{RoomName: "General's Quarters"}, Status: status.Pending, ConfirmationCode: "GROUP234"},
+			{ID: 9, RoomID: 1, Room: models.Room{RoomName: "Major's Suite"}, Status: status.Cancelled, ConfirmationCode: "GROUP234"},
+		}
+	}
+	if id == 10 || id == 11 || id == 12 {
+		// paid in full through the fake provider, whose first payment in the handler tests is pay_000001;
+		// 10 arrives long after the free cancellation period, 11 tomorrow and 12, booked under the
+		// moderate policy, in three days
+		reservation.RoomID = 1
+		reservation.Email = "paid@here.com"
+		reservation.ConfirmationCode = "PAID2345"
+		reservation.StartDate = time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+		reservation.EndDate = time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC)
+		if id == 11 {
+			reservation.StartDate = time.Now().AddDate(0, 0, 1)
+			reservation.EndDate = time.Now().AddDate(0, 0, 3)
+		}
+		if id == 12 {
+			reservation.StartDate = time.Now().AddDate(0, 0, 3)
+			reservation.EndDate = time.Now().AddDate(0, 0, 5)
+			reservation.CancellationPolicyID = 2
+			reservation.CancellationPolicy = testCancellationPolicies[1].Name
+			reservation.CancellationTiers = testCancellationPolicies[1].Tiers
+		}
+		reservation.TotalAmount = 20000
+		reservation.Currency = "USD"
+		reservation.Payments = []models.Payment{
+			{ID: 1, ReservationID: id, Provider: "fake", Reference: "pay_000001", Kind: payments.Full,
+				Status: payments.Captured, Amount: 20000, Currency: "USD"},
+		}
+	}
+	if id == 13 {
+		// booked by a guest flagged as do not rent
+		reservation.GuestID = 2
+	}
 	return reservation, nil
 }
 
-// UpdateReservation updates a user in the database
-func (m *testDBRepo) UpdateReservation(r models.Reservation) error {
+// UpdateReservation updates a reservation's guest details, recording the change in the audit log
+func (m *testDBRepo) UpdateReservation(actor models.Actor, r models.Reservation) error {
 	return nil
 }
 
-func (m *testDBRepo) DeleteReservation(id int) error {
+// DeleteReservation moves a reservation to the trash and releases its room restrictions,
+// recording it in the audit log
+func (m *testDBRepo) DeleteReservation(actor models.Actor, id int) error {
 	return nil
 }
 
-// UpdatedProcessedForReservation updates processed for a reservation by id
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+// DeletedReservations returns the reservations in the trash, most recently deleted first
+func (m *testDBRepo) DeletedReservations() ([]models.Reservation, error) {
+	deletedAt := time.Now().Add(-time.Hour)
+	reservations := []models.Reservation{
+		{ID: 7, FirstName: "Tess", LastName: "Trashed", Email: "trashed@here.com",
+			StartDate: time.Now().AddDate(0, 0, 10), EndDate: time.Now().AddDate(0, 0, 12),
+			RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"}, DeletedAt: &deletedAt},
+	}
+	return reservations, nil
+}
+
+// RestoreReservation takes a reservation out of the trash and books its room again
+func (m *testDBRepo) RestoreReservation(actor models.Actor, id int) error {
+	if id == 2 {
+		return errors.New("some error")
+	}
+	if id == 3 {
+		return repository.ErrRoomUnavailable
+	}
 	return nil
 }
 
+// PurgeDeletedReservations removes for good the reservations put in the trash before before that
+// have no payments or charges
+func (m *testDBRepo) PurgeDeletedReservations(before time.Time) (int, error) {
+	return 0, nil
+}
+
+// UpdateReservationStatus moves a reservation to status to, recording the change
+func (m *testDBRepo) UpdateReservationStatus(actor models.Actor, id int, to string) error {
+	if id == 2 {
+		return errors.New("some error")
+	}
+	if id == 3 || id == 4 {
+		return repository.ErrInvalidStatusChange
+	}
+	return nil
+}
+
+// ExpireUnpaidReservations cancels the pending reservations whose payment was due by now,
+// releasing their rooms. It fails in 2060.
+func (m *testDBRepo) ExpireUnpaidReservations(now time.Time) ([]models.RoomRestriction, error) {
+	if now.Year() == 2060 {
+		return nil, errors.New("some error")
+	}
+	return nil, nil
+}
+
+// CancelReservation cancels a reservation, recording why and the penalty charged
+func (m *testDBRepo) CancelReservation(actor models.Actor, id int, c models.Cancellation) error {
+	return m.UpdateReservationStatus(actor, id, status.Cancelled)
+}
+
+// CancelReservationGroup cancels every reservation booked under a confirmation code that can still be cancelled
+func (m *testDBRepo) CancelReservationGroup(actor models.Actor, code string, c models.Cancellation) (int, error) {
+	if code == "BROKEN23" {
+		return 0, errors.New("some error")
+	}
+	if code == "DONE2345" {
+		return 0, repository.ErrInvalidStatusChange
+	}
+	return 2, nil
+}
+
 func (m *testDBRepo) AllRooms() ([]models.Room, error) {
-	var rooms []models.Room
-	return rooms, nil
+	return m.ActiveRooms()
 }
 
 // GetRestrictionsForRoomByDate resturns restrictions for a room by a date range
@@ -126,11 +444,565 @@ func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Ti
 }
 
 // InsertBlockForRoom inserts a room restriction
-func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
-	return nil
+func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) (int, error) {
+	if id == 2 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
 }
 
 // DeleteBlockByID deletes a room restriction
 func (m *testDBRepo) DeleteBlockByID(id int) error {
 	return nil
 }
+
+// UpdateBlocks adds and removes owner blocks on rooms' calendars, recording each change in the audit log
+func (m *testDBRepo) UpdateBlocks(actor models.Actor, add []models.RoomRestriction, remove []int) error {
+	for _, b := range add {
+		if b.RoomID == 2 {
+			return errors.New("some error")
+		}
+	}
+	return nil
+}
+
+// GetCalendarBlocksForRoom returns the blocks imported into a room from a calendar source
+func (m *testDBRepo) GetCalendarBlocksForRoom(roomID int, source string) ([]models.CalendarBlock, error) {
+	var blocks []models.CalendarBlock
+	if roomID == 3 {
+		return blocks, errors.New("some error")
+	}
+	return blocks, nil
+}
+
+// InsertCalendarBlock records a block imported from a calendar source
+func (m *testDBRepo) InsertCalendarBlock(b models.CalendarBlock) error {
+	return nil
+}
+
+// GetReservationByConfirmationCode gets a reservation using the confirmation code and the guest's email
+func (m *testDBRepo) GetReservationByConfirmationCode(code, email string) (models.Reservation, error) {
+	var reservation models.Reservation
+	if code == "BROKEN23" {
+		return reservation, errors.New("some error")
+	}
+	if code == "GROUP234" && email == "group@here.com" {
+		// the group booking of reservations 8 and 9, found through 9, which was cancelled on its own
+		return models.Reservation{ID: 9, RoomID: 1, Status: status.Cancelled, Email: email, ConfirmationCode: code}, nil
+	}
+	if code != "ABCD2345" || email != "john@smith.com" {
+		return reservation, sql.ErrNoRows
+	}
+	reservation.ID = 1
+	reservation.RoomID = 1
+	reservation.Status = status.Pending
+	reservation.Email = email
+	reservation.ConfirmationCode = code
+	return reservation, nil
+}
+
+// UpdateReservationDates moves a reservation and its room restriction to new dates
+func (m *testDBRepo) UpdateReservationDates(actor models.Actor, res models.Reservation) error {
+	if res.RoomID == 2 {
+		return errors.New("some error")
+	}
+	if res.RoomID == 3 {
+		return repository.ErrRoomUnavailable
+	}
+	if res.StartDate.Year() == 2057 {
+		// cancelled while the guest was changing the dates
+		return repository.ErrInvalidStatusChange
+	}
+	return nil
+}
+
+// GetRateOverridesForRoom returns the rate overrides for a room that overlap a date range
+func (m *testDBRepo) GetRateOverridesForRoom(roomID int, start, end time.Time) ([]models.RateOverride, error) {
+	var overrides []models.RateOverride
+	if start.Year() == 2055 {
+		// a non-refundable rate for the whole year
+		overrides = append(overrides, models.RateOverride{ID: 1, RoomID: roomID, Name: "Saver",
+			StartDate: time.Date(2055, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2055, 12, 31, 0, 0, 0, 0, time.UTC),
+			NightlyRate: 8000, CancellationPolicyID: 4})
+	}
+	return overrides, nil
+}
+
+// InsertPayment records a charge or refund against a reservation
+func (m *testDBRepo) InsertPayment(p models.Payment) (int, error) {
+	if p.ReservationID == 2 {
+		return 0, errors.New("some error")
+	}
+	if p.ReservationID == 14 {
+		// released for not being paid in time while the guest was paying
+		return 0, repository.ErrPaymentTooLate
+	}
+	if p.ReservationID == 15 && p.Kind != payments.Refund {
+		// paid for by another checkout of the same booking while the guest was paying
+		return 0, repository.ErrAlreadyPaid
+	}
+	return 1, nil
+}
+
+// UpdatePaymentStatus sets the status of the payment a provider knows by reference, returning
+// sql.ErrNoRows if there is none
+func (m *testDBRepo) UpdatePaymentStatus(provider, reference, to string) error {
+	if reference == "broken" {
+		return errors.New("some error")
+	}
+	if reference == "unknown" {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist
+func (m *testDBRepo) InsertWaitlistEntry(e models.WaitlistEntry) (int, error) {
+	if e.StartDate.Year() == 2060 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+// GetWaitlistEntryByID returns a waitlist entry. The room is held for 1, 2 is still waiting,
+// the hold on 3 has lapsed and 4 can't be read.
+func (m *testDBRepo) GetWaitlistEntryByID(id int) (models.WaitlistEntry, error) {
+	e := models.WaitlistEntry{
+		ID:        id,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		Adults:    2,
+		Status:    waitlist.Offered,
+		RoomID:    1,
+	}
+	switch id {
+	case 1:
+		e.HoldExpiresAt = time.Now().Add(time.Hour)
+	case 2:
+		e.Status = waitlist.Waiting
+		e.RoomID = 0
+	case 3:
+		e.HoldExpiresAt = time.Now().Add(-time.Hour)
+	case 4:
+		return e, errors.New("some error")
+	default:
+		return models.WaitlistEntry{}, sql.ErrNoRows
+	}
+	return e, nil
+}
+
+// WaitlistEntriesForRoom returns the guests waiting for a stay overlapping start to end who would take the room
+func (m *testDBRepo) WaitlistEntriesForRoom(roomID int, start, end time.Time) ([]models.WaitlistEntry, error) {
+	var entries []models.WaitlistEntry
+	return entries, nil
+}
+
+// HoldRoomForWaitlist holds a room for a waiting guest's stay
+func (m *testDBRepo) HoldRoomForWaitlist(entryID, roomID int, until time.Time) (int, error) {
+	return 1, nil
+}
+
+// ExpireWaitlistOffers releases the holds that had lapsed at now
+func (m *testDBRepo) ExpireWaitlistOffers(now time.Time) ([]models.RoomRestriction, error) {
+	var released []models.RoomRestriction
+	return released, nil
+}
+
+// BookWaitlistOffer books group, releasing the room held for a waitlist entry
+func (m *testDBRepo) BookWaitlistOffer(entryID int, group []models.Reservation) ([]int, error) {
+	return m.CreateReservations(group)
+}
+
+// GetStayRulesForArrival returns the stay rules, for any room, that cover an arrival date
+func (m *testDBRepo) GetStayRulesForArrival(arrival time.Time) ([]models.StayRule, error) {
+	var rules []models.StayRule
+	if arrival.Year() == 2052 {
+		return rules, errors.New("some error")
+	}
+
+	// summer arrivals are on Saturdays for a week or more, and the suite's summer stays end on a Saturday
+	summer := []models.StayRule{
+		{ID: 1, Name: "Summer", StartDate: time.Date(2050, 6, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 8, 31, 0, 0, 0, 0, time.UTC), MinNights: 7, ArrivalWeekdays: "6"},
+		{ID: 2, RoomID: 2, Name: "Suite summer", StartDate: time.Date(2050, 6, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 8, 31, 0, 0, 0, 0, time.UTC), DepartureWeekdays: "6"},
+	}
+	for _, rule := range summer {
+		if !arrival.Before(rule.StartDate) && !arrival.After(rule.EndDate) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// testCharges are the taxes and fees in 2053: a tax on every room and a cleaning fee on the first
+var testCharges = []models.Charge{
+	{ID: 1, Name: "Occupancy Tax", Kind: "tax", Basis: "percent", Amount: 1000, StartDate: time.Date(2053, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2053, 12, 31, 0, 0, 0, 0, time.UTC)},
+	{ID: 2, RoomID: 1, Name: "Cleaning Fee", Kind: "fee", Basis: "per_stay", Amount: 2500, StartDate: time.Date(2053, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2053, 12, 31, 0, 0, 0, 0, time.UTC)},
+}
+
+// GetChargesForStay returns the taxes and fees, for any room, that cover a night of a stay from
+// start up to end, taxes first
+func (m *testDBRepo) GetChargesForStay(start, end time.Time) ([]models.Charge, error) {
+	var charges []models.Charge
+	if start.Year() == 2054 {
+		return charges, errors.New("some error")
+	}
+	for _, c := range testCharges {
+		if start.Before(c.EndDate.AddDate(0, 0, 1)) && end.After(c.StartDate) {
+			charges = append(charges, c)
+		}
+	}
+	return charges, nil
+}
+
+// TaxChargesForMonth returns the taxes charged on reservations, not in the trash, with nights in
+// the month starting on month, along with each reservation's dates, status and currency
+func (m *testDBRepo) TaxChargesForMonth(month time.Time) ([]models.ReservationCharge, error) {
+	var charges []models.ReservationCharge
+	if month.Year() == 2060 {
+		return charges, errors.New("some error")
+	}
+	if month.Year() != 2053 || month.Month() != time.January {
+		return charges, nil
+	}
+
+	res := models.Reservation{ID: 1, StartDate: time.Date(2053, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2053, 1, 3, 0, 0, 0, 0, time.UTC), Status: "confirmed", Currency: "USD"}
+	charges = append(charges, models.ReservationCharge{ID: 1, ReservationID: 1, ChargeID: 1, Name: "Occupancy Tax", Kind: "tax", Basis: "percent", Rate: 1000, Nights: 2, TaxableAmount: 20000, Amount: 2000, Reservation: res})
+	return charges, nil
+}
+
+// testCancellationPolicies are the policies the migrations seed
+var testCancellationPolicies = []models.CancellationPolicy{
+	{ID: 1, Name: "Flexible", Tiers: []models.CancellationTier{{Days: 1, Percent: 0}}},
+	{ID: 2, Name: "Moderate", Tiers: []models.CancellationTier{{Days: 5, Percent: 0}, {Days: 1, Percent: 50}}},
+	{ID: 3, Name: "Strict", Tiers: []models.CancellationTier{{Days: 14, Percent: 0}, {Days: 7, Percent: 50}}},
+	{ID: 4, Name: "Non-refundable"},
+}
+
+// AllCancellationPolicies returns the cancellation policies, ordered by name
+func (m *testDBRepo) AllCancellationPolicies() ([]models.CancellationPolicy, error) {
+	return testCancellationPolicies, nil
+}
+
+// GetCancellationPolicyByID returns a cancellation policy by id
+func (m *testDBRepo) GetCancellationPolicyByID(id int) (models.CancellationPolicy, error) {
+	for _, p := range testCancellationPolicies {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return models.CancellationPolicy{}, sql.ErrNoRows
+}
+
+// ActiveRooms returns the rooms that are still offered to guests, in display order
+func (m *testDBRepo) ActiveRooms() ([]models.Room, error) {
+	rooms := []models.Room{
+		{ID: 1, RoomName: "General's Quarters", Slug: "generals-quarters", Capacity: 2, MaxAdults: 2, MaxChildren: 0, BaseRate: 10000, Currency: "USD"},
+		{ID: 2, RoomName: "Major's Suite", Slug: "majors-suite", Capacity: 4, MaxAdults: 2, MaxChildren: 2, BaseRate: 10000, Currency: "USD"},
+	}
+	return rooms, nil
+}
+
+// GetRoomBySlug gets a room by its slug
+func (m *testDBRepo) GetRoomBySlug(slug string) (models.Room, error) {
+	rooms, _ := m.ActiveRooms()
+	for _, room := range rooms {
+		if room.Slug == slug {
+			return room, nil
+		}
+	}
+	if slug == "broken" {
+		return models.Room{}, errors.New("some error")
+	}
+	return models.Room{}, sql.ErrNoRows
+}
+
+// InsertRoom inserts a room and its photos, placing it after the existing rooms
+func (m *testDBRepo) InsertRoom(actor models.Actor, room models.Room) (int, error) {
+	if room.RoomName == "Broken Room" {
+		return 0, errors.New("some error")
+	}
+	return 3, nil
+}
+
+// UpdateRoom updates a room and replaces its photos
+func (m *testDBRepo) UpdateRoom(actor models.Actor, room models.Room) error {
+	if room.RoomName == "Broken Room" {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// UpdateRetiredForRoom retires a room, or brings a retired room back, by id
+func (m *testDBRepo) UpdateRetiredForRoom(actor models.Actor, id, retired int) error {
+	return nil
+}
+
+// ReorderRooms sets the display order of rooms to the order of ids
+func (m *testDBRepo) ReorderRooms(actor models.Actor, ids []int) error {
+	return nil
+}
+
+// EnqueueMail adds a message to the mail outbox
+func (m *testDBRepo) EnqueueMail(msg models.MailData) (int, error) {
+	return 1, nil
+}
+
+// ClaimMail takes messages that are due from the mail outbox
+func (m *testDBRepo) ClaimMail(limit int, lease time.Duration) ([]models.OutboxMail, error) {
+	var mail []models.OutboxMail
+	return mail, nil
+}
+
+// MarkMailSent records that a message has been sent
+func (m *testDBRepo) MarkMailSent(id int) error {
+	return nil
+}
+
+// RetryMail records a failed attempt to send a message and when to try again
+func (m *testDBRepo) RetryMail(id, attempts int, next time.Time, lastErr string) error {
+	return nil
+}
+
+// DeadLetterMail records that a message has failed for the last time
+func (m *testDBRepo) DeadLetterMail(id, attempts int, lastErr string) error {
+	return nil
+}
+
+// FailedMail returns the messages that could not be sent
+func (m *testDBRepo) FailedMail() ([]models.OutboxMail, error) {
+	mail := []models.OutboxMail{
+		{
+			ID:        1,
+			Mail:      models.MailData{To: "john@smith.com", From: "me@here.com", Subject: "Reservation Confirmation"},
+			Status:    "dead",
+			Attempts:  8,
+			LastError: "connection refused",
+		},
+	}
+	return mail, nil
+}
+
+// ResendMail puts a failed message back in the outbox to be sent again
+func (m *testDBRepo) ResendMail(actor models.Actor, id int) error {
+	if id == 2 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// testPromoCodes are the promo codes known to the test repository. USEDUP has been used once and
+// is used up, EXPIRED has expired, SUITE is only for a room that doesn't exist and LASTONE is taken
+// by someone else while the guest books.
+var testPromoCodes = []models.PromoCode{
+	{ID: 1, Code: "SAVE10", Kind: promo.Percent, Amount: 10, Currency: "USD", Active: 1, Redemptions: 3},
+	{ID: 2, Code: "FLAT50", Kind: promo.Fixed, Amount: 5000, Currency: "USD", RoomIDs: []int{1}, Active: 1},
+	{ID: 3, Code: "USEDUP", Kind: promo.Percent, Amount: 20, Currency: "USD", MaxUses: 1, Active: 1, Redemptions: 1},
+	{ID: 4, Code: "EXPIRED", Kind: promo.Percent, Amount: 20, Currency: "USD", Active: 1,
+		ValidUntil: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{ID: 7, Code: "SUITE", Kind: promo.Percent, Amount: 20, Currency: "USD", RoomIDs: []int{99}, Active: 1},
+	{ID: 6, Code: "LASTONE", Kind: promo.Percent, Amount: 20, Currency: "USD", MaxUses: 10, Active: 1},
+}
+
+// AllPromoCodes returns every promo code with how many bookings have used each
+func (m *testDBRepo) AllPromoCodes() ([]models.PromoCode, error) {
+	return testPromoCodes, nil
+}
+
+// GetPromoCodeByID returns a promo code by id. 5 can't be read.
+func (m *testDBRepo) GetPromoCodeByID(id int) (models.PromoCode, error) {
+	if id == 5 {
+		return models.PromoCode{}, errors.New("some error")
+	}
+	for _, p := range testPromoCodes {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return models.PromoCode{}, sql.ErrNoRows
+}
+
+// GetPromoCodeByCode returns the promo code a guest entered. BROKEN can't be read.
+func (m *testDBRepo) GetPromoCodeByCode(code string) (models.PromoCode, error) {
+	if code == "BROKEN" {
+		return models.PromoCode{}, errors.New("some error")
+	}
+	for _, p := range testPromoCodes {
+		if p.Code == code {
+			return p, nil
+		}
+	}
+	return models.PromoCode{}, sql.ErrNoRows
+}
+
+// PromoCodeUses returns how many bookings have used a promo code, and how many of them were made
+// with email
+func (m *testDBRepo) PromoCodeUses(id int, email string) (int, int, error) {
+	for _, p := range testPromoCodes {
+		if p.ID == id {
+			return p.Redemptions, 0, nil
+		}
+	}
+	return 0, 0, nil
+}
+
+// InsertPromoCode adds a promo code. FAIL can't be added.
+func (m *testDBRepo) InsertPromoCode(actor models.Actor, p models.PromoCode) (int, error) {
+	if p.Code == "FAIL" {
+		return 0, errors.New("some error")
+	}
+	return 8, nil
+}
+
+// UpdatePromoCode saves changes to a promo code
+func (m *testDBRepo) UpdatePromoCode(actor models.Actor, p models.PromoCode) error {
+	if p.Code == "FAIL" {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// EnableTOTP turns on two-factor login for a user with secret, replacing their recovery codes
+func (m *testDBRepo) EnableTOTP(id int, secret string, recoveryCodeHashes []string) error {
+	if id == 5 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// DisableTOTP turns off two-factor login for a user and removes their recovery codes
+func (m *testDBRepo) DisableTOTP(id int) error {
+	return nil
+}
+
+// UseTOTPCounter records that a user's code for a time step was accepted
+func (m *testDBRepo) UseTOTPCounter(id int, counter int64) error {
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces a user's recovery codes with new ones
+func (m *testDBRepo) ReplaceRecoveryCodes(id int, hashes []string) error {
+	return nil
+}
+
+// UseRecoveryCode marks one of a user's unused recovery codes as used
+func (m *testDBRepo) UseRecoveryCode(id int, hash string) error {
+	if id == 2 && hash == tokens.Hash(TestRecoveryCode) {
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (m *testDBRepo) CountRecoveryCodes(id int) (int, error) {
+	return 8, nil
+}
+
+// GetSetting returns the value of a site setting, or "" if it has not been set
+func (m *testDBRepo) GetSetting(name string) (string, error) {
+	return m.settings[name], nil
+}
+
+// UpdateSetting sets the value of a site setting
+func (m *testDBRepo) UpdateSetting(actor models.Actor, name, value string) error {
+	m.settings[name] = value
+	return nil
+}
+
+// AuditEvents returns the audit log matching f, newest first
+func (m *testDBRepo) AuditEvents(f models.AuditFilter) ([]models.AuditEvent, error) {
+	if f.UserID == 5 {
+		return nil, errors.New("some error")
+	}
+	events := []models.AuditEvent{
+		{ID: 1, UserID: 1, Action: "update", Entity: "reservation", EntityID: 1,
+			Before: `{"id":1,"first_name":"John"}`, After: `{"id":1,"first_name":"Jon"}`,
+			IPAddress: "192.0.2.1", CreatedAt: time.Now(),
+			User: models.User{ID: 1, FirstName: "Owen", LastName: "Owner", Email: "me@here.com"}},
+	}
+	return events, nil
+}
+
+// testGuests are the guests known to the test repository. Jon Smith is a duplicate of John Smith
+// with the same phone number, flagged as do not rent, and Broken Guest can't be read.
+var testGuests = []models.Guest{
+	{ID: 1, FirstName: "John", LastName: "Smith", Email: "john@smith.com", Phone: "555-0100", Notes: "Likes a quiet room", VIP: 1},
+	{ID: 2, FirstName: "Jon", LastName: "Smith", Email: "jon@smith.com", Phone: "555-0100", DoNotRent: 1},
+	{ID: 3, FirstName: "Broken", LastName: "Guest", Email: "broken@here.com"},
+}
+
+// AllGuests returns the guests whose name or email contains search. A search for "error" fails.
+func (m *testDBRepo) AllGuests(search string) ([]models.Guest, error) {
+	if search == "error" {
+		return nil, errors.New("some error")
+	}
+	var guests []models.Guest
+	for _, g := range testGuests {
+		name := strings.ToLower(g.FirstName + " " + g.LastName)
+		if strings.Contains(name, strings.ToLower(search)) || strings.Contains(g.Email, strings.ToLower(search)) {
+			guests = append(guests, g)
+		}
+	}
+	return guests, nil
+}
+
+// GetGuestByID returns a guest by id. John Smith has stayed once and cancelled once, and 3 can't
+// be read.
+func (m *testDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	if id == 3 {
+		return models.Guest{}, errors.New("some error")
+	}
+	for _, g := range testGuests {
+		if g.ID != id {
+			continue
+		}
+		if id == 1 {
+			g.Reservations = []models.Reservation{
+				{ID: 5, GuestID: 1, Status: status.CheckedOut, Room: models.Room{RoomName: "General's Quarters"},
+					StartDate: time.Date(2050, 3, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 3, 4, 0, 0, 0, 0, time.UTC),
+					TotalAmount: 30000, Currency: "USD"},
+				{ID: 6, GuestID: 1, Status: status.Cancelled, Room: models.Room{RoomName: "Major's Suite"},
+					StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+					TotalAmount: 20000, Currency: "USD"},
+			}
+			g.CountStays()
+		}
+		return g, nil
+	}
+	return models.Guest{}, sql.ErrNoRows
+}
+
+// SimilarGuests returns the other guests with the same name or phone number as g
+func (m *testDBRepo) SimilarGuests(g models.Guest) ([]models.Guest, error) {
+	var guests []models.Guest
+	for _, other := range testGuests {
+		if other.ID != g.ID && other.Phone != "" && other.Phone == g.Phone {
+			guests = append(guests, other)
+		}
+	}
+	return guests, nil
+}
+
+// UpdateGuest updates a guest's details, notes and flags. 2 can't be updated.
+func (m *testDBRepo) UpdateGuest(actor models.Actor, g models.Guest) error {
+	if g.ID == 2 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// MergeGuests merges the guest with mergeID into the one with keepID. 3 can't be merged.
+func (m *testDBRepo) MergeGuests(actor models.Actor, keepID, mergeID int) error {
+	if keepID == mergeID {
+		return repository.ErrSameGuest
+	}
+	if mergeID == 3 {
+		return errors.New("some error")
+	}
+	if mergeID > 3 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -1,18 +1,62 @@
 package repository
 
 import (
+	"errors"
 	"time"
 
 	"github.com/eador/bookings/internal/models"
 )
 
+// ErrRoomUnavailable is returned when a room is already booked or blocked for the requested dates
+var ErrRoomUnavailable = errors.New("room no longer available")
+
+// ErrInvalidStatusChange is returned when a reservation can't move from its status to the one asked for
+var ErrInvalidStatusChange = errors.New("reservation can't change to that status")
+
+// ErrPaymentTooLate is returned when paying for a reservation that was released for not being
+// paid in time
+var ErrPaymentTooLate = errors.New("reservation released before it was paid for")
+
+// ErrAlreadyPaid is returned when charging for a booking that has already been paid for
+var ErrAlreadyPaid = errors.New("reservation has already been paid for")
+
+// ErrSameGuest is returned when merging a guest into themselves
+var ErrSameGuest = errors.New("can't merge a guest into themselves")
+
+// ErrInvalidCredentials is returned by Authenticate for an unknown email address or a wrong password alike
+var ErrInvalidCredentials = errors.New("invalid login credentials")
+
 type DatabaseRepo interface {
-	AllUsers() bool
+	AllUsers() ([]models.User, error)
+	UpdateUserAccessLevel(actor models.Actor, id, accessLevel int) error
+	GetUserByEmail(email string) (models.User, error)
+	InsertUser(actor models.Actor, u models.User) (int, error)
+	UpdateUserActive(actor models.Actor, id, active int) error
+	UpdatePassword(id int, password string) error
+	InsertUserToken(t models.UserToken) error
+	UseUserToken(hash, purpose string) (int, error)
+	RecordFailedLogin(id int) (int, error)
+	LockUser(id int, until time.Time) error
+	UnlockUser(actor models.Actor, id int) error
+	LockedUsers() ([]models.User, error)
+	InsertLoginAttempt(a models.LoginAttempt) error
+	CountFailedLoginsFromIP(ip string, since time.Time) (int, error)
+	RecentLoginAttempts(limit int) ([]models.LoginAttempt, error)
+	EnableTOTP(id int, secret string, recoveryCodeHashes []string) error
+	DisableTOTP(id int) error
+	UseTOTPCounter(id int, counter int64) error
+	ReplaceRecoveryCodes(id int, hashes []string) error
+	UseRecoveryCode(id int, hash string) error
+	CountRecoveryCodes(id int) (int, error)
+	GetSetting(name string) (string, error)
+	UpdateSetting(actor models.Actor, name, value string) error
 
 	InsertReservation(res models.Reservation) (int, error)
 	InsertRoomRestricition(r models.RoomRestriction) error
+	CreateReservation(res models.Reservation) (int, error)
+	CreateReservations(group []models.Reservation) ([]int, error)
 	SearchAvailabilityByDatesByRoomID(start time.Time, end time.Time, roomID int) (bool, error)
-	SearchAvailablitiyForAllRooms(start, end time.Time) ([]models.Room, error)
+	SearchAvailablitiyForAllRooms(start, end time.Time, adults, children int) ([]models.Room, error)
 	GetRoomById(id int) (models.Room, error)
 	GetUserByID(id int) (models.User, error)
 	UpdateUser(u models.User) error
@@ -20,11 +64,71 @@ type DatabaseRepo interface {
 	AllReservations() ([]models.Reservation, error)
 	NewReservations() ([]models.Reservation, error)
 	GetReservationByID(id int) (models.Reservation, error)
-	UpdateReservation(r models.Reservation) error
-	DeleteReservation(id int) error
-	UpdateProcessedForReservation(id, processed int) error
+	UpdateReservation(actor models.Actor, r models.Reservation) error
+	DeleteReservation(actor models.Actor, id int) error
+	DeletedReservations() ([]models.Reservation, error)
+	RestoreReservation(actor models.Actor, id int) error
+	PurgeDeletedReservations(before time.Time) (int, error)
+	UpdateReservationStatus(actor models.Actor, id int, to string) error
+	ExpireUnpaidReservations(now time.Time) ([]models.RoomRestriction, error)
+	CancelReservation(actor models.Actor, id int, c models.Cancellation) error
+	CancelReservationGroup(actor models.Actor, code string, c models.Cancellation) (int, error)
+	ReservationsByStatus(status string) ([]models.Reservation, error)
 	AllRooms() ([]models.Room, error)
 	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
-	InsertBlockForRoom(id int, startDate time.Time) error
+	InsertBlockForRoom(id int, startDate time.Time) (int, error)
 	DeleteBlockByID(id int) error
+	UpdateBlocks(actor models.Actor, add []models.RoomRestriction, remove []int) error
+	GetCalendarBlocksForRoom(roomID int, source string) ([]models.CalendarBlock, error)
+	InsertCalendarBlock(b models.CalendarBlock) error
+
+	GetReservationByConfirmationCode(code, email string) (models.Reservation, error)
+	UpdateReservationDates(actor models.Actor, res models.Reservation) error
+
+	GetRateOverridesForRoom(roomID int, start, end time.Time) ([]models.RateOverride, error)
+	GetStayRulesForArrival(arrival time.Time) ([]models.StayRule, error)
+	GetChargesForStay(start, end time.Time) ([]models.Charge, error)
+	TaxChargesForMonth(month time.Time) ([]models.ReservationCharge, error)
+	AllCancellationPolicies() ([]models.CancellationPolicy, error)
+	GetCancellationPolicyByID(id int) (models.CancellationPolicy, error)
+
+	InsertPayment(p models.Payment) (int, error)
+	UpdatePaymentStatus(provider, reference, to string) error
+
+	InsertWaitlistEntry(e models.WaitlistEntry) (int, error)
+	GetWaitlistEntryByID(id int) (models.WaitlistEntry, error)
+	WaitlistEntriesForRoom(roomID int, start, end time.Time) ([]models.WaitlistEntry, error)
+	HoldRoomForWaitlist(entryID, roomID int, until time.Time) (int, error)
+	ExpireWaitlistOffers(now time.Time) ([]models.RoomRestriction, error)
+	BookWaitlistOffer(entryID int, group []models.Reservation) ([]int, error)
+
+	AllPromoCodes() ([]models.PromoCode, error)
+	GetPromoCodeByID(id int) (models.PromoCode, error)
+	GetPromoCodeByCode(code string) (models.PromoCode, error)
+	PromoCodeUses(id int, email string) (int, int, error)
+	InsertPromoCode(actor models.Actor, p models.PromoCode) (int, error)
+	UpdatePromoCode(actor models.Actor, p models.PromoCode) error
+
+	AllGuests(search string) ([]models.Guest, error)
+	GetGuestByID(id int) (models.Guest, error)
+	SimilarGuests(g models.Guest) ([]models.Guest, error)
+	UpdateGuest(actor models.Actor, g models.Guest) error
+	MergeGuests(actor models.Actor, keepID, mergeID int) error
+
+	ActiveRooms() ([]models.Room, error)
+	GetRoomBySlug(slug string) (models.Room, error)
+	InsertRoom(actor models.Actor, room models.Room) (int, error)
+	UpdateRoom(actor models.Actor, room models.Room) error
+	UpdateRetiredForRoom(actor models.Actor, id, retired int) error
+	ReorderRooms(actor models.Actor, ids []int) error
+
+	EnqueueMail(msg models.MailData) (int, error)
+	ClaimMail(limit int, lease time.Duration) ([]models.OutboxMail, error)
+	MarkMailSent(id int) error
+	RetryMail(id, attempts int, next time.Time, lastErr string) error
+	DeadLetterMail(id, attempts int, lastErr string) error
+	FailedMail() ([]models.OutboxMail, error)
+	ResendMail(actor models.Actor, id int) error
+
+	AuditEvents(f models.AuditFilter) ([]models.AuditEvent, error)
 }
@@ -0,0 +1,95 @@
+package status
+
+// The statuses a reservation moves through. New reservations are Pending.
+const (
+	Pending    = "pending"
+	Confirmed  = "confirmed"
+	CheckedIn  = "checked_in"
+	CheckedOut = "checked_out"
+	Cancelled  = "cancelled"
+	NoShow     = "no_show"
+)
+
+// Status describes a reservation status. Action is what moving a reservation to it is called.
+type Status struct {
+	Value  string
+	Name   string
+	Action string
+}
+
+var statuses = []Status{
+	{Pending, "Pending", ""},
+	{Confirmed, "Confirmed", "Confirm"},
+	{CheckedIn, "Checked In", "Check In"},
+	{CheckedOut, "Checked Out", "Check Out"},
+	{Cancelled, "Cancelled", "Cancel"},
+	{NoShow, "No Show", "No Show"},
+}
+
+// transitions lists the statuses each status can change to. Statuses that are not listed are final.
+var transitions = map[string][]string{
+	Pending:   {Confirmed, Cancelled},
+	Confirmed: {CheckedIn, Cancelled, NoShow},
+	CheckedIn: {CheckedOut},
+}
+
+// All returns every status in the order a reservation usually moves through them
+func All() []Status {
+	return statuses
+}
+
+// Get returns the status with value s
+func Get(s string) (Status, bool) {
+	for _, st := range statuses {
+		if st.Value == s {
+			return st, true
+		}
+	}
+	return Status{}, false
+}
+
+// Name returns the name of status s, or s itself if it is unknown
+func Name(s string) string {
+	if st, ok := Get(s); ok {
+		return st.Name
+	}
+	return s
+}
+
+// Valid reports whether s is a status
+func Valid(s string) bool {
+	_, ok := Get(s)
+	return ok
+}
+
+// Next returns the statuses a reservation with status from can change to
+func Next(from string) []Status {
+	var next []Status
+	for _, to := range transitions[from] {
+		st, _ := Get(to)
+		next = append(next, st)
+	}
+	return next
+}
+
+// CanChange reports whether a reservation with status from can change to status to
+func CanChange(from, to string) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleasesRoom reports whether a reservation with status s no longer holds its room, so its
+// dates can be booked by someone else
+func ReleasesRoom(s string) bool {
+	return s == Cancelled || s == NoShow
+}
+
+// Upcoming reports whether a reservation with status s is still to come, so the guest can
+// change its dates or cancel it
+func Upcoming(s string) bool {
+	return s == Pending || s == Confirmed
+}
@@ -0,0 +1,67 @@
+package status
+
+import "testing"
+
+func TestCanChange(t *testing.T) {
+	tests := []struct {
+		from     string
+		to       string
+		expected bool
+	}{
+		{Pending, Confirmed, true},
+		{Pending, Cancelled, true},
+		{Pending, CheckedIn, false},
+		{Confirmed, CheckedIn, true},
+		{Confirmed, NoShow, true},
+		{Confirmed, Pending, false},
+		{CheckedIn, CheckedOut, true},
+		{CheckedIn, Cancelled, false},
+		{CheckedOut, CheckedIn, false},
+		{Cancelled, Confirmed, false},
+		{NoShow, CheckedIn, false},
+		{Pending, Pending, false},
+		{"unknown", Confirmed, false},
+	}
+	for _, e := range tests {
+		if got := CanChange(e.from, e.to); got != e.expected {
+			t.Errorf("CanChange(%s, %s): expected %t but got %t", e.from, e.to, e.expected, got)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	next := Next(Confirmed)
+	if len(next) != 3 || next[0].Value != CheckedIn || next[0].Action != "Check In" {
+		t.Errorf("unexpected next statuses for confirmed: %v", next)
+	}
+	if len(Next(CheckedOut)) != 0 {
+		t.Error("expected checked out to be final")
+	}
+}
+
+func TestName(t *testing.T) {
+	if Name(CheckedIn) != "Checked In" || Name(NoShow) != "No Show" {
+		t.Error("unexpected status names")
+	}
+	if Name("unknown") != "unknown" {
+		t.Errorf("expected an unknown status to be its own name but got %s", Name("unknown"))
+	}
+	if Valid("unknown") || !Valid(Pending) {
+		t.Error("unexpected result from Valid")
+	}
+}
+
+func TestReleasesRoom(t *testing.T) {
+	for _, st := range All() {
+		expected := st.Value == Cancelled || st.Value == NoShow
+		if ReleasesRoom(st.Value) != expected {
+			t.Errorf("ReleasesRoom(%s): expected %t", st.Value, expected)
+		}
+	}
+}
+
+func TestUpcoming(t *testing.T) {
+	if !Upcoming(Pending) || !Upcoming(Confirmed) || Upcoming(CheckedIn) || Upcoming(Cancelled) {
+		t.Error("unexpected result from Upcoming")
+	}
+}
@@ -0,0 +1,127 @@
+package stayrules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// The stay fields a Violation can belong to
+const (
+	Arrival   = "arrival"
+	Departure = "departure"
+)
+
+// Violation describes a rule a stay breaks and whether it is the arrival or departure date at fault
+type Violation struct {
+	Field   string
+	Message string
+}
+
+// Check returns the ways a stay in room roomID from start up to end breaks the rules, or nil if it
+// keeps them. Arrival can never be in the past and departure must be after arrival; the other
+// rules come from the StayRules covering the arrival date. now is the current time.
+func Check(rules []models.StayRule, roomID int, start, end, now time.Time) []Violation {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	var vs []Violation
+	if start.Before(today) {
+		vs = append(vs, Violation{Arrival, "Arrival can not be in the past"})
+	}
+	if !end.After(start) {
+		vs = append(vs, Violation{Departure, "Departure must be after arrival"})
+	}
+	if len(vs) > 0 {
+		return vs
+	}
+
+	nights := int(end.Sub(start).Hours() / 24)
+	add := func(field, message string) {
+		for _, v := range vs {
+			if v.Field == field && v.Message == message {
+				return
+			}
+		}
+		vs = append(vs, Violation{field, message})
+	}
+
+	for _, rule := range rules {
+		if !Applies(rule, roomID, start) {
+			continue
+		}
+		if rule.MinLeadDays > 0 && start.Before(today.AddDate(0, 0, rule.MinLeadDays)) {
+			add(Arrival, fmt.Sprintf("Arrival must be at least %s from today", plural(rule.MinLeadDays, "day")))
+		}
+		if rule.MaxHorizonDays > 0 && start.After(today.AddDate(0, 0, rule.MaxHorizonDays)) {
+			add(Arrival, fmt.Sprintf("Reservations can only be made up to %s ahead", plural(rule.MaxHorizonDays, "day")))
+		}
+		if days := Weekdays(rule.ArrivalWeekdays); len(days) > 0 && !contains(days, start.Weekday()) {
+			add(Arrival, "Arrival must be on a "+dayList(days))
+		}
+		if days := Weekdays(rule.DepartureWeekdays); len(days) > 0 && !contains(days, end.Weekday()) {
+			add(Departure, "Departure must be on a "+dayList(days))
+		}
+		if rule.MinNights > 0 && nights < rule.MinNights {
+			add(Departure, fmt.Sprintf("Stays must be at least %s", plural(rule.MinNights, "night")))
+		}
+		if rule.MaxNights > 0 && nights > rule.MaxNights {
+			add(Departure, fmt.Sprintf("Stays can be at most %s", plural(rule.MaxNights, "night")))
+		}
+	}
+
+	return vs
+}
+
+// Applies reports whether a rule covers a stay in room roomID arriving on arrival. The rule's
+// date range is inclusive.
+func Applies(rule models.StayRule, roomID int, arrival time.Time) bool {
+	if rule.RoomID != 0 && rule.RoomID != roomID {
+		return false
+	}
+	return !arrival.Before(rule.StartDate) && !arrival.After(rule.EndDate)
+}
+
+// Weekdays parses a comma separated list of weekday numbers, where 0 is Sunday, skipping any
+// that are not valid
+func Weekdays(s string) []time.Weekday {
+	var days []time.Weekday
+	for _, w := range strings.Split(s, ",") {
+		day, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || day < 0 || day > 6 {
+			continue
+		}
+		days = append(days, time.Weekday(day))
+	}
+	return days
+}
+
+func contains(days []time.Weekday, d time.Weekday) bool {
+	for _, day := range days {
+		if day == d {
+			return true
+		}
+	}
+	return false
+}
+
+// dayList names weekdays for a message, e.g. "Friday, Saturday or Sunday"
+func dayList(days []time.Weekday) string {
+	names := make([]string, len(days))
+	for i, d := range days {
+		names[i] = d.String()
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,81 @@
+package stayrules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+// now is a Wednesday afternoon
+var now = time.Date(2050, 1, 5, 15, 30, 0, 0, time.UTC)
+
+var rules = []models.StayRule{
+	{Name: "Standard", StartDate: date("2050-01-01"), EndDate: date("2050-12-31"), MinNights: 1, MaxNights: 14, MinLeadDays: 1, MaxHorizonDays: 180},
+	// summer arrivals are on Saturdays for a week or more
+	{Name: "Summer", StartDate: date("2050-06-01"), EndDate: date("2050-06-30"), MinNights: 7, ArrivalWeekdays: "6"},
+	{RoomID: 2, Name: "Suite weekends", StartDate: date("2050-01-01"), EndDate: date("2050-03-31"), DepartureWeekdays: "0,1"},
+}
+
+var checkTests = []struct {
+	name     string
+	roomID   int
+	start    string
+	end      string
+	expected []Violation
+}{
+	{"valid", 1, "2050-01-10", "2050-01-12", nil},
+	{"past", 1, "2050-01-04", "2050-01-06", []Violation{{Arrival, "Arrival can not be in the past"}}},
+	{"same day", 1, "2050-01-10", "2050-01-10", []Violation{{Departure, "Departure must be after arrival"}}},
+	{"reversed", 1, "2050-01-10", "2050-01-08", []Violation{{Departure, "Departure must be after arrival"}}},
+	{"lead time", 1, "2050-01-05", "2050-01-07", []Violation{{Arrival, "Arrival must be at least 1 day from today"}}},
+	{"horizon", 1, "2050-07-09", "2050-07-12", []Violation{{Arrival, "Reservations can only be made up to 180 days ahead"}}},
+	{"too long", 1, "2050-01-10", "2050-01-30", []Violation{{Departure, "Stays can be at most 14 nights"}}},
+	{"summer", 1, "2050-06-04", "2050-06-11", nil},
+	{"summer weekday", 1, "2050-06-06", "2050-06-13", []Violation{{Arrival, "Arrival must be on a Saturday"}}},
+	{"summer short", 1, "2050-06-04", "2050-06-06", []Violation{{Departure, "Stays must be at least 7 nights"}}},
+	{"suite departure", 2, "2050-01-10", "2050-01-12", []Violation{{Departure, "Departure must be on a Sunday or Monday"}}},
+	{"suite rule other room", 1, "2050-01-14", "2050-01-15", nil},
+	{"suite valid", 2, "2050-01-14", "2050-01-16", nil},
+}
+
+func TestCheck(t *testing.T) {
+	for _, e := range checkTests {
+		vs := Check(rules, e.roomID, date(e.start), date(e.end), now)
+		if len(vs) != len(e.expected) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, vs)
+			continue
+		}
+		for i := range vs {
+			if vs[i] != e.expected[i] {
+				t.Errorf("%s: expected %v but got %v", e.name, e.expected[i], vs[i])
+			}
+		}
+	}
+}
+
+func TestCheck_Duplicates(t *testing.T) {
+	twice := []models.StayRule{
+		{StartDate: date("2050-01-01"), EndDate: date("2050-12-31"), MinNights: 3},
+		{RoomID: 1, StartDate: date("2050-01-01"), EndDate: date("2050-12-31"), MinNights: 3},
+	}
+	vs := Check(twice, 1, date("2050-01-10"), date("2050-01-11"), now)
+	if len(vs) != 1 {
+		t.Errorf("expected one violation but got %v", vs)
+	}
+}
+
+func TestWeekdays(t *testing.T) {
+	days := Weekdays(" 5, 6,x,9")
+	if len(days) != 2 || days[0] != time.Friday || days[1] != time.Saturday {
+		t.Errorf("unexpected weekdays %v", days)
+	}
+	if dayList([]time.Weekday{time.Friday, time.Saturday, time.Sunday}) != "Friday, Saturday or Sunday" {
+		t.Error("unexpected day list")
+	}
+}
@@ -0,0 +1,257 @@
+package taxes
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/status"
+)
+
+// The kinds of charge. Only taxes are included in the tax report.
+const (
+	Tax = "tax"
+	Fee = "fee"
+)
+
+// The ways a charge is worked out
+const (
+	// Percent charges a percentage of the room price, after any discount
+	Percent = "percent"
+	// PerStay charges a flat amount once for a stay that arrives within the charge's dates
+	PerStay = "per_stay"
+	// PerNight charges a flat amount for each night
+	PerNight = "per_night"
+	// PerGuestNight charges a flat amount for each guest, adults and children, each night
+	PerGuestNight = "per_guest_night"
+)
+
+// Applies reports whether a charge covers the night starting on d in room roomID. The charge's
+// date range is inclusive.
+func Applies(c models.Charge, roomID int, d time.Time) bool {
+	if c.RoomID != 0 && c.RoomID != roomID {
+		return false
+	}
+	return !d.Before(c.StartDate) && !d.After(c.EndDate)
+}
+
+// Calculate works out the taxes and fees on a reservation from the charges that cover it. res
+// must already be priced, with TotalAmount holding the room price after any discount; each
+// percentage is taken of the part of it paid for the nights the charge covers.
+func Calculate(charges []models.Charge, res models.Reservation) []models.ReservationCharge {
+	var nights []time.Time
+	for d := res.StartDate; d.Before(res.EndDate); d = d.AddDate(0, 0, 1) {
+		nights = append(nights, d)
+	}
+	if len(nights) == 0 {
+		return nil
+	}
+
+	// the price of each night, falling back to an even split when there is no breakdown
+	prices := make([]int, len(nights))
+	roomAmount := 0
+	for i := range nights {
+		prices[i] = 1
+		if len(res.Nights) == len(nights) {
+			prices[i] = res.Nights[i].Amount
+		}
+		roomAmount += prices[i]
+	}
+
+	guests := res.Adults + res.Children
+	if guests < 1 {
+		guests = 1
+	}
+
+	var list []models.ReservationCharge
+	for _, c := range charges {
+		covered, price := 0, 0
+		for i, d := range nights {
+			if Applies(c, res.RoomID, d) {
+				covered++
+				price += prices[i]
+			}
+		}
+		if covered == 0 {
+			continue
+		}
+
+		taxable := res.TotalAmount
+		if roomAmount > 0 {
+			taxable = res.TotalAmount * price / roomAmount
+		}
+
+		rc := models.ReservationCharge{
+			ChargeID:      c.ID,
+			Name:          c.Name,
+			Kind:          c.Kind,
+			Basis:         c.Basis,
+			Rate:          c.Amount,
+			Nights:        covered,
+			TaxableAmount: taxable,
+		}
+		switch c.Basis {
+		case Percent:
+			rc.Amount = (taxable*c.Amount + 5000) / 10000
+		case PerStay:
+			if !Applies(c, res.RoomID, res.StartDate) {
+				continue
+			}
+			rc.Amount = c.Amount
+		case PerNight:
+			rc.Amount = c.Amount * covered
+		case PerGuestNight:
+			rc.Amount = c.Amount * covered * guests
+		default:
+			continue
+		}
+		list = append(list, rc)
+	}
+	return list
+}
+
+// Apply records the taxes and fees on a priced reservation and adds them to its TotalAmount
+func Apply(charges []models.Charge, res *models.Reservation) {
+	res.Charges = Calculate(charges, *res)
+	res.TotalAmount += res.ChargesAmount()
+}
+
+// FormatRate formats a percentage held in hundredths of a percent, e.g. 1250 is "12.5%"
+func FormatRate(rate int) string {
+	return strconv.FormatFloat(float64(rate)/100, 'f', -1, 64) + "%"
+}
+
+// ReportLine totals one tax for a month. Nights counts the room nights it was charged on and
+// TaxableAmount what they cost.
+type ReportLine struct {
+	Name          string
+	Currency      string
+	Nights        int
+	TaxableAmount int
+	Amount        int
+}
+
+// Report lists the taxes charged on the nights stayed in a month. Nights counts the room nights
+// any tax was charged on.
+type Report struct {
+	Month  time.Time
+	Lines  []ReportLine
+	Nights int
+}
+
+// MonthlyReport totals the tax charges for the nights stayed in the month starting on month.
+// Each charge is shared out evenly over its reservation's nights, so a stay that runs into the
+// next month is reported partly in each, and the parts always add up to what was charged.
+// Charges on reservations that no longer hold their room and fees are left out.
+func MonthlyReport(month time.Time, charges []models.ReservationCharge) Report {
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	next := month.AddDate(0, 1, 0)
+	report := Report{Month: month}
+
+	index := make(map[string]int)
+	taxedNights := make(map[int]int)
+	for _, c := range charges {
+		res := c.Reservation
+		if c.Kind != Tax || status.ReleasesRoom(res.Status) {
+			continue
+		}
+
+		stay := nightsBetween(res.StartDate, res.EndDate)
+		if stay == 0 {
+			continue
+		}
+		before := clamp(nightsBetween(res.StartDate, month), stay)
+		upTo := clamp(nightsBetween(res.StartDate, next), stay)
+		if upTo == before {
+			continue
+		}
+		share := func(amount int) int {
+			return amount*upTo/stay - amount*before/stay
+		}
+
+		key := c.Name + "|" + res.Currency
+		i, ok := index[key]
+		if !ok {
+			i = len(report.Lines)
+			index[key] = i
+			report.Lines = append(report.Lines, ReportLine{Name: c.Name, Currency: res.Currency})
+		}
+		line := &report.Lines[i]
+		nights := share(c.Nights)
+		line.Nights += nights
+		line.TaxableAmount += share(c.TaxableAmount)
+		line.Amount += share(c.Amount)
+
+		if nights > taxedNights[res.ID] {
+			taxedNights[res.ID] = nights
+		}
+	}
+
+	for _, n := range taxedNights {
+		report.Nights += n
+	}
+	sort.SliceStable(report.Lines, func(i, j int) bool {
+		if report.Lines[i].Name != report.Lines[j].Name {
+			return report.Lines[i].Name < report.Lines[j].Name
+		}
+		return report.Lines[i].Currency < report.Lines[j].Currency
+	})
+	return report
+}
+
+// WriteCSV writes a report as CSV for filing, with amounts in major units such as 129.50
+func WriteCSV(w io.Writer, report Report) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"Month", "Tax", "Currency", "Taxable Nights", "Taxable Amount", "Tax Collected"})
+	if err != nil {
+		return err
+	}
+
+	month := report.Month.Format("2006-01")
+	for _, l := range report.Lines {
+		err = cw.Write([]string{
+			month,
+			l.Name,
+			l.Currency,
+			strconv.Itoa(l.Nights),
+			decimal(l.TaxableAmount),
+			decimal(l.Amount),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// decimal formats an amount in minor units without a currency symbol
+func decimal(amount int) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+// nightsBetween counts the nights from start up to end, or 0 if end is not after start
+func nightsBetween(start, end time.Time) int {
+	if !end.After(start) {
+		return 0
+	}
+	return int(end.Sub(start).Hours()/24 + 0.5)
+}
+
+// clamp limits n to at most max
+func clamp(n, max int) int {
+	if n > max {
+		return max
+	}
+	return n
+}
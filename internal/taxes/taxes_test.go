@@ -0,0 +1,169 @@
+package taxes
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/status"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+// stay is a two night stay in room 1 for two adults and a child, at 100.00 then 200.00 a night
+func stay() models.Reservation {
+	return models.Reservation{
+		ID:        1,
+		RoomID:    1,
+		StartDate: date("2050-01-01"),
+		EndDate:   date("2050-01-03"),
+		Adults:    2,
+		Children:  1,
+		Currency:  "USD",
+		Nights: []models.ReservationNight{
+			{Night: date("2050-01-01"), Amount: 10000},
+			{Night: date("2050-01-02"), Amount: 20000},
+		},
+		TotalAmount: 30000,
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	always := func(c models.Charge) models.Charge {
+		c.StartDate, c.EndDate = date("2000-01-01"), date("2099-12-31")
+		return c
+	}
+
+	tests := []struct {
+		name            string
+		charge          models.Charge
+		discount        int
+		expectedNights  int
+		expectedTaxable int
+		expectedAmount  int
+	}{
+		{"percent", always(models.Charge{Basis: Percent, Amount: 1250}), 0, 2, 30000, 3750},
+		{"percent after a discount", always(models.Charge{Basis: Percent, Amount: 1000}), 3000, 2, 27000, 2700},
+		{"percent of the nights covered", models.Charge{Basis: Percent, Amount: 1000, StartDate: date("2050-01-02"), EndDate: date("2050-12-31")}, 0, 1, 20000, 2000},
+		{"per stay", always(models.Charge{Basis: PerStay, Amount: 2500}), 0, 2, 30000, 2500},
+		{"per stay arriving before the dates", models.Charge{Basis: PerStay, Amount: 2500, StartDate: date("2050-01-02"), EndDate: date("2050-12-31")}, 0, 0, 0, 0},
+		{"per night", always(models.Charge{Basis: PerNight, Amount: 300}), 0, 2, 30000, 600},
+		{"per guest per night", always(models.Charge{Basis: PerGuestNight, Amount: 100}), 0, 2, 30000, 600},
+		{"this room", always(models.Charge{RoomID: 1, Basis: PerNight, Amount: 300}), 0, 2, 30000, 600},
+		{"another room", always(models.Charge{RoomID: 2, Basis: PerNight, Amount: 300}), 0, 0, 0, 0},
+		{"before the stay", models.Charge{Basis: PerNight, Amount: 300, StartDate: date("2049-01-01"), EndDate: date("2049-12-31")}, 0, 0, 0, 0},
+		{"unknown basis", always(models.Charge{Basis: "per_pet", Amount: 300}), 0, 0, 0, 0},
+	}
+
+	for _, e := range tests {
+		res := stay()
+		res.DiscountAmount = e.discount
+		res.TotalAmount -= e.discount
+
+		list := Calculate([]models.Charge{e.charge}, res)
+		if e.expectedAmount == 0 {
+			if len(list) != 0 {
+				t.Errorf("%s: expected no charge but got %+v", e.name, list)
+			}
+			continue
+		}
+		if len(list) != 1 {
+			t.Errorf("%s: expected one charge but got %d", e.name, len(list))
+			continue
+		}
+		c := list[0]
+		if c.Nights != e.expectedNights || c.TaxableAmount != e.expectedTaxable || c.Amount != e.expectedAmount {
+			t.Errorf("%s: expected %d nights, %d taxable and %d charged but got %d, %d and %d", e.name,
+				e.expectedNights, e.expectedTaxable, e.expectedAmount, c.Nights, c.TaxableAmount, c.Amount)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	charges := []models.Charge{
+		{ID: 1, Name: "Occupancy Tax", Kind: Tax, Basis: Percent, Amount: 1000, StartDate: date("2000-01-01"), EndDate: date("2099-12-31")},
+		{ID: 2, Name: "Cleaning Fee", Kind: Fee, Basis: PerStay, Amount: 5000, StartDate: date("2000-01-01"), EndDate: date("2099-12-31")},
+	}
+	res := stay()
+	Apply(charges, &res)
+
+	if len(res.Charges) != 2 || res.Charges[0].ChargeID != 1 || res.Charges[1].Name != "Cleaning Fee" {
+		t.Fatalf("unexpected charges %+v", res.Charges)
+	}
+	if res.TotalAmount != 30000+3000+5000 {
+		t.Errorf("expected a total of 38000 but got %d", res.TotalAmount)
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := map[int]string{1000: "10%", 1250: "12.5%", 875: "8.75%", 0: "0%"}
+	for rate, expected := range tests {
+		if got := FormatRate(rate); got != expected {
+			t.Errorf("expected %q for %d but got %q", expected, rate, got)
+		}
+	}
+}
+
+func TestMonthlyReport(t *testing.T) {
+	// three nights over the end of January, two in January and one in February
+	res := models.Reservation{ID: 1, StartDate: date("2050-01-30"), EndDate: date("2050-02-02"), Currency: "USD", Status: status.Confirmed}
+	cancelled := models.Reservation{ID: 2, StartDate: date("2050-01-10"), EndDate: date("2050-01-12"), Currency: "USD", Status: status.Cancelled}
+	other := models.Reservation{ID: 3, StartDate: date("2050-01-10"), EndDate: date("2050-01-11"), Currency: "USD"}
+
+	charges := []models.ReservationCharge{
+		{Name: "Occupancy Tax", Kind: Tax, Nights: 3, TaxableAmount: 30000, Amount: 1000, Reservation: res},
+		{Name: "City Tax", Kind: Tax, Nights: 3, TaxableAmount: 30000, Amount: 900, Reservation: res},
+		{Name: "Cleaning Fee", Kind: Fee, Nights: 3, Amount: 5000, Reservation: res},
+		{Name: "Occupancy Tax", Kind: Tax, Nights: 2, TaxableAmount: 20000, Amount: 2000, Reservation: cancelled},
+		{Name: "Occupancy Tax", Kind: Tax, Nights: 1, TaxableAmount: 10000, Amount: 1000, Reservation: other},
+	}
+
+	jan := MonthlyReport(date("2050-01-15"), charges)
+	feb := MonthlyReport(date("2050-02-01"), charges)
+
+	if !jan.Month.Equal(date("2050-01-01")) {
+		t.Errorf("expected the report for January but got %s", jan.Month)
+	}
+	if len(jan.Lines) != 2 || jan.Lines[0].Name != "City Tax" || jan.Lines[1].Name != "Occupancy Tax" {
+		t.Fatalf("unexpected lines %+v", jan.Lines)
+	}
+	if l := jan.Lines[1]; l.Nights != 3 || l.TaxableAmount != 30000 || l.Amount != 1666 {
+		t.Errorf("unexpected January occupancy tax %+v", l)
+	}
+	if jan.Nights != 3 {
+		t.Errorf("expected 3 taxed nights in January but got %d", jan.Nights)
+	}
+	if len(feb.Lines) != 2 || feb.Nights != 1 {
+		t.Fatalf("unexpected February report %+v", feb)
+	}
+
+	// the months add up to what was charged
+	if jan.Lines[0].Amount+feb.Lines[0].Amount != 900 || jan.Lines[1].Amount+feb.Lines[1].Amount != 2000 {
+		t.Errorf("expected the months to add up but got %+v and %+v", jan.Lines, feb.Lines)
+	}
+
+	if empty := MonthlyReport(date("2050-03-01"), charges); len(empty.Lines) != 0 || empty.Nights != 0 {
+		t.Errorf("expected nothing in March but got %+v", empty)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	report := Report{
+		Month: date("2050-01-01"),
+		Lines: []ReportLine{{Name: "Occupancy Tax, City", Currency: "USD", Nights: 3, TaxableAmount: 30000, Amount: 1666}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Month,Tax,Currency,Taxable Nights,Taxable Amount,Tax Collected\n" +
+		"2050-01,\"Occupancy Tax, City\",USD,3,300.00,16.66\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected CSV:\n%s", buf.String())
+	}
+}
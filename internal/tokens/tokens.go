@@ -0,0 +1,117 @@
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The purposes a token can be issued for. A Waitlist token's UserID is the waitlist entry it
+// books the held room for.
+const (
+	Invite        = "invite"
+	PasswordReset = "reset"
+	Waitlist      = "waitlist"
+)
+
+var (
+	// ErrInvalid is returned for a token that is malformed or was not signed with our key
+	ErrInvalid = errors.New("tokens: invalid token")
+	// ErrExpired is returned for a correctly signed token that is past its expiry
+	ErrExpired = errors.New("tokens: token has expired")
+)
+
+// Claims is what a token says about itself
+type Claims struct {
+	UserID  int
+	Purpose string
+	Expires time.Time
+}
+
+// Signer issues and checks signed tokens. A token carries its claims and an HMAC of them, so it
+// can be checked without a database. Making a token single-use is left to the caller, who can
+// record its Hash when it is issued and mark it used when it is redeemed.
+type Signer struct {
+	key []byte
+}
+
+// New returns a signer using key, which should be long and random
+func New(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// Sign returns a new token for c
+func (s *Signer) Sign(c Claims) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%d:%s:%d:%s", c.UserID, c.Purpose, c.Expires.Unix(), hex.EncodeToString(nonce))
+	enc := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return enc + "." + base64.RawURLEncoding.EncodeToString(s.mac(enc)), nil
+}
+
+// Verify checks token was signed by s and has not expired at now, and returns its claims
+func (s *Signer) Verify(token string, now time.Time) (Claims, error) {
+	var c Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return c, ErrInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, s.mac(parts[0])) {
+		return c, ErrInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return c, ErrInvalid
+	}
+	fields := strings.Split(string(payload), ":")
+	if len(fields) != 4 {
+		return c, ErrInvalid
+	}
+	c.UserID, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return c, ErrInvalid
+	}
+	c.Purpose = fields[1]
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return c, ErrInvalid
+	}
+	c.Expires = time.Unix(expires, 0)
+
+	if !now.Before(c.Expires) {
+		return c, ErrExpired
+	}
+	return c, nil
+}
+
+func (s *Signer) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// Hash returns the value to store for a token, so the database never holds a usable token
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RandomKey returns a new random signing key
+func RandomKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
@@ -0,0 +1,66 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestSigner_SignVerify(t *testing.T) {
+	s := New([]byte("secret"))
+	token, err := s.Sign(Claims{UserID: 7, Purpose: PasswordReset, Expires: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.Verify(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UserID != 7 || c.Purpose != PasswordReset || !c.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected claims %+v", c)
+	}
+
+	other, _ := s.Sign(Claims{UserID: 7, Purpose: PasswordReset, Expires: now.Add(time.Hour)})
+	if other == token {
+		t.Error("expected two tokens with the same claims to differ")
+	}
+}
+
+func TestSigner_Verify(t *testing.T) {
+	s := New([]byte("secret"))
+	token, _ := s.Sign(Claims{UserID: 7, Purpose: Invite, Expires: now.Add(time.Hour)})
+	parts := strings.Split(token, ".")
+	forged, _ := New([]byte("guess")).Sign(Claims{UserID: 1, Purpose: Invite, Expires: now.Add(time.Hour)})
+
+	tests := []struct {
+		name     string
+		token    string
+		at       time.Time
+		expected error
+	}{
+		{"valid", token, now, nil},
+		{"expired", token, now.Add(time.Hour), ErrExpired},
+		{"other key", forged, now, ErrInvalid},
+		{"swapped payload", strings.Split(forged, ".")[0] + "." + parts[1], now, ErrInvalid},
+		{"no signature", parts[0], now, ErrInvalid},
+		{"garbage", "not.a-token", now, ErrInvalid},
+		{"empty", "", now, ErrInvalid},
+	}
+	for _, e := range tests {
+		if _, err := s.Verify(e.token, e.at); err != e.expected {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, err)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash("abc") != Hash("abc") || Hash("abc") == Hash("abd") {
+		t.Error("expected the hash to depend only on the token")
+	}
+	if len(Hash("abc")) != 64 {
+		t.Errorf("expected a hex sha256 but got %s", Hash("abc"))
+	}
+}
@@ -0,0 +1,106 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 test key from RFC 6238 appendix B
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode_RFC6238(t *testing.T) {
+	// the RFC gives 8 digit codes; the last 6 digits are the 6 digit code
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, e := range tests {
+		code, err := Code(rfcSecret, Counter(time.Unix(e.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != e.expected {
+			t.Errorf("at %d expected %s but got %s", e.unix, e.expected, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, _ := Code(rfcSecret, Counter(now))
+
+	if counter, ok := Validate(rfcSecret, code, now); !ok || counter != Counter(now) {
+		t.Errorf("expected the current code to be valid at step %d but got %d %t", Counter(now), counter, ok)
+	}
+	if _, ok := Validate(rfcSecret, code[:3]+" "+code[3:], now); !ok {
+		t.Error("expected a code typed with a space to be valid")
+	}
+	if _, ok := Validate(rfcSecret, code, now.Add(Period*time.Second)); !ok {
+		t.Error("expected the previous period's code to be valid")
+	}
+	if _, ok := Validate(rfcSecret, code, now.Add(3*Period*time.Second)); ok {
+		t.Error("expected an old code to be invalid")
+	}
+	if _, ok := Validate(rfcSecret, "12345", now); ok {
+		t.Error("expected a short code to be invalid")
+	}
+	if _, ok := Validate("not base32!", "123456", now); ok {
+		t.Error("expected a bad secret to be refused")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewSecret()
+	if a == b || len(a) != 32 {
+		t.Errorf("expected two different 32 character secrets but got %s and %s", a, b)
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("expected a usable secret but got %s", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Bookings", "me@here.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Bookings:me@here.com?") {
+		t.Errorf("unexpected label in %s", uri)
+	}
+	for _, want := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=Bookings", "digits=6", "period=30"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("expected %s in %s", want, uri)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' || seen[c] {
+			t.Errorf("unexpected recovery code %s", c)
+		}
+		seen[c] = true
+	}
+
+	if got := NormalizeRecoveryCode(" ABCDE fghjk "); got != "abcde-fghjk" {
+		t.Errorf("expected abcde-fghjk but got %s", got)
+	}
+	if got := NormalizeRecoveryCode("abcde-fghjk"); got != "abcde-fghjk" {
+		t.Errorf("expected abcde-fghjk but got %s", got)
+	}
+}
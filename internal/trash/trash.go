@@ -0,0 +1,78 @@
+package trash
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Store is the part of the database repository that holds deleted reservations
+type Store interface {
+	PurgeDeletedReservations(before time.Time) (int, error)
+}
+
+// Purger removes reservations for good once they have been in the trash for longer than
+// Retention, checking every Interval. Reservations with payments or charges are kept.
+type Purger struct {
+	Retention time.Duration
+	Interval  time.Duration
+	InfoLog   *log.Logger
+	ErrorLog  *log.Logger
+
+	store Store
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New returns a purger that keeps deleted reservations for retention, checking hourly
+func New(store Store, retention time.Duration, infoLog, errorLog *log.Logger) *Purger {
+	return &Purger{
+		Retention: retention,
+		Interval:  time.Hour,
+		InfoLog:   infoLog,
+		ErrorLog:  errorLog,
+		store:     store,
+		quit:      make(chan struct{}),
+	}
+}
+
+// Start purges the trash now and then every Interval until Stop is called
+func (p *Purger) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+
+		for {
+			p.PurgeOnce(time.Now())
+
+			select {
+			case <-p.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops purging, waiting for a purge in progress to finish
+func (p *Purger) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// PurgeOnce removes the reservations that had been in the trash longer than Retention at now,
+// returning how many were removed
+func (p *Purger) PurgeOnce(now time.Time) int {
+	n, err := p.store.PurgeDeletedReservations(now.Add(-p.Retention))
+	if err != nil {
+		p.ErrorLog.Println(err)
+		return 0
+	}
+	if n > 0 {
+		p.InfoLog.Printf("purged %d reservations from the trash", n)
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+package trash
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+// fakeStore records the cut off it was asked to purge before
+type fakeStore struct {
+	before time.Time
+	n      int
+	err    error
+	calls  chan time.Time
+}
+
+func (s *fakeStore) PurgeDeletedReservations(before time.Time) (int, error) {
+	s.before = before
+	if s.calls != nil {
+		s.calls <- before
+	}
+	return s.n, s.err
+}
+
+func newTestPurger(s *fakeStore) *Purger {
+	logger := log.New(ioutil.Discard, "", 0)
+	return New(s, 30*24*time.Hour, logger, logger)
+}
+
+func TestPurger_PurgeOnce(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	s := &fakeStore{n: 3}
+	if n := newTestPurger(s).PurgeOnce(now); n != 3 {
+		t.Errorf("expected 3 purged but got %d", n)
+	}
+	if want := now.AddDate(0, 0, -30); !s.before.Equal(want) {
+		t.Errorf("expected reservations deleted before %s to be purged but got %s", want, s.before)
+	}
+
+	s = &fakeStore{err: errors.New("some error")}
+	if n := newTestPurger(s).PurgeOnce(now); n != 0 {
+		t.Errorf("expected nothing purged on error but got %d", n)
+	}
+}
+
+func TestPurger_Start(t *testing.T) {
+	s := &fakeStore{calls: make(chan time.Time, 10)}
+	p := newTestPurger(s)
+	p.Interval = 10 * time.Millisecond
+	p.Start()
+	defer p.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-s.calls:
+		case <-time.After(time.Second):
+			t.Fatal("trash was not purged")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package unpaid
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// Store is the part of the database repository that holds reservations awaiting payment
+type Store interface {
+	ExpireUnpaidReservations(now time.Time) ([]models.RoomRestriction, error)
+}
+
+// Releaser is told about the rooms and dates that come free, such as waitlist.Offerer.Released
+type Releaser func(released ...models.RoomRestriction) int
+
+// Expirer cancels reservations that were not paid for by their payment deadline, checking every
+// Interval, so an abandoned checkout doesn't keep its rooms booked
+type Expirer struct {
+	Interval time.Duration
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+
+	store   Store
+	release Releaser
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New returns an expirer that tells release about the rooms it frees, checking every minute
+func New(store Store, release Releaser, infoLog, errorLog *log.Logger) *Expirer {
+	return &Expirer{
+		Interval: time.Minute,
+		InfoLog:  infoLog,
+		ErrorLog: errorLog,
+		store:    store,
+		release:  release,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start expires unpaid reservations now and then every Interval until Stop is called
+func (e *Expirer) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(e.Interval)
+		defer ticker.Stop()
+
+		for {
+			e.ExpireOnce(time.Now())
+
+			select {
+			case <-e.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops expiring reservations, waiting for a run in progress to finish
+func (e *Expirer) Stop() {
+	close(e.quit)
+	e.wg.Wait()
+}
+
+// ExpireOnce cancels the reservations whose payment was due by now and releases their rooms,
+// returning how many were cancelled
+func (e *Expirer) ExpireOnce(now time.Time) int {
+	released, err := e.store.ExpireUnpaidReservations(now)
+	if err != nil {
+		e.ErrorLog.Println(err)
+		return 0
+	}
+	if len(released) > 0 {
+		e.InfoLog.Printf("cancelled %d reservations that were not paid for in time", len(released))
+		e.release(released...)
+	}
+	return len(released)
+}
@@ -0,0 +1,75 @@
+package unpaid
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+)
+
+// fakeStore records when it was asked to expire reservations
+type fakeStore struct {
+	now      time.Time
+	released []models.RoomRestriction
+	err      error
+	calls    chan time.Time
+}
+
+func (s *fakeStore) ExpireUnpaidReservations(now time.Time) ([]models.RoomRestriction, error) {
+	s.now = now
+	if s.calls != nil {
+		s.calls <- now
+	}
+	return s.released, s.err
+}
+
+func newTestExpirer(s *fakeStore, release Releaser) *Expirer {
+	logger := log.New(ioutil.Discard, "", 0)
+	return New(s, release, logger, logger)
+}
+
+func TestExpirer_ExpireOnce(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	var got []models.RoomRestriction
+	release := func(released ...models.RoomRestriction) int {
+		got = append(got, released...)
+		return len(released)
+	}
+
+	s := &fakeStore{released: []models.RoomRestriction{{RoomID: 1}, {RoomID: 2}}}
+	if n := newTestExpirer(s, release).ExpireOnce(now); n != 2 {
+		t.Errorf("expected 2 cancelled but got %d", n)
+	}
+	if !s.now.Equal(now) {
+		t.Errorf("expected reservations due by %s to be expired but got %s", now, s.now)
+	}
+	if len(got) != 2 || got[1].RoomID != 2 {
+		t.Errorf("expected both rooms to be released but got %v", got)
+	}
+
+	got = nil
+	s = &fakeStore{err: errors.New("some error")}
+	if n := newTestExpirer(s, release).ExpireOnce(now); n != 0 || len(got) != 0 {
+		t.Errorf("expected nothing cancelled or released on error but got %d", n)
+	}
+}
+
+func TestExpirer_Start(t *testing.T) {
+	s := &fakeStore{calls: make(chan time.Time, 10)}
+	e := newTestExpirer(s, func(released ...models.RoomRestriction) int { return 0 })
+	e.Interval = 10 * time.Millisecond
+	e.Start()
+	defer e.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-s.calls:
+		case <-time.After(time.Second):
+			t.Fatal("unpaid reservations were not expired")
+		}
+	}
+}
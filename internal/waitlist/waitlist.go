@@ -0,0 +1,153 @@
+package waitlist
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/repository"
+)
+
+// The statuses a waitlist entry moves through. A Waiting guest is Offered a room when one comes
+// free, which is held for them until they have Booked it or the hold has Expired.
+const (
+	Waiting = "waiting"
+	Offered = "offered"
+	Booked  = "booked"
+	Expired = "expired"
+)
+
+// Store is the part of the database repository that holds the waitlist
+type Store interface {
+	WaitlistEntriesForRoom(roomID int, start, end time.Time) ([]models.WaitlistEntry, error)
+	GetRoomById(id int) (models.Room, error)
+	HoldRoomForWaitlist(entryID, roomID int, until time.Time) (int, error)
+	ExpireWaitlistOffers(now time.Time) ([]models.RoomRestriction, error)
+}
+
+// Notifier tells a guest that a room is being held for them
+type Notifier func(e models.WaitlistEntry) error
+
+// Offerer offers rooms that come free to the guests waiting for them. Each room is held for the
+// first guest it suits for Hold, and holds that lapse are released every Interval so the room
+// can be offered to the next guest.
+type Offerer struct {
+	Hold     time.Duration
+	Interval time.Duration
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+
+	store  Store
+	notify Notifier
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New returns an offerer that holds rooms for hold and tells guests about them with notify,
+// releasing lapsed holds every five minutes
+func New(store Store, hold time.Duration, notify Notifier, infoLog, errorLog *log.Logger) *Offerer {
+	return &Offerer{
+		Hold:     hold,
+		Interval: 5 * time.Minute,
+		InfoLog:  infoLog,
+		ErrorLog: errorLog,
+		store:    store,
+		notify:   notify,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Released offers the rooms and dates in released, which have just come free, to the guests
+// waiting for them, oldest entry first. It returns how many guests were offered a room.
+func (o *Offerer) Released(released ...models.RoomRestriction) int {
+	offered := 0
+	for _, rr := range released {
+		entries, err := o.store.WaitlistEntriesForRoom(rr.RoomID, rr.StartDate, rr.EndDate)
+		if err != nil {
+			o.ErrorLog.Println(err)
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		room, err := o.store.GetRoomById(rr.RoomID)
+		if err != nil {
+			o.ErrorLog.Println(err)
+			continue
+		}
+
+		for _, e := range entries {
+			if !e.WantsRoom(room.ID) || !room.Fits(e.Adults, e.Children) {
+				continue
+			}
+
+			until := time.Now().Add(o.Hold)
+			e.RoomRestrictionID, err = o.store.HoldRoomForWaitlist(e.ID, room.ID, until)
+			if errors.Is(err, repository.ErrRoomUnavailable) {
+				// only part of the guest's stay came free, or the room was taken first
+				continue
+			}
+			if err != nil {
+				o.ErrorLog.Println(err)
+				continue
+			}
+			e.Status = Offered
+			e.RoomID = room.ID
+			e.Room = room
+			e.HoldExpiresAt = until
+
+			err = o.notify(e)
+			if err != nil {
+				o.ErrorLog.Println(err)
+			}
+			o.InfoLog.Printf("holding %s for waitlist entry %d until %s", room.RoomName, e.ID, until.Format(time.RFC3339))
+			offered++
+		}
+	}
+	return offered
+}
+
+// Start releases lapsed holds now and then every Interval until Stop is called
+func (o *Offerer) Start() {
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+
+		ticker := time.NewTicker(o.Interval)
+		defer ticker.Stop()
+
+		for {
+			o.ExpireOnce(time.Now())
+
+			select {
+			case <-o.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops releasing holds, waiting for a release in progress to finish
+func (o *Offerer) Stop() {
+	close(o.quit)
+	o.wg.Wait()
+}
+
+// ExpireOnce releases the holds that had lapsed at now and offers the rooms to the next guests
+// waiting for them, returning how many holds were released
+func (o *Offerer) ExpireOnce(now time.Time) int {
+	released, err := o.store.ExpireWaitlistOffers(now)
+	if err != nil {
+		o.ErrorLog.Println(err)
+		return 0
+	}
+	if len(released) > 0 {
+		o.InfoLog.Printf("released %d lapsed waitlist holds", len(released))
+		o.Released(released...)
+	}
+	return len(released)
+}
@@ -0,0 +1,132 @@
+package waitlist
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/eador/bookings/internal/models"
+	"github.com/eador/bookings/internal/repository"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+// fakeStore holds rooms for the guests waiting for them, with each night of a room free at most
+// once
+type fakeStore struct {
+	entries  []models.WaitlistEntry
+	taken    map[int][]time.Time
+	held     []int
+	released []models.RoomRestriction
+	err      error
+}
+
+func (s *fakeStore) WaitlistEntriesForRoom(roomID int, start, end time.Time) ([]models.WaitlistEntry, error) {
+	var entries []models.WaitlistEntry
+	for _, e := range s.entries {
+		if e.Status == Waiting && e.StartDate.Before(end) && e.EndDate.After(start) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, s.err
+}
+
+func (s *fakeStore) GetRoomById(id int) (models.Room, error) {
+	return models.Room{ID: id, RoomName: "General's Quarters", Capacity: 2, MaxAdults: 2}, nil
+}
+
+func (s *fakeStore) HoldRoomForWaitlist(entryID, roomID int, until time.Time) (int, error) {
+	for i, e := range s.entries {
+		if e.ID != entryID {
+			continue
+		}
+		for _, night := range s.taken[roomID] {
+			if !night.Before(e.StartDate) && night.Before(e.EndDate) {
+				return 0, repository.ErrRoomUnavailable
+			}
+		}
+		for d := e.StartDate; d.Before(e.EndDate); d = d.AddDate(0, 0, 1) {
+			s.taken[roomID] = append(s.taken[roomID], d)
+		}
+		s.entries[i].Status = Offered
+		s.held = append(s.held, entryID)
+		return 100 + entryID, nil
+	}
+	return 0, errors.New("no such entry")
+}
+
+func (s *fakeStore) ExpireWaitlistOffers(now time.Time) ([]models.RoomRestriction, error) {
+	return s.released, s.err
+}
+
+func newTestOfferer(s *fakeStore, notified *[]models.WaitlistEntry) *Offerer {
+	logger := log.New(ioutil.Discard, "", 0)
+	return New(s, 24*time.Hour, func(e models.WaitlistEntry) error {
+		*notified = append(*notified, e)
+		return nil
+	}, logger, logger)
+}
+
+func TestOfferer_Released(t *testing.T) {
+	s := &fakeStore{
+		entries: []models.WaitlistEntry{
+			{ID: 1, StartDate: date("2050-01-01"), EndDate: date("2050-01-04"), Adults: 3, Status: Waiting},
+			{ID: 2, StartDate: date("2050-01-01"), EndDate: date("2050-01-04"), Adults: 2, RoomIDs: []int{2}, Status: Waiting},
+			{ID: 3, StartDate: date("2050-01-02"), EndDate: date("2050-01-03"), Adults: 2, Status: Waiting},
+			{ID: 4, StartDate: date("2050-01-02"), EndDate: date("2050-01-04"), Adults: 1, Status: Waiting},
+			{ID: 5, StartDate: date("2050-01-04"), EndDate: date("2050-01-05"), Adults: 1, Status: Waiting},
+		},
+		taken: map[int][]time.Time{1: {date("2050-01-04")}},
+	}
+	var notified []models.WaitlistEntry
+	o := newTestOfferer(s, &notified)
+
+	// 1 is too big for the room, 2 wants another room and 4 overlaps 3, who waited longer;
+	// 5 arrives after the nights that came free, and the room is taken that night anyway
+	n := o.Released(models.RoomRestriction{RoomID: 1, StartDate: date("2050-01-01"), EndDate: date("2050-01-04")})
+	if n != 1 || len(notified) != 1 {
+		t.Fatalf("expected one guest offered the room but got %d", n)
+	}
+	e := notified[0]
+	if e.ID != 3 || e.Status != Offered || e.RoomID != 1 || e.Room.RoomName == "" || e.RoomRestrictionID != 103 {
+		t.Errorf("unexpected offer %+v", e)
+	}
+	if hold := time.Until(e.HoldExpiresAt); hold < 23*time.Hour || hold > 24*time.Hour {
+		t.Errorf("expected the room held for a day but got %s", hold)
+	}
+
+	// the same nights coming free again have already been offered
+	notified = nil
+	if n = o.Released(models.RoomRestriction{RoomID: 1, StartDate: date("2050-01-01"), EndDate: date("2050-01-04")}); n != 0 {
+		t.Errorf("expected no more offers but got %d", n)
+	}
+}
+
+func TestOfferer_ExpireOnce(t *testing.T) {
+	s := &fakeStore{
+		entries: []models.WaitlistEntry{
+			{ID: 1, StartDate: date("2050-01-01"), EndDate: date("2050-01-02"), Adults: 1, Status: Waiting},
+		},
+		taken:    map[int][]time.Time{},
+		released: []models.RoomRestriction{{RoomID: 1, StartDate: date("2050-01-01"), EndDate: date("2050-01-02")}},
+	}
+	var notified []models.WaitlistEntry
+	o := newTestOfferer(s, &notified)
+
+	if n := o.ExpireOnce(time.Now()); n != 1 {
+		t.Errorf("expected one hold released but got %d", n)
+	}
+	if len(notified) != 1 || notified[0].ID != 1 {
+		t.Errorf("expected the room offered to the next guest but got %v", notified)
+	}
+
+	s.err = errors.New("some error")
+	if n := o.ExpireOnce(time.Now()); n != 0 {
+		t.Errorf("expected nothing released on error but got %d", n)
+	}
+}
@@ -0,0 +1,2 @@
+delete from rate_overrides;
+update rooms set base_rate = 0;
\ No newline at end of file
@@ -0,0 +1,5 @@
+update rooms set base_rate = 12900 where room_name = 'General''s Quarters';
+update rooms set base_rate = 15900 where room_name = 'Major''s Suite';
+
+INSERT INTO public.rate_overrides (room_id,"name",start_date,end_date,weekdays,nightly_rate,priority,created_at,updated_at)
+	SELECT id, 'Weekend', '2021-01-01', '2099-12-31', '5,6', base_rate + 3000, 10, now(), now() FROM rooms;
\ No newline at end of file
@@ -0,0 +1,2 @@
+delete from room_photos;
+update rooms set slug = 'room-' || id, description = '', amenities = '';
\ No newline at end of file
@@ -0,0 +1,13 @@
+update rooms set slug = 'generals-quarters', sort_order = 1, capacity = 2,
+	description = 'Your home away from home. Set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.',
+	amenities = E'Queen bed\nOcean view\nPrivate bathroom\nFree Wi-Fi'
+	where room_name = 'General''s Quarters';
+update rooms set slug = 'majors-suite', sort_order = 2, capacity = 4,
+	description = 'Your home away from home. Set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.',
+	amenities = E'King bed\nSofa bed\nOcean view\nPrivate bathroom\nFree Wi-Fi'
+	where room_name = 'Major''s Suite';
+
+INSERT INTO public.room_photos (room_id,url,caption,sort_order,created_at,updated_at)
+	SELECT id, '/static/images/generals-quarters.png', room_name, 1, now(), now() FROM rooms WHERE slug = 'generals-quarters';
+INSERT INTO public.room_photos (room_id,url,caption,sort_order,created_at,updated_at)
+	SELECT id, '/static/images/majors-suite.png', room_name, 1, now(), now() FROM rooms WHERE slug = 'majors-suite';
@@ -0,0 +1,5 @@
+alter table reservations add column processed integer not null default 0;
+alter table reservations add column cancelled integer not null default 0;
+
+update reservations set processed = 1 where status <> 'pending';
+update reservations set cancelled = 1 where status = 'cancelled';
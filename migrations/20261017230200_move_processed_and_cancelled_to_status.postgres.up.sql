@@ -0,0 +1,5 @@
+update reservations set status = 'confirmed', status_changed_at = updated_at where processed = 1;
+update reservations set status = 'cancelled', status_changed_at = updated_at where cancelled = 1;
+
+alter table reservations drop column processed;
+alter table reservations drop column cancelled;
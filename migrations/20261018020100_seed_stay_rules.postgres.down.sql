@@ -0,0 +1 @@
+delete from stay_rules;
\ No newline at end of file
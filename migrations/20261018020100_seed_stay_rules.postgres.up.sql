@@ -0,0 +1,2 @@
+INSERT INTO public.stay_rules (room_id,"name",start_date,end_date,min_nights,max_nights,min_lead_days,max_horizon_days,created_at,updated_at)
+	VALUES (NULL, 'Standard', '2021-01-01', '2099-12-31', 1, 30, 0, 365, now(), now());
\ No newline at end of file
@@ -0,0 +1 @@
+delete from restrictions where restriction_name = 'Waitlist Hold';
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT INTO public.restrictions (restriction_name,created_at,updated_at) VALUES
+	 ('Waitlist Hold',now(),now());
\ No newline at end of file
@@ -0,0 +1 @@
+delete from cancellation_policies where "name" in ('Flexible','Moderate','Strict','Non-refundable');
\ No newline at end of file
@@ -0,0 +1,5 @@
+INSERT INTO public.cancellation_policies ("name",description,tiers,created_at,updated_at) VALUES
+	('Flexible','Cancel for free until the day before arrival.','1:0',now(),now()),
+	('Moderate','Cancel for free up to 5 days before arrival, or for half the price until the day before.','5:0,1:50',now(),now()),
+	('Strict','Cancel for free up to 14 days before arrival, or for half the price up to 7 days before.','14:0,7:50',now(),now()),
+	('Non-refundable','A lower price that can''t be refunded if you cancel.','',now(),now());
\ No newline at end of file
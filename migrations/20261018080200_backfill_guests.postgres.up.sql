@@ -0,0 +1,4 @@
+insert into guests (first_name, last_name, email, phone, created_at, updated_at)
+select distinct on (lower(trim(email))) first_name, last_name, lower(trim(email)), phone, now(), now()
+from reservations where trim(email) <> '' order by lower(trim(email)), created_at desc;
+update reservations r set guest_id = g.id from guests g where g.email = lower(trim(r.email));
\ No newline at end of file
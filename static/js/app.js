@@ -113,6 +113,16 @@ function Book(csrf_token, room_id) {
               <input disabled required class="form-control" type="text" name="end" id="end" placeholder="Departure">
             </div>
           </div>
+          <div class="row mt-3">
+            <div class="col">
+              <label for="adults">Adults</label>
+              <input required class="form-control" type="number" min="1" name="adults" id="adults" value="2">
+            </div>
+            <div class="col">
+              <label for="children">Children</label>
+              <input required class="form-control" type="number" min="0" name="children" id="children" value="0">
+            </div>
+          </div>
         </div>
       </div>
     </form>
@@ -160,12 +170,16 @@ function Book(csrf_token, room_id) {
                   + data.start_date
                   + '&e='
                   + data.end_date 
+                  + '&a='
+                  + data.adults
+                  + '&c='
+                  + data.children
                   + '" class="btn btn-primary">'
                   + 'Book now!</a></p>',
               })
             } else {
               attention.error({
-                msg: "No Availability",
+                msg: data.message || "No Availability",
               });
             }
           })